@@ -0,0 +1,38 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// defaultErrorLimit is how many errors are
+// listed when the query doesn't say.
+const defaultErrorLimit = 100
+
+// listErrors returns the latest failed plugin actions,
+// newest first. The query can set plugin (a ServiceName)
+// and limit.
+func listErrors(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	query := req.URL.Query()
+	limit := defaultErrorLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	docs, err := rethink.GetStore().ListErrors(query.Get("plugin"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, docs)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/health"
+)
+
+// readyTimeout bounds how long the
+// readiness checks can take.
+const readyTimeout = 3 * time.Second
+
+var started = time.Now()
+
+// liveness is the body of a /healthz response.
+type liveness struct {
+	Status string
+	Uptime string
+}
+
+// readiness is the body of a /readyz response.
+type readiness struct {
+	Ready  bool
+	Checks []health.Result
+}
+
+// healthz replies 200 while the
+// process is serving requests.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, liveness{
+		Status: "ok",
+		Uptime: time.Since(started).Round(time.Second).String(),
+	})
+}
+
+// readyz runs the registered health checks, replying
+// 200 if they all pass and 503 if any fail, with the
+// result of each.
+func readyz(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	ok, results := health.Run(ctx)
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness{Ready: ok, Checks: results})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
+	"github.com/ramrod-project/backend-controller-go/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readyz(t *testing.T) {
+	f, _, cleanup := useFakes(t)
+	defer cleanup()
+
+	feed := health.NewStatus()
+	health.Register("docker", dockerservicemanager.PingOrchestrator)
+	health.Register("plugin_changefeed", feed.Check)
+	defer health.Unregister("docker")
+	defer health.Unregister("plugin_changefeed")
+
+	handler := NewHandler(nil)
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+	checks := func(body map[string]interface{}) map[string]interface{} {
+		errs := make(map[string]interface{})
+		for _, c := range body["Checks"].([]interface{}) {
+			check := c.(map[string]interface{})
+			errs[check["Name"].(string)] = check["Error"]
+		}
+		return errs
+	}
+
+	// Live whatever the checks say
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["Status"])
+
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, false, body["Ready"])
+	assert.Equal(t, map[string]interface{}{
+		"docker":            nil,
+		"plugin_changefeed": "not started",
+	}, checks(body))
+
+	feed.Set("", nil)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["Ready"])
+
+	f.SetPingError(errors.New("connection refused"))
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{
+		"docker":            "connection refused",
+		"plugin_changefeed": nil,
+	}, checks(body))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// pluginActions are the DesiredStates
+// set by each plugin action.
+var pluginActions = map[string]rethink.PluginDesiredState{
+	"activate": rethink.DesiredStateActivate,
+	"restart":  rethink.DesiredStateRestart,
+	"stop":     rethink.DesiredStateStop,
+	"scale":    rethink.DesiredStateScale,
+	"pause":    rethink.DesiredStatePause,
+	"resume":   rethink.DesiredStateResume,
+	"upgrade":  rethink.DesiredStateUpgrade,
+}
+
+// pluginRequest is the body of a plugin action. Name
+// picks the advertised plugin to copy when activating a
+// new ServiceName. Other fields that are set replace the
+// plugin's. Mode can only be set when activating, and
+// scaling, pausing and resuming take only Replicas. Tag
+// and Digest are the image to upgrade to, and can only
+// be set when upgrading.
+type pluginRequest struct {
+	Name          string
+	Interface     string
+	ExternalPorts []string
+	InternalPorts []string
+	Environment   []string
+	Replicas      *int
+	Mode          string
+	Tag           string
+	Digest        string
+}
+
+// pluginDetail is a plugin with its service and tasks.
+type pluginDetail struct {
+	Plugin  map[string]interface{}
+	Service *swarm.Service
+	Tasks   []swarm.Task
+}
+
+// requestError is an error with the
+// status code it should be returned with.
+type requestError struct {
+	Status int
+	Err    error
+}
+
+func (e *requestError) Error() string {
+	return e.Err.Error()
+}
+
+func newRequestError(status int, format string, args ...interface{}) error {
+	return &requestError{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+// statusOf returns the status code for an error.
+func statusOf(err error) int {
+	switch e := err.(type) {
+	case *requestError:
+		return e.Status
+	case *dockerservicemanager.PortConflictError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func listPlugins(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	docs, err := rethink.GetStore().ListPlugins()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, docs)
+}
+
+// pluginRoute handles /api/plugins/<ServiceName>
+// and /api/plugins/<ServiceName>/<action>.
+func pluginRoute(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/plugins/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	if len(parts) == 1 {
+		if !allowMethod(w, req, http.MethodGet) {
+			return
+		}
+		detail, err := getPlugin(req.Context(), parts[0])
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, detail)
+		return
+	}
+
+	if _, ok := pluginActions[parts[1]]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", parts[1]))
+		return
+	}
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+
+	var body pluginRequest
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	doc, err := changePlugin(req.Context(), parts[0], parts[1], body)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, doc)
+}
+
+func getPlugin(ctx context.Context, serviceName string) (pluginDetail, error) {
+	doc, err := rethink.GetStore().GetPluginByServiceName(serviceName)
+	if err != nil {
+		return pluginDetail{}, err
+	}
+	if doc == nil {
+		return pluginDetail{}, newRequestError(http.StatusNotFound, "no plugin with ServiceName %v", serviceName)
+	}
+
+	svc, tasks, err := dockerservicemanager.PluginService(ctx, serviceName)
+	if err != nil {
+		return pluginDetail{}, err
+	}
+	return pluginDetail{Plugin: doc, Service: svc, Tasks: tasks}, nil
+}
+
+// advertised returns the advertised row for a
+// plugin name, or nil if there is none.
+func advertised(name string) (map[string]interface{}, error) {
+	docs, err := rethink.GetStore().ListPlugins()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if doc["Name"] == name && doc["ServiceName"] == "" && doc["State"] != string(rethink.StateRetired) {
+			return doc, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkInterface checks that a plugin can
+// run on the node with the given interface.
+func checkInterface(address string, os interface{}) error {
+	if address == "" {
+		return newRequestError(http.StatusBadRequest, "Interface is required")
+	}
+	node, err := findNode(address)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return newRequestError(http.StatusBadRequest, "no node with Interface %v", address)
+	}
+	if os != string(rethink.PluginOSAll) && os != node["OS"] {
+		return newRequestError(http.StatusBadRequest, "plugin OS %v can't run on %v node %v", os, node["OS"], address)
+	}
+	return nil
+}
+
+// changePlugin checks and then writes the DesiredState
+// for an action, returning the plugin's row. Activating a
+// ServiceName without a row copies the advertised plugin.
+func changePlugin(ctx context.Context, serviceName string, action string, body pluginRequest) (map[string]interface{}, error) {
+	store := rethink.GetStore()
+
+	existing, err := store.GetPluginByServiceName(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	switch {
+	case existing != nil:
+		for k, v := range existing {
+			doc[k] = v
+		}
+		if body.Name != "" && body.Name != existing["Name"] {
+			return nil, newRequestError(http.StatusConflict, "%v is a %v plugin", serviceName, existing["Name"])
+		}
+	case action != "activate":
+		return nil, newRequestError(http.StatusNotFound, "no plugin with ServiceName %v", serviceName)
+	case body.Name == "":
+		return nil, newRequestError(http.StatusBadRequest, "Name is required to activate a new plugin")
+	default:
+		template, err := advertised(body.Name)
+		if err != nil {
+			return nil, err
+		}
+		if template == nil {
+			return nil, newRequestError(http.StatusNotFound, "no plugin %v advertised", body.Name)
+		}
+		for k, v := range template {
+			if k != "id" {
+				doc[k] = v
+			}
+		}
+		doc["ServiceName"] = serviceName
+		doc["ServiceID"] = ""
+		doc["State"] = string(rethink.StateStopped)
+	}
+
+	if doc["DesiredState"] != "" && doc["DesiredState"] != nil {
+		return nil, newRequestError(http.StatusConflict, "%v already has DesiredState %v", serviceName, doc["DesiredState"])
+	}
+	// The handler acts on the plugin's ServiceID
+	switch running := doc["ServiceID"] != "" && doc["ServiceID"] != nil; {
+	case action == "activate" && running:
+		return nil, newRequestError(http.StatusConflict, "%v is already running", serviceName)
+	case action != "activate" && !running:
+		return nil, newRequestError(http.StatusConflict, "%v is not running", serviceName)
+	}
+	// One made part way through a change waits for it
+	state, _ := doc["State"].(string)
+	if err := rethink.CheckRequest(rethink.PluginState(state), pluginActions[action]); err != nil && err != rethink.ErrRequestQueued {
+		return nil, newRequestError(http.StatusConflict, "%v", err)
+	}
+
+	switch {
+	case action == "scale" && body.Replicas == nil:
+		return nil, newRequestError(http.StatusBadRequest, "Replicas is required to scale a plugin")
+	case (action == "scale" || action == "pause") && doc["Mode"] == string(rethink.ModeGlobal):
+		return nil, newRequestError(http.StatusConflict, "%v is a global plugin", serviceName)
+	case body.Mode != "" && action != "activate":
+		return nil, newRequestError(http.StatusBadRequest, "Mode can only be set when activating")
+	case action == "upgrade" && body.Tag == "" && body.Digest == "":
+		return nil, newRequestError(http.StatusBadRequest, "Tag or Digest is required to upgrade a plugin")
+	case action != "upgrade" && (body.Tag != "" || body.Digest != ""):
+		return nil, newRequestError(http.StatusBadRequest, "Tag and Digest can only be set when upgrading")
+	}
+	if action == "upgrade" {
+		// The swarm has nothing to roll out, so it
+		// would never say the upgrade had finished
+		tag, _ := doc["Tag"].(string)
+		digest, _ := doc["Digest"].(string)
+		runTag, runDigest := dockerservicemanager.ImageVersion(tag, digest)
+		if newTag, newDigest := dockerservicemanager.ImageVersion(body.Tag, body.Digest); newTag == runTag && newDigest == runDigest {
+			return nil, newRequestError(http.StatusConflict, "%v already runs that image", serviceName)
+		}
+	}
+	// Only the fields the request sets are written,
+	// so that the handler's own changes aren't undone
+	set := make(map[string]interface{})
+	setField := func(k string, v interface{}) {
+		doc[k] = v
+		set[k] = v
+	}
+	if action == "upgrade" {
+		setField("TargetTag", body.Tag)
+		setField("TargetDigest", body.Digest)
+		setField("UpgradeStatus", "")
+	}
+	if body.Replicas != nil {
+		setField("Replicas", *body.Replicas)
+	}
+	if body.Mode != "" {
+		setField("Mode", body.Mode)
+	}
+
+	// Only these change the service's spec
+	configures := action == "activate" || action == "restart"
+	if configures {
+		if body.Interface != "" {
+			setField("Interface", body.Interface)
+		}
+		if body.ExternalPorts != nil || body.InternalPorts != nil {
+			setField("ExternalPorts", orEmpty(body.ExternalPorts))
+			setField("InternalPorts", orEmpty(body.InternalPorts))
+		}
+		if body.Environment != nil {
+			for _, env := range body.Environment {
+				if !envVarName.MatchString(env) {
+					return nil, newRequestError(http.StatusBadRequest, "environment variable %q must be NAME=value", env)
+				}
+			}
+			setField("Environment", body.Environment)
+		}
+		address, _ := doc["Interface"].(string)
+		if err := checkInterface(address, doc["OS"]); err != nil {
+			return nil, err
+		}
+	}
+	setField("DesiredState", string(pluginActions[action]))
+
+	// Parsed the way the plugin monitor will
+	plugin, err := rethink.ParsePlugin(normalize(doc))
+	if err != nil {
+		return nil, newRequestError(http.StatusBadRequest, "%v", err)
+	}
+	if plugin.Mode == rethink.ModeGlobal && body.Replicas != nil {
+		return nil, newRequestError(http.StatusBadRequest, "Replicas can't be set for a global plugin")
+	}
+	if configures || action == "upgrade" {
+		if err := dockerservicemanager.ValidatePlugin(*plugin); err != nil {
+			return nil, newRequestError(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if configures {
+		if err := dockerservicemanager.CheckPluginPorts(ctx, *plugin); err != nil {
+			return nil, err
+		}
+	}
+
+	if existing == nil {
+		err = store.InsertPlugin(doc)
+	} else {
+		// Refused if the plugin changed since it was checked
+		err = store.TransitionPlugin(serviceName, map[string]string{
+			"State":        state,
+			"DesiredState": "",
+		}, set, nil)
+	}
+	if err == rethink.ErrStaleState {
+		return nil, newRequestError(http.StatusConflict, "%v changed while the request was checked, try again", serviceName)
+	} else if err != nil {
+		return nil, err
+	}
+
+	written, err := store.GetPluginByServiceName(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+func orEmpty(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// normalize round-trips a document through JSON, so that
+// it parses the same as one read from the database.
+func normalize(doc map[string]interface{}) map[string]interface{} {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return doc
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return doc
+	}
+	return res
+}
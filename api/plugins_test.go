@@ -0,0 +1,549 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+	"github.com/stretchr/testify/assert"
+)
+
+// useFakes sets up a swarm with one posix node, and a
+// store with it and an advertised Harness plugin.
+func useFakes(t *testing.T) (*orchestrator.FakeSwarm, *rethink.MemoryStore, func()) {
+	f := orchestrator.NewFakeSwarm()
+	node := f.AddNode("manager", "192.168.1.1", "linux", swarm.NodeRoleManager)
+	node.Spec.Annotations.Labels = map[string]string{"os": "posix", "ip": "192.168.1.1"}
+	assert.Nil(t, f.NodeUpdate(context.Background(), node.ID, node.Version, node.Spec))
+
+	m := rethink.NewMemoryStore()
+	assert.Nil(t, m.UpsertNode(map[string]interface{}{
+		"Interface":    "192.168.1.1",
+		"NodeHostName": "manager",
+		"OS":           "posix",
+		"TCPPorts":     []string{"6000"},
+		"UDPPorts":     []string{},
+	}))
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceID":     "",
+		"ServiceName":   "",
+		"DesiredState":  "",
+		"State":         "Available",
+		"Interface":     "",
+		"ExternalPorts": []string{"5000/tcp"},
+		"InternalPorts": []string{"5000/tcp"},
+		"OS":            "all",
+		"Environment":   []string{},
+		"Extra":         false,
+	}))
+
+	dockerservicemanager.SetOrchestrator(f)
+	rethink.SetStore(m)
+	return f, m, func() {
+		dockerservicemanager.SetOrchestrator(nil)
+		rethink.SetStore(nil)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	running := map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceID":     "",
+		"ServiceName":   "Harness-7000",
+		"DesiredState":  "",
+		"State":         "Active",
+		"Interface":     "192.168.1.1",
+		"ExternalPorts": []string{"7000/tcp"},
+		"InternalPorts": []string{"5000/tcp"},
+		"OS":            "all",
+		"Environment":   []string{},
+		"Extra":         false,
+		"Tag":           "1.0",
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		state   string
+		status  int
+		wantErr string
+		check   func(*testing.T, *rethink.MemoryStore, map[string]interface{})
+	}{
+		{
+			name:   "List plugins",
+			method: http.MethodGet,
+			path:   "/api/plugins",
+			status: http.StatusOK,
+		},
+		{
+			name:   "Show plugin",
+			method: http.MethodGet,
+			path:   "/api/plugins/Harness-7000",
+			status: http.StatusOK,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Harness-7000", res["Plugin"].(map[string]interface{})["ServiceName"])
+				assert.Equal(t, "Harness-7000", res["Service"].(map[string]interface{})["Spec"].(map[string]interface{})["Name"])
+				assert.Len(t, res["Tasks"], 1)
+			},
+		},
+		{
+			name:    "Show missing plugin",
+			method:  http.MethodGet,
+			path:    "/api/plugins/Harness-9000",
+			status:  http.StatusNotFound,
+			wantErr: "no plugin with ServiceName Harness-9000",
+		},
+		{
+			name:   "Activate new",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-5000/activate",
+			body:   `{"Name": "Harness", "Interface": "192.168.1.1", "Environment": ["DEBUG=1"]}`,
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				doc, err := m.GetPluginByServiceName("Harness-5000")
+				assert.Nil(t, err)
+				assert.Equal(t, "Activate", doc["DesiredState"])
+				assert.Equal(t, "192.168.1.1", doc["Interface"])
+				assert.Equal(t, []interface{}{"5000/tcp"}, doc["ExternalPorts"])
+				assert.Equal(t, []interface{}{"DEBUG=1"}, doc["Environment"])
+			},
+		},
+		{
+			name:    "Activate unadvertised",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Other-5000/activate",
+			body:    `{"Name": "Other", "Interface": "192.168.1.1"}`,
+			status:  http.StatusNotFound,
+			wantErr: "no plugin Other advertised",
+		},
+		{
+			name:    "Activate without name",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-5000/activate",
+			body:    `{"Interface": "192.168.1.1"}`,
+			status:  http.StatusBadRequest,
+			wantErr: "Name is required to activate a new plugin",
+		},
+		{
+			name:    "Activate running",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/activate",
+			status:  http.StatusConflict,
+			wantErr: "Harness-7000 is already running",
+		},
+		{
+			name:    "Port conflict",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-6000/activate",
+			body:    `{"Name": "Harness", "Interface": "192.168.1.1", "ExternalPorts": ["6000/tcp"], "InternalPorts": ["5000/tcp"]}`,
+			status:  http.StatusConflict,
+			wantErr: "port conflict: 6000/tcp is already in use on 192.168.1.1",
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				doc, err := m.GetPluginByServiceName("Harness-6000")
+				assert.Nil(t, err)
+				assert.Nil(t, doc)
+			},
+		},
+		{
+			name:    "Bad ports",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-5000/activate",
+			body:    `{"Name": "Harness", "Interface": "192.168.1.1", "ExternalPorts": ["5000/sctp"], "InternalPorts": ["5000/tcp"]}`,
+			status:  http.StatusBadRequest,
+			wantErr: `unknown protocol "sctp"`,
+		},
+		{
+			name:    "Bad environment",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-5000/activate",
+			body:    `{"Name": "Harness", "Interface": "192.168.1.1", "Environment": ["DEBUG"]}`,
+			status:  http.StatusBadRequest,
+			wantErr: `environment variable "DEBUG" must be NAME=value`,
+		},
+		{
+			name:    "Unknown interface",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-5000/activate",
+			body:    `{"Name": "Harness", "Interface": "10.0.0.1"}`,
+			status:  http.StatusBadRequest,
+			wantErr: "no node with Interface 10.0.0.1",
+		},
+		{
+			name:    "Unknown field",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-5000/activate",
+			body:    `{"Name": "Harness", "Ports": []}`,
+			status:  http.StatusBadRequest,
+			wantErr: "invalid request",
+		},
+		{
+			name:   "Restart",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/restart",
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Restart", res["DesiredState"])
+			},
+		},
+		{
+			name:    "Restart stopped",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/restart",
+			state:   "Stopped",
+			status:  http.StatusConflict,
+			wantErr: "cannot Restart a plugin that is Stopped",
+		},
+		{
+			name:   "Stop while restarting",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/stop",
+			state:  "Restarting",
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Stop", res["DesiredState"])
+			},
+		},
+		{
+			name:   "Stop",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/stop",
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Stop", res["DesiredState"])
+			},
+		},
+		{
+			name:   "Scale",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/scale",
+			body:   `{"Replicas": 3}`,
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Scale", res["DesiredState"])
+				assert.Equal(t, float64(3), res["Replicas"])
+			},
+		},
+		{
+			name:    "Scale without replicas",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/scale",
+			status:  http.StatusBadRequest,
+			wantErr: "Replicas is required to scale a plugin",
+		},
+		{
+			name:    "Scale to none",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/scale",
+			body:    `{"Replicas": 0}`,
+			status:  http.StatusBadRequest,
+			wantErr: "invalid Replicas 0 sent",
+		},
+		{
+			name:   "Pause",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/pause",
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Pause", res["DesiredState"])
+			},
+		},
+		{
+			name:    "Resume active",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/resume",
+			status:  http.StatusConflict,
+			wantErr: "cannot Resume a plugin that is Active",
+		},
+		{
+			name:   "Resume paused",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/resume",
+			state:  "Paused",
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Resume", res["DesiredState"])
+			},
+		},
+		{
+			name:   "Upgrade",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-7000/upgrade",
+			body:   `{"Tag": "2.0"}`,
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "Upgrade", res["DesiredState"])
+				assert.Equal(t, "2.0", res["TargetTag"])
+				assert.Equal(t, "", res["TargetDigest"])
+			},
+		},
+		{
+			name:    "Upgrade to running image",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/upgrade",
+			body:    `{"Tag": "1.0"}`,
+			status:  http.StatusConflict,
+			wantErr: "Harness-7000 already runs that image",
+		},
+		{
+			name:    "Upgrade without tag",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/upgrade",
+			status:  http.StatusBadRequest,
+			wantErr: "Tag or Digest is required to upgrade a plugin",
+		},
+		{
+			name:    "Upgrade to bad digest",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/upgrade",
+			body:    `{"Digest": "latest"}`,
+			status:  http.StatusBadRequest,
+			wantErr: `Digest must be <algorithm>:<hex>, got "latest"`,
+		},
+		{
+			name:    "Tag on restart",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/restart",
+			body:    `{"Tag": "2.0"}`,
+			status:  http.StatusBadRequest,
+			wantErr: "Tag and Digest can only be set when upgrading",
+		},
+		{
+			name:   "Activate global",
+			method: http.MethodPost,
+			path:   "/api/plugins/Harness-5000/activate",
+			body:   `{"Name": "Harness", "Interface": "192.168.1.1", "Mode": "global"}`,
+			status: http.StatusAccepted,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, "global", res["Mode"])
+			},
+		},
+		{
+			name:    "Change mode",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/restart",
+			body:    `{"Mode": "global"}`,
+			status:  http.StatusBadRequest,
+			wantErr: "Mode can only be set when activating",
+		},
+		{
+			name:    "Stop missing",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-9000/stop",
+			status:  http.StatusNotFound,
+			wantErr: "no plugin with ServiceName Harness-9000",
+		},
+		{
+			name:    "Unknown action",
+			method:  http.MethodPost,
+			path:    "/api/plugins/Harness-7000/retire",
+			status:  http.StatusNotFound,
+			wantErr: `unknown action "retire"`,
+		},
+		{
+			name:    "Wrong method",
+			method:  http.MethodGet,
+			path:    "/api/plugins/Harness-7000/stop",
+			status:  http.StatusMethodNotAllowed,
+			wantErr: "method not allowed",
+		},
+		{
+			name:   "Ports for node",
+			method: http.MethodGet,
+			path:   "/api/ports/192.168.1.1",
+			status: http.StatusOK,
+			check: func(t *testing.T, m *rethink.MemoryStore, res map[string]interface{}) {
+				assert.Equal(t, []interface{}{"6000", "7000"}, res["TCPPorts"])
+			},
+		},
+		{
+			name:    "Ports for missing node",
+			method:  http.MethodGet,
+			path:    "/api/ports/10.0.0.1",
+			status:  http.StatusNotFound,
+			wantErr: "no node with Interface 10.0.0.1",
+		},
+		{
+			name:    "List errors bad limit",
+			method:  http.MethodGet,
+			path:    "/api/errors?limit=none",
+			status:  http.StatusBadRequest,
+			wantErr: `invalid limit "none"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, m, restore := useFakes(t)
+			defer restore()
+
+			// Harness-7000 is running
+			resp, err := f.ServiceCreate(context.Background(), swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: "Harness-7000"},
+				EndpointSpec: &swarm.EndpointSpec{
+					Ports: []swarm.PortConfig{
+						{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 5000, PublishedPort: 7000},
+					},
+				},
+			}, types.ServiceCreateOptions{})
+			assert.Nil(t, err)
+			running["ServiceID"] = resp.ID
+			running["State"] = "Active"
+			if tt.state != "" {
+				running["State"] = tt.state
+			}
+			assert.Nil(t, m.InsertPlugin(running))
+			assert.Nil(t, m.AddPort("192.168.1.1", "7000", swarm.PortConfigProtocolTCP))
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			NewHandler(nil).ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			if tt.path == "/api/plugins" {
+				var docs []map[string]interface{}
+				assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &docs))
+				assert.Len(t, docs, 2)
+				return
+			}
+			var res map[string]interface{}
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			if tt.wantErr != "" {
+				assert.Contains(t, res["error"], tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, m, res)
+			}
+		})
+	}
+}
+
+func TestNewHandler_StopThenActivate(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evts, evtErrs := dockerservicemanager.EventMonitor(ctx)
+	errs := rethink.EventUpdate(ctx, evts)
+	go func() {
+		for range evtErrs {
+		}
+	}()
+	go func() {
+		for range errs {
+		}
+	}()
+
+	resp, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "Harness-7000"},
+		EndpointSpec: &swarm.EndpointSpec{
+			Ports: []swarm.PortConfig{
+				{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 5000, PublishedPort: 7000},
+			},
+		},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceID":     resp.ID,
+		"ServiceName":   "Harness-7000",
+		"DesiredState":  "",
+		"State":         "Active",
+		"Interface":     "192.168.1.1",
+		"ExternalPorts": []string{"7000/tcp"},
+		"InternalPorts": []string{"5000/tcp"},
+		"OS":            "all",
+		"Environment":   []string{},
+		"Extra":         false,
+	}))
+
+	post := func(path string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		NewHandler(nil).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Stopped the way the plugin handler would
+	assert.Equal(t, http.StatusAccepted, post("/api/plugins/Harness-7000/stop", ""))
+	assert.Nil(t, dockerservicemanager.RemovePluginService(ctx, resp.ID))
+
+	var doc map[string]interface{}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		doc, err = m.GetPluginByServiceName("Harness-7000")
+		assert.Nil(t, err)
+		if doc["State"] == "Stopped" {
+			break
+		}
+	}
+	assert.Equal(t, "Stopped", doc["State"])
+	assert.Equal(t, "", doc["ServiceID"])
+
+	assert.Equal(t, http.StatusAccepted, post("/api/plugins/Harness-7000/activate", ""))
+	doc, err = m.GetPluginByServiceName("Harness-7000")
+	assert.Nil(t, err)
+	assert.Equal(t, "Activate", doc["DesiredState"])
+}
+
+// racingStore changes a plugin's State each
+// time it has been read, as an event would.
+type racingStore struct {
+	*rethink.MemoryStore
+}
+
+func (s racingStore) GetPluginByServiceName(serviceName string) (map[string]interface{}, error) {
+	doc, err := s.MemoryStore.GetPluginByServiceName(serviceName)
+	if doc != nil {
+		s.MemoryStore.TransitionPlugin(serviceName, nil, map[string]interface{}{"State": "Failed"}, nil)
+	}
+	return doc, err
+}
+
+func TestNewHandler_Stale(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+
+	resp, err := f.ServiceCreate(context.Background(), swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "Harness-7000"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceID":     resp.ID,
+		"ServiceName":   "Harness-7000",
+		"DesiredState":  "",
+		"State":         "Active",
+		"Interface":     "192.168.1.1",
+		"ExternalPorts": []string{"7000/tcp"},
+		"InternalPorts": []string{"5000/tcp"},
+		"OS":            "all",
+		"Environment":   []string{},
+		"Extra":         false,
+	}))
+	rethink.SetStore(racingStore{m})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/plugins/Harness-7000/restart", strings.NewReader(""))
+	rec := httptest.NewRecorder()
+	NewHandler(nil).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Harness-7000 changed while the request was checked")
+
+	// The event's State is kept
+	doc, err := m.GetPluginByServiceName("Harness-7000")
+	assert.Nil(t, err)
+	assert.Equal(t, "Failed", doc["State"])
+	assert.Equal(t, "", doc["DesiredState"])
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+func listPorts(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	docs, err := rethink.GetStore().ListPorts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, docs)
+}
+
+func getPorts(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	address := strings.TrimPrefix(req.URL.Path, "/api/ports/")
+	doc, err := findNode(address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if doc == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no node with Interface %v", address))
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// findNode returns the Ports table document for
+// an interface, or nil if there is none.
+func findNode(address string) (map[string]interface{}, error) {
+	docs, err := rethink.GetStore().ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if doc["Interface"] == address {
+			return doc, nil
+		}
+	}
+	return nil, nil
+}
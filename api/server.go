@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/metrics"
+)
+
+// NewHandler returns the controller's HTTP API:
+//
+//	GET  /api/plugins
+//	GET  /api/plugins/<ServiceName>
+//	POST /api/plugins/<ServiceName>/activate
+//	POST /api/plugins/<ServiceName>/restart
+//	POST /api/plugins/<ServiceName>/stop
+//	POST /api/plugins/<ServiceName>/scale
+//	POST /api/plugins/<ServiceName>/pause
+//	POST /api/plugins/<ServiceName>/resume
+//	POST /api/plugins/<ServiceName>/upgrade
+//	GET  /api/ports
+//	GET  /api/ports/<Interface>
+//	GET  /api/errors
+//	GET  /api/events
+//	GET  /metrics
+//	GET  /healthz
+//	GET  /readyz
+//
+// Requests are checked the same way the plugin handler
+// checks a DesiredState, which is then written to the
+// Plugins table for the handler to act on. Events are
+// streamed from broker, if it isn't nil. /readyz runs
+// the checks registered with the health package.
+func NewHandler(broker *Broker) http.Handler {
+	mux := http.NewServeMux()
+	if broker != nil {
+		mux.Handle("/api/events", broker)
+	}
+	mux.HandleFunc("/api/plugins", listPlugins)
+	mux.HandleFunc("/api/plugins/", pluginRoute)
+	mux.HandleFunc("/api/ports", listPorts)
+	mux.HandleFunc("/api/ports/", getPorts)
+	mux.HandleFunc("/api/errors", listErrors)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	return mux
+}
+
+// Serve runs the API on addr until the context is
+// done, then shuts it down. Failing to serve (e.g. the
+// address is in use) is fatal. The error channel is
+// closed once the server has stopped.
+func Serve(ctx context.Context, addr string, handler http.Handler) <-chan error {
+	errs := make(chan error)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	go func() {
+		defer close(errs)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			select {
+			case <-ctx.Done():
+			case errs <- errorhandler.New(errorhandler.ComponentAPI, errorhandler.SeverityFatal, err):
+			}
+		}
+		<-done
+	}()
+
+	log.Printf("api listening on %v", addr)
+	return errs
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("api: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// allowMethod replies 405 unless the request
+// uses method, and returns whether it did.
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+	return false
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+const (
+	// EventPlugin is a plugin status update.
+	EventPlugin = "plugin"
+	// EventNode is a node added to, changed in or
+	// removed from the Ports table.
+	EventNode = "node"
+	// EventLog is a log line from a plugin. Logs
+	// aren't kept for replay.
+	EventLog = "log"
+)
+
+// subscriberBuffer is how many events a stream can
+// fall behind by before it is closed.
+const subscriberBuffer = 256
+
+// heartbeatInterval is how often an idle stream is
+// sent a comment, to keep proxies from closing it.
+const heartbeatInterval = 15 * time.Second
+
+// Event is a change streamed to clients.
+type Event struct {
+	ID          uint64
+	Type        string
+	ServiceName string `json:",omitempty"`
+	Data        interface{}
+}
+
+type subscriber struct {
+	events chan Event
+	match  func(Event) bool
+}
+
+// Broker keeps the last events published and fans
+// them out to the streams subscribed to them.
+type Broker struct {
+	size int
+
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	subs    map[*subscriber]struct{}
+	closed  bool
+}
+
+// NewBroker returns a Broker that keeps the last
+// size events for replay.
+func NewBroker(size int) *Broker {
+	return &Broker{
+		size:   size,
+		nextID: 1,
+		subs:   make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish sends an event to every matching stream.
+// Events other than logs are kept for replay.
+func (b *Broker) Publish(eventType string, serviceName string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	e := Event{
+		ID:          b.nextID,
+		Type:        eventType,
+		ServiceName: serviceName,
+		Data:        data,
+	}
+	b.nextID++
+
+	if eventType != EventLog && b.size > 0 {
+		b.history = append(b.history, e)
+		if len(b.history) > b.size {
+			b.history = b.history[len(b.history)-b.size:]
+		}
+	}
+
+	for s := range b.subs {
+		if !s.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// Too far behind, the client can
+			// reconnect with Last-Event-ID
+			delete(b.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+// subscribe returns a subscriber for the matching events,
+// and the kept events to replay to it: those after since,
+// or if since is 0 the last replay of them.
+func (b *Broker) subscribe(match func(Event) bool, since uint64, replay int) (*subscriber, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &subscriber{
+		events: make(chan Event, subscriberBuffer),
+		match:  match,
+	}
+	if b.closed {
+		close(s.events)
+		return s, nil
+	}
+	b.subs[s] = struct{}{}
+
+	var missed []Event
+	for _, e := range b.history {
+		if match(e) && (since == 0 || e.ID > since) {
+			missed = append(missed, e)
+		}
+	}
+	if since == 0 {
+		if replay < len(missed) {
+			missed = missed[len(missed)-replay:]
+		}
+	}
+	return s, missed
+}
+
+func (b *Broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// close ends every stream.
+func (b *Broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// nodeChanges returns the node events between
+// two listings of the Ports table.
+func nodeChanges(prev map[string]map[string]interface{}, docs []map[string]interface{}) (map[string]map[string]interface{}, []interface{}) {
+	var changes []interface{}
+	next := make(map[string]map[string]interface{})
+
+	for _, doc := range docs {
+		address := fmt.Sprintf("%v", doc["Interface"])
+		next[address] = doc
+		if old, ok := prev[address]; !ok || !reflect.DeepEqual(old, doc) {
+			changes = append(changes, doc)
+		}
+	}
+	for address := range prev {
+		if _, ok := next[address]; !ok {
+			changes = append(changes, map[string]interface{}{
+				"Interface": address,
+				"Removed":   true,
+			})
+		}
+	}
+	return next, changes
+}
+
+// Follow publishes the plugin status updates written by
+// rethink.EventUpdate, the logs stored by
+// rethink.AggregateLogs, and the changes to the Ports
+// table (checked every interval) until the context is
+// done, when every stream is ended.
+func (b *Broker) Follow(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error)
+
+	// Watched now, so that nothing written
+	// after Follow returns is missed
+	transitions := rethink.WatchTransitions(ctx)
+	logs := rethink.WatchLogs(ctx)
+	nodes := make(map[string]map[string]interface{})
+	if docs, err := rethink.GetStore().ListPorts(); err == nil {
+		nodes, _ = nodeChanges(nil, docs)
+	}
+
+	go func() {
+		defer close(errs)
+		defer b.close()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t, ok := <-transitions:
+				if !ok {
+					return
+				}
+				b.Publish(EventPlugin, t.ServiceName, t.Update)
+			case l, ok := <-logs:
+				if !ok {
+					return
+				}
+				b.Publish(EventLog, l.ServiceName, l)
+			case <-ticker.C:
+				docs, err := rethink.GetStore().ListPorts()
+				if err != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case errs <- errorhandler.Transient(errorhandler.ComponentStream, err):
+					}
+					continue
+				}
+				var changes []interface{}
+				nodes, changes = nodeChanges(nodes, docs)
+				for _, doc := range changes {
+					b.Publish(EventNode, "", doc)
+				}
+			}
+		}
+	}()
+
+	return errs
+}
+
+// splitList splits a comma separated
+// query value, dropping empty entries.
+func splitList(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// ServeHTTP streams events as Server-Sent Events. The
+// query can set:
+//
+//	plugin  ServiceNames to stream events for (comma separated)
+//	types   event types to stream (default "plugin,node")
+//	replay  how many kept events to send first
+//
+// Logs are only streamed for chosen plugins. A client
+// reconnecting with Last-Event-ID is sent the kept
+// events it missed instead of the replay.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	query := req.URL.Query()
+	plugins := splitList(query.Get("plugin"))
+	types := splitList(query.Get("types"))
+	if len(types) == 0 {
+		types = map[string]bool{EventPlugin: true, EventNode: true}
+	}
+	for t := range types {
+		if t != EventPlugin && t != EventNode && t != EventLog {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown event type %q", t))
+			return
+		}
+	}
+	if types[EventLog] && len(plugins) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("logs can only be streamed for a plugin"))
+		return
+	}
+
+	replay := 0
+	if v := query.Get("replay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid replay %q", v))
+			return
+		}
+		replay = n
+	}
+	var since uint64
+	if v := req.Header.Get("Last-Event-ID"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %q", v))
+			return
+		}
+		since = n
+	}
+
+	match := func(e Event) bool {
+		if !types[e.Type] {
+			return false
+		}
+		// Node events aren't for any one plugin
+		return len(plugins) == 0 || e.Type == EventNode || plugins[e.ServiceName]
+	}
+	s, missed := b.subscribe(match, since, replay)
+	defer b.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+
+	for _, e := range missed {
+		if send(e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			if send(e) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
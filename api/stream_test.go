@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_subscribe(t *testing.T) {
+	b := NewBroker(3)
+	for _, name := range []string{"A", "B", "A", "A"} {
+		b.Publish(EventPlugin, name, nil)
+	}
+	b.Publish(EventLog, "A", "not kept")
+
+	onlyA := func(e Event) bool { return e.ServiceName == "A" }
+	ids := func(events []Event) []uint64 {
+		var res []uint64
+		for _, e := range events {
+			res = append(res, e.ID)
+		}
+		return res
+	}
+
+	// The first event has fallen out of the history
+	s, missed := b.subscribe(onlyA, 0, 5)
+	assert.Equal(t, []uint64{3, 4}, ids(missed))
+	b.unsubscribe(s)
+
+	s, missed = b.subscribe(onlyA, 0, 1)
+	assert.Equal(t, []uint64{4}, ids(missed))
+	b.unsubscribe(s)
+
+	// Last-Event-ID wins over replay
+	s, missed = b.subscribe(onlyA, 2, 0)
+	assert.Equal(t, []uint64{3, 4}, ids(missed))
+
+	b.Publish(EventPlugin, "B", nil)
+	b.Publish(EventLog, "A", "line")
+	e := <-s.events
+	assert.Equal(t, Event{ID: 7, Type: EventLog, ServiceName: "A", Data: "line"}, e)
+
+	// A stream too far behind is ended
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish(EventPlugin, "A", nil)
+	}
+	n := 0
+	for range s.events {
+		n++
+	}
+	assert.Equal(t, subscriberBuffer, n)
+	b.unsubscribe(s)
+}
+
+func Test_nodeChanges(t *testing.T) {
+	a := map[string]interface{}{"Interface": "192.168.1.1", "TCPPorts": []interface{}{}}
+	a2 := map[string]interface{}{"Interface": "192.168.1.1", "TCPPorts": []interface{}{"5000"}}
+	b := map[string]interface{}{"Interface": "192.168.1.2", "TCPPorts": []interface{}{}}
+
+	nodes, changes := nodeChanges(nil, []map[string]interface{}{a, b})
+	assert.Equal(t, []interface{}{a, b}, changes)
+
+	nodes, changes = nodeChanges(nodes, []map[string]interface{}{a, b})
+	assert.Empty(t, changes)
+
+	nodes, changes = nodeChanges(nodes, []map[string]interface{}{a2})
+	assert.Equal(t, []interface{}{
+		a2,
+		map[string]interface{}{"Interface": "192.168.1.2", "Removed": true},
+	}, changes)
+	assert.Len(t, nodes, 1)
+}
+
+func TestBroker_ServeHTTP(t *testing.T) {
+	b := NewBroker(10)
+	b.Publish(EventPlugin, "Harness-5000", map[string]string{"State": "Active"})
+	b.Publish(EventPlugin, "Other-6000", map[string]string{"State": "Active"})
+
+	server := httptest.NewServer(NewHandler(b))
+	defer server.Close()
+
+	for _, query := range []string{"?types=log", "?types=nope", "?replay=-1"} {
+		res, err := http.Get(server.URL + "/api/events" + query)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/events?plugin=Harness-5000&types=plugin,log&replay=5", nil)
+	assert.Nil(t, err)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				lines <- line
+			}
+		}
+		close(lines)
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			return "timed out"
+		}
+	}
+
+	assert.Equal(t, "id: 1", next())
+	assert.Equal(t, "event: plugin", next())
+	assert.Equal(t, `data: {"ID":1,"Type":"plugin","ServiceName":"Harness-5000","Data":{"State":"Active"}}`, next())
+
+	b.Publish(EventLog, "Other-6000", "skipped")
+	b.Publish(EventNode, "", "skipped")
+	b.Publish(EventLog, "Harness-5000", "hello")
+	assert.Equal(t, "id: 5", next())
+	assert.Equal(t, "event: log", next())
+	assert.True(t, strings.HasSuffix(next(), `"Data":"hello"}`))
+
+	// Closing the broker ends the stream
+	b.close()
+	_, ok := <-lines
+	assert.False(t, ok)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+const usage = `usage: controller <command> [arguments]
+
+commands:
+  run                                    run the controller (the default)
+  status                                 show the Plugins and Ports tables
+  plugin <action> <ServiceName>          set a plugin's DesiredState, where action
+                                         is start, stop, restart, pause or resume
+  nodes                                  show the advertised nodes
+  logs [--follow] <ServiceName>          show a plugin's logs
+  reconcile [--dry-run]                  reconcile plugins and ports once
+  manifest validate <file>...            check manifest files
+  manifest schema                        print the manifest JSON Schema
+  healthcheck [--live]                   check a running controller is ready (or live)`
+
+// commands are the controller's subcommands. Each takes
+// its arguments and returns the exit code.
+var commands = map[string]func(args []string, stdout io.Writer, stderr io.Writer) int{
+	"run":         runCommand,
+	"status":      statusCommand,
+	"plugin":      pluginCommand,
+	"nodes":       nodesCommand,
+	"logs":        logsCommand,
+	"reconcile":   reconcileCommand,
+	"manifest":    manifestCommand,
+	"healthcheck": healthcheckCommand,
+	"help": func(args []string, stdout io.Writer, stderr io.Writer) int {
+		printUsage(stdout)
+		return 0
+	},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, usage)
+}
+
+// newFlagSet returns a flag set for a subcommand
+// that reports errors rather than exiting.
+func newFlagSet(name string, usage string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %v\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses flags wherever they are in args
+// (e.g. "logs Harness-5000 --follow"), returning the
+// other arguments in order.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// connectBrain sets up the store for a one-off command,
+// returning a func to close its session.
+func connectBrain() (func() error, error) { // pragma: no cover
+	sessions := rethink.NewSessionManager(rethink.DefaultConnectOpts())
+	rethink.SetSessionManager(sessions)
+	rethink.SetStore(rethink.NewRethinkStore(sessions))
+
+	if !checkDB(sessions, 10*time.Second) {
+		sessions.Close()
+		return nil, errors.New("database connection attempt timed out")
+	}
+	return sessions.Close, nil
+}
+
+// withBrain connects to the brain and runs f,
+// reporting any error from either.
+func withBrain(stderr io.Writer, f func() error) int { // pragma: no cover
+	closeBrain, err := connectBrain()
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	defer closeBrain()
+
+	if err := f(); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// field returns a document field for a table, or
+// "-" if it is empty.
+func field(doc map[string]interface{}, key string) string {
+	switch v := doc[key].(type) {
+	case nil:
+		return "-"
+	case string:
+		if v == "" {
+			return "-"
+		}
+		return v
+	case []interface{}:
+		if len(v) == 0 {
+			return "-"
+		}
+		list := make([]string, len(v))
+		for i, s := range v {
+			list[i] = fmt.Sprintf("%v", s)
+		}
+		return strings.Join(list, ",")
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// sortDocs sorts documents by the given fields, in order.
+func sortDocs(docs []map[string]interface{}, keys ...string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range keys {
+			a, b := field(docs[i], key), field(docs[j], key)
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+}
+
+// printPlugins writes the Plugins table as columns.
+func printPlugins(w io.Writer, docs []map[string]interface{}) error {
+	sortDocs(docs, "Name", "ServiceName")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSERVICE\tSTATE\tDESIRED\tINTERFACE\tPORTS")
+	for _, doc := range docs {
+		// Published ports show any that were assigned
+		ports := field(doc, "PublishedPorts")
+		if ports == "-" {
+			ports = field(doc, "ExternalPorts")
+		}
+		fmt.Fprintf(
+			tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			field(doc, "Name"),
+			field(doc, "ServiceName"),
+			field(doc, "State"),
+			field(doc, "DesiredState"),
+			field(doc, "Interface"),
+			ports,
+		)
+	}
+	return tw.Flush()
+}
+
+// printNodes writes the Ports table as columns,
+// with the used ports if showPorts is set.
+func printNodes(w io.Writer, docs []map[string]interface{}, showPorts bool) error {
+	sortDocs(docs, "Interface")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if showPorts {
+		fmt.Fprintln(tw, "INTERFACE\tHOSTNAME\tOS\tTCP\tUDP")
+	} else {
+		fmt.Fprintln(tw, "INTERFACE\tHOSTNAME\tOS")
+	}
+	for _, doc := range docs {
+		fmt.Fprintf(tw, "%v\t%v\t%v", field(doc, "Interface"), field(doc, "NodeHostName"), field(doc, "OS"))
+		if showPorts {
+			fmt.Fprintf(tw, "\t%v\t%v", field(doc, "TCPPorts"), field(doc, "UDPPorts"))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// status writes the Plugins and Ports tables.
+func status(w io.Writer) error {
+	store := rethink.GetStore()
+
+	plugins, err := store.ListPlugins()
+	if err != nil {
+		return err
+	}
+	nodes, err := store.ListPorts()
+	if err != nil {
+		return err
+	}
+
+	if err := printPlugins(w, plugins); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	return printNodes(w, nodes, true)
+}
+
+func statusCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("status", "controller status", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		fs.Usage()
+		return 2
+	}
+	return withBrain(stderr, func() error {
+		return status(stdout)
+	})
+}
+
+func nodesCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("nodes", "controller nodes", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		fs.Usage()
+		return 2
+	}
+	return withBrain(stderr, func() error {
+		nodes, err := rethink.GetStore().ListPorts()
+		if err != nil {
+			return err
+		}
+		return printNodes(stdout, nodes, false)
+	})
+}
+
+// pluginActions are the DesiredStates set
+// by "controller plugin <action>".
+var pluginActions = map[string]rethink.PluginDesiredState{
+	"start":   rethink.DesiredStateActivate,
+	"stop":    rethink.DesiredStateStop,
+	"restart": rethink.DesiredStateRestart,
+	"pause":   rethink.DesiredStatePause,
+	"resume":  rethink.DesiredStateResume,
+}
+
+// setDesiredState writes the DesiredState for
+// an action to the plugin with serviceName, if
+// its State allows it.
+func setDesiredState(serviceName string, action string) (rethink.PluginDesiredState, error) {
+	desired, ok := pluginActions[action]
+	if !ok {
+		return "", fmt.Errorf("unknown action %q", action)
+	}
+
+	store := rethink.GetStore()
+	doc, err := store.GetPluginByServiceName(serviceName)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", fmt.Errorf("no plugin with ServiceName %v", serviceName)
+	}
+	state, _ := doc["State"].(string)
+	if err := rethink.CheckRequest(rethink.PluginState(state), desired); err != nil && err != rethink.ErrRequestQueued {
+		return "", err
+	}
+	if desired == rethink.DesiredStatePause && doc["Mode"] == string(rethink.ModeGlobal) {
+		return "", fmt.Errorf("cannot pause global plugin %v", serviceName)
+	}
+
+	err = store.UpdatePluginStatus(serviceName, map[string]string{
+		"DesiredState": string(desired),
+	})
+	return desired, err
+}
+
+func pluginCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("plugin", "controller plugin start|stop|restart|pause|resume <ServiceName>", stderr)
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 2 {
+		fs.Usage()
+		return 2
+	}
+	if _, ok := pluginActions[rest[0]]; !ok {
+		fs.Usage()
+		return 2
+	}
+	return withBrain(stderr, func() error {
+		desired, err := setDesiredState(rest[1], rest[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%v: DesiredState set to %v\n", rest[1], desired)
+		return nil
+	})
+}
+
+func logsCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("logs", "controller logs [--follow] <ServiceName>", stderr)
+	follow := fs.Bool("follow", false, "keep printing new logs until interrupted")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	return withBrain(stderr, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		go func() {
+			select {
+			case <-sigs:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		logs, errs := rethink.ServiceLogs(ctx, rest[0], *follow)
+		for l := range logs {
+			ts := time.Unix(0, int64(l.LogTimestamp)*int64(time.Millisecond))
+			fmt.Fprintf(stdout, "%v %v\n", ts.Format(time.RFC3339), l.Log)
+		}
+		return <-errs
+	})
+}
+
+func reconcileCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("reconcile", "controller reconcile [--dry-run]", stderr)
+	dryRun := fs.Bool("dry-run", false, "print what would change without changing it")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	return withBrain(stderr, func() error {
+		actions, err := dockerservicemanager.Reconcile(context.Background(), *dryRun)
+		if err != nil {
+			return err
+		}
+		if len(actions) == 0 {
+			fmt.Fprintln(stdout, "nothing to reconcile")
+		}
+		failed := 0
+		for _, a := range actions {
+			fmt.Fprintln(stdout, a)
+			if a.Err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%v of %v actions failed", failed, len(actions))
+		}
+		return nil
+	})
+}
+
+// healthURL returns the URL of a health endpoint on the
+// API listening on addr, reached through the loopback
+// address if addr doesn't name a host.
+func healthURL(addr string, path string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("http://%v%v", net.JoinHostPort(host, port), path), nil
+}
+
+// healthcheckCommand checks the controller's own API. It
+// fails unless /readyz (or with --live, /healthz) replies
+// 200. The container healthcheck uses --live, so a lost
+// dependency doesn't get the controller restarted.
+func healthcheckCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("healthcheck", "controller healthcheck [--live]", stderr)
+	live := fs.Bool("live", false, "only check that the controller is running")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	path := "/readyz"
+	if *live {
+		path = "/healthz"
+	}
+	url, err := healthURL(apiAddr(), path)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	io.Copy(stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "error: %v replied %v\n", path, resp.Status)
+		return 1
+	}
+	return 0
+}
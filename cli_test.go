@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		want   []string
+		follow bool
+	}{
+		{
+			name: "No flags",
+			args: []string{"Harness-5000"},
+			want: []string{"Harness-5000"},
+		},
+		{
+			name:   "Flag first",
+			args:   []string{"--follow", "Harness-5000"},
+			want:   []string{"Harness-5000"},
+			follow: true,
+		},
+		{
+			name:   "Flag last",
+			args:   []string{"Harness-5000", "--follow"},
+			want:   []string{"Harness-5000"},
+			follow: true,
+		},
+		{
+			name: "Nothing",
+			args: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFlagSet("logs", "logs", ioutil.Discard)
+			follow := fs.Bool("follow", false, "")
+			got, err := parseArgs(fs, tt.args)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.follow, *follow)
+		})
+	}
+
+	fs := newFlagSet("logs", "logs", ioutil.Discard)
+	_, err := parseArgs(fs, []string{"--nope"})
+	assert.NotNil(t, err)
+}
+
+func Test_status(t *testing.T) {
+	m := rethink.NewMemoryStore()
+	rethink.SetStore(m)
+	defer rethink.SetStore(nil)
+
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceName":   "Harness-5000",
+		"State":         "Active",
+		"DesiredState":  "",
+		"Interface":     "192.168.1.1",
+		"ExternalPorts": []string{"5000/tcp"},
+	}))
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":          "Harness",
+		"ServiceName":   "",
+		"State":         "Available",
+		"DesiredState":  "",
+		"Interface":     "",
+		"ExternalPorts": []string{},
+	}))
+	assert.Nil(t, m.UpsertNode(map[string]interface{}{
+		"Interface":    "192.168.1.1",
+		"NodeHostName": "manager",
+		"OS":           "posix",
+		"TCPPorts":     []string{"5000"},
+		"UDPPorts":     []string{},
+	}))
+
+	var b bytes.Buffer
+	assert.Nil(t, status(&b))
+	assert.Equal(t, ""+
+		"NAME     SERVICE       STATE      DESIRED  INTERFACE    PORTS\n"+
+		"Harness  -             Available  -        -            -\n"+
+		"Harness  Harness-5000  Active     -        192.168.1.1  5000/tcp\n"+
+		"\n"+
+		"INTERFACE    HOSTNAME  OS     TCP   UDP\n"+
+		"192.168.1.1  manager   posix  5000  -\n",
+		b.String(),
+	)
+}
+
+func Test_setDesiredState(t *testing.T) {
+	m := rethink.NewMemoryStore()
+	rethink.SetStore(m)
+	defer rethink.SetStore(nil)
+
+	assert.Nil(t, m.InsertPlugin(map[string]interface{}{
+		"Name":         "Harness",
+		"ServiceName":  "Harness-5000",
+		"State":        "Stopped",
+		"DesiredState": "",
+	}))
+
+	tests := []struct {
+		name        string
+		serviceName string
+		state       rethink.PluginState
+		action      string
+		want        rethink.PluginDesiredState
+		wantErr     bool
+	}{
+		{
+			name:        "Start",
+			serviceName: "Harness-5000",
+			state:       rethink.StateStopped,
+			action:      "start",
+			want:        rethink.DesiredStateActivate,
+		},
+		{
+			name:        "Restart",
+			serviceName: "Harness-5000",
+			state:       rethink.StateActive,
+			action:      "restart",
+			want:        rethink.DesiredStateRestart,
+		},
+		{
+			name:        "Restart stopped",
+			serviceName: "Harness-5000",
+			state:       rethink.StateStopped,
+			action:      "restart",
+			wantErr:     true,
+		},
+		{
+			name:        "Stop",
+			serviceName: "Harness-5000",
+			state:       rethink.StateActive,
+			action:      "stop",
+			want:        rethink.DesiredStateStop,
+		},
+		{
+			name:        "Stop while restarting",
+			serviceName: "Harness-5000",
+			state:       rethink.StateRestarting,
+			action:      "stop",
+			want:        rethink.DesiredStateStop,
+		},
+		{
+			name:        "Pause",
+			serviceName: "Harness-5000",
+			state:       rethink.StateActive,
+			action:      "pause",
+			want:        rethink.DesiredStatePause,
+		},
+		{
+			name:        "Resume",
+			serviceName: "Harness-5000",
+			state:       rethink.StatePaused,
+			action:      "resume",
+			want:        rethink.DesiredStateResume,
+		},
+		{
+			name:        "Unknown action",
+			serviceName: "Harness-5000",
+			action:      "retire",
+			wantErr:     true,
+		},
+		{
+			name:        "Unknown plugin",
+			serviceName: "Harness-6000",
+			action:      "start",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.state != "" {
+				m.UpdatePluginStatus("Harness-5000", map[string]string{
+					"State":        string(tt.state),
+					"DesiredState": "",
+				})
+			}
+			got, err := setDesiredState(tt.serviceName, tt.action)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			doc, err := m.GetPluginByServiceName(tt.serviceName)
+			assert.Nil(t, err)
+			assert.Equal(t, string(tt.want), doc["DesiredState"])
+		})
+	}
+}
+
+func Test_healthURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Port only",
+			addr: ":8080",
+			want: "http://127.0.0.1:8080/readyz",
+		},
+		{
+			name: "Any address",
+			addr: "0.0.0.0:9000",
+			want: "http://127.0.0.1:9000/readyz",
+		},
+		{
+			name: "Host",
+			addr: "controller:8080",
+			want: "http://controller:8080/readyz",
+		},
+		{
+			name:    "No port",
+			addr:    "controller",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := healthURL(tt.addr, "/readyz")
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
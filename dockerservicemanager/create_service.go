@@ -14,15 +14,21 @@ import (
 	container "github.com/docker/docker/api/types/container"
 	mount "github.com/docker/docker/api/types/mount"
 	swarm "github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
 	rethink "github.com/ramrod-project/backend-controller-go/rethink"
 )
 
 var ipv4 = regexp.MustCompile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
 
+// PluginLabel is set on the containers of every
+// plugin service, to the plugin's ServiceName, so that
+// their events can be picked out whatever the image.
+const PluginLabel = "ramrod.plugin"
+
 type dockerImageName struct {
-	Name string
-	Tag  string
+	Name   string
+	Tag    string
+	Digest string
 }
 
 // String method for image name
@@ -30,8 +36,14 @@ func (d dockerImageName) String() string {
 	var stringBuf bytes.Buffer
 
 	stringBuf.WriteString(d.Name)
-	stringBuf.WriteString(":")
-	stringBuf.WriteString(d.Tag)
+	if d.Tag != "" {
+		stringBuf.WriteString(":")
+		stringBuf.WriteString(d.Tag)
+	}
+	if d.Digest != "" {
+		stringBuf.WriteString("@")
+		stringBuf.WriteString(d.Digest)
+	}
 
 	return stringBuf.String()
 }
@@ -47,8 +59,28 @@ type PluginServiceConfig struct {
 	Ports       []swarm.PortConfig `json:",omitempty"`
 	ServiceName string
 	Volumes     []mount.Mount `json:",omitempty"`
+	// Image, Tag and Digest override the ramrodpcp
+	// interpreter image, or just its tag and digest.
+	Image       string                     `json:",omitempty"`
+	Tag         string                     `json:",omitempty"`
+	Digest      string                     `json:",omitempty"`
+	Resources   *rethink.PluginResources   `json:",omitempty"`
+	Healthcheck *rethink.PluginHealthcheck `json:",omitempty"`
+	// Replicas is how many tasks a replicated service
+	// runs, 1 unless set. A global service runs one on
+	// every node for its OS, whatever its Address.
+	Replicas uint64             `json:",omitempty"`
+	Mode     rethink.PluginMode `json:",omitempty"`
+	// Startup is set for the services the controller
+	// starts itself, which aren't rolled out like plugins.
+	Startup bool `json:",omitempty"`
 }
 
+// updateMonitor is how long each new task is watched
+// during a service update. A task failing within it
+// rolls the whole update back.
+const updateMonitor = 30 * time.Second
+
 func getTagFromEnv() string {
 	temp := os.Getenv("TAG")
 	if temp == "" {
@@ -57,6 +89,16 @@ func getTagFromEnv() string {
 	return temp
 }
 
+// ImageVersion returns the tag and digest a plugin
+// pinned to tag and digest runs, which is the TAG
+// the controller runs when it isn't pinned.
+func ImageVersion(tag, digest string) (string, string) {
+	if tag == "" && digest == "" {
+		return getTagFromEnv(), ""
+	}
+	return tag, digest
+}
+
 func hostString(h string, i string) string {
 	var stringBuf bytes.Buffer
 
@@ -69,24 +111,76 @@ func hostString(h string, i string) string {
 
 // GetManagerIP returns the string version of the primary IPv4
 // address associated with the manager node in the swarm.
-func GetManagerIP() string {
+func GetManagerIP() (string, error) {
 	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	list, err := dockerClient.NodeList(ctx, types.NodeListOptions{})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	for _, node := range list {
 		if node.Spec.Role == swarm.NodeRoleManager {
-			return node.Status.Addr
+			return node.Status.Addr, nil
 		}
 	}
-	return ""
+	return "", nil
+}
+
+// healthConfig returns the controller's default service
+// healthcheck, with any fields a plugin sets overridden.
+func healthConfig(check *rethink.PluginHealthcheck) (*container.HealthConfig, error) {
+	health := &container.HealthConfig{
+		Interval: time.Second,
+		Timeout:  time.Second * 3,
+		Retries:  3,
+	}
+	if check == nil {
+		return health, nil
+	}
+
+	if len(check.Test) > 0 {
+		health.Test = check.Test
+	}
+	if check.Interval != "" {
+		d, err := time.ParseDuration(check.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthcheck interval: %v", err)
+		}
+		health.Interval = d
+	}
+	if check.Timeout != "" {
+		d, err := time.ParseDuration(check.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthcheck timeout: %v", err)
+		}
+		health.Timeout = d
+	}
+	if check.Retries > 0 {
+		health.Retries = check.Retries
+	}
+	return health, nil
+}
+
+// resourceRequirements converts a plugin's resource
+// limits, returning nil if it has none.
+func resourceRequirements(res *rethink.PluginResources) (*swarm.ResourceRequirements, error) {
+	if res == nil || (res.CPUs == 0 && res.MemoryMB == 0) {
+		return nil, nil
+	}
+	if res.CPUs < 0 || res.MemoryMB < 0 {
+		return nil, fmt.Errorf("invalid resource limits: %+v", *res)
+	}
+	return &swarm.ResourceRequirements{
+		Limits: &swarm.Resources{
+			NanoCPUs:    int64(res.CPUs * 1e9),
+			MemoryBytes: res.MemoryMB * 1024 * 1024,
+		},
+	}, nil
 }
 
 func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error) {
@@ -95,12 +189,10 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 			Name:   config.ServiceName,
 			Labels: make(map[string]string),
 		}
-		hosts     []string
-		imageName = &dockerImageName{
-			Tag: getTagFromEnv(),
-		}
-		labels          = make(map[string]string)
-		maxAttempts     = uint64(3)
+		hosts           []string
+		imageName       = &dockerImageName{}
+		labels          = map[string]string{PluginLabel: config.ServiceName}
+		maxAttempts     = uint64(rethink.MaxRestartAttempts)
 		placementConfig = &swarm.Placement{}
 		replicas        = uint64(1)
 		stopGrace       = time.Second
@@ -119,14 +211,22 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 			imageName.Name = "ramrodpcp/interpreter-plugin"
 		}
 		placementConfig.Constraints = []string{"node.labels.os==posix"}
-		hosts = append(hosts, hostString("rethinkdb", GetManagerIP()))
-		config.Environment = append(config.Environment, "RETHINK_HOST="+GetManagerIP())
+		managerIP, err := GetManagerIP()
+		if err != nil {
+			return &swarm.ServiceSpec{}, err
+		}
+		hosts = append(hosts, hostString("rethinkdb", managerIP))
+		config.Environment = append(config.Environment, "RETHINK_HOST="+managerIP)
 	} else if config.OS == rethink.PluginOSWindows {
 		annotations.Labels["os"] = "nt"
 		imageName.Name = "ramrodpcp/interpreter-plugin-windows"
 		placementConfig.Constraints = []string{"node.labels.os==nt"}
-		hosts = append(hosts, hostString("rethinkdb", GetManagerIP()))
-		config.Environment = append(config.Environment, "RETHINK_HOST="+GetManagerIP())
+		managerIP, err := GetManagerIP()
+		if err != nil {
+			return &swarm.ServiceSpec{}, err
+		}
+		hosts = append(hosts, hostString("rethinkdb", managerIP))
+		config.Environment = append(config.Environment, "RETHINK_HOST="+managerIP)
 	} else {
 		return &swarm.ServiceSpec{}, fmt.Errorf("invalid OS setting: %v", config.OS)
 	}
@@ -136,22 +236,52 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 		var stringBuf bytes.Buffer
 		stringBuf.WriteString("node.labels.ip==")
 		stringBuf.WriteString(v)
-		placementConfig.Constraints = append(placementConfig.Constraints, stringBuf.String())
+		if config.Mode != rethink.ModeGlobal {
+			placementConfig.Constraints = append(placementConfig.Constraints, stringBuf.String())
+		}
 	} else {
 		return &swarm.ServiceSpec{}, fmt.Errorf("must specify valid ip address, got: %v", config.Address)
 	}
 
+	mode := swarm.ServiceMode{
+		Replicated: &swarm.ReplicatedService{
+			Replicas: &replicas,
+		},
+	}
+	switch config.Mode {
+	case rethink.ModeGlobal:
+		mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	case rethink.ModeReplicated, "":
+		if config.Replicas > 0 {
+			replicas = config.Replicas
+		}
+	default:
+		return &swarm.ServiceSpec{}, fmt.Errorf("invalid mode: %v", config.Mode)
+	}
+
+	// Plugins may ship their own image, and
+	// be pinned (or upgraded) to a tag or digest
+	if config.Image != "" {
+		imageName.Name = config.Image
+	}
+	imageName.Tag, imageName.Digest = ImageVersion(config.Tag, config.Digest)
+
+	healthcheck, err := healthConfig(config.Healthcheck)
+	if err != nil {
+		return &swarm.ServiceSpec{}, err
+	}
+	resources, err := resourceRequirements(config.Resources)
+	if err != nil {
+		return &swarm.ServiceSpec{}, err
+	}
+
 	serviceSpec := &swarm.ServiceSpec{
 		Annotations: annotations,
 		TaskTemplate: swarm.TaskSpec{
 			ContainerSpec: swarm.ContainerSpec{
-				DNSConfig: &swarm.DNSConfig{},
-				Env:       config.Environment,
-				Healthcheck: &container.HealthConfig{
-					Interval: time.Second,
-					Timeout:  time.Second * 3,
-					Retries:  3,
-				},
+				DNSConfig:       &swarm.DNSConfig{},
+				Env:             config.Environment,
+				Healthcheck:     healthcheck,
 				Image:           imageName.String(),
 				Labels:          labels,
 				Mounts:          config.Volumes,
@@ -160,6 +290,7 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 				TTY:             false,
 				Hosts:           hosts,
 			},
+			Resources: resources,
 			RestartPolicy: &swarm.RestartPolicy{
 				Condition:   "on-failure",
 				MaxAttempts: &maxAttempts,
@@ -171,11 +302,7 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 				},
 			},
 		},
-		Mode: swarm.ServiceMode{
-			Replicated: &swarm.ReplicatedService{
-				Replicas: &replicas,
-			},
-		},
+		Mode: mode,
 		UpdateConfig: &swarm.UpdateConfig{
 			Parallelism: 0,
 			Delay:       0,
@@ -186,20 +313,39 @@ func generateServiceSpec(config *PluginServiceConfig) (*swarm.ServiceSpec, error
 		},
 	}
 
+	// Plugins are upgraded a task at a time, and
+	// rolled back if the new ones fail
+	if !config.Startup {
+		serviceSpec.UpdateConfig = &swarm.UpdateConfig{
+			Parallelism:   1,
+			Delay:         0,
+			FailureAction: orchestrator.UpdateFailureActionRollback,
+			Monitor:       updateMonitor,
+		}
+	}
+
 	return serviceSpec, nil
 }
 
 // CreatePluginService creates a service for a plugin
 // given a PluginServiceConfig.
-func CreatePluginService(config *PluginServiceConfig) (types.ServiceCreateResponse, error) {
+func CreatePluginService(ctx context.Context, config *PluginServiceConfig) (types.ServiceCreateResponse, error) {
 
-	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 
 	if err != nil {
 		return types.ServiceCreateResponse{}, err
 	}
 
+	addresses, err := portAddresses(config)
+	if err != nil {
+		return types.ServiceCreateResponse{}, err
+	}
+	config.Ports, err = allocatePorts(addresses, config.Ports, nil)
+	if err != nil {
+		return types.ServiceCreateResponse{}, err
+	}
+
 	serviceSpec, err := generateServiceSpec(config)
 
 	if err != nil {
@@ -207,16 +353,22 @@ func CreatePluginService(config *PluginServiceConfig) (types.ServiceCreateRespon
 	}
 
 	resp, err := dockerClient.ServiceCreate(ctx, *serviceSpec, types.ServiceCreateOptions{})
+	if err != nil {
+		// Nothing was published, so no ports are used
+		return resp, err
+	}
 	log.Printf("Started service %+v", resp)
 
 	//update ports
-	for _, port := range config.Ports {
-		err := rethink.AddPort(config.Address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
-		if err != nil {
-			log.Printf("%v", err)
+	for _, address := range addresses {
+		for _, port := range config.Ports {
+			err := rethink.AddPort(address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
+			if err != nil {
+				log.Printf("%v", err)
+			}
 		}
 	}
 
-	return resp, err
+	return resp, nil
 
 }
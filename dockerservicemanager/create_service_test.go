@@ -11,6 +11,7 @@ import (
 	container "github.com/docker/docker/api/types/container"
 	swarm "github.com/docker/docker/api/types/swarm"
 	client "github.com/docker/docker/client"
+	rethink "github.com/ramrod-project/backend-controller-go/rethink"
 	"github.com/ramrod-project/backend-controller-go/test"
 	"github.com/stretchr/testify/assert"
 	r "gopkg.in/gorethink/gorethink.v4"
@@ -42,7 +43,7 @@ func Test_CreatePluginService(t *testing.T) {
 	}
 
 	testPort := map[string]interface{}{
-		"Interface":    GetManagerIP(),
+		"Interface":    managerIP(t),
 		"TCPPorts":     []string{},
 		"UDPPorts":     []string{},
 		"NodeHostName": "test",
@@ -74,7 +75,7 @@ func Test_CreatePluginService(t *testing.T) {
 			name: "Test creating a plugin service",
 			args: args{
 				config: PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -107,7 +108,7 @@ func Test_CreatePluginService(t *testing.T) {
 								"PORT=5000",
 								"PLUGIN=Harness",
 								"PLUGIN_NAME=Harness-5000tcp",
-								"RETHINK_HOST=" + GetManagerIP(),
+								"RETHINK_HOST=" + managerIP(t),
 							},
 						},
 						Networks: []swarm.NetworkAttachmentConfig{
@@ -134,7 +135,7 @@ func Test_CreatePluginService(t *testing.T) {
 			name: "Bad network",
 			args: args{
 				config: PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -161,7 +162,7 @@ func Test_CreatePluginService(t *testing.T) {
 			name: "Duplicate service name",
 			args: args{
 				config: PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -188,7 +189,7 @@ func Test_CreatePluginService(t *testing.T) {
 			name: "Test creating an 'extra' plugin service",
 			args: args{
 				config: PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -222,7 +223,7 @@ func Test_CreatePluginService(t *testing.T) {
 								"PORT=7000",
 								"PLUGIN=Harness",
 								"PLUGIN_NAME=Harness-7000tcp",
-								"RETHINK_HOST=" + GetManagerIP(),
+								"RETHINK_HOST=" + managerIP(t),
 							},
 						},
 						Networks: []swarm.NetworkAttachmentConfig{
@@ -249,7 +250,7 @@ func Test_CreatePluginService(t *testing.T) {
 	generatedIDs := make([]string, len(tests))
 	for i, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := CreatePluginService(&tt.args.config)
+			got, err := CreatePluginService(context.Background(), &tt.args.config)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreatePluginService() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -345,7 +346,7 @@ func Test_generateServiceSpec(t *testing.T) {
 			name: "Good config",
 			args: args{
 				config: &PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -375,7 +376,7 @@ func Test_generateServiceSpec(t *testing.T) {
 							"LOGLEVEL=DEBUG",
 							"PORT=666",
 							"PLUGIN=GoodPlugin",
-							"RETHINK_HOST=" + GetManagerIP(),
+							"RETHINK_HOST=" + managerIP(t),
 						},
 						Healthcheck: &container.HealthConfig{
 							Interval: time.Second,
@@ -392,7 +393,7 @@ func Test_generateServiceSpec(t *testing.T) {
 					Placement: &swarm.Placement{
 						Constraints: []string{
 							"node.labels.os==posix",
-							"node.labels.ip==" + GetManagerIP(),
+							"node.labels.ip==" + managerIP(t),
 						},
 					},
 					Networks: []swarm.NetworkAttachmentConfig{
@@ -422,7 +423,7 @@ func Test_generateServiceSpec(t *testing.T) {
 			name: "Good config (win)",
 			args: args{
 				config: &PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=PROD",
 						"LOGLEVEL=DEBUG",
@@ -452,7 +453,7 @@ func Test_generateServiceSpec(t *testing.T) {
 							"LOGLEVEL=DEBUG",
 							"PORT=777",
 							"PLUGIN=GoodPluginWin",
-							"RETHINK_HOST=" + GetManagerIP(),
+							"RETHINK_HOST=" + managerIP(t),
 						},
 						Healthcheck: &container.HealthConfig{
 							Interval: time.Second,
@@ -461,7 +462,7 @@ func Test_generateServiceSpec(t *testing.T) {
 						},
 						Image:           "ramrodpcp/interpreter-plugin-windows:" + tag,
 						StopGracePeriod: &second,
-						Hosts:           []string{hostString("rethinkdb", GetManagerIP())},
+						Hosts:           []string{hostString("rethinkdb", managerIP(t))},
 					},
 					RestartPolicy: &swarm.RestartPolicy{
 						Condition:   "on-failure",
@@ -470,7 +471,7 @@ func Test_generateServiceSpec(t *testing.T) {
 					Placement: &swarm.Placement{
 						Constraints: []string{
 							"node.labels.os==nt",
-							"node.labels.ip==" + GetManagerIP(),
+							"node.labels.ip==" + managerIP(t),
 						},
 					},
 					Networks: []swarm.NetworkAttachmentConfig{
@@ -500,7 +501,7 @@ func Test_generateServiceSpec(t *testing.T) {
 			name: "Bad config OS",
 			args: args{
 				config: &PluginServiceConfig{
-					Address: GetManagerIP(),
+					Address: managerIP(t),
 					Environment: []string{
 						"STAGE=DEV",
 						"LOGLEVEL=DEBUG",
@@ -603,13 +604,25 @@ func Test_GetManagerIP(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := GetManagerIP(); got != tt.want {
-				t.Errorf("GetManagerIP() = %v, want %v", got, tt.want)
+			got, err := GetManagerIP()
+			assert.Nil(t, err)
+			if got != tt.want {
+				t.Errorf("managerIP(t) = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+// managerIP is GetManagerIP for test
+// tables, failing the test on an error.
+func managerIP(t *testing.T) string {
+	ip, err := GetManagerIP()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return ip
+}
+
 func Test_hostString(t *testing.T) {
 	type args struct {
 		h string
@@ -637,3 +650,117 @@ func Test_hostString(t *testing.T) {
 		})
 	}
 }
+
+func Test_dockerImageName(t *testing.T) {
+	tests := []struct {
+		name  string
+		image dockerImageName
+		want  string
+	}{
+		{
+			name:  "Tag",
+			image: dockerImageName{Name: "ramrodpcp/interpreter-plugin", Tag: "latest"},
+			want:  "ramrodpcp/interpreter-plugin:latest",
+		},
+		{
+			name:  "Digest",
+			image: dockerImageName{Name: "example/plugin", Digest: "sha256:abc"},
+			want:  "example/plugin@sha256:abc",
+		},
+		{
+			name:  "Tag and digest",
+			image: dockerImageName{Name: "example/plugin", Tag: "1.0", Digest: "sha256:abc"},
+			want:  "example/plugin:1.0@sha256:abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.image.String())
+		})
+	}
+}
+
+func Test_healthConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   *rethink.PluginHealthcheck
+		want    *container.HealthConfig
+		wantErr bool
+	}{
+		{
+			name: "Default",
+			want: &container.HealthConfig{
+				Interval: time.Second,
+				Timeout:  3 * time.Second,
+				Retries:  3,
+			},
+		},
+		{
+			name: "Override",
+			check: &rethink.PluginHealthcheck{
+				Test:     []string{"CMD-SHELL", "curl -f localhost"},
+				Interval: "10s",
+				Retries:  5,
+			},
+			want: &container.HealthConfig{
+				Test:     []string{"CMD-SHELL", "curl -f localhost"},
+				Interval: 10 * time.Second,
+				Timeout:  3 * time.Second,
+				Retries:  5,
+			},
+		},
+		{
+			name:    "Bad duration",
+			check:   &rethink.PluginHealthcheck{Timeout: "soon"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := healthConfig(tt.check)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("healthConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_resourceRequirements(t *testing.T) {
+	tests := []struct {
+		name    string
+		res     *rethink.PluginResources
+		want    *swarm.ResourceRequirements
+		wantErr bool
+	}{
+		{
+			name: "None",
+		},
+		{
+			name: "Limits",
+			res:  &rethink.PluginResources{CPUs: 0.5, MemoryMB: 256},
+			want: &swarm.ResourceRequirements{
+				Limits: &swarm.Resources{
+					NanoCPUs:    500000000,
+					MemoryBytes: 256 * 1024 * 1024,
+				},
+			},
+		},
+		{
+			name:    "Negative",
+			res:     &rethink.PluginResources{MemoryMB: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resourceRequirements(tt.res)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resourceRequirements() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
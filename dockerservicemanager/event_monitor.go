@@ -2,20 +2,35 @@ package dockerservicemanager
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	events "github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/health"
+	"github.com/ramrod-project/backend-controller-go/helper"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
+	"github.com/ramrod-project/backend-controller-go/rethink"
 )
 
 func eventFanIn(eventChans []<-chan events.Message, errChans []<-chan error) (<-chan events.Message, <-chan error) {
+	var (
+		evtWg sync.WaitGroup
+		errWg sync.WaitGroup
+	)
 	evts := make(chan events.Message)
 	errs := make(chan error)
 
 	// Collect errors
+	errWg.Add(len(errChans))
 	for _, errChan := range errChans {
 		go func(c <-chan error) {
+			defer errWg.Done()
 			for err := range c {
 				errs <- err
 			}
@@ -23,36 +38,195 @@ func eventFanIn(eventChans []<-chan events.Message, errChans []<-chan error) (<-
 	}
 
 	// Collect messages
+	evtWg.Add(len(eventChans))
 	for _, eventChan := range eventChans {
 		go func(c <-chan events.Message) {
+			defer evtWg.Done()
 			for evt := range c {
 				evts <- evt
 			}
 		}(eventChan)
 	}
 
+	go func() {
+		errWg.Wait()
+		close(errs)
+	}()
+	go func() {
+		evtWg.Wait()
+		close(evts)
+	}()
+
 	return evts, errs
 }
 
+// eventCheckpoint is the position of an event stream.
+// It holds the time of the last event passed on, and
+// the events already passed on at that time, since a
+// stream resumed with Since replays them.
+type eventCheckpoint struct {
+	timeNano int64
+	seen     map[string]struct{}
+}
+
+func eventKey(evt events.Message) string {
+	return fmt.Sprintf("%v %v %v", evt.Type, evt.Actor.ID, evt.Action)
+}
+
+// observe advances the checkpoint past an event,
+// returning false if it was already passed on.
+func (c *eventCheckpoint) observe(evt events.Message) bool {
+	switch {
+	case evt.TimeNano < c.timeNano:
+		return false
+	case evt.TimeNano > c.timeNano:
+		c.timeNano = evt.TimeNano
+		c.seen = make(map[string]struct{})
+	}
+	key := eventKey(evt)
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = struct{}{}
+	return true
+}
+
+// since returns the checkpoint in the format
+// expected by EventsOptions.Since.
+func (c *eventCheckpoint) since() string {
+	if c.timeNano == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%09d", c.timeNano/int64(time.Second), c.timeNano%int64(time.Second))
+}
+
+// EventStreamHealth reports whether each docker
+// event stream (by filtered type) is subscribed.
+var EventStreamHealth = health.NewStatus()
+
+// resumeEvents follows a filtered event stream, and
+// resubscribes from its checkpoint with backoff
+// whenever the stream errors, reporting whether it's
+// subscribed to status. It starts after the last event
+// of its type that EventUpdate handled, so none are
+// missed across a restart. Both channels are closed
+// once the context is done.
+func resumeEvents(ctx context.Context, dockerClient orchestrator.Orchestrator, filter filters.Args, status *health.Status) (<-chan events.Message, <-chan error) {
+	out := make(chan events.Message)
+	errs := make(chan error)
+
+	checkpoint := &eventCheckpoint{}
+	part := strings.Join(filter.Get("type"), ",")
+	opened := time.Now().UnixNano()
+
+	go func() {
+		defer close(errs)
+		defer close(out)
+		defer status.Set(part, errors.New("stopped"))
+
+		// Without a stored checkpoint, resume from
+		// when the stream was first opened
+		last, err := rethink.GetStore().GetEventCheckpoint(part)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case errs <- errorhandler.Transient(
+				errorhandler.ComponentEventMonitor,
+				fmt.Errorf("reading %v event checkpoint: %v", part, err),
+			):
+			}
+		}
+		if last > 0 {
+			last++
+		} else {
+			last = opened
+		}
+		checkpoint.observe(events.Message{TimeNano: last})
+
+		backoff := helper.NewBackoff(100*time.Millisecond, 30*time.Second)
+
+		for {
+			streamCtx, cancel := context.WithCancel(ctx)
+			evts, streamErrs := dockerClient.Events(streamCtx, types.EventsOptions{
+				Filters: filter,
+				Since:   checkpoint.since(),
+			})
+			status.Set(part, nil)
+
+		L:
+			for {
+				select {
+				case <-ctx.Done():
+					cancel()
+					return
+				case evt := <-evts:
+					backoff.Reset()
+					if !checkpoint.observe(evt) {
+						continue
+					}
+					select {
+					case <-ctx.Done():
+						cancel()
+						return
+					case out <- evt:
+					}
+				case e, ok := <-streamErrs:
+					err = e
+					if !ok || err == nil {
+						err = fmt.Errorf("stream closed")
+					}
+					break L
+				}
+			}
+			cancel()
+			status.Set(part, err)
+
+			delay := backoff.Next()
+			select {
+			case <-ctx.Done():
+				return
+			case errs <- errorhandler.Transient(
+				errorhandler.ComponentEventMonitor,
+				fmt.Errorf("event stream ended: %v, resubscribing in %v", err, delay),
+			):
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	return out, errs
+}
+
 // EventMonitor monitors events from the docker client
 // and provides an event channel and an error channel
 // for other consumers. Right now, all events are passed
 // and must be parsed/handled by the rethink EventUpdate
-// routine.
-func EventMonitor() (<-chan events.Message, <-chan error) {
-	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+// routine. If a stream errors it is resubscribed from
+// the last event passed on, so no events are missed
+// or repeated. Both channels are closed once the
+// context is done, or straight away, after a fatal
+// error, if there's no docker client.
+func EventMonitor(ctx context.Context) (<-chan events.Message, <-chan error) {
+	dockerClient, err := getOrchestrator()
 	if err != nil {
-		panic(err)
+		eventChan := make(chan events.Message)
+		errChan := make(chan error, 1)
+		errChan <- errorhandler.New(errorhandler.ComponentEventMonitor, errorhandler.SeverityFatal, err)
+		close(eventChan)
+		close(errChan)
+		return eventChan, errChan
 	}
 
-	// Filter plugin containers (start and die events)
+	// Filter plugin containers (health and die events),
+	// which are labelled whatever image they run
 	containerFilter := filters.NewArgs()
 	containerFilter.Add("type", "container")
-	containerFilter.Add("image", "ramrodpcp/interpreter-plugin")
-	containerFilter.Add("image", "ramrodpcp/interpreter-plugin-extra")
-	containerFilter.Add("image", "ramrodpcp/interpreter-plugin-windows")
-	containerFilter.Add("image", "ramrodpcp/auxiliary-services")
+	containerFilter.Add("label", PluginLabel)
 	containerFilter.Add("event", "die")
 	containerFilter.Add("event", "health_status")
 
@@ -60,13 +234,9 @@ func EventMonitor() (<-chan events.Message, <-chan error) {
 	serviceFilter := filters.NewArgs()
 	serviceFilter.Add("type", "service")
 
-	containerChan, errContainerChan := dockerClient.Events(ctx, types.EventsOptions{
-		Filters: containerFilter,
-	})
+	containerChan, errContainerChan := resumeEvents(ctx, dockerClient, containerFilter, EventStreamHealth)
 
-	serviceChan, errServiceChan := dockerClient.Events(ctx, types.EventsOptions{
-		Filters: serviceFilter,
-	})
+	serviceChan, errServiceChan := resumeEvents(ctx, dockerClient, serviceFilter, EventStreamHealth)
 
 	eventChan, errChan := eventFanIn(
 		[]<-chan events.Message{containerChan, serviceChan},
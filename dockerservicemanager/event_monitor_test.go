@@ -2,6 +2,7 @@ package dockerservicemanager
 
 import (
 	"context"
+	"errors"
 	"log"
 	"testing"
 	"time"
@@ -9,8 +10,12 @@ import (
 	"github.com/docker/docker/api/types"
 	container "github.com/docker/docker/api/types/container"
 	events "github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	swarm "github.com/docker/docker/api/types/swarm"
 	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/health"
 	"github.com/ramrod-project/backend-controller-go/helper"
+	"github.com/ramrod-project/backend-controller-go/rethink"
 	"github.com/ramrod-project/backend-controller-go/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -435,7 +440,7 @@ func TestEventMonitor(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			res := make(chan bool)
-			evts, errs := EventMonitor()
+			evts, errs := EventMonitor(ctx)
 			go func() {
 				res <- tt.wait(t, evts, tt.timeout)
 				close(res)
@@ -458,3 +463,214 @@ func TestEventMonitor(t *testing.T) {
 		t.Errorf("setup error: %v", err)
 	}
 }
+
+func Test_eventCheckpoint(t *testing.T) {
+	evt := func(timeNano int64, id string, action string) events.Message {
+		return events.Message{
+			Type:     "service",
+			Action:   action,
+			Actor:    events.Actor{ID: id},
+			TimeNano: timeNano,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		evts      []events.Message
+		want      []bool
+		wantSince string
+	}{
+		{
+			name:      "empty",
+			wantSince: "",
+		},
+		{
+			name: "in order",
+			evts: []events.Message{
+				evt(1533221452162910336, "a", "create"),
+				evt(1533221452162910337, "a", "update"),
+			},
+			want:      []bool{true, true},
+			wantSince: "1533221452.162910337",
+		},
+		{
+			name: "replayed",
+			evts: []events.Message{
+				evt(1533221452000000001, "a", "create"),
+				evt(1533221452000000002, "a", "update"),
+				evt(1533221452000000001, "a", "create"),
+				evt(1533221452000000002, "a", "update"),
+				evt(1533221452000000003, "a", "remove"),
+			},
+			want:      []bool{true, true, false, false, true},
+			wantSince: "1533221452.000000003",
+		},
+		{
+			name: "same time",
+			evts: []events.Message{
+				evt(1533221452000000001, "a", "create"),
+				evt(1533221452000000001, "b", "create"),
+				evt(1533221452000000001, "a", "create"),
+			},
+			want:      []bool{true, true, false},
+			wantSince: "1533221452.000000001",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &eventCheckpoint{}
+			var got []bool
+			for _, e := range tt.evts {
+				got = append(got, c.observe(e))
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantSince, c.since())
+		})
+	}
+}
+
+func Test_resumeEvents(t *testing.T) {
+	f, _, restore := useFakes(t)
+	defer restore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	status := health.NewStatus()
+	serviceFilter := filters.NewArgs()
+	serviceFilter.Add("type", "service")
+	evts, errs := resumeEvents(ctx, f, serviceFilter, status)
+
+	next := func() string {
+		select {
+		case e := <-evts:
+			return e.Action + " " + e.Actor.Attributes["name"]
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	_, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "first"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "create first", next())
+	assert.Nil(t, status.Check(ctx))
+
+	// Daemon hiccup, and a service is created
+	// before the stream is resubscribed
+	f.InterruptEvents(errors.New("unexpected EOF"))
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "event stream ended: unexpected EOF")
+	case <-time.After(time.Second):
+		t.Errorf("stream error not reported")
+	}
+	assert.EqualError(t, status.Check(ctx), "service: unexpected EOF")
+	_, err = f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "second"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	// The missed event arrives once, and the
+	// last one seen is not repeated
+	assert.Equal(t, "create second", next())
+	assert.Equal(t, "", next())
+	assert.Nil(t, status.Check(ctx))
+}
+
+func Test_resumeEvents_Checkpoint(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+
+	serviceFilter := filters.NewArgs()
+	serviceFilter.Add("type", "service")
+	create := func(name string) {
+		_, err := f.ServiceCreate(context.Background(), swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: name},
+		}, types.ServiceCreateOptions{})
+		assert.Nil(t, err)
+	}
+	follow := func() (<-chan events.Message, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		evts, errs := resumeEvents(ctx, f, serviceFilter, health.NewStatus())
+		go func() {
+			for range errs {
+			}
+		}()
+		return evts, cancel
+	}
+	next := func(evts <-chan events.Message) (events.Message, bool) {
+		select {
+		case e := <-evts:
+			return e, true
+		case <-time.After(time.Second):
+			return events.Message{}, false
+		}
+	}
+
+	evts, cancel := follow()
+	create("first")
+	evt, ok := next(evts)
+	assert.True(t, ok)
+	assert.Equal(t, "first", evt.Actor.Attributes["name"])
+	cancel()
+
+	// Handled, then the controller restarts
+	// after another service is created
+	assert.Nil(t, m.SetEventCheckpoint("service", evt.TimeNano))
+	create("second")
+
+	evts, cancel = follow()
+	defer cancel()
+	evt, ok = next(evts)
+	assert.True(t, ok)
+	assert.Equal(t, "second", evt.Actor.Attributes["name"])
+	_, ok = next(evts)
+	assert.False(t, ok)
+}
+
+func TestEventMonitor_Label(t *testing.T) {
+	f, _, restore := useFakes(t)
+	defer restore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evts, errs := EventMonitor(ctx)
+	go func() {
+		for range errs {
+		}
+	}()
+
+	// A plugin with its own image, and a
+	// service the controller didn't start
+	_, err := CreatePluginService(ctx, &PluginServiceConfig{
+		Address:     "192.168.1.1",
+		OS:          rethink.PluginOSPosix,
+		ServiceName: "ThirdPartyService",
+		Image:       "acme/thirdparty",
+	})
+	assert.Nil(t, err)
+	other, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "OtherService"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{Image: "ramrodpcp/interpreter-plugin"},
+		},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetTaskHealth(other.ID, true))
+
+	var seen []string
+	timeout := time.After(time.Second)
+L:
+	for {
+		select {
+		case e := <-evts:
+			if e.Type == "container" {
+				seen = append(seen, e.Action+" "+e.Actor.Attributes["com.docker.swarm.service.name"])
+			}
+		case <-timeout:
+			break L
+		}
+	}
+	assert.Equal(t, []string{"health_status: healthy ThirdPartyService"}, seen)
+}
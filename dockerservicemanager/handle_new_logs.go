@@ -8,11 +8,13 @@ import (
 
 	"github.com/docker/docker/api/types"
 	swarm "github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/client"
 	"github.com/ramrod-project/backend-controller-go/customtypes"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/metrics"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
 )
 
-func newLogger(ctx context.Context, dockerClient *client.Client, svc swarm.Service) (<-chan customtypes.Log, <-chan error) {
+func newLogger(ctx context.Context, dockerClient orchestrator.Orchestrator, svc swarm.Service) (<-chan customtypes.Log, <-chan error) {
 	logs := make(chan customtypes.Log)
 	errs := make(chan error)
 
@@ -31,8 +33,14 @@ func newLogger(ctx context.Context, dockerClient *client.Client, svc swarm.Servi
 			Follow:     true,
 		})
 
+		// A failed log stream loses that
+		// service's logs, nothing else
+		logErr := func(err error) error {
+			return errorhandler.New(errorhandler.ComponentLogHandler, errorhandler.SeverityWarning, err).ForService(svcName, svcID)
+		}
+
 		if err != nil {
-			errs <- err
+			errs <- logErr(err)
 			return
 		}
 		defer logOut.Close()
@@ -40,9 +48,9 @@ func newLogger(ctx context.Context, dockerClient *client.Client, svc swarm.Servi
 		h := make([]byte, 8)
 		n, err := logOut.Read(h)
 		if err != nil {
-			errs <- err
+			errs <- logErr(err)
 		} else if n == 0 {
-			errs <- fmt.Errorf("nothing read")
+			errs <- logErr(fmt.Errorf("nothing read"))
 		}
 
 		scanner := bufio.NewScanner(logOut)
@@ -57,6 +65,8 @@ func newLogger(ctx context.Context, dockerClient *client.Client, svc swarm.Servi
 
 			new := scanner.Scan()
 			if new {
+				metrics.LogLinesIngested.Inc(svcName)
+				metrics.LogQueueDepth.Add(1)
 				logs <- customtypes.Log{
 					Log:          scanner.Text(),
 					LogTimestamp: uint64(time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))),
@@ -84,7 +94,7 @@ func NewLogHandler(ctx context.Context, newSvcs <-chan swarm.Service) (<-chan (<
 	go func(in <-chan swarm.Service) {
 		defer close(ret)
 		defer close(logErrs)
-		dockerClient, err := client.NewEnvClient()
+		dockerClient, err := getOrchestrator()
 		if err != nil {
 			logErrs <- err
 			return
@@ -100,8 +110,16 @@ func NewLogHandler(ctx context.Context, newSvcs <-chan swarm.Service) (<-chan (<
 					return
 				}
 				logger, errChan := newLogger(ctx, dockerClient, con)
-				errChans <- errChan
-				ret <- logger
+				select {
+				case <-ctx.Done():
+					return
+				case errChans <- errChan:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case ret <- logger:
+				}
 			}
 		}
 	}(newSvcs)
@@ -133,7 +151,11 @@ func NewLogHandler(ctx context.Context, newSvcs <-chan swarm.Service) (<-chan (<
 						chans = append(chans[:i], chans[i+1:]...)
 						i--
 					} else if e != nil {
-						errs <- e
+						select {
+						case <-ctx.Done():
+							return
+						case errs <- e:
+						}
 					}
 				default:
 					break
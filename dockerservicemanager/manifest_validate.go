@@ -0,0 +1,368 @@
+package dockerservicemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+var (
+	envVarName     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	imageDigest    = regexp.MustCompile(`^[A-Za-z0-9_+.-]+:[A-Fa-f0-9]{32,}$`)
+	manifestOSList = []rethink.PluginOS{
+		rethink.PluginOSPosix,
+		rethink.PluginOSWindows,
+		rethink.PluginOSAll,
+	}
+)
+
+// ManifestError is a problem found in a manifest,
+// at a 1-based line and column.
+type ManifestError struct {
+	Line    int
+	Column  int
+	Message string
+	offset  int
+}
+
+// Error method for ManifestError
+func (e ManifestError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", e.Line, e.Column, e.Message)
+}
+
+// manifestPosition is where a plugin object in a
+// manifest starts, and where each of its keys are.
+type manifestPosition struct {
+	Start int
+	Keys  map[string]int
+}
+
+// scanManifest returns the offsets of each plugin object
+// in a manifest array, and of their keys. It assumes the
+// manifest is valid JSON.
+func scanManifest(content []byte) []manifestPosition {
+	var (
+		positions []manifestPosition
+		depth     = 0
+		expectKey = false
+	)
+
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; c {
+		case '[', '{':
+			depth++
+			if c == '{' && depth == 2 {
+				positions = append(positions, manifestPosition{
+					Start: i,
+					Keys:  make(map[string]int),
+				})
+				expectKey = true
+			}
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 2 {
+				expectKey = true
+			}
+		case '"':
+			start := i
+			for i++; i < len(content) && content[i] != '"'; i++ {
+				if content[i] == '\\' {
+					i++
+				}
+			}
+			if depth == 2 && expectKey && len(positions) > 0 {
+				var key string
+				if json.Unmarshal(content[start:i+1], &key) == nil {
+					positions[len(positions)-1].Keys[key] = start
+				}
+				expectKey = false
+			}
+		}
+	}
+	return positions
+}
+
+// lineColumn converts a byte offset to a
+// 1-based line and column.
+func lineColumn(content []byte, offset int) (int, int) {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// validatePlugin returns the problems with one manifest
+// plugin, by the key (or "" for the plugin) they're at.
+func validatePlugin(p ManifestPlugin, keys map[string]int) map[string][]string {
+	problems := make(map[string][]string)
+	add := func(key string, format string, args ...interface{}) {
+		if _, ok := keys[key]; !ok {
+			key = ""
+		}
+		problems[key] = append(problems[key], fmt.Sprintf(format, args...))
+	}
+
+	for key := range keys {
+		if !manifestKeys[key] {
+			add(key, "unknown field %q", key)
+		}
+	}
+
+	if p.Name == "" {
+		add("Name", "Name is required")
+	}
+
+	validOS := false
+	for _, os := range manifestOSList {
+		validOS = validOS || p.OS == os
+	}
+	if !validOS {
+		add("OS", "OS must be one of %v, got %q", manifestOSList, p.OS)
+	}
+
+	for _, port := range p.InternalPorts {
+		if _, err := parsePortRange(port); err != nil {
+			add("InternalPorts", "%v", err)
+		}
+	}
+	for _, port := range p.ExternalPorts {
+		if _, err := parsePortRange(port); err != nil {
+			add("ExternalPorts", "%v", err)
+		}
+	}
+	if _, ok := problems["InternalPorts"]; !ok {
+		if _, ok := problems["ExternalPorts"]; !ok {
+			if _, err := PluginPorts(p.InternalPorts, p.ExternalPorts); err != nil {
+				add("ExternalPorts", "%v", err)
+			}
+		}
+	}
+
+	for _, env := range p.Environment {
+		if !envVarName.MatchString(env) {
+			add("Environment", "environment variable %q must be NAME=value", env)
+		}
+	}
+
+	if p.Image == "" && p.Tag != "" {
+		add("Tag", "Tag needs an Image")
+	}
+	if p.Image == "" && p.Digest != "" {
+		add("Digest", "Digest needs an Image")
+	}
+	if p.Digest != "" && !imageDigest.MatchString(p.Digest) {
+		add("Digest", "Digest must be <algorithm>:<hex>, got %q", p.Digest)
+	}
+	if _, err := resourceRequirements(p.Resources); err != nil {
+		add("Resources", "%v", err)
+	}
+	if _, err := healthConfig(p.Healthcheck); err != nil {
+		add("Healthcheck", "%v", err)
+	}
+	_, hasReplicas := keys["Replicas"]
+	if hasReplicas && p.Replicas < 1 {
+		add("Replicas", "Replicas must be at least 1, got %v", p.Replicas)
+	}
+	switch p.Mode {
+	case "", rethink.ModeReplicated:
+	case rethink.ModeGlobal:
+		if hasReplicas {
+			add("Replicas", "Replicas can't be set for a global plugin")
+		}
+	default:
+		add("Mode", "Mode must be %v or %v, got %q", rethink.ModeReplicated, rethink.ModeGlobal, p.Mode)
+	}
+
+	return problems
+}
+
+// manifestKeys are the fields a manifest plugin may set.
+var manifestKeys = map[string]bool{
+	"Name":          true,
+	"OS":            true,
+	"Extra":         true,
+	"Description":   true,
+	"Image":         true,
+	"Tag":           true,
+	"Digest":        true,
+	"ExternalPorts": true,
+	"InternalPorts": true,
+	"Environment":   true,
+	"Resources":     true,
+	"Healthcheck":   true,
+	"Replicas":      true,
+	"Mode":          true,
+}
+
+// ValidateManifest checks the contents of a manifest
+// file, returning every problem found in file order. An
+// empty result means it is valid.
+func ValidateManifest(content []byte) []ManifestError {
+	at := func(offset int, format string, args ...interface{}) ManifestError {
+		line, column := lineColumn(content, offset)
+		return ManifestError{
+			Line:    line,
+			Column:  column,
+			Message: fmt.Sprintf(format, args...),
+			offset:  offset,
+		}
+	}
+
+	var plugins []ManifestPlugin
+	if err := json.Unmarshal(content, &plugins); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			// Offset is just past the bad character
+			offset := int(e.Offset) - 1
+			if offset < 0 {
+				offset = 0
+			}
+			return []ManifestError{at(offset, "%v", e)}
+		case *json.UnmarshalTypeError:
+			// Offset is just past the bad value
+			field := e.Field[strings.LastIndex(e.Field, ".")+1:]
+			if field == "" {
+				return []ManifestError{at(int(e.Offset), "manifest must be an array of plugins, got %v", e.Value)}
+			}
+			return []ManifestError{at(int(e.Offset), "%v must be %v, got %v", field, e.Type, e.Value)}
+		}
+		return []ManifestError{at(0, "%v", err)}
+	}
+
+	var (
+		errs      []ManifestError
+		positions = scanManifest(content)
+		names     = make(map[string]int)
+	)
+	for i, p := range plugins {
+		pos := manifestPosition{Keys: map[string]int{}}
+		if i < len(positions) {
+			pos = positions[i]
+		}
+		offsetOf := func(key string) int {
+			if offset, ok := pos.Keys[key]; ok {
+				return offset
+			}
+			return pos.Start
+		}
+
+		for key, messages := range validatePlugin(p, pos.Keys) {
+			for _, message := range messages {
+				errs = append(errs, at(offsetOf(key), "%v", message))
+			}
+		}
+
+		if p.Name == "" {
+			continue
+		}
+		if first, ok := names[p.Name]; ok {
+			line, _ := lineColumn(content, first)
+			errs = append(errs, at(offsetOf("Name"), "plugin %v is already declared on line %v", p.Name, line))
+			continue
+		}
+		names[p.Name] = offsetOf("Name")
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].offset != errs[j].offset {
+			return errs[i].offset < errs[j].offset
+		}
+		return errs[i].Message < errs[j].Message
+	})
+	return errs
+}
+
+// ManifestSchema returns a JSON Schema for
+// manifest.json, for use in editors.
+func ManifestSchema() ([]byte, error) {
+	stringArray := func(pattern string) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"type":    "string",
+				"pattern": pattern,
+			},
+		}
+	}
+	var osEnum []string
+	for _, os := range manifestOSList {
+		osEnum = append(osEnum, string(os))
+	}
+
+	plugin := map[string]interface{}{
+		"type":                 "object",
+		"required":             []string{"Name", "OS"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"Name": map[string]interface{}{
+				"type":      "string",
+				"minLength": 1,
+			},
+			"OS": map[string]interface{}{
+				"type": "string",
+				"enum": osEnum,
+			},
+			"Extra": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Use the interpreter image with extra packages.",
+			},
+			"Description": map[string]interface{}{"type": "string"},
+			"Image": map[string]interface{}{
+				"type":        "string",
+				"description": "Image to run instead of the ramrodpcp interpreter.",
+			},
+			"Tag": map[string]interface{}{"type": "string"},
+			"Digest": map[string]interface{}{
+				"type":    "string",
+				"pattern": imageDigest.String(),
+			},
+			"ExternalPorts": stringArray(`^(auto|0|[0-9]+(-[0-9]+)?)/(tcp|udp|TCP|UDP)$`),
+			"InternalPorts": stringArray(`^[0-9]+(-[0-9]+)?/(tcp|udp|TCP|UDP)$`),
+			"Environment":   stringArray(envVarName.String()),
+			"Resources": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties": map[string]interface{}{
+					"CPUs":     map[string]interface{}{"type": "number", "minimum": 0},
+					"MemoryMB": map[string]interface{}{"type": "integer", "minimum": 0},
+				},
+			},
+			"Healthcheck": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties": map[string]interface{}{
+					"Test":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+					"Interval": map[string]interface{}{"type": "string", "description": "A duration, e.g. 5s."},
+					"Timeout":  map[string]interface{}{"type": "string", "description": "A duration, e.g. 5s."},
+					"Retries":  map[string]interface{}{"type": "integer", "minimum": 0},
+				},
+			},
+			"Replicas": map[string]interface{}{
+				"type":        "integer",
+				"minimum":     1,
+				"description": "Tasks to run for a replicated plugin.",
+			},
+			"Mode": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{string(rethink.ModeReplicated), string(rethink.ModeGlobal)},
+				"description": "global runs a task on every node for the plugin's OS.",
+			},
+		},
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "Controller plugin manifest",
+		"type":    "array",
+		"items":   plugin,
+	}, "", "  ")
+}
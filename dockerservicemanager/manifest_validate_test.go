@@ -0,0 +1,121 @@
+package dockerservicemanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name: "Valid",
+			content: `[
+  {"Name": "Harness", "OS": "all"},
+  {
+    "Name": "ThirdParty",
+    "OS": "posix",
+    "Image": "example/plugin",
+    "Digest": "sha256:0123456789abcdef0123456789abcdef",
+    "ExternalPorts": ["auto/tcp", "9000-9001/udp"],
+    "InternalPorts": ["80/tcp", "53-54/udp"],
+    "Environment": ["MODE=fast", "EMPTY="],
+    "Resources": {"CPUs": 0.5, "MemoryMB": 128},
+    "Healthcheck": {"Test": ["CMD", "true"], "Interval": "5s"},
+    "Replicas": 3
+  },
+  {"Name": "Listener", "OS": "posix", "Mode": "global"}
+]`,
+		},
+		{
+			name: "Syntax error",
+			content: `[
+  {"Name": "Harness", "OS": "all"}
+  {"Name": "Other", "OS": "all"}
+]`,
+			want: []string{"3:3: invalid character '{' after array element"},
+		},
+		{
+			name:    "Wrong type",
+			content: `[{"Name": "Harness", "OS": "all", "Extra": "yes"}]`,
+			want:    []string{"1:49: Extra must be bool, got string"},
+		},
+		{
+			name:    "Not an array",
+			content: `{"Name": "Harness", "OS": "all"}`,
+			want:    []string{"1:2: manifest must be an array of plugins, got object"},
+		},
+		{
+			name: "Plugin problems",
+			content: `[
+  {"Name": "Harness", "OS": "all"},
+  {"OS": "linux", "Colour": "red"},
+  {
+    "Name": "Harness",
+    "OS": "posix",
+    "ExternalPorts": ["5000/tcp"],
+    "InternalPorts": ["5000/sctp"],
+    "Environment": ["1BAD=x", "NOEQUALS"],
+    "Tag": "1.0",
+    "Resources": {"MemoryMB": -1}
+  },
+  {"Name": "Unpaired", "OS": "nt", "ExternalPorts": ["1/tcp", "2/tcp"], "InternalPorts": ["1/tcp"]},
+  {"Name": "Scaled", "OS": "posix", "Replicas": 0, "Mode": "spread"},
+  {"Name": "Everywhere", "OS": "posix", "Replicas": 2, "Mode": "global"}
+]`,
+			want: []string{
+				"3:3: Name is required",
+				"3:4: OS must be one of [posix nt all], got \"linux\"",
+				"3:19: unknown field \"Colour\"",
+				"5:5: plugin Harness is already declared on line 2",
+				"8:5: malformed port \"5000/sctp\": unknown protocol \"sctp\"",
+				"9:5: environment variable \"1BAD=x\" must be NAME=value",
+				"9:5: environment variable \"NOEQUALS\" must be NAME=value",
+				"10:5: Tag needs an Image",
+				"11:5: invalid resource limits: {CPUs:0 MemoryMB:-1}",
+				"13:36: unpaired ports: 1 internal, 2 external",
+				"14:37: Replicas must be at least 1, got 0",
+				"14:52: Mode must be replicated or global, got \"spread\"",
+				"15:41: Replicas can't be set for a global plugin",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range ValidateManifest([]byte(tt.content)) {
+				got = append(got, e.Error())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidateManifest_repo(t *testing.T) {
+	content, err := ioutil.ReadFile("../manifest.json")
+	assert.Nil(t, err)
+	assert.Empty(t, ValidateManifest(content))
+}
+
+func TestManifestSchema(t *testing.T) {
+	schema, err := ManifestSchema()
+	assert.Nil(t, err)
+
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal(schema, &doc))
+	items := doc["items"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"Name", "OS"}, items["required"])
+
+	// Every field a plugin may set is described
+	properties := items["properties"].(map[string]interface{})
+	assert.Len(t, properties, len(manifestKeys))
+	for key := range manifestKeys {
+		assert.Contains(t, properties, key)
+	}
+}
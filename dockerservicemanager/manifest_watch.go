@@ -0,0 +1,291 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// manifestFields are the advertised row fields
+// that come from a plugin's manifest entry.
+var manifestFields = []string{
+	"OS",
+	"Extra",
+	"ExternalPorts",
+	"InternalPorts",
+	"Environment",
+	"Description",
+	"Image",
+	"Tag",
+	"Digest",
+	"Resources",
+	"Healthcheck",
+	"Replicas",
+	"Mode",
+}
+
+// manifestFiles returns manifest.json followed by the
+// *.json fragments in MANIFEST_DIR (if set), by name.
+func manifestFiles() ([]string, error) {
+	files := []string{"manifest.json"}
+
+	dir := os.Getenv("MANIFEST_DIR")
+	if dir == "" {
+		return files, nil
+	}
+	fragments, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fragments)
+	return append(files, fragments...), nil
+}
+
+// loadManifest reads manifest.json and any fragments,
+// returning their plugins and a fingerprint of their
+// contents. The fingerprint is returned with parse
+// errors too, so that a bad edit is only reported once.
+// Plugin names must be unique across files.
+func loadManifest() ([]ManifestPlugin, string, error) {
+	files, err := manifestFiles()
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.New()
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		contents[i], err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(hash, "%v\x00%v\x00", file, len(contents[i]))
+		hash.Write(contents[i])
+	}
+	fingerprint := fmt.Sprintf("%x", hash.Sum(nil))
+
+	var (
+		plugins = []ManifestPlugin{}
+		seen    = make(map[string]string)
+	)
+	for i, file := range files {
+		if errs := ValidateManifest(contents[i]); len(errs) > 0 {
+			return nil, fingerprint, fmt.Errorf("%v:%v", file, errs[0])
+		}
+		var fragment []ManifestPlugin
+		if err := json.Unmarshal(contents[i], &fragment); err != nil {
+			return nil, fingerprint, fmt.Errorf("%v: %v", file, err)
+		}
+		for _, p := range fragment {
+			if other, ok := seen[p.Name]; ok {
+				return nil, fingerprint, fmt.Errorf("%v: plugin %v already declared in %v", file, p.Name, other)
+			}
+			seen[p.Name] = file
+		}
+		plugins = append(plugins, fragment...)
+	}
+
+	if len(plugins) < 1 {
+		return plugins, fingerprint, fmt.Errorf("no plugins found in manifest.json")
+	}
+	return plugins, fingerprint, nil
+}
+
+// manifestDiff is the set of changes needed to bring
+// the advertised plugin rows in line with the manifest.
+type manifestDiff struct {
+	// Add are new rows to insert.
+	Add []map[string]interface{}
+	// Update are changed fields by row id.
+	Update map[string]map[string]interface{}
+	// Retire are the ids of rows no longer in the manifest.
+	Retire []string
+}
+
+// Empty returns whether there is nothing to change.
+func (d manifestDiff) Empty() bool {
+	return len(d.Add) == 0 && len(d.Update) == 0 && len(d.Retire) == 0
+}
+
+// String method for manifestDiff
+func (d manifestDiff) String() string {
+	return fmt.Sprintf("+%v ~%v -%v", len(d.Add), len(d.Update), len(d.Retire))
+}
+
+// diffManifest compares the manifest to the advertised
+// rows (those without a ServiceName). Rows for running
+// services are copies made by the frontend, and are never
+// changed.
+func diffManifest(manifest []ManifestPlugin, docs []map[string]interface{}) manifestDiff {
+	diff := manifestDiff{Update: make(map[string]map[string]interface{})}
+
+	advertised := make(map[string]map[string]interface{})
+	for _, doc := range docs {
+		if doc["ServiceName"] != "" {
+			continue
+		}
+		name, ok := doc["Name"].(string)
+		if !ok {
+			continue
+		}
+		if _, ok := advertised[name]; !ok {
+			advertised[name] = doc
+		}
+	}
+
+	inManifest := make(map[string]bool)
+	for _, plugin := range manifest {
+		inManifest[plugin.Name] = true
+		entry := plugin.entry()
+
+		doc, ok := advertised[plugin.Name]
+		if !ok {
+			diff.Add = append(diff.Add, entry)
+			continue
+		}
+
+		// Compare the way the store decodes documents
+		want := normalizeDoc(entry)
+		have := normalizeDoc(doc)
+		update := make(map[string]interface{})
+		for _, field := range manifestFields {
+			if !reflect.DeepEqual(want[field], have[field]) {
+				update[field] = want[field]
+			}
+		}
+		if have["State"] == string(rethink.StateRetired) {
+			update["State"] = string(rethink.StateAvailable)
+		}
+		if len(update) > 0 {
+			diff.Update[fmt.Sprintf("%v", doc["id"])] = update
+		}
+	}
+
+	var retired []string
+	for name, doc := range advertised {
+		if !inManifest[name] && doc["State"] != string(rethink.StateRetired) {
+			retired = append(retired, fmt.Sprintf("%v", doc["id"]))
+		}
+	}
+	sort.Strings(retired)
+	diff.Retire = retired
+
+	return diff
+}
+
+// normalizeDoc round-trips a document through JSON, so
+// that values compare the same however they were built.
+func normalizeDoc(doc map[string]interface{}) map[string]interface{} {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return doc
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return doc
+	}
+	return res
+}
+
+// applyManifest brings the advertised plugin
+// rows in line with the manifest.
+func applyManifest(manifest []ManifestPlugin) (manifestDiff, error) {
+	store := rethink.GetStore()
+
+	docs, err := store.ListPlugins()
+	if err != nil {
+		return manifestDiff{}, err
+	}
+
+	diff := diffManifest(manifest, docs)
+	for _, entry := range diff.Add {
+		if err := store.InsertPlugin(entry); err != nil {
+			return diff, err
+		}
+	}
+	for id, update := range diff.Update {
+		if err := store.UpdatePlugin(id, update); err != nil {
+			return diff, err
+		}
+	}
+	for _, id := range diff.Retire {
+		err := store.UpdatePlugin(id, map[string]interface{}{
+			"State": string(rethink.StateRetired),
+		})
+		if err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
+
+// WatchManifest checks manifest.json (and the fragments
+// in MANIFEST_DIR) every interval, and re-advertises the
+// plugins when they change. New plugins are added,
+// changed ones updated and removed ones Retired. An
+// invalid manifest is reported and the rows are left as
+// they are.
+func WatchManifest(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error)
+
+	// Taken now, so that changes made after
+	// WatchManifest returns are picked up
+	_, last, _ := loadManifest()
+
+	go func() {
+		defer close(errs)
+
+		sendErr := func(err error) {
+			select {
+			case <-ctx.Done():
+			case errs <- err:
+			}
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			manifest, fingerprint, err := loadManifest()
+			if err != nil {
+				if fingerprint != last {
+					sendErr(fmt.Errorf("manifest: %v", err))
+				}
+				last = fingerprint
+				continue
+			}
+			if fingerprint == last {
+				continue
+			}
+
+			diff, err := applyManifest(manifest)
+			if err != nil {
+				// Try again next time
+				sendErr(fmt.Errorf("manifest: %v", err))
+				continue
+			}
+			last = fingerprint
+			if !diff.Empty() {
+				log.Printf("manifest reloaded: %v", diff)
+			}
+		}
+	}()
+
+	return errs
+}
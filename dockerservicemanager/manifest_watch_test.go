@@ -0,0 +1,141 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/rethink"
+	"github.com/stretchr/testify/assert"
+)
+
+// advertisedDoc returns a row the way the store
+// would decode it.
+func advertisedDoc(entry map[string]interface{}, id string) map[string]interface{} {
+	doc := normalizeDoc(entry)
+	doc["id"] = id
+	return doc
+}
+
+func Test_diffManifest(t *testing.T) {
+	docs := []map[string]interface{}{
+		advertisedDoc(ManifestPlugin{Name: "Same", OS: rethink.PluginOSPosix}.entry(), "1"),
+		advertisedDoc(ManifestPlugin{Name: "Changed", OS: rethink.PluginOSPosix}.entry(), "2"),
+		advertisedDoc(ManifestPlugin{Name: "Removed", OS: rethink.PluginOSPosix}.entry(), "3"),
+		advertisedDoc(map[string]interface{}{
+			"Name":          "Returned",
+			"ServiceName":   "",
+			"State":         string(rethink.StateRetired),
+			"OS":            string(rethink.PluginOSPosix),
+			"Extra":         false,
+			"ExternalPorts": []string{},
+			"InternalPorts": []string{},
+			"Environment":   []string{},
+		}, "4"),
+		// A running copy of a removed plugin is left alone
+		advertisedDoc(map[string]interface{}{
+			"Name":        "Gone",
+			"ServiceName": "GoneService",
+			"State":       string(rethink.StateActive),
+		}, "5"),
+	}
+
+	diff := diffManifest([]ManifestPlugin{
+		{Name: "Same", OS: rethink.PluginOSPosix},
+		{Name: "Changed", OS: rethink.PluginOSPosix, Image: "example/plugin", ExternalPorts: []string{"80/tcp"}, InternalPorts: []string{"80/tcp"}},
+		{Name: "Returned", OS: rethink.PluginOSPosix},
+		{Name: "New", OS: rethink.PluginOSWindows},
+	}, docs)
+
+	assert.Equal(t, []map[string]interface{}{
+		ManifestPlugin{Name: "New", OS: rethink.PluginOSWindows}.entry(),
+	}, diff.Add)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"2": {
+			"Image":         "example/plugin",
+			"ExternalPorts": []interface{}{"80/tcp"},
+			"InternalPorts": []interface{}{"80/tcp"},
+		},
+		"4": {"State": string(rethink.StateAvailable)},
+	}, diff.Update)
+	assert.Equal(t, []string{"3"}, diff.Retire)
+	assert.Equal(t, "+1 ~2 -1", diff.String())
+
+	assert.True(t, diffManifest([]ManifestPlugin{{Name: "Same", OS: rethink.PluginOSPosix}}, docs[:1]).Empty())
+}
+
+func TestWatchManifest(t *testing.T) {
+	_, m, restore := useFakes(t)
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	env := os.Getenv("MANIFEST_DIR")
+	defer os.Setenv("MANIFEST_DIR", env)
+	os.Setenv("MANIFEST_DIR", dir)
+
+	write := func(file string, content string) {
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+	}
+	write("manifest.json", `[{"Name": "Harness", "OS": "all"}]`)
+	defer os.Remove("manifest.json")
+	write(filepath.Join(dir, "extra.json"), `[{"Name": "ThirdParty", "OS": "posix", "Image": "example/plugin"}]`)
+
+	assert.Nil(t, PluginAdvertise())
+	states := func() map[string]string {
+		docs, err := m.ListPlugins()
+		assert.Nil(t, err)
+		res := make(map[string]string)
+		for _, doc := range docs {
+			res[doc["Name"].(string)] = doc["State"].(string)
+		}
+		return res
+	}
+	assert.Equal(t, map[string]string{"Harness": "Available", "ThirdParty": "Available"}, states())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := WatchManifest(ctx, 20*time.Millisecond)
+
+	waitFor := func(want map[string]string) {
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case e := <-errs:
+				t.Fatalf("%v", e)
+			case <-timeout:
+				t.Fatalf("got %v, want %v", states(), want)
+			case <-time.After(20 * time.Millisecond):
+			}
+			if assert.ObjectsAreEqual(want, states()) {
+				return
+			}
+		}
+	}
+
+	// Added in a fragment
+	write(filepath.Join(dir, "more.json"), `[{"Name": "Another", "OS": "nt"}]`)
+	waitFor(map[string]string{"Harness": "Available", "ThirdParty": "Available", "Another": "Available"})
+
+	// Removed from its fragment
+	write(filepath.Join(dir, "extra.json"), `[]`)
+	waitFor(map[string]string{"Harness": "Available", "ThirdParty": "Retired", "Another": "Available"})
+
+	// An invalid manifest is reported and changes nothing
+	write("manifest.json", `[{"Name": "Harness"`)
+	select {
+	case e := <-errs:
+		assert.Contains(t, e.Error(), "manifest.json")
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no error for invalid manifest")
+	}
+	assert.Equal(t, map[string]string{"Harness": "Available", "ThirdParty": "Retired", "Another": "Available"}, states())
+
+	cancel()
+	for range errs {
+	}
+}
@@ -10,7 +10,8 @@ import (
 	events "github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	swarm "github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
 )
 
 var imageRegex = regexp.MustCompile(`^ramrodpcp.*?`)
@@ -25,7 +26,7 @@ func newLogFilter() filters.Args {
 	return logFilter
 }
 
-func stackServices(ctx context.Context, dockerClient *client.Client) ([]swarm.Service, error) {
+func stackServices(ctx context.Context, dockerClient orchestrator.Orchestrator) ([]swarm.Service, error) {
 
 	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{})
 	if err != nil {
@@ -46,16 +47,23 @@ func stackServices(ctx context.Context, dockerClient *client.Client) ([]swarm.Se
 }
 
 // NewLogMonitor returns a channel of container objects
-// for new containers that start.
+// for new containers that start. Both channels are
+// closed once the context is done, or straight away,
+// after a fatal error, if there's no docker client.
 func NewLogMonitor(ctx context.Context) (<-chan swarm.Service, <-chan error) {
-	ret := make(chan swarm.Service)
-	errs := make(chan error)
-
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 	if err != nil {
-		panic(err)
+		svcChan := make(chan swarm.Service)
+		errChan := make(chan error, 1)
+		errChan <- errorhandler.New(errorhandler.ComponentLogMonitor, errorhandler.SeverityFatal, err)
+		close(svcChan)
+		close(errChan)
+		return svcChan, errChan
 	}
 
+	ret := make(chan swarm.Service)
+	errs := make(chan error)
+
 	// Filter plugin containers (start events)
 	logFilter := newLogFilter()
 
@@ -66,14 +74,33 @@ func NewLogMonitor(ctx context.Context) (<-chan swarm.Service, <-chan error) {
 	go func(in <-chan events.Message) {
 		defer close(ret)
 		defer close(errs)
+
+		send := func(svc swarm.Service) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case ret <- svc:
+				return true
+			}
+		}
+		sendErr := func(err error) {
+			select {
+			case <-ctx.Done():
+			case errs <- err:
+			}
+		}
+
 		// Get initial containers in stack
 		stackSvcs, err := stackServices(ctx, dockerClient)
 		if err != nil {
-			panic(err)
+			sendErr(err)
+			return
 		}
 
 		for _, svc := range stackSvcs {
-			ret <- svc
+			if !send(svc) {
+				return
+			}
 		}
 
 		for {
@@ -81,7 +108,7 @@ func NewLogMonitor(ctx context.Context) (<-chan swarm.Service, <-chan error) {
 			case <-ctx.Done():
 				return
 			case e := <-errSvcStart:
-				errs <- e
+				sendErr(e)
 			case n := <-in:
 				svc := swarm.Service{}
 			L:
@@ -89,7 +116,7 @@ func NewLogMonitor(ctx context.Context) (<-chan swarm.Service, <-chan error) {
 					time.Sleep(300 * time.Millisecond)
 					svc, _, err = dockerClient.ServiceInspectWithRaw(ctx, n.Actor.ID)
 					if err != nil {
-						errs <- err
+						sendErr(err)
 						continue L
 					}
 					if svc.ID != n.Actor.ID {
@@ -98,13 +125,15 @@ func NewLogMonitor(ctx context.Context) (<-chan swarm.Service, <-chan error) {
 					break
 				}
 				if len(svc.ID) == 0 {
-					errs <- fmt.Errorf("could not inspect service %v", n.Actor.ID)
+					sendErr(fmt.Errorf("could not inspect service %v", n.Actor.ID))
 					break
 				}
-				ret <- svc
+				if !send(svc) {
+					return
+				}
 			}
 		}
 	}(svcStart)
 
-	return ret, errSvcStart
+	return ret, errs
 }
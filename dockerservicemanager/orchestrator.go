@@ -0,0 +1,49 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
+)
+
+var (
+	orchestratorLock   sync.Mutex
+	dockerOrchestrator orchestrator.Orchestrator
+)
+
+// SetOrchestrator sets the Orchestrator used by every
+// service manager routine. If it is never called, a docker
+// client is created from the environment on first use.
+func SetOrchestrator(o orchestrator.Orchestrator) {
+	orchestratorLock.Lock()
+	defer orchestratorLock.Unlock()
+
+	dockerOrchestrator = o
+}
+
+func getOrchestrator() (orchestrator.Orchestrator, error) {
+	orchestratorLock.Lock()
+	defer orchestratorLock.Unlock()
+
+	if dockerOrchestrator != nil {
+		return dockerOrchestrator, nil
+	}
+	o, err := orchestrator.NewDockerOrchestrator()
+	if err != nil {
+		return nil, err
+	}
+	dockerOrchestrator = o
+	return dockerOrchestrator, nil
+}
+
+// PingOrchestrator checks that the docker API
+// can be reached.
+func PingOrchestrator(ctx context.Context) error {
+	dockerClient, err := getOrchestrator()
+	if err != nil {
+		return err
+	}
+	_, err = dockerClient.Ping(ctx)
+	return err
+}
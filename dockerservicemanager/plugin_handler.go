@@ -2,12 +2,15 @@ package dockerservicemanager
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"log"
 	"os"
-	"strconv"
-	"strings"
+	"time"
 
 	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/metrics"
 	rethink "github.com/ramrod-project/backend-controller-go/rethink"
 )
 
@@ -40,43 +43,32 @@ func getEnvByKey(k string) string {
 
 func pluginToConfig(plugin rethink.Plugin) (PluginServiceConfig, error) {
 	var (
-		proto       swarm.PortConfigProtocol
-		mode        swarm.PortConfigPublishMode
 		environment []string
 		extra       = false
 	)
 
-	mode = swarm.PortConfigPublishModeHost
-
-	// Right now only one port is passed
-	intPort, err := strconv.ParseUint(strings.Split(plugin.InternalPorts[0], "/")[0], 10, 32)
-	if err != nil {
-		return PluginServiceConfig{}, fmt.Errorf("Unable to parse port %v", plugin.InternalPorts[0])
-	}
-	extPort, err := strconv.ParseUint(strings.Split(plugin.ExternalPorts[0], "/")[0], 10, 32)
+	ports, err := PluginPorts(plugin.InternalPorts, plugin.ExternalPorts)
 	if err != nil {
-		return PluginServiceConfig{}, fmt.Errorf("Unable to parse port %v", plugin.ExternalPorts[0])
+		return PluginServiceConfig{}, err
 	}
 
 	if plugin.Extra {
 		extra = true
 	}
 
-	// Parse to check protocol
-	if strings.Split(plugin.ExternalPorts[0], "/")[1] == string(swarm.PortConfigProtocolTCP) {
-		proto = swarm.PortConfigProtocolTCP
-	} else {
-		proto = swarm.PortConfigProtocolUDP
-	}
-
 	// Concatonate environment variables (if provided)
 	environment = []string{
 		getEnvByKey("STAGE"),
 		getEnvByKey("LOGLEVEL"),
-		envString("PORT", fmt.Sprintf("%v", intPort)),
+	}
+	// PORT is the plugin's primary (first) port
+	if len(ports) > 0 {
+		environment = append(environment, envString("PORT", fmt.Sprintf("%v", ports[0].TargetPort)))
+	}
+	environment = append(environment,
 		envString("PLUGIN", plugin.Name),
 		envString("PLUGIN_NAME", plugin.ServiceName),
-	}
+	)
 	if len(plugin.Environment) > 0 {
 		environment = append(environment, plugin.Environment...)
 	}
@@ -87,56 +79,395 @@ func pluginToConfig(plugin rethink.Plugin) (PluginServiceConfig, error) {
 		Address:     plugin.Address,
 		Network:     "pcp",
 		OS:          plugin.OS,
-		Ports: []swarm.PortConfig{swarm.PortConfig{
-			Protocol:      proto,
-			TargetPort:    uint32(intPort),
-			PublishedPort: uint32(extPort),
-			PublishMode:   mode,
-		}},
+		Ports:       ports,
 		ServiceName: plugin.ServiceName,
+		Image:       plugin.Image,
+		Tag:         plugin.Tag,
+		Digest:      plugin.Digest,
+		Resources:   plugin.Resources,
+		Healthcheck: plugin.Healthcheck,
+		Replicas:    uint64(plugin.Replicas),
+		Mode:        plugin.Mode,
 	}, nil
 }
 
-func selectChange(plugin rethink.Plugin) error {
-	// if plugin has no servicename, it cannot be started
-	if plugin.ServiceName == "" {
+// actionTimeout bounds a single plugin action. Actions
+// aren't tied to the controller's context, so that one
+// in flight at shutdown is finished rather than cut off.
+const actionTimeout = 2 * time.Minute
+
+// recordOutcome writes the outcome of a plugin action
+// back for the user who asked for it. A failure is added
+// to the Errors table and set as the plugin's LastError,
+// which the next success clears. A port conflict or an
+// illegal request also clears the DesiredState that can't
+// be met, along with an upgrade's target. The action's
+// error is returned either way.
+func recordOutcome(plugin rethink.Plugin, err error) error {
+	store := rethink.GetStore()
+
+	if err == nil {
+		if plugin.LastError == "" {
+			return nil
+		}
+		updateErr := store.UpdatePluginStatus(plugin.ServiceName, map[string]string{
+			"LastError":   "",
+			"LastErrorAt": "",
+		})
+		if updateErr != nil {
+			return fmt.Errorf("clearing LastError failed: %v", updateErr)
+		}
 		return nil
 	}
+
+	now := rethink.Timestamp(time.Now())
+	update := map[string]string{
+		"LastError":   err.Error(),
+		"LastErrorAt": now,
+	}
+	if refused(err) {
+		update["DesiredState"] = string(rethink.DesiredStateNull)
+		if plugin.DesiredState == rethink.DesiredStateUpgrade {
+			update["TargetTag"] = ""
+			update["TargetDigest"] = ""
+		}
+	}
+	recordErr := store.InsertError(rethink.PluginError{
+		Timestamp:   now,
+		Plugin:      plugin.Name,
+		ServiceName: plugin.ServiceName,
+		ServiceID:   plugin.ServiceID,
+		Action:      string(plugin.DesiredState),
+		Message:     err.Error(),
+	})
+	if updateErr := store.UpdatePluginStatus(plugin.ServiceName, update); updateErr != nil {
+		recordErr = updateErr
+	}
+	if recordErr != nil {
+		return fmt.Errorf("%v (recording it failed: %v)", err, recordErr)
+	}
+	return err
+}
+
+// observeOperation records how long a service
+// operation that started at start took.
+func observeOperation(operation string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	metrics.ServiceOperationSeconds.Observe(time.Since(start).Seconds(), operation, outcome)
+}
+
+// refused returns whether an action failed because
+// its DesiredState can't be met, so trying it again
+// won't help.
+func refused(err error) bool {
+	switch err.(type) {
+	case *PortConflictError, *rethink.IllegalRequestError:
+		return true
+	}
+	return false
+}
+
+// pendingStates are the States a plugin is in
+// while its service is started, stopped, paused,
+// resumed or upgraded.
+var pendingStates = map[rethink.PluginDesiredState]rethink.PluginState{
+	rethink.DesiredStateActivate: rethink.StateStarting,
+	rethink.DesiredStateStop:     rethink.StateStopping,
+	rethink.DesiredStatePause:    rethink.StatePaused,
+	rethink.DesiredStateResume:   rethink.StateStarting,
+	rethink.DesiredStateUpgrade:  rethink.StateRestarting,
+}
+
+// taskFields are the task lists written with a plugin's
+// pending State. A plugin being paused has its tasks
+// moved to OldTasks, so that their events are ignored.
+func taskFields(plugin rethink.Plugin, pending rethink.PluginState) map[string]interface{} {
+	fields := map[string]interface{}{"State": string(pending)}
+	if pending == rethink.StatePaused {
+		fields["HealthyTasks"] = []string{}
+		fields["OldTasks"] = append(append([]string{}, plugin.OldTasks...), plugin.HealthyTasks...)
+		fields["Health"] = "paused"
+	}
+	return fields
+}
+
+// replicaCount is the number of tasks
+// a replicated plugin runs.
+func replicaCount(plugin rethink.Plugin) uint64 {
+	if plugin.Replicas < 1 {
+		return 1
+	}
+	return uint64(plugin.Replicas)
+}
+
+func stateChange(from rethink.PluginState, to rethink.PluginState, reason string) *rethink.StateChange {
+	return &rethink.StateChange{
+		From:   from,
+		To:     to,
+		At:     rethink.Timestamp(time.Now()),
+		Reason: reason,
+	}
+}
+
+// selectChange acts on a plugin's DesiredState,
+// recording the outcome on its row. A request the
+// plugin's State doesn't allow is refused, and one
+// made part way through a change waits for it.
+// Starting and stopping plugins are moved to a pending
+// State first, and back again if the action fails.
+func selectChange(ctx context.Context, plugin rethink.Plugin) error {
+	_, err := applyChange(ctx, plugin)
+	return err
+}
+
+// Outcomes of applyChange that didn't act on the plugin
+const (
+	outcomeQueued  = "queued"
+	outcomeSkipped = "skipped"
+)
+
+// applyChange is selectChange, also returning the outcome
+// counted by metrics.PluginActions: "ok" or "error" if it
+// was acted on, "queued" if it waits for a change part way
+// through, or "skipped" if it was already in hand or
+// withdrawn.
+func applyChange(ctx context.Context, plugin rethink.Plugin) (string, error) {
+	// if plugin has no servicename, it cannot be started
+	if plugin.ServiceName == "" || plugin.DesiredState == rethink.DesiredStateNull {
+		return outcomeSkipped, nil
+	}
+	if pending, ok := pendingStates[plugin.DesiredState]; ok && plugin.State == pending {
+		// Written when the action began, so
+		// it's in hand already
+		return outcomeSkipped, nil
+	}
+	switch err := rethink.CheckRequest(plugin.State, plugin.DesiredState); err {
+	case nil:
+	case rethink.ErrRequestQueued:
+		return outcomeQueued, nil
+	default:
+		return outcome(recordOutcome(plugin, err))
+	}
+
+	store := rethink.GetStore()
+	desired := string(plugin.DesiredState)
+	pending, ok := pendingStates[plugin.DesiredState]
+	if ok {
+		err := store.TransitionPlugin(
+			plugin.ServiceName,
+			map[string]string{"DesiredState": desired},
+			taskFields(plugin, pending),
+			stateChange(plugin.State, pending, desired),
+		)
+		if err == rethink.ErrStaleState {
+			// Withdrawn since it was read
+			return outcomeSkipped, nil
+		} else if err != nil {
+			return outcome(recordOutcome(plugin, err))
+		}
+	}
+
+	err := changeService(ctx, plugin)
+	if err != nil && ok {
+		// Nothing changed, so it's back where it was
+		reset := map[string]interface{}{"State": string(plugin.State)}
+		if pending == rethink.StatePaused {
+			reset["HealthyTasks"] = append([]string{}, plugin.HealthyTasks...)
+			reset["OldTasks"] = append([]string{}, plugin.OldTasks...)
+			reset["Health"] = rethink.HealthSummary(&plugin)
+		}
+		resetErr := store.TransitionPlugin(
+			plugin.ServiceName,
+			map[string]string{"State": string(pending), "DesiredState": desired},
+			reset,
+			stateChange(pending, plugin.State, desired+" failed"),
+		)
+		if resetErr != nil && resetErr != rethink.ErrStaleState {
+			log.Printf("%v: resetting State failed: %v", plugin.ServiceName, resetErr)
+		}
+	}
+	return outcome(recordOutcome(plugin, err))
+}
+
+// outcome returns the outcome of a change that was
+// acted on, given its error.
+func outcome(err error) (string, error) {
+	if err != nil {
+		return "error", err
+	}
+	return "ok", nil
+}
+
+func changeService(ctx context.Context, plugin rethink.Plugin) error {
 	switch plugin.DesiredState {
 	case rethink.DesiredStateActivate:
 		config, err := pluginToConfig(plugin)
 		if err != nil {
 			return err
 		}
-		_, err = CreatePluginService(&config)
+		start := time.Now()
+		_, err = CreatePluginService(ctx, &config)
+		observeOperation("create", start, err)
+		if err == nil {
+			recordPorts(plugin, config.Ports)
+		}
 		return err
 	case rethink.DesiredStateRestart:
 		config, err := pluginToConfig(plugin)
 		if err != nil {
 			return err
 		}
-		_, err = UpdatePluginService(plugin.ServiceID, &config)
+		start := time.Now()
+		_, err = UpdatePluginService(ctx, plugin.ServiceID, &config)
+		observeOperation("update", start, err)
+		if err == nil {
+			recordPorts(plugin, config.Ports)
+		}
 		return err
 	case rethink.DesiredStateStop:
-		err := RemovePluginService(plugin.ServiceID)
+		start := time.Now()
+		err := RemovePluginService(ctx, plugin.ServiceID)
+		observeOperation("remove", start, err)
+		if err == nil {
+			recordPorts(plugin, nil)
+		}
+		return err
+	case rethink.DesiredStateScale:
+		return scalePlugin(ctx, plugin)
+	case rethink.DesiredStatePause:
+		return pausePlugin(ctx, plugin)
+	case rethink.DesiredStateResume:
+		start := time.Now()
+		err := ScalePluginService(ctx, plugin.ServiceID, replicaCount(plugin))
+		observeOperation("resume", start, err)
+		return err
+	case rethink.DesiredStateUpgrade:
+		// The swarm rolls it back if the new tasks
+		// fail, and the events say which way it went
+		plugin.Tag = plugin.TargetTag
+		plugin.Digest = plugin.TargetDigest
+		config, err := pluginToConfig(plugin)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		_, err = UpdatePluginService(ctx, plugin.ServiceID, &config)
+		observeOperation("upgrade", start, err)
+		if err == nil {
+			recordPorts(plugin, config.Ports)
+		}
 		return err
-	case rethink.DesiredStateNull:
-		return nil
 	}
 	return fmt.Errorf("desired state not matched")
 }
 
+// recordPorts writes the ports a plugin's service
+// publishes to its row, so that any assigned from
+// "auto" can be seen. The service has changed by
+// then, so a failure is only logged.
+func recordPorts(plugin rethink.Plugin, ports []swarm.PortConfig) {
+	published := make([]string, len(ports))
+	for i, p := range ports {
+		published[i] = portKey(p.PublishedPort, p.Protocol)
+	}
+	err := rethink.GetStore().TransitionPlugin(
+		plugin.ServiceName,
+		nil,
+		map[string]interface{}{"PublishedPorts": published},
+		nil,
+	)
+	if err != nil {
+		log.Printf("%v: recording ports failed: %v", plugin.ServiceName, err)
+	}
+}
+
+// finishRequest clears a DesiredState that no event
+// marks as met, once its service has been updated.
+func finishRequest(plugin rethink.Plugin, health string) error {
+	err := rethink.GetStore().TransitionPlugin(
+		plugin.ServiceName,
+		map[string]string{"DesiredState": string(plugin.DesiredState)},
+		map[string]interface{}{
+			"DesiredState": string(rethink.DesiredStateNull),
+			"Health":       health,
+		},
+		nil,
+	)
+	if err == rethink.ErrStaleState {
+		// Asked for something else meanwhile
+		return nil
+	}
+	return err
+}
+
+// scalePlugin changes the number of tasks a plugin's
+// service runs to its Replicas. No event marks the end
+// of scaling, so its DesiredState is cleared here.
+func scalePlugin(ctx context.Context, plugin rethink.Plugin) error {
+	start := time.Now()
+	err := ScalePluginService(ctx, plugin.ServiceID, replicaCount(plugin))
+	observeOperation("scale", start, err)
+	if err != nil {
+		return err
+	}
+	return finishRequest(plugin, rethink.HealthSummary(&plugin))
+}
+
+// pausePlugin scales a plugin's service to no tasks,
+// keeping its spec, ports and ServiceID for Resume.
+func pausePlugin(ctx context.Context, plugin rethink.Plugin) error {
+	start := time.Now()
+	err := ScalePluginService(ctx, plugin.ServiceID, 0)
+	observeOperation("pause", start, err)
+	if err != nil {
+		return err
+	}
+	return finishRequest(plugin, "paused")
+}
+
+// actionError is a failed plugin action. Refused actions
+// need the plugin's row changed, so aren't retryable.
+func actionError(plugin rethink.Plugin, err error) *errorhandler.Error {
+	e := errorhandler.New(errorhandler.ComponentPluginHandler, errorhandler.SeverityError, err)
+	e.Retryable = !refused(err)
+	return e.ForService(plugin.ServiceName, plugin.ServiceID)
+}
+
 // HandlePluginChanges takes a channel of Plugins
 // being fed by the plugin monitor routine and performs
-// actions on their services as needed.
-func HandlePluginChanges(feed <-chan rethink.Plugin) <-chan error {
+// actions on their services as needed. Once the context
+// is done it stops taking new plugins, and closes the
+// error channel after the action in progress finishes.
+func HandlePluginChanges(ctx context.Context, feed <-chan rethink.Plugin) <-chan error {
 	errChan := make(chan error)
 
 	go func(in <-chan rethink.Plugin) {
-		for plugin := range in {
-			err := selectChange(plugin)
+		defer close(errChan)
+		for {
+			var (
+				plugin rethink.Plugin
+				ok     bool
+			)
+			select {
+			case <-ctx.Done():
+				return
+			case plugin, ok = <-in:
+				if !ok {
+					return
+				}
+			}
+
+			actionCtx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+			result, err := applyChange(actionCtx, plugin)
+			cancel()
+			if plugin.ServiceName != "" && plugin.DesiredState != rethink.DesiredStateNull {
+				metrics.PluginActions.Inc(string(plugin.DesiredState), result)
+			}
 			if err != nil {
-				errChan <- err
+				errChan <- actionError(plugin, err)
 			}
 		}
 	}(feed)
@@ -2,14 +2,18 @@ package dockerservicemanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	swarm "github.com/docker/docker/api/types/swarm"
 	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
 	rethink "github.com/ramrod-project/backend-controller-go/rethink"
 	"github.com/ramrod-project/backend-controller-go/test"
 	"github.com/stretchr/testify/assert"
@@ -166,6 +170,99 @@ func Test_pluginToConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Multi-port plugin",
+			args: args{
+				plugin: rethink.Plugin{
+					Name:          "MultiPlugin",
+					ServiceID:     "",
+					ServiceName:   "MultiPluginService",
+					DesiredState:  "",
+					State:         "Available",
+					Address:       "192.168.1.1",
+					ExternalPorts: []string{"8080/tcp", "9000-9001/udp"},
+					InternalPorts: []string{"5000/tcp", "6000-6001/udp"},
+					OS:            rethink.PluginOSPosix,
+					Environment:   []string{},
+				},
+			},
+			want: PluginServiceConfig{
+				Environment: []string{
+					"STAGE=" + stage,
+					"LOGLEVEL=" + log,
+					"PORT=5000",
+					"PLUGIN=MultiPlugin",
+					"PLUGIN_NAME=MultiPluginService",
+				},
+				Address: "192.168.1.1",
+				Network: "pcp",
+				OS:      rethink.PluginOSPosix,
+				Ports: []swarm.PortConfig{
+					swarm.PortConfig{
+						Protocol:      swarm.PortConfigProtocolTCP,
+						TargetPort:    uint32(5000),
+						PublishedPort: uint32(8080),
+						PublishMode:   swarm.PortConfigPublishModeHost,
+					},
+					swarm.PortConfig{
+						Protocol:      swarm.PortConfigProtocolUDP,
+						TargetPort:    uint32(6000),
+						PublishedPort: uint32(9000),
+						PublishMode:   swarm.PortConfigPublishModeHost,
+					},
+					swarm.PortConfig{
+						Protocol:      swarm.PortConfigProtocolUDP,
+						TargetPort:    uint32(6001),
+						PublishedPort: uint32(9001),
+						PublishMode:   swarm.PortConfigPublishModeHost,
+					},
+				},
+				ServiceName: "MultiPluginService",
+			},
+			wantErr: false,
+		},
+		{
+			name: "No ports",
+			args: args{
+				plugin: rethink.Plugin{
+					Name:          "EmptyPlugin",
+					ServiceName:   "EmptyPluginService",
+					State:         "Available",
+					Address:       "192.168.1.1",
+					ExternalPorts: []string{},
+					InternalPorts: []string{},
+					OS:            rethink.PluginOSPosix,
+				},
+			},
+			want: PluginServiceConfig{
+				Environment: []string{
+					"STAGE=" + stage,
+					"LOGLEVEL=" + log,
+					"PLUGIN=EmptyPlugin",
+					"PLUGIN_NAME=EmptyPluginService",
+				},
+				Address:     "192.168.1.1",
+				Network:     "pcp",
+				OS:          rethink.PluginOSPosix,
+				ServiceName: "EmptyPluginService",
+			},
+			wantErr: false,
+		},
+		{
+			name: "Unpaired ports",
+			args: args{
+				plugin: rethink.Plugin{
+					Name:          "BadPlugin",
+					ServiceName:   "BadPluginService",
+					Address:       "192.168.1.1",
+					ExternalPorts: []string{"5000/tcp"},
+					InternalPorts: []string{"5000/tcp", "5001/tcp"},
+					OS:            rethink.PluginOSPosix,
+				},
+			},
+			want:    PluginServiceConfig{},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -201,7 +298,7 @@ func Test_selectChange(t *testing.T) {
 	}
 
 	e := map[string]interface{}{
-		"Interface":    GetManagerIP(),
+		"Interface":    managerIP(t),
 		"NodeHostName": "ubuntu",
 		"OS":           "posix",
 		"TCPPorts":     []string{},
@@ -240,7 +337,7 @@ func Test_selectChange(t *testing.T) {
 					ServiceName:   "HarnessService1",
 					DesiredState:  "Activate",
 					State:         "Available",
-					Address:       GetManagerIP(),
+					Address:       managerIP(t),
 					ExternalPorts: []string{"5000/tcp"},
 					InternalPorts: []string{"5000/tcp"},
 					OS:            rethink.PluginOSAll,
@@ -258,7 +355,7 @@ func Test_selectChange(t *testing.T) {
 					ServiceName:   "HarnessService2",
 					DesiredState:  "Activate",
 					State:         "Available",
-					Address:       GetManagerIP(),
+					Address:       managerIP(t),
 					ExternalPorts: []string{"5001/tcp"},
 					InternalPorts: []string{"5001/tcp"},
 					OS:            rethink.PluginOSPosix,
@@ -279,7 +376,7 @@ func Test_selectChange(t *testing.T) {
 					ServiceName:   "HarnessService1",
 					DesiredState:  "Restart",
 					State:         "Active",
-					Address:       GetManagerIP(),
+					Address:       managerIP(t),
 					ExternalPorts: []string{"5000/tcp", "6000/tcp"},
 					InternalPorts: []string{"5000/tcp", "6000/tcp"},
 					OS:            rethink.PluginOSAll,
@@ -297,7 +394,7 @@ func Test_selectChange(t *testing.T) {
 					ServiceName:   "HarnessService2",
 					DesiredState:  "Restart",
 					State:         "Active",
-					Address:       GetManagerIP(),
+					Address:       managerIP(t),
 					ExternalPorts: []string{"5001/tcp", "9999/tcp"},
 					InternalPorts: []string{"5001/tcp", "9999/tcp"},
 					OS:            rethink.PluginOSPosix,
@@ -336,7 +433,7 @@ func Test_selectChange(t *testing.T) {
 			if tt.args.plugin.DesiredState == "Restart" {
 				tt.args.plugin.ServiceID = test.GetServiceID(ctx, dockerClient, tt.args.plugin.ServiceName)
 			}
-			err := selectChange(tt.args.plugin)
+			err := selectChange(context.Background(), tt.args.plugin)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("selectChange() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -370,3 +467,408 @@ func Test_selectChange(t *testing.T) {
 	}
 	os.Setenv("STAGE", env)
 }
+
+func TestHandlePluginChanges_Shutdown(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "ShutdownService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+		Environment:   []string{},
+	}
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("ShutdownService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := make(chan rethink.Plugin)
+	errs := HandlePluginChanges(ctx, feed)
+
+	// The action taken before cancelling still finishes
+	feed <- plugin
+	cancel()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("error channel not closed after cancel")
+		case e, ok := <-errs:
+			if ok {
+				t.Errorf("%v", e)
+				continue
+			}
+			services, err := f.ServiceList(context.Background(), types.ServiceListOptions{})
+			assert.Nil(t, err)
+			assert.Len(t, services, 1)
+			return
+		}
+	}
+}
+
+func Test_actionError(t *testing.T) {
+	plugin := rethink.Plugin{
+		ServiceName: "Harness-5000tcp",
+		ServiceID:   "abc123",
+	}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{
+			name:      "Docker error",
+			err:       errors.New("no such image"),
+			retryable: true,
+		},
+		{
+			name: "Port conflict",
+			err: &PortConflictError{
+				Address:  "192.168.1.1",
+				Port:     5000,
+				Protocol: swarm.PortConfigProtocolTCP,
+			},
+			retryable: false,
+		},
+		{
+			name: "Illegal request",
+			err: &rethink.IllegalRequestError{
+				State:   rethink.StateStopped,
+				Desired: rethink.DesiredStateRestart,
+			},
+			retryable: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := actionError(plugin, tt.err)
+			assert.Equal(t, errorhandler.ComponentPluginHandler, e.Component)
+			assert.Equal(t, errorhandler.SeverityError, e.Severity)
+			assert.Equal(t, tt.retryable, e.Retryable)
+			assert.Equal(t, "Harness-5000tcp", e.ServiceName)
+			assert.Equal(t, "abc123", e.ServiceID)
+			assert.Equal(t, tt.err, e.Err)
+		})
+	}
+}
+
+func Test_recordOutcome(t *testing.T) {
+	_, m, restore := useFakes(t)
+	defer restore()
+
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("FailingService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "FailingService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOS("beos"),
+	}
+
+	// Refused, so the user can see why
+	err := selectChange(context.Background(), plugin)
+	assert.EqualError(t, err, "invalid OS setting: beos")
+
+	doc, err := m.GetPluginByServiceName("FailingService")
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid OS setting: beos", doc["LastError"])
+	assert.NotEmpty(t, doc["LastErrorAt"])
+	assert.Equal(t, "Activate", doc["DesiredState"])
+	assert.Equal(t, "Available", doc["State"])
+
+	errs, err := m.ListErrors("FailingService", 0)
+	assert.Nil(t, err)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "TestPlugin", errs[0]["Plugin"])
+	assert.Equal(t, "Activate", errs[0]["Action"])
+	assert.Equal(t, "invalid OS setting: beos", errs[0]["Message"])
+	assert.Equal(t, doc["LastErrorAt"], errs[0]["Timestamp"])
+
+	// The next success clears it
+	plugin.OS = rethink.PluginOSPosix
+	plugin.LastError = doc["LastError"].(string)
+	assert.Nil(t, selectChange(context.Background(), plugin))
+
+	doc, err = m.GetPluginByServiceName("FailingService")
+	assert.Nil(t, err)
+	assert.Equal(t, "", doc["LastError"])
+	assert.Equal(t, "", doc["LastErrorAt"])
+	assert.Equal(t, "Starting", doc["State"])
+
+	// Each move is in its history
+	var moves []string
+	for _, c := range doc["StateHistory"].([]interface{}) {
+		change := c.(map[string]interface{})
+		moves = append(moves, fmt.Sprintf("%v->%v (%v)", change["From"], change["To"], change["Reason"]))
+	}
+	assert.Equal(t, []string{
+		"Available->Starting (Activate)",
+		"Starting->Available (Activate failed)",
+		"Available->Starting (Activate)",
+	}, moves)
+
+	errs, err = m.ListErrors("FailingService", 0)
+	assert.Nil(t, err)
+	assert.Len(t, errs, 1)
+}
+
+func Test_selectChange_CheckRequest(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("StoppedService", rethink.DesiredStateRestart, rethink.StateStopped)))
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("RestartingService", rethink.DesiredStateStop, rethink.StateRestarting)))
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "StoppedService",
+		DesiredState:  rethink.DesiredStateRestart,
+		State:         rethink.StateStopped,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+	}
+
+	// Refused, and the request cleared
+	result, err := applyChange(context.Background(), plugin)
+	assert.EqualError(t, err, "cannot Restart a plugin that is Stopped")
+	assert.Equal(t, "error", result)
+
+	doc, err := m.GetPluginByServiceName("StoppedService")
+	assert.Nil(t, err)
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, "cannot Restart a plugin that is Stopped", doc["LastError"])
+
+	// Left until the plugin has restarted
+	plugin.ServiceName = "RestartingService"
+	plugin.DesiredState = rethink.DesiredStateStop
+	plugin.State = rethink.StateRestarting
+	result, err = applyChange(context.Background(), plugin)
+	assert.Nil(t, err)
+	assert.Equal(t, outcomeQueued, result)
+
+	doc, err = m.GetPluginByServiceName("RestartingService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Stop", doc["DesiredState"])
+	assert.Nil(t, doc["LastError"])
+
+	// Already begun, so nothing is done again
+	plugin.ServiceName = "StoppedService"
+	plugin.DesiredState = rethink.DesiredStateStop
+	plugin.State = rethink.StateStopping
+	result, err = applyChange(context.Background(), plugin)
+	assert.Nil(t, err)
+	assert.Equal(t, outcomeSkipped, result)
+
+	services, err := f.ServiceList(context.Background(), types.ServiceListOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, services)
+}
+
+func Test_scalePlugin(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "ScaledService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+	}
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("ScaledService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+	assert.Nil(t, selectChange(ctx, plugin))
+	services, err := f.ServiceList(ctx, types.ServiceListOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, uint64(1), *services[0].Spec.Mode.Replicated.Replicas)
+
+	assert.Nil(t, m.UpdatePluginStatus("ScaledService", map[string]string{
+		"ServiceID":    services[0].ID,
+		"State":        "Active",
+		"DesiredState": "Scale",
+	}))
+	plugin.ServiceID = services[0].ID
+	plugin.State = rethink.StateActive
+	plugin.DesiredState = rethink.DesiredStateScale
+	plugin.Replicas = 3
+	assert.Nil(t, selectChange(ctx, plugin))
+
+	svc, _, err := f.ServiceInspectWithRaw(ctx, services[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), *svc.Spec.Mode.Replicated.Replicas)
+	doc, err := m.GetPluginByServiceName("ScaledService")
+	assert.Nil(t, err)
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, "0/3 healthy", doc["Health"])
+
+	// Global plugins run one task per node
+	plugin.ServiceName = "GlobalService"
+	plugin.Mode = rethink.ModeGlobal
+	config, err := pluginToConfig(plugin)
+	assert.Nil(t, err)
+	spec, err := generateServiceSpec(&config)
+	assert.Nil(t, err)
+	assert.NotNil(t, spec.Mode.Global)
+	assert.Nil(t, spec.Mode.Replicated)
+	assert.Equal(t, []string{"node.labels.os==posix"}, spec.TaskTemplate.Placement.Constraints)
+
+	svc.Spec.Mode = spec.Mode
+	_, err = f.ServiceUpdate(ctx, svc.ID, svc.Version, svc.Spec, types.ServiceUpdateOptions{})
+	assert.Nil(t, err)
+	assert.EqualError(t, ScalePluginService(ctx, svc.ID, 2), "cannot scale global service ScaledService")
+}
+
+func Test_pausePlugin(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "PausedService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+		Replicas:      2,
+	}
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("PausedService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+	assert.Nil(t, selectChange(ctx, plugin))
+	services, err := f.ServiceList(ctx, types.ServiceListOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, services, 1)
+	serviceID := services[0].ID
+
+	assert.Nil(t, m.TransitionPlugin("PausedService", nil, map[string]interface{}{
+		"ServiceID":    serviceID,
+		"State":        "Active",
+		"DesiredState": "Pause",
+		"HealthyTasks": []string{"task-1", "task-2"},
+	}, nil))
+	plugin.ServiceID = serviceID
+	plugin.State = rethink.StateActive
+	plugin.DesiredState = rethink.DesiredStatePause
+	plugin.HealthyTasks = []string{"task-1", "task-2"}
+	assert.Nil(t, selectChange(ctx, plugin))
+
+	// The service and its ports are kept with no tasks
+	svc, _, err := f.ServiceInspectWithRaw(ctx, serviceID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), *svc.Spec.Mode.Replicated.Replicas)
+	assert.Len(t, svc.Spec.EndpointSpec.Ports, 1)
+	doc, err := m.GetPluginByServiceName("PausedService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Paused", doc["State"])
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, serviceID, doc["ServiceID"])
+	assert.Equal(t, []interface{}{}, doc["HealthyTasks"])
+	assert.Equal(t, []interface{}{"task-1", "task-2"}, doc["OldTasks"])
+	node, err := m.GetPorts("192.168.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"1080"}, node["TCPPorts"])
+
+	// The row written when pausing began isn't acted on
+	plugin.State = rethink.StatePaused
+	assert.Nil(t, selectChange(ctx, plugin))
+	doc, err = m.GetPluginByServiceName("PausedService")
+	assert.Nil(t, err)
+	assert.Nil(t, doc["LastError"])
+
+	// Resuming starts its Replicas again
+	assert.Nil(t, m.UpdatePluginStatus("PausedService", map[string]string{"DesiredState": "Resume"}))
+	plugin.State = rethink.StatePaused
+	plugin.DesiredState = rethink.DesiredStateResume
+	plugin.HealthyTasks = nil
+	assert.Nil(t, selectChange(ctx, plugin))
+
+	svc, _, err = f.ServiceInspectWithRaw(ctx, serviceID)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), *svc.Spec.Mode.Replicated.Replicas)
+	doc, err = m.GetPluginByServiceName("PausedService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Starting", doc["State"])
+	assert.Equal(t, "Resume", doc["DesiredState"])
+}
+
+func Test_upgradePlugin(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "UpgradedService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+	}
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("UpgradedService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+	assert.Nil(t, selectChange(ctx, plugin))
+	services, err := f.ServiceList(ctx, types.ServiceListOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, services, 1)
+	serviceID := services[0].ID
+	update := services[0].Spec.UpdateConfig
+	assert.Equal(t, uint64(1), update.Parallelism)
+	assert.Equal(t, orchestrator.UpdateFailureActionRollback, update.FailureAction)
+	assert.Equal(t, updateMonitor, update.Monitor)
+
+	upgrade := func(tag string) {
+		assert.Nil(t, m.UpdatePluginStatus("UpgradedService", map[string]string{
+			"ServiceID":    serviceID,
+			"State":        "Active",
+			"DesiredState": "Upgrade",
+			"TargetTag":    tag,
+		}))
+		plugin.ServiceID = serviceID
+		plugin.State = rethink.StateActive
+		plugin.DesiredState = rethink.DesiredStateUpgrade
+		plugin.TargetTag = tag
+		assert.Nil(t, selectChange(ctx, plugin))
+	}
+	upgrade("2.0")
+	svc, _, err := f.ServiceInspectWithRaw(ctx, serviceID)
+	assert.Nil(t, err)
+	image := svc.Spec.TaskTemplate.ContainerSpec.Image
+	assert.True(t, strings.HasSuffix(image, ":2.0"), image)
+	doc, err := m.GetPluginByServiceName("UpgradedService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Restarting", doc["State"])
+
+	// A bad image is rolled back by the swarm
+	f.RejectImage(strings.TrimSuffix(image, "2.0") + "bad")
+	upgrade("bad")
+	svc, _, err = f.ServiceInspectWithRaw(ctx, serviceID)
+	assert.Nil(t, err)
+	assert.Equal(t, image, svc.Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Equal(t, orchestrator.UpdateStateRollbackCompleted, svc.UpdateStatus.State)
+
+	// and the reconciler records it if the events were missed
+	doc, err = m.GetPluginByServiceName("UpgradedService")
+	assert.Nil(t, err)
+	missed, err := rethink.ParsePlugin(doc)
+	assert.Nil(t, err)
+	fix := stateFix(missed, &svc)
+	assert.Equal(t, "", fix["DesiredState"])
+	assert.Equal(t, "Active", fix["State"])
+	assert.Equal(t, "RolledBack", fix["UpgradeStatus"])
+	assert.Equal(t, "upgrade to bad failed and was rolled back", fix["LastError"])
+}
@@ -0,0 +1,82 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	swarm "github.com/docker/docker/api/types/swarm"
+	rethink "github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// ValidatePlugin checks that a plugin can be turned
+// into a service config, the same way the plugin
+// handler does before acting on it, and that the
+// digest of any upgrade it has is well formed.
+func ValidatePlugin(plugin rethink.Plugin) error {
+	if plugin.TargetDigest != "" && !imageDigest.MatchString(plugin.TargetDigest) {
+		return fmt.Errorf("Digest must be <algorithm>:<hex>, got %q", plugin.TargetDigest)
+	}
+	_, err := pluginToConfig(plugin)
+	return err
+}
+
+// CheckPluginPorts checks the ports a plugin would
+// publish against the Ports table without claiming
+// them, returning a *PortConflictError for any already
+// in use. The ports of the plugin's own service don't
+// conflict with it.
+func CheckPluginPorts(ctx context.Context, plugin rethink.Plugin) error {
+	config, err := pluginToConfig(plugin)
+	if err != nil {
+		return err
+	}
+
+	var owned []swarm.PortConfig
+	svc, _, err := PluginService(ctx, plugin.ServiceName)
+	if err != nil {
+		return err
+	}
+	if svc != nil && svc.Spec.EndpointSpec != nil {
+		owned = svc.Spec.EndpointSpec.Ports
+	}
+
+	addresses, err := portAddresses(&config)
+	if err != nil {
+		return err
+	}
+	_, err = allocatePorts(addresses, config.Ports, owned)
+	return err
+}
+
+// PluginService returns the service with the given
+// name and its tasks, or a nil service if there is none.
+func PluginService(ctx context.Context, serviceName string) (*swarm.Service, []swarm.Task, error) {
+	dockerClient, err := getOrchestrator()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nameFilter := filters.NewArgs()
+	nameFilter.Add("name", serviceName)
+	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{Filters: nameFilter})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The name filter matches prefixes too
+	for _, svc := range services {
+		if svc.Spec.Annotations.Name != serviceName {
+			continue
+		}
+		taskFilter := filters.NewArgs()
+		taskFilter.Add("service", svc.ID)
+		tasks, err := dockerClient.TaskList(ctx, types.TaskListOptions{Filters: taskFilter})
+		if err != nil {
+			return nil, nil, err
+		}
+		return &svc, tasks, nil
+	}
+	return nil, []swarm.Task{}, nil
+}
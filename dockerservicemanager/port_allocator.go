@@ -0,0 +1,201 @@
+package dockerservicemanager
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// PortConflictError is returned when a plugin asks to
+// publish a port already in use on its interface.
+type PortConflictError struct {
+	Address  string
+	Port     uint32
+	Protocol swarm.PortConfigProtocol
+}
+
+// Error method for PortConflictError
+func (e *PortConflictError) Error() string {
+	return fmt.Sprintf("port conflict: %v/%v is already in use on %v", e.Port, e.Protocol, e.Address)
+}
+
+// defaultAutoPortRange is used to assign "auto"
+// external ports when AUTO_PORT_RANGE isn't set.
+const defaultAutoPortRange = "30000-32767"
+
+// getAutoPortRange returns the bounds of AUTO_PORT_RANGE
+// (e.g. "30000-31000"), or of defaultAutoPortRange.
+func getAutoPortRange() (uint32, uint32, error) {
+	temp := os.Getenv("AUTO_PORT_RANGE")
+	if temp == "" {
+		temp = defaultAutoPortRange
+	}
+
+	bounds := strings.Split(temp, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid AUTO_PORT_RANGE %q", temp)
+	}
+	start, err := parsePortNumber(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid AUTO_PORT_RANGE %q: %v", temp, err)
+	}
+	end, err := parsePortNumber(bounds[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid AUTO_PORT_RANGE %q: %v", temp, err)
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid AUTO_PORT_RANGE %q: range is backwards", temp)
+	}
+	return start, end, nil
+}
+
+func portKey(port uint32, protocol swarm.PortConfigProtocol) string {
+	return fmt.Sprintf("%v/%v", port, protocol)
+}
+
+// usedPorts returns the ports marked as used on an
+// interface in the Ports table, keyed "<port>/<proto>".
+func usedPorts(address string) (map[string]bool, error) {
+	doc, err := rethink.GetStore().GetPorts(address)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	for field, protocol := range map[string]swarm.PortConfigProtocol{
+		"TCPPorts": swarm.PortConfigProtocolTCP,
+		"UDPPorts": swarm.PortConfigProtocolUDP,
+	} {
+		list, _ := doc[field].([]interface{})
+		for _, v := range list {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			p, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				continue
+			}
+			used[portKey(uint32(p), protocol)] = true
+		}
+	}
+	return used, nil
+}
+
+// nodeAddresses returns the interfaces of the nodes
+// in the Ports table with the given os label.
+func nodeAddresses(nodes []map[string]interface{}, osLabel string) []string {
+	var addresses []string
+	for _, node := range nodes {
+		address, ok := node["Interface"].(string)
+		if ok && node["OS"] == osLabel {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// portAddresses returns the interfaces a service's ports
+// are published on. A global service runs on, and
+// publishes them on, every node for its OS.
+func portAddresses(config *PluginServiceConfig) ([]string, error) {
+	if config.Mode != rethink.ModeGlobal {
+		return []string{config.Address}, nil
+	}
+	nodes, err := rethink.GetStore().ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	return nodeAddresses(nodes, rethink.NodeOS(config.OS)), nil
+}
+
+// allocatePorts checks the ports a service will publish
+// on addresses against the Ports table, returning a
+// *PortConflictError for any already in use on any of
+// them. Ports with PublishedPort 0 are assigned one free
+// on all of them, reusing the port the service already
+// publishes for that target if there is one. owned are
+// the ports published by the service being updated,
+// which don't conflict with it.
+func allocatePorts(addresses []string, ports []swarm.PortConfig, owned []swarm.PortConfig) ([]swarm.PortConfig, error) {
+	if len(ports) == 0 {
+		return ports, nil
+	}
+
+	// The address each used port is used on
+	used := make(map[string]string)
+	for _, address := range addresses {
+		onAddress, err := usedPorts(address)
+		if err != nil {
+			return nil, err
+		}
+		for key := range onAddress {
+			if _, ok := used[key]; !ok {
+				used[key] = address
+			}
+		}
+	}
+	reuse := make(map[string]uint32)
+	for _, p := range owned {
+		delete(used, portKey(p.PublishedPort, p.Protocol))
+		reuse[portKey(p.TargetPort, p.Protocol)] = p.PublishedPort
+	}
+	isUsed := func(key string) bool {
+		_, ok := used[key]
+		return ok
+	}
+
+	allocated := make([]swarm.PortConfig, len(ports))
+	copy(allocated, ports)
+
+	// Requested ports are claimed before any are
+	// assigned, so an assigned one can't take them
+	for _, p := range allocated {
+		if p.PublishedPort == 0 {
+			continue
+		}
+		key := portKey(p.PublishedPort, p.Protocol)
+		if address, ok := used[key]; ok {
+			return nil, &PortConflictError{
+				Address:  address,
+				Port:     p.PublishedPort,
+				Protocol: p.Protocol,
+			}
+		}
+		used[key] = ""
+	}
+
+	for i, p := range allocated {
+		if p.PublishedPort != 0 {
+			continue
+		}
+		if prev, ok := reuse[portKey(p.TargetPort, p.Protocol)]; ok && !isUsed(portKey(prev, p.Protocol)) {
+			allocated[i].PublishedPort = prev
+			used[portKey(prev, p.Protocol)] = ""
+			continue
+		}
+
+		start, end, err := getAutoPortRange()
+		if err != nil {
+			return nil, err
+		}
+		for port := start; port <= end; port++ {
+			if !isUsed(portKey(port, p.Protocol)) {
+				allocated[i].PublishedPort = port
+				used[portKey(port, p.Protocol)] = ""
+				break
+			}
+		}
+		if allocated[i].PublishedPort == 0 {
+			return nil, fmt.Errorf("no free %v port in %v-%v on %v", p.Protocol, start, end, strings.Join(addresses, ", "))
+		}
+	}
+
+	return allocated, nil
+}
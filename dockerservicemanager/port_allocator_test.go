@@ -0,0 +1,270 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_allocatePorts(t *testing.T) {
+	_, m, restore := useFakes(t)
+	defer restore()
+
+	env := os.Getenv("AUTO_PORT_RANGE")
+	defer os.Setenv("AUTO_PORT_RANGE", env)
+	os.Setenv("AUTO_PORT_RANGE", "30000-30002")
+
+	assert.Nil(t, m.AddPort("192.168.1.1", "5000", swarm.PortConfigProtocolTCP))
+	assert.Nil(t, m.AddPort("192.168.1.1", "30000", swarm.PortConfigProtocolTCP))
+
+	port := func(proto swarm.PortConfigProtocol, target, published uint32) swarm.PortConfig {
+		return swarm.PortConfig{
+			Protocol:      proto,
+			TargetPort:    target,
+			PublishedPort: published,
+			PublishMode:   swarm.PortConfigPublishModeHost,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		ports   []swarm.PortConfig
+		owned   []swarm.PortConfig
+		want    []swarm.PortConfig
+		wantErr bool
+		err     error
+	}{
+		{
+			name:    "No ports",
+			address: "10.0.0.1",
+		},
+		{
+			name:    "Free port",
+			address: "192.168.1.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 5000, 5001)},
+			want:    []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 5000, 5001)},
+		},
+		{
+			name:    "Other protocol is free",
+			address: "192.168.1.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolUDP, 5000, 5000)},
+			want:    []swarm.PortConfig{port(swarm.PortConfigProtocolUDP, 5000, 5000)},
+		},
+		{
+			name:    "Conflict",
+			address: "192.168.1.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+			wantErr: true,
+			err: &PortConflictError{
+				Address:  "192.168.1.1",
+				Port:     5000,
+				Protocol: swarm.PortConfigProtocolTCP,
+			},
+		},
+		{
+			name:    "Own port",
+			address: "192.168.1.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+			owned:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+			want:    []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+		},
+		{
+			name:    "Auto",
+			address: "192.168.1.1",
+			ports: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 80, 0),
+				port(swarm.PortConfigProtocolTCP, 81, 30001),
+				port(swarm.PortConfigProtocolUDP, 82, 0),
+			},
+			want: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 80, 30002),
+				port(swarm.PortConfigProtocolTCP, 81, 30001),
+				port(swarm.PortConfigProtocolUDP, 82, 30000),
+			},
+		},
+		{
+			name:    "Auto range exhausted",
+			address: "192.168.1.1",
+			ports: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 80, 0),
+				port(swarm.PortConfigProtocolTCP, 81, 0),
+				port(swarm.PortConfigProtocolTCP, 82, 0),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Auto keeps own port",
+			address: "192.168.1.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 0)},
+			owned:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+			want:    []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 5000)},
+		},
+		{
+			name:    "Unknown interface",
+			address: "10.0.0.1",
+			ports:   []swarm.PortConfig{port(swarm.PortConfigProtocolTCP, 80, 80)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := allocatePorts([]string{tt.address}, tt.ports, tt.owned)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("allocatePorts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			} else if tt.err != nil {
+				assert.Equal(t, tt.err, err)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_rejectOnConflict(t *testing.T) {
+	_, m, restore := useFakes(t)
+	defer restore()
+
+	assert.Nil(t, m.AddPort("192.168.1.1", "1080", swarm.PortConfigProtocolTCP))
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("ConflictService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+
+	err := selectChange(context.Background(), rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "ConflictService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"1080/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+	})
+	assert.IsType(t, &PortConflictError{}, err)
+
+	doc, err := m.GetPluginByServiceName("ConflictService")
+	assert.Nil(t, err)
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, "port conflict: 1080/tcp is already in use on 192.168.1.1", doc["LastError"])
+}
+
+func Test_recordPorts(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+
+	env := os.Getenv("AUTO_PORT_RANGE")
+	defer os.Setenv("AUTO_PORT_RANGE", env)
+	os.Setenv("AUTO_PORT_RANGE", "30000-30002")
+
+	doc := reconcileTestPlugin("AutoService", rethink.DesiredStateActivate, rethink.StateAvailable)
+	doc["ExternalPorts"] = []string{"auto/tcp"}
+	assert.Nil(t, m.InsertPlugin(doc))
+
+	plugin := rethink.Plugin{
+		Name:          "TestPlugin",
+		ServiceName:   "AutoService",
+		DesiredState:  rethink.DesiredStateActivate,
+		State:         rethink.StateAvailable,
+		Address:       "192.168.1.1",
+		ExternalPorts: []string{"auto/tcp"},
+		InternalPorts: []string{"1080/tcp"},
+		OS:            rethink.PluginOSPosix,
+	}
+	assert.Nil(t, selectChange(context.Background(), plugin))
+
+	// The assigned port is on the row
+	doc, err := m.GetPluginByServiceName("AutoService")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"30000/tcp"}, doc["PublishedPorts"])
+	assert.Equal(t, []interface{}{"auto/tcp"}, doc["ExternalPorts"])
+
+	// A service that isn't created uses no ports
+	_, err = f.ServiceCreate(context.Background(), swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "DuplicateService"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	config := &PluginServiceConfig{
+		Address:     "192.168.1.1",
+		OS:          rethink.PluginOSPosix,
+		ServiceName: "DuplicateService",
+		Ports: []swarm.PortConfig{{
+			Protocol:      swarm.PortConfigProtocolTCP,
+			TargetPort:    2080,
+			PublishedPort: 2080,
+		}},
+	}
+	_, err = CreatePluginService(context.Background(), config)
+	assert.NotNil(t, err)
+
+	node, err := m.GetPorts("192.168.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"30000"}, node["TCPPorts"])
+}
+
+func Test_globalPorts(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	node := f.AddNode("worker", "192.168.1.2", "linux", swarm.NodeRoleWorker)
+	node.Spec.Annotations.Labels = map[string]string{"os": "posix", "ip": "192.168.1.2"}
+	assert.Nil(t, f.NodeUpdate(ctx, node.ID, node.Version, node.Spec))
+	for _, doc := range []map[string]interface{}{
+		{"Interface": "192.168.1.2", "NodeHostName": "worker", "OS": "posix", "TCPPorts": []string{"1080"}, "UDPPorts": []string{}},
+		{"Interface": "192.168.1.3", "NodeHostName": "windows", "OS": "nt", "TCPPorts": []string{}, "UDPPorts": []string{}},
+	} {
+		assert.Nil(t, m.UpsertNode(doc))
+	}
+
+	config := func(port uint32) *PluginServiceConfig {
+		return &PluginServiceConfig{
+			Address:     "192.168.1.1",
+			OS:          rethink.PluginOSPosix,
+			Mode:        rethink.ModeGlobal,
+			ServiceName: "GlobalService",
+			Ports: []swarm.PortConfig{{
+				Protocol:      swarm.PortConfigProtocolTCP,
+				TargetPort:    port,
+				PublishedPort: port,
+			}},
+		}
+	}
+	tcpPorts := func(address string) interface{} {
+		doc, err := m.GetPorts(address)
+		assert.Nil(t, err)
+		return doc["TCPPorts"]
+	}
+
+	// In use on another node it would run on
+	_, err := CreatePluginService(ctx, config(1080))
+	assert.Equal(t, &PortConflictError{
+		Address:  "192.168.1.2",
+		Port:     1080,
+		Protocol: swarm.PortConfigProtocolTCP,
+	}, err)
+
+	// Recorded on every posix node
+	resp, err := CreatePluginService(ctx, config(2080))
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"2080"}, tcpPorts("192.168.1.1"))
+	assert.Equal(t, []interface{}{"1080", "2080"}, tcpPorts("192.168.1.2"))
+	assert.Equal(t, []interface{}{}, tcpPorts("192.168.1.3"))
+
+	// which the reconciler agrees with, only freeing
+	// the port no service publishes
+	actions, err := ReconcilePorts(ctx, true)
+	assert.Nil(t, err)
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, "192.168.1.2", actions[0].ServiceName)
+		assert.Equal(t, "remove 1080/tcp", actions[0].Detail)
+	}
+
+	// and freed on every one
+	assert.Nil(t, RemovePluginService(ctx, resp.ID))
+	assert.Equal(t, []interface{}{}, tcpPorts("192.168.1.1"))
+	assert.Equal(t, []interface{}{"1080"}, tcpPorts("192.168.1.2"))
+}
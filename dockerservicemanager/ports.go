@@ -0,0 +1,132 @@
+package dockerservicemanager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	swarm "github.com/docker/docker/api/types/swarm"
+)
+
+// portRange is a parsed port entry such as "5000/tcp"
+// or "8000-8010/udp". A single port has Start == End.
+// An "auto/tcp" or "0/tcp" entry is Auto, with no ports.
+type portRange struct {
+	Start    uint32
+	End      uint32
+	Protocol swarm.PortConfigProtocol
+	Auto     bool
+}
+
+// parsePortNumber parses one port number in 1-65535.
+func parsePortNumber(s string) (uint32, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port number %q", s)
+	}
+	return uint32(p), nil
+}
+
+// parsePortRange parses a "<port>[-<port>]/<tcp|udp>"
+// entry from a plugin's InternalPorts or ExternalPorts.
+// The port may also be "auto" (or "0").
+func parsePortRange(entry string) (portRange, error) {
+	parts := strings.Split(entry, "/")
+	if len(parts) != 2 {
+		return portRange{}, fmt.Errorf("malformed port %q, expected <port>[-<port>]/<tcp|udp>", entry)
+	}
+
+	var proto swarm.PortConfigProtocol
+	switch strings.ToLower(parts[1]) {
+	case string(swarm.PortConfigProtocolTCP):
+		proto = swarm.PortConfigProtocolTCP
+	case string(swarm.PortConfigProtocolUDP):
+		proto = swarm.PortConfigProtocolUDP
+	default:
+		return portRange{}, fmt.Errorf("malformed port %q: unknown protocol %q", entry, parts[1])
+	}
+
+	if parts[0] == "auto" || parts[0] == "0" {
+		return portRange{Protocol: proto, Auto: true}, nil
+	}
+
+	bounds := strings.Split(parts[0], "-")
+	if len(bounds) > 2 {
+		return portRange{}, fmt.Errorf("malformed port %q", entry)
+	}
+	start, err := parsePortNumber(bounds[0])
+	if err != nil {
+		return portRange{}, fmt.Errorf("malformed port %q: %v", entry, err)
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = parsePortNumber(bounds[1])
+		if err != nil {
+			return portRange{}, fmt.Errorf("malformed port %q: %v", entry, err)
+		}
+		if end < start {
+			return portRange{}, fmt.Errorf("malformed port %q: range is backwards", entry)
+		}
+	}
+
+	return portRange{Start: start, End: end, Protocol: proto}, nil
+}
+
+// PluginPorts pairs each entry in a plugin's InternalPorts
+// with the entry at the same index in its ExternalPorts,
+// and converts them to published port configs. Paired
+// ranges must be the same size and protocol, and are
+// expanded into one config per port.
+func PluginPorts(internal, external []string) ([]swarm.PortConfig, error) {
+	if len(internal) != len(external) {
+		return nil, fmt.Errorf("unpaired ports: %v internal, %v external", len(internal), len(external))
+	}
+
+	var ports []swarm.PortConfig
+	for i := range internal {
+		in, err := parsePortRange(internal[i])
+		if err != nil {
+			return nil, err
+		}
+		ex, err := parsePortRange(external[i])
+		if err != nil {
+			return nil, err
+		}
+		if in.Auto {
+			return nil, fmt.Errorf("internal port %v can't be auto", internal[i])
+		}
+		if in.Protocol != ex.Protocol {
+			return nil, fmt.Errorf("protocol mismatch pairing %v with %v", internal[i], external[i])
+		}
+		if !ex.Auto && in.End-in.Start != ex.End-ex.Start {
+			return nil, fmt.Errorf("range size mismatch pairing %v with %v", internal[i], external[i])
+		}
+		for offset := uint32(0); offset <= in.End-in.Start; offset++ {
+			published := ex.Start + offset
+			if ex.Auto {
+				published = 0
+			}
+			ports = append(ports, swarm.PortConfig{
+				Protocol:      in.Protocol,
+				TargetPort:    in.Start + offset,
+				PublishedPort: published,
+				PublishMode:   swarm.PortConfigPublishModeHost,
+			})
+		}
+	}
+
+	// Publishing the same port twice fails at the swarm
+	seen := make(map[string]bool)
+	for _, p := range ports {
+		if p.PublishedPort == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%v/%v", p.PublishedPort, p.Protocol)
+		if seen[key] {
+			return nil, fmt.Errorf("port %v published more than once", key)
+		}
+		seen[key] = true
+	}
+
+	return ports, nil
+}
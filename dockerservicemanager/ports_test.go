@@ -0,0 +1,190 @@
+package dockerservicemanager
+
+import (
+	"testing"
+
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parsePortRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    portRange
+		wantErr bool
+	}{
+		{
+			name:  "Single tcp",
+			entry: "5000/tcp",
+			want:  portRange{Start: 5000, End: 5000, Protocol: swarm.PortConfigProtocolTCP},
+		},
+		{
+			name:  "Range udp",
+			entry: "8000-8010/UDP",
+			want:  portRange{Start: 8000, End: 8010, Protocol: swarm.PortConfigProtocolUDP},
+		},
+		{
+			name:    "No protocol",
+			entry:   "5000",
+			wantErr: true,
+		},
+		{
+			name:    "Bad protocol",
+			entry:   "5000/sctp",
+			wantErr: true,
+		},
+		{
+			name:    "Not a number",
+			entry:   "http/tcp",
+			wantErr: true,
+		},
+		{
+			name:    "Out of range",
+			entry:   "70000/tcp",
+			wantErr: true,
+		},
+		{
+			name:  "Auto",
+			entry: "auto/udp",
+			want:  portRange{Protocol: swarm.PortConfigProtocolUDP, Auto: true},
+		},
+		{
+			name:  "Zero is auto",
+			entry: "0/tcp",
+			want:  portRange{Protocol: swarm.PortConfigProtocolTCP, Auto: true},
+		},
+		{
+			name:    "Zero in range",
+			entry:   "0-10/tcp",
+			wantErr: true,
+		},
+		{
+			name:    "Backwards range",
+			entry:   "8010-8000/tcp",
+			wantErr: true,
+		},
+		{
+			name:    "Too many bounds",
+			entry:   "1-2-3/tcp",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePortRange(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePortRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPluginPorts(t *testing.T) {
+	port := func(proto swarm.PortConfigProtocol, target, published uint32) swarm.PortConfig {
+		return swarm.PortConfig{
+			Protocol:      proto,
+			TargetPort:    target,
+			PublishedPort: published,
+			PublishMode:   swarm.PortConfigPublishModeHost,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		internal []string
+		external []string
+		want     []swarm.PortConfig
+		wantErr  bool
+	}{
+		{
+			name: "No ports",
+		},
+		{
+			name:     "Control and data ports",
+			internal: []string{"5000/tcp", "5001/udp"},
+			external: []string{"80/tcp", "53/udp"},
+			want: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 5000, 80),
+				port(swarm.PortConfigProtocolUDP, 5001, 53),
+			},
+		},
+		{
+			name:     "Range",
+			internal: []string{"8000-8002/tcp"},
+			external: []string{"9000-9002/tcp"},
+			want: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 8000, 9000),
+				port(swarm.PortConfigProtocolTCP, 8001, 9001),
+				port(swarm.PortConfigProtocolTCP, 8002, 9002),
+			},
+		},
+		{
+			name:     "Same number, both protocols",
+			internal: []string{"53/tcp", "53/udp"},
+			external: []string{"53/tcp", "53/udp"},
+			want: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 53, 53),
+				port(swarm.PortConfigProtocolUDP, 53, 53),
+			},
+		},
+		{
+			name:     "Auto external",
+			internal: []string{"5000/tcp", "6000-6001/udp"},
+			external: []string{"auto/tcp", "0/udp"},
+			want: []swarm.PortConfig{
+				port(swarm.PortConfigProtocolTCP, 5000, 0),
+				port(swarm.PortConfigProtocolUDP, 6000, 0),
+				port(swarm.PortConfigProtocolUDP, 6001, 0),
+			},
+		},
+		{
+			name:     "Auto internal",
+			internal: []string{"auto/tcp"},
+			external: []string{"5000/tcp"},
+			wantErr:  true,
+		},
+		{
+			name:     "Unpaired",
+			internal: []string{"5000/tcp", "5001/tcp"},
+			external: []string{"5000/tcp"},
+			wantErr:  true,
+		},
+		{
+			name:     "Malformed",
+			internal: []string{"5000"},
+			external: []string{"5000/tcp"},
+			wantErr:  true,
+		},
+		{
+			name:     "Protocol mismatch",
+			internal: []string{"5000/tcp"},
+			external: []string{"5000/udp"},
+			wantErr:  true,
+		},
+		{
+			name:     "Range size mismatch",
+			internal: []string{"8000-8010/tcp"},
+			external: []string{"9000-9005/tcp"},
+			wantErr:  true,
+		},
+		{
+			name:     "Published twice",
+			internal: []string{"5000/tcp", "5001/tcp"},
+			external: []string{"80-81/tcp", "81/tcp"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PluginPorts(tt.internal, tt.external)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("PluginPorts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
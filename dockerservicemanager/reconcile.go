@@ -0,0 +1,331 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// ReconcileKind is the kind of correction
+// made by the reconciler.
+type ReconcileKind string
+
+const (
+	// ReconcileReapply is an outstanding DesiredState
+	// being applied again.
+	ReconcileReapply ReconcileKind = "reapply"
+	// ReconcileState is a plugin's State (or ServiceID)
+	// being corrected to match its service.
+	ReconcileState ReconcileKind = "state"
+	// ReconcilePort is a port being added to or removed
+	// from a node's TCPPorts or UDPPorts to match its
+	// services. Its ServiceName is the node's Interface.
+	ReconcilePort ReconcileKind = "port"
+)
+
+// ReconcileAction is a single correction made
+// (or, in a dry run, to be made) by Reconcile.
+type ReconcileAction struct {
+	ServiceName string
+	Kind        ReconcileKind
+	Detail      string
+	Err         error
+}
+
+// String method for ReconcileAction
+func (a ReconcileAction) String() string {
+	if a.Err != nil {
+		return fmt.Sprintf("%v: %v %v failed: %v", a.ServiceName, a.Kind, a.Detail, a.Err)
+	}
+	return fmt.Sprintf("%v: %v %v", a.ServiceName, a.Kind, a.Detail)
+}
+
+// stateFix returns the update correcting a plugin
+// whose DesiredState has already been met, or whose
+// State has drifted from its service.
+func stateFix(plugin *rethink.Plugin, svc *swarm.Service) map[string]string {
+	update := make(map[string]string)
+
+	switch {
+	case plugin.DesiredState == rethink.DesiredStateActivate && svc != nil,
+		plugin.DesiredState == rethink.DesiredStateStop && svc == nil,
+		plugin.DesiredState == rethink.DesiredStateRestart && plugin.State == rethink.StateRestarting &&
+			svc != nil && !rollingOut(svc),
+		plugin.DesiredState == rethink.DesiredStateScale && svc != nil && scaled(svc, replicaCount(*plugin)),
+		plugin.DesiredState == rethink.DesiredStatePause && plugin.State == rethink.StatePaused &&
+			svc != nil && scaled(svc, 0),
+		plugin.DesiredState == rethink.DesiredStateResume && plugin.State == rethink.StateStarting &&
+			svc != nil && scaled(svc, replicaCount(*plugin)):
+		// Done, but the event was missed
+		update["DesiredState"] = ""
+	case plugin.DesiredState == rethink.DesiredStateUpgrade &&
+		(plugin.State == rethink.StateRestarting || plugin.State == rethink.StateRollingBack) &&
+		svc != nil && !rollingOut(svc) && rethink.UpgradeOutcome(plugin, string(svc.UpdateStatus.State), update):
+		// Ended, but the event was missed
+		update["DesiredState"] = ""
+	case plugin.DesiredState != rethink.DesiredStateNull:
+		return update
+	}
+
+	if svc == nil {
+		if hasService(plugin.State) {
+			update["State"] = string(rethink.StateStopped)
+		}
+		if plugin.ServiceID != "" {
+			update["ServiceID"] = ""
+		}
+		return update
+	}
+	// A Starting plugin is Active once a task is healthy,
+	// which only its events say, and a Stopping one is
+	// Stopped once its service is gone
+	switch plugin.State {
+	case rethink.StateStopped, rethink.StateAvailable:
+		update["State"] = string(rethink.StateActive)
+	case rethink.StateRestarting, rethink.StateRollingBack:
+		if update["UpgradeStatus"] == string(rethink.UpgradeRollbackFailed) {
+			update["State"] = string(rethink.StateFailed)
+		} else if !rollingOut(svc) {
+			update["State"] = string(rethink.StateActive)
+		}
+	}
+	if plugin.ServiceID != svc.ID {
+		update["ServiceID"] = svc.ID
+	}
+	return update
+}
+
+// applyFix writes a stateFix through the plugin's state
+// machine, as long as it hasn't changed since it was read.
+func applyFix(plugin *rethink.Plugin, update map[string]string) error {
+	var change *rethink.StateChange
+	if next, ok := update["State"]; ok && rethink.PluginState(next) != plugin.State {
+		if !rethink.CanTransition(plugin.State, rethink.PluginState(next)) {
+			return fmt.Errorf("cannot go from %v to %v", plugin.State, next)
+		}
+		change = stateChange(plugin.State, rethink.PluginState(next), "reconcile")
+	}
+	fields := make(map[string]interface{})
+	for k, v := range update {
+		fields[k] = v
+	}
+	return rethink.GetStore().TransitionPlugin(
+		plugin.ServiceName,
+		map[string]string{
+			"State":        string(plugin.State),
+			"DesiredState": string(plugin.DesiredState),
+		},
+		fields,
+		change,
+	)
+}
+
+// hasService returns whether a plugin
+// in a State should have a service.
+func hasService(state rethink.PluginState) bool {
+	return state == rethink.StateActive || state == rethink.StatePaused || rethink.Transitional(state)
+}
+
+// scaled returns whether a service
+// already runs want tasks.
+func scaled(svc *swarm.Service, want uint64) bool {
+	replicated := svc.Spec.Mode.Replicated
+	return replicated != nil && replicated.Replicas != nil && *replicated.Replicas == want
+}
+
+// reapply applies a plugin's DesiredState again, the
+// same way HandlePluginChanges would have.
+func reapply(plugin rethink.Plugin, svc *swarm.Service) error {
+	// Any change in flight has stalled, so the
+	// request is checked against what is running
+	if svc != nil {
+		plugin.ServiceID = svc.ID
+		switch {
+		case plugin.DesiredState == rethink.DesiredStateResume && plugin.State == rethink.StateStarting:
+			plugin.State = rethink.StatePaused
+		case plugin.DesiredState == rethink.DesiredStatePause && plugin.State == rethink.StatePaused:
+			plugin.State = rethink.StateActive
+		case rethink.Transitional(plugin.State):
+			plugin.State = rethink.StateActive
+		}
+	} else {
+		if hasService(plugin.State) {
+			plugin.State = rethink.StateStopped
+		}
+		if plugin.DesiredState == rethink.DesiredStateRestart {
+			// Nothing to restart, so start it
+			plugin.DesiredState = rethink.DesiredStateActivate
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+	return selectChange(ctx, plugin)
+}
+
+// reconcile compares every plugin with a ServiceName to
+// the swarm's services. Outstanding DesiredStates are
+// only reapplied if they were also outstanding in prev,
+// so that changes still in flight aren't applied twice
+// (a nil prev reapplies them all). It returns the actions
+// taken and the DesiredStates left outstanding.
+func reconcile(ctx context.Context, prev map[string]rethink.PluginDesiredState, dryRun bool) ([]ReconcileAction, map[string]rethink.PluginDesiredState, error) {
+	var (
+		actions []ReconcileAction
+		pending = make(map[string]rethink.PluginDesiredState)
+	)
+
+	dockerClient, err := getOrchestrator()
+	if err != nil {
+		return nil, prev, err
+	}
+
+	store := rethink.GetStore()
+	nodes, err := store.ListPorts()
+	if err != nil {
+		return nil, prev, err
+	}
+
+	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, prev, err
+	}
+	byName := make(map[string]*swarm.Service)
+	for i := range services {
+		byName[services[i].Spec.Annotations.Name] = &services[i]
+	}
+
+	// Ports are fixed against the lists read above,
+	// before any services are created below
+	actions = append(actions, reconcilePorts(nodes, services, dryRun)...)
+
+	docs, err := store.ListPlugins()
+	if err != nil {
+		return nil, prev, err
+	}
+
+	for _, doc := range docs {
+		if name, ok := doc["ServiceName"].(string); !ok || name == "" {
+			continue
+		}
+		plugin, err := rethink.ParsePlugin(doc)
+		if err != nil {
+			actions = append(actions, ReconcileAction{
+				ServiceName: doc["ServiceName"].(string),
+				Kind:        ReconcileState,
+				Detail:      "parse",
+				Err:         err,
+			})
+			continue
+		}
+		svc := byName[plugin.ServiceName]
+
+		if update := stateFix(plugin, svc); len(update) > 0 {
+			action := ReconcileAction{
+				ServiceName: plugin.ServiceName,
+				Kind:        ReconcileState,
+				Detail:      fmt.Sprintf("%v", update),
+			}
+			if !dryRun {
+				action.Err = applyFix(plugin, update)
+			}
+			if action.Err == rethink.ErrStaleState {
+				// Changed since it was listed, so
+				// it's looked at again next time
+				continue
+			}
+			actions = append(actions, action)
+			if _, ok := update["DesiredState"]; ok {
+				continue
+			}
+		}
+
+		if plugin.DesiredState == rethink.DesiredStateNull {
+			continue
+		}
+		if svc != nil && rollingOut(svc) {
+			// Still in flight
+			pending[plugin.ServiceName] = plugin.DesiredState
+			continue
+		}
+		if last, ok := prev[plugin.ServiceName]; prev != nil && (!ok || last != plugin.DesiredState) {
+			pending[plugin.ServiceName] = plugin.DesiredState
+			continue
+		}
+		action := ReconcileAction{
+			ServiceName: plugin.ServiceName,
+			Kind:        ReconcileReapply,
+			Detail:      string(plugin.DesiredState),
+		}
+		if !dryRun {
+			action.Err = reapply(*plugin, svc)
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, pending, nil
+}
+
+// Reconcile compares the Plugins and Ports tables to the
+// swarm's services once, reapplying every outstanding
+// DesiredState and correcting State and port drift. With dryRun
+// nothing is changed, and the actions that would be
+// taken are returned.
+func Reconcile(ctx context.Context, dryRun bool) ([]ReconcileAction, error) {
+	actions, _, err := reconcile(ctx, nil, dryRun)
+	return actions, err
+}
+
+// ReconcilePlugins runs the reconciler every interval
+// until the context is done, logging what it fixes. A
+// DesiredState is reapplied once it has been outstanding
+// for a whole interval.
+func ReconcilePlugins(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+
+		pending := make(map[string]rethink.PluginDesiredState)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			var (
+				actions []ReconcileAction
+				err     error
+			)
+			actions, pending, err = reconcile(ctx, pending, false)
+			var failed []error
+			if err != nil {
+				failed = append(failed, fmt.Errorf("reconcile: %v", err))
+			}
+			for _, a := range actions {
+				if a.Err != nil {
+					failed = append(failed, fmt.Errorf("reconcile: %v", a))
+				} else {
+					log.Printf("reconciled %v", a)
+				}
+			}
+			for _, err := range failed {
+				select {
+				case <-ctx.Done():
+					return
+				case errs <- err:
+				}
+			}
+		}
+	}()
+
+	return errs
+}
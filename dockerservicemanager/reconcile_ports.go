@@ -0,0 +1,175 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+)
+
+// serviceAddress returns the interface a service's ports
+// are published on, from the node.labels.ip placement
+// constraint generateServiceSpec gives every replicated
+// service.
+func serviceAddress(svc swarm.Service) string {
+	if svc.Spec.TaskTemplate.Placement == nil {
+		return ""
+	}
+	for _, c := range svc.Spec.TaskTemplate.Placement.Constraints {
+		if strings.HasPrefix(c, "node.labels.ip==") {
+			return strings.TrimPrefix(c, "node.labels.ip==")
+		}
+	}
+	return ""
+}
+
+// serviceAddresses returns the interfaces a service's
+// ports are published on, given the Ports table's nodes.
+// A global service publishes them on every node it can
+// be placed on.
+func serviceAddresses(svc swarm.Service, nodes []map[string]interface{}) []string {
+	if svc.Spec.Mode.Global != nil {
+		osLabel := "posix"
+		if svc.Spec.TaskTemplate.Placement != nil {
+			for _, c := range svc.Spec.TaskTemplate.Placement.Constraints {
+				if strings.HasPrefix(c, "node.labels.os==") {
+					osLabel = strings.TrimPrefix(c, "node.labels.os==")
+				}
+			}
+		}
+		return nodeAddresses(nodes, osLabel)
+	}
+	address := serviceAddress(svc)
+	if address == "" {
+		// Not placed by us, so fall back to the plugin row
+		address, _ = rethink.GetIPFromID(svc.ID)
+	}
+	if address == "" {
+		return nil
+	}
+	return []string{address}
+}
+
+// livePorts returns the ports published by the swarm's
+// services, by interface and then "<port>/<proto>".
+func livePorts(services []swarm.Service, nodes []map[string]interface{}) map[string]map[string]bool {
+	live := make(map[string]map[string]bool)
+	for _, svc := range services {
+		if svc.Spec.EndpointSpec == nil || len(svc.Spec.EndpointSpec.Ports) == 0 {
+			continue
+		}
+		for _, address := range serviceAddresses(svc, nodes) {
+			if live[address] == nil {
+				live[address] = make(map[string]bool)
+			}
+			for _, p := range svc.Spec.EndpointSpec.Ports {
+				live[address][portKey(p.PublishedPort, p.Protocol)] = true
+			}
+		}
+	}
+	return live
+}
+
+// reconcilePorts rebuilds each node's TCPPorts and
+// UDPPorts from the ports its services publish, freeing
+// ports left behind by removed services and adding any
+// that were never recorded. nodes must be read before
+// services are listed, since ports are recorded after
+// their service is created and freed after it is
+// removed. The fixes are made with AddPort and RemovePort
+// so that ports written while it runs aren't overwritten.
+func reconcilePorts(nodes []map[string]interface{}, services []swarm.Service, dryRun bool) []ReconcileAction {
+	var actions []ReconcileAction
+
+	store := rethink.GetStore()
+	live := livePorts(services, nodes)
+	for _, node := range nodes {
+		address, ok := node["Interface"].(string)
+		if !ok {
+			continue
+		}
+
+		recorded := make(map[string]bool)
+		for field, protocol := range map[string]swarm.PortConfigProtocol{
+			"TCPPorts": swarm.PortConfigProtocolTCP,
+			"UDPPorts": swarm.PortConfigProtocolUDP,
+		} {
+			list, _ := node[field].([]interface{})
+			for _, v := range list {
+				if s, ok := v.(string); ok {
+					recorded[s+"/"+string(protocol)] = true
+				}
+			}
+		}
+
+		var added, removed []string
+		for key := range live[address] {
+			if !recorded[key] {
+				added = append(added, key)
+			}
+		}
+		for key := range recorded {
+			if !live[address][key] {
+				removed = append(removed, key)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+
+		for _, key := range added {
+			actions = append(actions, portAction(address, "add", key, dryRun, store.AddPort))
+		}
+		for _, key := range removed {
+			actions = append(actions, portAction(address, "remove", key, dryRun, store.RemovePort))
+		}
+	}
+
+	return actions
+}
+
+// portAction applies (unless dryRun) one port fix,
+// given its "<port>/<proto>" key.
+func portAction(address string, verb string, key string, dryRun bool, apply func(string, string, swarm.PortConfigProtocol) error) ReconcileAction {
+	action := ReconcileAction{
+		ServiceName: address,
+		Kind:        ReconcilePort,
+		Detail:      verb + " " + key,
+	}
+	if dryRun {
+		return action
+	}
+
+	parts := strings.SplitN(key, "/", 2)
+	if _, err := strconv.ParseUint(parts[0], 10, 16); err != nil || len(parts) != 2 {
+		action.Err = fmt.Errorf("invalid port %v", key)
+		return action
+	}
+	action.Err = apply(address, parts[0], swarm.PortConfigProtocol(parts[1]))
+	return action
+}
+
+// ReconcilePorts compares the Ports table to the ports
+// published by the swarm's services once, and corrects
+// it. With dryRun nothing is changed, and the actions
+// that would be taken are returned.
+func ReconcilePorts(ctx context.Context, dryRun bool) ([]ReconcileAction, error) {
+	dockerClient, err := getOrchestrator()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := rethink.GetStore().ListPorts()
+	if err != nil {
+		return nil, err
+	}
+	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return reconcilePorts(nodes, services, dryRun), nil
+}
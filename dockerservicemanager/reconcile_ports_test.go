@@ -0,0 +1,61 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcilePorts(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	_, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "PortService"},
+		TaskTemplate: swarm.TaskSpec{
+			Placement: &swarm.Placement{
+				Constraints: []string{"node.labels.os==posix", "node.labels.ip==192.168.1.1"},
+			},
+		},
+		EndpointSpec: &swarm.EndpointSpec{
+			Ports: []swarm.PortConfig{
+				{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 5000, PublishedPort: 5000},
+				{Protocol: swarm.PortConfigProtocolUDP, TargetPort: 53, PublishedPort: 53},
+			},
+		},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	// 5000/tcp was recorded, 9000/tcp is left over
+	// from a removed service, and 53/udp is missing
+	assert.Nil(t, m.AddPort("192.168.1.1", "5000", swarm.PortConfigProtocolTCP))
+	assert.Nil(t, m.AddPort("192.168.1.1", "9000", swarm.PortConfigProtocolTCP))
+
+	want := []ReconcileAction{
+		{ServiceName: "192.168.1.1", Kind: ReconcilePort, Detail: "add 53/udp"},
+		{ServiceName: "192.168.1.1", Kind: ReconcilePort, Detail: "remove 9000/tcp"},
+	}
+
+	actions, err := ReconcilePorts(ctx, true)
+	assert.Nil(t, err)
+	assert.Equal(t, want, actions)
+	doc, err := m.GetPorts("192.168.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"5000", "9000"}, doc["TCPPorts"])
+
+	actions, err = ReconcilePorts(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, want, actions)
+	doc, err = m.GetPorts("192.168.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"5000"}, doc["TCPPorts"])
+	assert.Equal(t, []interface{}{"53"}, doc["UDPPorts"])
+
+	actions, err = ReconcilePorts(ctx, false)
+	assert.Nil(t, err)
+	assert.Empty(t, actions)
+}
@@ -0,0 +1,200 @@
+package dockerservicemanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
+	"github.com/ramrod-project/backend-controller-go/rethink"
+	"github.com/stretchr/testify/assert"
+)
+
+// useFakes points the service manager at a fake swarm
+// with one posix manager, and at an in-memory store
+// advertising it. The returned func restores the defaults.
+func useFakes(t *testing.T) (*orchestrator.FakeSwarm, *rethink.MemoryStore, func()) {
+	f := orchestrator.NewFakeSwarm()
+	node := f.AddNode("manager", "192.168.1.1", "linux", swarm.NodeRoleManager)
+	node.Spec.Annotations.Labels = map[string]string{"os": "posix", "ip": "192.168.1.1"}
+	assert.Nil(t, f.NodeUpdate(context.Background(), node.ID, node.Version, node.Spec))
+
+	m := rethink.NewMemoryStore()
+	assert.Nil(t, m.UpsertNode(map[string]interface{}{
+		"Interface":    "192.168.1.1",
+		"NodeHostName": "manager",
+		"OS":           "posix",
+		"TCPPorts":     []string{},
+		"UDPPorts":     []string{},
+	}))
+
+	SetOrchestrator(f)
+	rethink.SetStore(m)
+	return f, m, func() {
+		SetOrchestrator(nil)
+		rethink.SetStore(nil)
+	}
+}
+
+func reconcileTestPlugin(serviceName string, desired rethink.PluginDesiredState, state rethink.PluginState) map[string]interface{} {
+	return map[string]interface{}{
+		"Name":          "TestPlugin",
+		"ServiceID":     "",
+		"ServiceName":   serviceName,
+		"DesiredState":  string(desired),
+		"State":         string(state),
+		"Interface":     "192.168.1.1",
+		"ExternalPorts": []string{"1080/tcp"},
+		"InternalPorts": []string{"1080/tcp"},
+		"OS":            string(rethink.PluginOSPosix),
+		"Environment":   []string{},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	f, m, restore := useFakes(t)
+	defer restore()
+	ctx := context.Background()
+
+	running, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "RunningService"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	removing, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "RemovingService"},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	none := uint64(0)
+	paused, err := f.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "PausedService"},
+		Mode:        swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &none}},
+	}, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	for _, p := range []map[string]interface{}{
+		reconcileTestPlugin("MissedService", rethink.DesiredStateActivate, rethink.StateAvailable),
+		reconcileTestPlugin("GoneService", rethink.DesiredStateNull, rethink.StateActive),
+		reconcileTestPlugin("RunningService", rethink.DesiredStateNull, rethink.StateStopped),
+		reconcileTestPlugin("StoppedService", rethink.DesiredStateStop, rethink.StateActive),
+		reconcileTestPlugin("IdleService", rethink.DesiredStateNull, rethink.StateAvailable),
+		reconcileTestPlugin("StuckService", rethink.DesiredStateNull, rethink.StateStopping),
+		reconcileTestPlugin("RemovingService", rethink.DesiredStateNull, rethink.StateStopping),
+		reconcileTestPlugin("PausedService", rethink.DesiredStatePause, rethink.StatePaused),
+		reconcileTestPlugin("GonePausedService", rethink.DesiredStateNull, rethink.StatePaused),
+	} {
+		assert.Nil(t, m.InsertPlugin(p))
+	}
+	// Stopped, but the remove event was missed
+	removed := reconcileTestPlugin("RemovedService", rethink.DesiredStateNull, rethink.StateStopped)
+	removed["ServiceID"] = "removed-service-id"
+	assert.Nil(t, m.InsertPlugin(removed))
+	// Advertised plugins without a service are ignored
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("", rethink.DesiredStateNull, rethink.StateAvailable)))
+
+	want := []string{
+		"MissedService: reapply Activate",
+		"GoneService: state map[State:Stopped]",
+		"RunningService: state map[ServiceID:" + running.ID + " State:Active]",
+		"StoppedService: state map[DesiredState: State:Stopped]",
+		"StuckService: state map[State:Stopped]",
+		"RemovingService: state map[ServiceID:" + removing.ID + "]",
+		"PausedService: state map[DesiredState: ServiceID:" + paused.ID + "]",
+		"GonePausedService: state map[State:Stopped]",
+		"RemovedService: state map[ServiceID:]",
+	}
+
+	// Dry run changes nothing
+	actions, err := Reconcile(context.Background(), true)
+	assert.Nil(t, err)
+	var got []string
+	for _, a := range actions {
+		got = append(got, a.String())
+	}
+	assert.Equal(t, want, got)
+	doc, err := m.GetPluginByServiceName("GoneService")
+	assert.Nil(t, err)
+	assert.Equal(t, string(rethink.StateActive), doc["State"])
+
+	actions, err = Reconcile(context.Background(), false)
+	assert.Nil(t, err)
+	got = nil
+	for _, a := range actions {
+		got = append(got, a.String())
+	}
+	assert.Equal(t, want, got)
+
+	for name, state := range map[string]rethink.PluginState{
+		"GoneService":       rethink.StateStopped,
+		"RunningService":    rethink.StateActive,
+		"StoppedService":    rethink.StateStopped,
+		"IdleService":       rethink.StateAvailable,
+		"StuckService":      rethink.StateStopped,
+		"RemovingService":   rethink.StateStopping,
+		"PausedService":     rethink.StatePaused,
+		"GonePausedService": rethink.StateStopped,
+		"RemovedService":    rethink.StateStopped,
+	} {
+		doc, err := m.GetPluginByServiceName(name)
+		assert.Nil(t, err)
+		assert.Equal(t, string(state), doc["State"], name)
+		assert.Equal(t, "", doc["DesiredState"], name)
+	}
+
+	// Fixed through the state machine
+	doc, err = m.GetPluginByServiceName("GoneService")
+	assert.Nil(t, err)
+	if history, ok := doc["StateHistory"].([]interface{}); assert.True(t, ok) && assert.NotEmpty(t, history) {
+		last := history[len(history)-1].(map[string]interface{})
+		assert.Equal(t, "Active", last["From"])
+		assert.Equal(t, "Stopped", last["To"])
+		assert.Equal(t, "reconcile", last["Reason"])
+	}
+
+	services, err := f.ServiceList(ctx, types.ServiceListOptions{})
+	assert.Nil(t, err)
+	var missedID string
+	for _, s := range services {
+		if s.Spec.Annotations.Name == "MissedService" {
+			missedID = s.ID
+		}
+	}
+	assert.NotEmpty(t, missedID)
+
+	// With no event to clear it, the met DesiredState
+	// is cleared next time, but it is left Starting
+	// until a task reports healthy
+	actions, err = Reconcile(context.Background(), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReconcileAction{{
+		ServiceName: "MissedService",
+		Kind:        ReconcileState,
+		Detail:      "map[DesiredState: ServiceID:" + missedID + "]",
+	}}, actions)
+}
+
+func Test_reconcileGrace(t *testing.T) {
+	_, m, restore := useFakes(t)
+	defer restore()
+
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("StoppedService", rethink.DesiredStateStop, rethink.StateActive)))
+	assert.Nil(t, m.InsertPlugin(reconcileTestPlugin("MissedService", rethink.DesiredStateActivate, rethink.StateAvailable)))
+
+	// First seen outstanding, so left alone
+	actions, pending, err := reconcile(context.Background(), map[string]rethink.PluginDesiredState{}, false)
+	assert.Nil(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, map[string]rethink.PluginDesiredState{
+		"MissedService": rethink.DesiredStateActivate,
+	}, pending)
+
+	// Still outstanding a pass later, so reapplied
+	actions, pending, err = reconcile(context.Background(), pending, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReconcileAction{{
+		ServiceName: "MissedService",
+		Kind:        ReconcileReapply,
+		Detail:      string(rethink.DesiredStateActivate),
+	}}, actions)
+	assert.Empty(t, pending)
+}
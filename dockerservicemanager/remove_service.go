@@ -5,15 +5,13 @@ import (
 	"log"
 	"strconv"
 
-	client "github.com/docker/docker/client"
 	"github.com/ramrod-project/backend-controller-go/rethink"
 )
 
 // RemovePluginService removes a service for a plugin
 // given a service ID.
-func RemovePluginService(serviceID string) error {
-	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+func RemovePluginService(ctx context.Context, serviceID string) error {
+	dockerClient, err := getOrchestrator()
 
 	if err != nil {
 		return err
@@ -24,11 +22,12 @@ func RemovePluginService(serviceID string) error {
 		return err
 	}
 	//update ports
-	servIP, err := rethink.GetIPFromID(serviceID)
+	nodes, err := rethink.GetStore().ListPorts()
 	if err != nil {
 		log.Printf("%v", err)
 	}
-	log.Printf("serv id: \n%v", servIP)
+	addresses := serviceAddresses(serv, nodes)
+	log.Printf("serv addresses: \n%v", addresses)
 
 	log.Printf("Removing service %v\n", serviceID)
 
@@ -37,10 +36,12 @@ func RemovePluginService(serviceID string) error {
 		return err
 	}
 
-	for _, port := range serv.Spec.EndpointSpec.Ports {
-		err := rethink.RemovePort(servIP, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
-		if err != nil {
-			log.Printf("%v", err)
+	for _, address := range addresses {
+		for _, port := range serv.Spec.EndpointSpec.Ports {
+			err := rethink.RemovePort(address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
+			if err != nil {
+				log.Printf("%v", err)
+			}
 		}
 	}
 
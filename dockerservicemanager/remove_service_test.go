@@ -48,7 +48,7 @@ func TestRemovePluginService(t *testing.T) {
 	}
 
 	testPort := map[string]interface{}{
-		"Interface":    GetManagerIP(),
+		"Interface":    managerIP(t),
 		"TCPPorts":     []string{"666"},
 		"UDPPorts":     []string{},
 		"NodeHostName": "test",
@@ -145,7 +145,7 @@ func TestRemovePluginService(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := RemovePluginService(tt.args.serviceID); (err != nil) != tt.wantErr {
+			if err := RemovePluginService(context.Background(), tt.args.serviceID); (err != nil) != tt.wantErr {
 				t.Errorf("RemovePluginService() error = %v, wantErr %v", err, tt.wantErr)
 				if err := test.DockerCleanUp(ctx, dockerClient, netID); err != nil {
 					t.Errorf("cleanup error: %v", err)
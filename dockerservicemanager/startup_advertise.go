@@ -2,7 +2,6 @@ package dockerservicemanager
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -12,15 +11,76 @@ import (
 
 	"github.com/docker/docker/api/types"
 	swarm "github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
 	rethink "github.com/ramrod-project/backend-controller-go/rethink"
-	r "gopkg.in/gorethink/gorethink.v4"
 )
 
+// ManifestPlugin is a plugin entry in manifest.json.
+// Everything but Name and OS is optional. Plugins that
+// don't set an Image run in the ramrodpcp interpreter
+// images.
 type ManifestPlugin struct {
-	Name  string           `json:"Name",omitempty`
-	OS    rethink.PluginOS `json:"OS",omitempty`
-	Extra bool             `json:"Extra,omitempty"`
+	Name          string                     `json:"Name"`
+	OS            rethink.PluginOS           `json:"OS"`
+	Extra         bool                       `json:"Extra,omitempty"`
+	Description   string                     `json:"Description,omitempty"`
+	Image         string                     `json:"Image,omitempty"`
+	Tag           string                     `json:"Tag,omitempty"`
+	Digest        string                     `json:"Digest,omitempty"`
+	ExternalPorts []string                   `json:"ExternalPorts,omitempty"`
+	InternalPorts []string                   `json:"InternalPorts,omitempty"`
+	Environment   []string                   `json:"Environment,omitempty"`
+	Resources     *rethink.PluginResources   `json:"Resources,omitempty"`
+	Healthcheck   *rethink.PluginHealthcheck `json:"Healthcheck,omitempty"`
+	Replicas      int                        `json:"Replicas,omitempty"`
+	Mode          rethink.PluginMode         `json:"Mode,omitempty"`
+}
+
+// entry returns the advertised Plugins table
+// row for a manifest plugin.
+func (p ManifestPlugin) entry() map[string]interface{} {
+	orEmpty := func(list []string) []string {
+		if list == nil {
+			return []string{}
+		}
+		return list
+	}
+
+	entry := map[string]interface{}{
+		"Name":          p.Name,
+		"ServiceID":     "",
+		"ServiceName":   "",
+		"DesiredState":  "",
+		"State":         "Available",
+		"Interface":     "",
+		"ExternalPorts": orEmpty(p.ExternalPorts),
+		"InternalPorts": orEmpty(p.InternalPorts),
+		"OS":            string(p.OS),
+		"Environment":   orEmpty(p.Environment),
+		"Extra":         p.Extra,
+	}
+	for k, v := range map[string]string{
+		"Description": p.Description,
+		"Image":       p.Image,
+		"Tag":         p.Tag,
+		"Digest":      p.Digest,
+	} {
+		if v != "" {
+			entry[k] = v
+		}
+	}
+	if p.Resources != nil {
+		entry["Resources"] = p.Resources
+	}
+	if p.Healthcheck != nil {
+		entry["Healthcheck"] = p.Healthcheck
+	}
+	if p.Replicas != 0 {
+		entry["Replicas"] = p.Replicas
+	}
+	if p.Mode != "" {
+		entry["Mode"] = string(p.Mode)
+	}
+	return entry
 }
 
 var osMap = map[string]rethink.PluginOS{
@@ -38,7 +98,7 @@ func getRethinkHost() string {
 
 func getLeaderHostname() (string, error) {
 	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 	if err != nil {
 		return "", err
 	}
@@ -62,7 +122,7 @@ func getLeaderHostname() (string, error) {
 func getNodes() ([]map[string]interface{}, error) {
 
 	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 	if err != nil {
 		return nil, err
 	}
@@ -112,71 +172,22 @@ func getNodes() ([]map[string]interface{}, error) {
 }
 
 func getPlugins() ([]ManifestPlugin, error) {
-	var plugins []ManifestPlugin
-
-	// Open Manifest file (should be in same directory)
-	manifest, err := os.Open("manifest.json")
-	if err != nil {
-		return nil, err
-	}
-
-	jsonParser := json.NewDecoder(manifest)
-	if err = jsonParser.Decode(&plugins); err != nil {
-		return nil, err
-	}
-
-	if len(plugins) < 1 {
-		return plugins, fmt.Errorf("no plugins found in manifest.json")
-	}
-
-	return plugins, nil
+	// Read manifest.json (should be in same directory)
+	// and any fragments in MANIFEST_DIR
+	plugins, _, err := loadManifest()
+	return plugins, err
 }
 
+// advertisePlugins brings the advertised plugin rows in
+// line with the manifest, adding new plugins, updating
+// changed ones and retiring removed ones.
 func advertisePlugins(manifest []ManifestPlugin) error {
-	var (
-		doc map[string]interface{}
-	)
-
 	if len(manifest) < 1 {
 		return errors.New("no plugins to advertise")
 	}
 
-	session, err := r.Connect(r.ConnectOpts{
-		Address: getRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
-
-L:
-	for _, plugin := range manifest {
-		pluginEntry := map[string]interface{}{
-			"Name":          plugin.Name,
-			"ServiceID":     "",
-			"ServiceName":   "",
-			"DesiredState":  "",
-			"State":         "Available",
-			"Interface":     "",
-			"ExternalPorts": []string{},
-			"InternalPorts": []string{},
-			"OS":            string(plugin.OS),
-			"Environment":   []string{},
-			"Extra":         plugin.Extra,
-		}
-		cursor, err := r.DB("Controller").Table("Plugins").Run(session)
-		if err != nil {
-			return err
-		}
-		for cursor.Next(&doc) {
-			if doc["Name"].(string) == plugin.Name && doc["ServiceName"] == "" {
-				continue L
-			}
-		}
-		_, err = r.DB("Controller").Table("Plugins").Insert(pluginEntry).RunWrite(session)
-	}
-
+	_, err := applyManifest(manifest)
 	return err
-
 }
 
 func advertiseStartupService(service map[string]interface{}) error {
@@ -186,14 +197,9 @@ func advertiseStartupService(service map[string]interface{}) error {
 		return errors.New("service must have (plugin) Name")
 	}
 
-	session, err := r.Connect(r.ConnectOpts{
-		Address: getRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
+	store := rethink.GetStore()
 
-	_, err = r.DB("Controller").Table("Plugins").Insert(service).RunWrite(session)
+	err := store.InsertPlugin(service)
 	if err != nil {
 		return err
 	}
@@ -204,92 +210,47 @@ func advertiseStartupService(service map[string]interface{}) error {
 	}
 
 	if len(service["ExternalPorts"].([]string)) > 0 {
-		var (
-			doc    = make(map[string]interface{})
-			filter = map[string]string{
-				"NodeHostName": leader,
-			}
-			newTCP []string
-			newUDP []string
-		)
-
-		res, err := r.DB("Controller").Table("Ports").Filter(filter).Run(session)
+		nodes, err := store.ListPorts()
 		if err != nil {
 			return err
 		}
 
-		if res.Next(&doc) {
-			for _, tcpPort := range doc["TCPPorts"].([]interface{}) {
-				newTCP = append(newTCP, tcpPort.(string))
-			}
-			for _, udpPort := range doc["UDPPorts"].([]interface{}) {
-				newUDP = append(newUDP, udpPort.(string))
+		var address string
+		for _, doc := range nodes {
+			if doc["NodeHostName"] == leader {
+				address = doc["Interface"].(string)
+				break
 			}
+		}
+		if address == "" {
+			return errors.New("leader port entry not found")
+		}
 
-			for _, port := range service["ExternalPorts"].([]string) {
-				split := strings.Split(port, "/")
-				if split[1] == "tcp" {
-					newTCP = append(newTCP, split[0])
-				} else if split[1] == "udp" {
-					newUDP = append(newUDP, split[0])
-				} else {
-					return fmt.Errorf("port %v not set to tcp or udp", port)
-				}
+		for _, port := range service["ExternalPorts"].([]string) {
+			split := strings.Split(port, "/")
+			if split[1] != "tcp" && split[1] != "udp" {
+				return fmt.Errorf("port %v not set to tcp or udp", port)
 			}
-
-			doc["TCPPorts"] = newTCP
-			doc["UDPPorts"] = newUDP
-
-			_, err := r.DB("Controller").Table("Ports").Get(doc["id"]).Update(doc).RunWrite(session)
+			err = store.AddPort(address, split[0], swarm.PortConfigProtocol(split[1]))
 			if err != nil {
 				return err
 			}
-		} else {
-			return errors.New("leader port entry not found")
 		}
-
 	}
 	return nil
 }
 
-func checkForNode(name string) string {
-	var doc map[string]interface{}
-
-	session, err := r.Connect(r.ConnectOpts{
-		Address: getRethinkHost(),
-	})
-	if err != nil {
-		return ""
-	}
-
-	cursor, err := r.DB("Controller").Table("Ports").Run(session)
-	for cursor.Next(&doc) {
-		if doc["NodeHostName"].(string) == name {
-			return doc["id"].(string)
-		}
-	}
-	return ""
-}
-
 func advertiseIPs(entries []map[string]interface{}) error {
+	var err error
 
 	if len(entries) < 1 {
 		return errors.New("no nodes to advertise")
 	}
 
-	session, err := r.Connect(r.ConnectOpts{
-		Address: getRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
+	store := rethink.GetStore()
 
 	for _, e := range entries {
-		if resID := checkForNode(e["NodeHostName"].(string)); resID == "" {
-			_, err = r.DB("Controller").Table("Ports").Insert(e).RunWrite(session)
-		} else {
-			_, err = r.DB("Controller").Table("Ports").Get(resID).Update(e).RunWrite(session)
-		}
+		err = store.UpsertNode(e)
 	}
 
 	return err
@@ -312,8 +273,9 @@ func NodeAdvertise() error {
 	return err
 }
 
-// PluginAdvertise reads manifest.json and
-// populates the database with proper plugin entries
+// PluginAdvertise reads manifest.json (and the fragments
+// in MANIFEST_DIR) and populates the database with
+// proper plugin entries
 func PluginAdvertise() error {
 
 	// Read the manifest
@@ -471,7 +471,7 @@ func Test_advertisePlugins(t *testing.T) {
 					"Interface":     "",
 					"ExternalPorts": []string{},
 					"InternalPorts": []string{},
-					"OS":            string(rethink.PluginOSAll),
+					"OS":            string(rethink.PluginOSPosix),
 					"Environment":   []string{},
 					"Extra":         true,
 				},
@@ -732,3 +732,72 @@ func Test_getLeaderHostname(t *testing.T) {
 		})
 	}
 }
+
+func Test_ManifestPlugin_entry(t *testing.T) {
+	var plugins []ManifestPlugin
+	err := json.Unmarshal([]byte(`[
+		{"Name": "Basic", "OS": "posix"},
+		{
+			"Name": "ThirdParty",
+			"OS": "posix",
+			"Description": "Ships its own image",
+			"Image": "example/plugin",
+			"Digest": "sha256:abc",
+			"ExternalPorts": ["8080/tcp"],
+			"InternalPorts": ["80/tcp"],
+			"Environment": ["MODE=fast"],
+			"Resources": {"CPUs": 1, "MemoryMB": 512},
+			"Healthcheck": {"Test": ["CMD", "true"], "Retries": 2}
+		}
+	]`), &plugins)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"Name":          "Basic",
+		"ServiceID":     "",
+		"ServiceName":   "",
+		"DesiredState":  "",
+		"State":         "Available",
+		"Interface":     "",
+		"ExternalPorts": []string{},
+		"InternalPorts": []string{},
+		"OS":            string(rethink.PluginOSPosix),
+		"Environment":   []string{},
+		"Extra":         false,
+	}, plugins[0].entry())
+
+	assert.Equal(t, map[string]interface{}{
+		"Name":          "ThirdParty",
+		"ServiceID":     "",
+		"ServiceName":   "",
+		"DesiredState":  "",
+		"State":         "Available",
+		"Interface":     "",
+		"ExternalPorts": []string{"8080/tcp"},
+		"InternalPorts": []string{"80/tcp"},
+		"OS":            string(rethink.PluginOSPosix),
+		"Environment":   []string{"MODE=fast"},
+		"Extra":         false,
+		"Description":   "Ships its own image",
+		"Image":         "example/plugin",
+		"Digest":        "sha256:abc",
+		"Resources":     &rethink.PluginResources{CPUs: 1, MemoryMB: 512},
+		"Healthcheck":   &rethink.PluginHealthcheck{Test: []string{"CMD", "true"}, Retries: 2},
+	}, plugins[1].entry())
+
+	// The row parses back into the same plugin settings
+	entry := plugins[1].entry()
+	entry["ServiceName"] = "ThirdPartyService"
+	m := rethink.NewMemoryStore()
+	assert.Nil(t, m.InsertPlugin(entry))
+	doc, err := m.GetPluginByServiceName("ThirdPartyService")
+	assert.Nil(t, err)
+	plugin, err := rethink.ParsePlugin(doc)
+	assert.Nil(t, err)
+	config, err := pluginToConfig(*plugin)
+	assert.Nil(t, err)
+	assert.Equal(t, "example/plugin", config.Image)
+	assert.Equal(t, "sha256:abc", config.Digest)
+	assert.Equal(t, &rethink.PluginResources{CPUs: 1, MemoryMB: 512}, config.Resources)
+	assert.Equal(t, []string{"CMD", "true"}, config.Healthcheck.Test)
+}
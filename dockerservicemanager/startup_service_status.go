@@ -9,9 +9,7 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
 	"github.com/ramrod-project/backend-controller-go/rethink"
-	r "gopkg.in/gorethink/gorethink.v4"
 )
 
 func concatPort(port uint32, proto swarm.PortConfigProtocol) string {
@@ -80,19 +78,17 @@ func serviceToEntry(svc swarm.Service) (map[string]interface{}, error) {
 // in the database
 func StartupServiceStatus() error {
 	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 	if err != nil {
 		return err
 	}
 
-	session, err := r.Connect(r.ConnectOpts{
-		Address: getRethinkHost(),
-	})
+	store := rethink.GetStore()
+
+	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{})
 	if err != nil {
 		return err
 	}
-
-	services, err := dockerClient.ServiceList(ctx, types.ServiceListOptions{})
 	// Check current services to see if already running
 	for _, s := range services {
 		// If part of stack, ignore
@@ -100,35 +96,25 @@ func StartupServiceStatus() error {
 			continue
 		}
 		// Otherwise, check db and add/update as necessary
-		cursor, err := r.DB("Controller").Table("Plugins").Filter(map[string]string{"ServiceName": s.Spec.Annotations.Name}).Run(session)
+		current, err := store.GetPluginByServiceName(s.Spec.Annotations.Name)
 		if err != nil {
 			return err
 		}
 		// Get current ID from db if it exists
 		// If exists, update, otherwise create
-		var (
-			doc       map[string]interface{}
-			id        string
-			operation r.Term
-		)
-		if cursor.Next(&doc) {
+		doc, err := serviceToEntry(s)
+		if err != nil {
+			return err
+		}
+		if current != nil {
 			// Update entry
-			id = doc["id"].(string)
-			doc, err = serviceToEntry(s)
-			if err != nil {
-				return err
-			}
+			id := current["id"].(string)
 			doc["id"] = id
-			operation = r.DB("Controller").Table("Plugins").Get(id).Update(doc)
+			err = store.UpdatePlugin(id, doc)
 		} else {
 			// Create entry
-			doc, err = serviceToEntry(s)
-			if err != nil {
-				return err
-			}
-			operation = r.DB("Controller").Table("Plugins").Insert(doc)
+			err = store.InsertPlugin(doc)
 		}
-		_, err = operation.Run(session)
 		if err != nil {
 			return err
 		}
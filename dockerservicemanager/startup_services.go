@@ -8,7 +8,6 @@ import (
 	"github.com/docker/docker/api/types"
 	mount "github.com/docker/docker/api/types/mount"
 	swarm "github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
 
 	"github.com/ramrod-project/backend-controller-go/rethink"
 )
@@ -21,7 +20,6 @@ var harnessConfig = PluginServiceConfig{
 		envString("PLUGIN", "Harness"),
 		envString("PLUGIN_NAME", "Harness-5000tcp"),
 	},
-	Address: GetManagerIP(),
 	Network: "pcp",
 	OS:      rethink.PluginOSAll,
 	Ports: []swarm.PortConfig{
@@ -33,6 +31,7 @@ var harnessConfig = PluginServiceConfig{
 		},
 	},
 	ServiceName: "Harness-5000tcp",
+	Startup:     true,
 }
 
 var auxConfig = PluginServiceConfig{
@@ -41,10 +40,10 @@ var auxConfig = PluginServiceConfig{
 		getEnvByKey("LOGLEVEL"),
 		getEnvByKey("TAG"),
 	},
-	Address:     GetManagerIP(),
 	Network:     "pcp",
 	OS:          rethink.PluginOSAll,
 	ServiceName: "AuxiliaryServices",
+	Startup:     true,
 	Volumes: []mount.Mount{
 		mount.Mount{
 			Type:   mount.TypeBind,
@@ -56,7 +55,7 @@ var auxConfig = PluginServiceConfig{
 
 func checkService(service string) bool {
 	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+	dockerClient, err := getOrchestrator()
 
 	if err != nil {
 		return false
@@ -77,8 +76,18 @@ func checkService(service string) bool {
 // and AUX_START environment variables are set to YES.
 func StartupServices() error {
 
+	// The manager address is looked up here rather than
+	// at package init so that importing this package
+	// doesn't require a reachable swarm.
+	managerIP, err := GetManagerIP()
+	if err != nil {
+		return err
+	}
+	harnessConfig.Address = managerIP
+	auxConfig.Address = managerIP
+
 	if os.Getenv("START_HARNESS") == "YES" && !checkService(harnessConfig.ServiceName) {
-		res, err := CreatePluginService(&harnessConfig)
+		res, err := CreatePluginService(context.Background(), &harnessConfig)
 		if err != nil {
 			return err
 		}
@@ -88,7 +97,7 @@ func StartupServices() error {
 			"ServiceName":   harnessConfig.ServiceName,
 			"DesiredState":  "",
 			"State":         "Active",
-			"Interface":     GetManagerIP(),
+			"Interface":     managerIP,
 			"ExternalPorts": []string{"5000/tcp"},
 			"InternalPorts": []string{"5000/tcp"},
 			"OS":            string(rethink.PluginOSAll),
@@ -100,7 +109,7 @@ func StartupServices() error {
 	}
 
 	if os.Getenv("START_AUX") == "YES" && !checkService(auxConfig.ServiceName) {
-		res, err := CreatePluginService(&auxConfig)
+		res, err := CreatePluginService(context.Background(), &auxConfig)
 		if err != nil {
 			return err
 		}
@@ -110,7 +119,7 @@ func StartupServices() error {
 			"ServiceName":   auxConfig.ServiceName,
 			"DesiredState":  "",
 			"State":         "Active",
-			"Interface":     GetManagerIP(),
+			"Interface":     managerIP,
 			"ExternalPorts": []string{"20/tcp", "21/tcp", "80/tcp", "53/udp"},
 			"InternalPorts": []string{"20/tcp", "21/tcp", "80/tcp", "53/udp"},
 			"OS":            string(rethink.PluginOSPosix),
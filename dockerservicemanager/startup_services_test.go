@@ -26,6 +26,7 @@ var testServiceSpec = swarm.ServiceSpec{
 			DNSConfig: &swarm.DNSConfig{},
 			Image:     "alpine:3.7",
 			Command:   []string{"sleep", "30"},
+			Labels:    map[string]string{PluginLabel: "TestService"},
 		},
 		RestartPolicy: &swarm.RestartPolicy{
 			Condition: "on-failure",
@@ -135,7 +136,7 @@ func Test_StartupServices(t *testing.T) {
 
 	_, err = r.DB("Controller").Table("Ports").Insert(
 		map[string]interface{}{
-			"Interface":    GetManagerIP(),
+			"Interface":    managerIP(t),
 			"NodeHostName": leader,
 			"OS":           "posix",
 			"TCPPorts":     []string{},
@@ -281,7 +282,7 @@ func Test_StartupServices(t *testing.T) {
 							return false
 						case d := <-changeChan:
 							if _, ok := d["Interface"]; ok {
-								if d["Interface"].(string) != GetManagerIP() {
+								if d["Interface"].(string) != managerIP(t) {
 									break
 								}
 							}
@@ -12,10 +12,10 @@ import (
 
 	"github.com/docker/docker/api/types"
 	swarm "github.com/docker/docker/api/types/swarm"
-	client "github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/orchestrator"
 )
 
-func checkReady(ctx context.Context, dockerClient *client.Client, serviceID string) (uint64, error) {
+func checkReady(ctx context.Context, dockerClient orchestrator.Orchestrator, serviceID string) (uint64, error) {
 
 	start := time.Now()
 	for {
@@ -26,14 +26,28 @@ func checkReady(ctx context.Context, dockerClient *client.Client, serviceID stri
 		if err != nil {
 			return 0, err
 		}
-		if inspectResults.UpdateStatus.State != swarm.UpdateStateUpdating {
+		if !rollingOut(&inspectResults) {
 			return inspectResults.Version.Index, nil
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
 	return 0, fmt.Errorf("timeout: service %v still updating", serviceID)
 }
 
+// rollingOut returns whether a service is
+// part way through an update or its rollback.
+func rollingOut(svc *swarm.Service) bool {
+	switch svc.UpdateStatus.State {
+	case swarm.UpdateStateUpdating, orchestrator.UpdateStateRollbackStarted:
+		return true
+	}
+	return false
+}
+
 func containsPort(port *swarm.PortConfig, comparePorts *[]swarm.PortConfig) bool {
 	for _, cP := range *comparePorts {
 		if reflect.DeepEqual(*port, cP) {
@@ -43,50 +57,100 @@ func containsPort(port *swarm.PortConfig, comparePorts *[]swarm.PortConfig) bool
 	return false
 }
 
+// ScalePluginService sets the number of tasks a replicated
+// plugin service runs, leaving the rest of its spec alone.
+// Scaling to 0 keeps the service, and its ports, with no
+// tasks running.
+func ScalePluginService(ctx context.Context, serviceID string, replicas uint64) error {
+	dockerClient, err := getOrchestrator()
+	if err != nil {
+		return err
+	}
+
+	version, err := checkReady(ctx, dockerClient, serviceID)
+	if err != nil {
+		return err
+	}
+	serv, _, err := dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		return err
+	}
+	if serv.Spec.Mode.Replicated == nil {
+		return fmt.Errorf("cannot scale global service %v", serv.Spec.Annotations.Name)
+	}
+	serv.Spec.Mode.Replicated.Replicas = &replicas
+	_, err = dockerClient.ServiceUpdate(ctx, serviceID, swarm.Version{Index: version}, serv.Spec, types.ServiceUpdateOptions{})
+	return err
+}
+
 // UpdatePluginService updates a given service by ID string
 // and given a valid PluginServiceConfig. It will attempt
 // to update the service and relaunch it.
-func UpdatePluginService(serviceID string, config *PluginServiceConfig) (types.ServiceUpdateResponse, error) {
-	ctx := context.Background()
-	dockerClient, err := client.NewEnvClient()
+func UpdatePluginService(ctx context.Context, serviceID string, config *PluginServiceConfig) (types.ServiceUpdateResponse, error) {
+	dockerClient, err := getOrchestrator()
 
 	if err != nil {
 		return types.ServiceUpdateResponse{}, err
 	}
 
-	serviceSpec, err := generateServiceSpec(config)
+	version, err := checkReady(ctx, dockerClient, serviceID)
 	if err != nil {
 		return types.ServiceUpdateResponse{}, err
 	}
 
-	version, err := checkReady(ctx, dockerClient, serviceID)
+	serv, _, err := dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+
+	// The service's own ports aren't conflicts
+	var owned []swarm.PortConfig
+	if serv.Spec.EndpointSpec != nil {
+		owned = serv.Spec.EndpointSpec.Ports
+	}
+	nodes, err := rethink.GetStore().ListPorts()
+	if err != nil {
+		return types.ServiceUpdateResponse{}, err
+	}
+	ownedAddresses := serviceAddresses(serv, nodes)
+	addresses, err := portAddresses(config)
+	if err != nil {
+		return types.ServiceUpdateResponse{}, err
+	}
+	config.Ports, err = allocatePorts(addresses, config.Ports, owned)
 	if err != nil {
 		return types.ServiceUpdateResponse{}, err
 	}
 
-	serv, _, err := dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	serviceSpec, err := generateServiceSpec(config)
 	if err != nil {
-		log.Printf("%v", err)
+		return types.ServiceUpdateResponse{}, err
 	}
 	resp, err := dockerClient.ServiceUpdate(ctx, serviceID, swarm.Version{Index: version}, *serviceSpec, types.ServiceUpdateOptions{})
 	if err != nil {
 		return resp, err
 	}
-	for _, port := range serv.Spec.EndpointSpec.Ports {
-		// if old port is not in new ports
-		if !containsPort(&port, &config.Ports) {
-			err = rethink.RemovePort(config.Address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
-			if err != nil {
-				log.Printf("%v", err)
+	for _, address := range ownedAddresses {
+		for _, port := range owned {
+			// if old port is not in new ports on the address
+			if !containsPort(&port, &config.Ports) || !rethink.Contains(addresses, address) {
+				err := rethink.RemovePort(address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
+				if err != nil {
+					log.Printf("%v", err)
+				}
 			}
 		}
 	}
-	for _, port := range config.Ports {
-		err = rethink.AddPort(config.Address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
-		if err != nil {
-			log.Printf("%v", err)
+	for _, address := range addresses {
+		for _, port := range config.Ports {
+			err := rethink.AddPort(address, strconv.FormatUint(uint64(port.PublishedPort), 10), port.Protocol)
+			if err != nil {
+				log.Printf("%v", err)
+			}
 		}
 	}
 
-	return resp, err
+	// The service is updated, and the reconciler
+	// fixes any port bookkeeping that failed
+	return resp, nil
 }
@@ -61,7 +61,7 @@ func TestUpdatePluginService(t *testing.T) {
 	}
 
 	testPort := map[string]interface{}{
-		"Interface":    GetManagerIP(),
+		"Interface":    managerIP(t),
 		"TCPPorts":     []string{},
 		"UDPPorts":     []string{},
 		"NodeHostName": "ubuntu",
@@ -91,7 +91,7 @@ func TestUpdatePluginService(t *testing.T) {
 					"LOGLEVEL=DEBUG",
 					"PORT=666",
 					"PLUGIN=Harness",
-					"RETHINK_HOST=" + GetManagerIP(),
+					"RETHINK_HOST=" + managerIP(t),
 				},
 				Healthcheck: &container.HealthConfig{
 					Interval: time.Second,
@@ -140,7 +140,7 @@ func TestUpdatePluginService(t *testing.T) {
 					"LOGLEVEL=DEBUG",
 					"PORT=667",
 					"PLUGIN=Harness",
-					"RETHINK_HOST=" + GetManagerIP(),
+					"RETHINK_HOST=" + managerIP(t),
 				},
 				Healthcheck: &container.HealthConfig{
 					Interval: time.Second,
@@ -223,7 +223,7 @@ func TestUpdatePluginService(t *testing.T) {
 						PublishMode:   swarm.PortConfigPublishModeHost,
 					}},
 					ServiceName: "GoodService",
-					Address:     GetManagerIP(),
+					Address:     managerIP(t),
 				},
 				id: id,
 			},
@@ -241,7 +241,7 @@ func TestUpdatePluginService(t *testing.T) {
 								"PORT=666",
 								"PLUGIN=Harness",
 								"PLUGIN_NAME=GoodService",
-								"RETHINK_HOST=" + GetManagerIP(),
+								"RETHINK_HOST=" + managerIP(t),
 								"TEST=TEST",
 							},
 						},
@@ -290,7 +290,7 @@ func TestUpdatePluginService(t *testing.T) {
 						PublishMode:   swarm.PortConfigPublishModeHost,
 					}},
 					ServiceName: "GoodServiceExtra",
-					Address:     GetManagerIP(),
+					Address:     managerIP(t),
 					Extra:       true,
 				},
 				id: extraID,
@@ -309,7 +309,7 @@ func TestUpdatePluginService(t *testing.T) {
 								"PORT=667",
 								"PLUGIN=Harness",
 								"PLUGIN_NAME=GoodServiceExtra",
-								"RETHINK_HOST=" + GetManagerIP(),
+								"RETHINK_HOST=" + managerIP(t),
 								"TEST=TEST",
 							},
 						},
@@ -357,7 +357,7 @@ func TestUpdatePluginService(t *testing.T) {
 						PublishMode:   swarm.PortConfigPublishModeIngress,
 					}},
 					ServiceName: "GoodService",
-					Address:     GetManagerIP(),
+					Address:     managerIP(t),
 				},
 				id: "",
 			},
@@ -386,7 +386,7 @@ func TestUpdatePluginService(t *testing.T) {
 						PublishMode:   swarm.PortConfigPublishModeIngress,
 					}},
 					ServiceName: "BadServiceUpdate",
-					Address:     GetManagerIP(),
+					Address:     managerIP(t),
 				},
 				id: id,
 			},
@@ -399,7 +399,7 @@ func TestUpdatePluginService(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			time.Sleep(time.Second)
-			got, err := UpdatePluginService(tt.args.id, tt.args.config)
+			got, err := UpdatePluginService(context.Background(), tt.args.id, tt.args.config)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UpdatePluginService() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -1 +1,139 @@
 package errorhandler
+
+import (
+	"fmt"
+)
+
+// Severity is how much an error matters
+// to the running controller.
+type Severity int
+
+const (
+	// SeverityInfo is expected and harmless, e.g.
+	// an event the controller doesn't act on.
+	SeverityInfo Severity = iota
+	// SeverityWarning is a transient failure the
+	// controller recovers from on its own.
+	SeverityWarning
+	// SeverityError is a failed operation, e.g. a
+	// plugin service that couldn't be created.
+	SeverityError
+	// SeverityFatal means the controller
+	// can't keep running.
+	SeverityFatal
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	case SeverityFatal:
+		return "fatal"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Component is the routine an error came from.
+type Component string
+
+const (
+	// ComponentPluginMonitor is rethink.MonitorPlugins.
+	ComponentPluginMonitor Component = "plugin_monitor"
+	// ComponentPluginHandler is
+	// dockerservicemanager.HandlePluginChanges.
+	ComponentPluginHandler Component = "plugin_handler"
+	// ComponentEventMonitor is
+	// dockerservicemanager.EventMonitor.
+	ComponentEventMonitor Component = "event_monitor"
+	// ComponentEventHandler is rethink.EventUpdate.
+	ComponentEventHandler Component = "event_handler"
+	// ComponentLogMonitor is
+	// dockerservicemanager.NewLogMonitor.
+	ComponentLogMonitor Component = "log_monitor"
+	// ComponentLogHandler is
+	// dockerservicemanager.NewLogHandler.
+	ComponentLogHandler Component = "log_handler"
+	// ComponentLogAggregator is rethink.AggregateLogs.
+	ComponentLogAggregator Component = "log_aggregator"
+	// ComponentReconciler is
+	// dockerservicemanager.ReconcilePlugins.
+	ComponentReconciler Component = "reconciler"
+	// ComponentManifest is
+	// dockerservicemanager.WatchManifest.
+	ComponentManifest Component = "manifest_watcher"
+	// ComponentStream is the api event stream.
+	ComponentStream Component = "stream"
+	// ComponentAPI is the HTTP API server.
+	ComponentAPI Component = "api"
+	// ComponentUnknown is for errors
+	// from an untagged channel.
+	ComponentUnknown Component = "unknown"
+)
+
+// Error is an error from one of the controller's
+// routines, with what it affected and how much
+// it matters.
+type Error struct {
+	Component   Component
+	Severity    Severity
+	Retryable   bool
+	ServiceName string
+	ServiceID   string
+	Err         error
+}
+
+// New returns an Error from a component.
+func New(component Component, severity Severity, err error) *Error {
+	return &Error{
+		Component: component,
+		Severity:  severity,
+		Err:       err,
+	}
+}
+
+// Transient returns a retryable warning, for
+// failures the component recovers from.
+func Transient(component Component, err error) *Error {
+	e := New(component, SeverityWarning, err)
+	e.Retryable = true
+	return e
+}
+
+// ForService sets the plugin service
+// affected by the error.
+func (e *Error) ForService(serviceName string, serviceID string) *Error {
+	e.ServiceName = serviceName
+	e.ServiceID = serviceID
+	return e
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.ServiceName != "":
+		return fmt.Sprintf("%v (%v): %v", e.Component, e.ServiceName, e.Err)
+	case e.ServiceID != "":
+		return fmt.Sprintf("%v (%v): %v", e.Component, e.ServiceID, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Component, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns err as an Error. Untyped errors are
+// taken to be failures of component.
+func Classify(component Component, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		if e.Component == "" {
+			e.Component = component
+		}
+		return e
+	}
+	return New(component, SeverityError, err)
+}
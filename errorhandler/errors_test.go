@@ -0,0 +1,69 @@
+package errorhandler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError_Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *Error
+		want string
+	}{
+		{
+			name: "Component",
+			err:  New(ComponentEventMonitor, SeverityWarning, errors.New("stream closed")),
+			want: "event_monitor: stream closed",
+		},
+		{
+			name: "Service name",
+			err:  New(ComponentPluginHandler, SeverityError, errors.New("no such image")).ForService("Harness-5000", "abc123"),
+			want: "plugin_handler (Harness-5000): no such image",
+		},
+		{
+			name: "Service ID",
+			err:  New(ComponentLogHandler, SeverityWarning, errors.New("nothing read")).ForService("", "abc123"),
+			want: "log_handler (abc123): nothing read",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.err.Error())
+		})
+	}
+}
+
+func TestTransient(t *testing.T) {
+	cause := errors.New("brain unavailable")
+	e := Transient(ComponentLogAggregator, cause)
+	assert.Equal(t, SeverityWarning, e.Severity)
+	assert.True(t, e.Retryable)
+	assert.Equal(t, cause, e.Unwrap())
+}
+
+func TestClassify(t *testing.T) {
+	untyped := errors.New("manifest.json: no plugins")
+	e := Classify(ComponentManifest, untyped)
+	assert.Equal(t, ComponentManifest, e.Component)
+	assert.Equal(t, SeverityError, e.Severity)
+	assert.False(t, e.Retryable)
+	assert.Equal(t, untyped, e.Err)
+
+	// Typed errors keep their component
+	typed := New(ComponentEventHandler, SeverityInfo, errors.New("unhandled container event: start"))
+	assert.Equal(t, typed, Classify(ComponentEventMonitor, typed))
+
+	blank := &Error{Severity: SeverityFatal, Err: errors.New("address in use")}
+	assert.Equal(t, ComponentAPI, Classify(ComponentAPI, blank).Component)
+}
+
+func TestSeverity_String(t *testing.T) {
+	assert.Equal(t, "info", SeverityInfo.String())
+	assert.Equal(t, "warning", SeverityWarning.String())
+	assert.Equal(t, "error", SeverityError.String())
+	assert.Equal(t, "fatal", SeverityFatal.String())
+	assert.Equal(t, "severity(9)", Severity(9).String())
+}
@@ -1,15 +1,75 @@
 package errorhandler
 
+import (
+	"log"
+	"sync"
+
+	"github.com/ramrod-project/backend-controller-go/metrics"
+)
+
+// ErrorHandler fans in any number of error channels.
+// The returned channel is closed once all of them are.
 func ErrorHandler(errorChans ...<-chan error) <-chan error {
+	var wg sync.WaitGroup
 	collector := make(chan error)
 
+	wg.Add(len(errorChans))
 	for _, errChan := range errorChans {
 		go func(c <-chan error) {
+			defer wg.Done()
 			for e := range c {
 				collector <- e
 			}
 		}(errChan)
 	}
 
+	go func() {
+		wg.Wait()
+		close(collector)
+	}()
+
 	return collector
 }
+
+// Tag passes on the errors from a component's channel
+// as Errors, classifying any that are untyped. The
+// returned channel is closed once errs is.
+func Tag(component Component, errs <-chan error) <-chan error {
+	out := make(chan error)
+
+	go func() {
+		defer close(out)
+		for err := range errs {
+			if err == nil {
+				continue
+			}
+			out <- Classify(component, err)
+		}
+	}()
+
+	return out
+}
+
+// Routes are the funcs that handle
+// errors of each severity.
+type Routes map[Severity]func(*Error)
+
+// Route handles every error from errs until it is
+// closed, counting them by component and severity. Each
+// is passed to the route for its severity, or logged
+// if it has none.
+func Route(errs <-chan error, routes Routes) {
+	for err := range errs {
+		if err == nil {
+			continue
+		}
+		e := Classify(ComponentUnknown, err)
+		metrics.Errors.Inc(string(e.Component), e.Severity.String())
+
+		if route, ok := routes[e.Severity]; ok {
+			route(e)
+			continue
+		}
+		log.Printf("%v: %v", e.Severity, e)
+	}
+}
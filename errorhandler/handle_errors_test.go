@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ramrod-project/backend-controller-go/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -71,6 +72,35 @@ func TestErrorHandler(t *testing.T) {
 				return true
 			},
 		},
+		{
+			name: "Closes when all channels close",
+			errorFuncs: []func(chan error){
+				func(errs chan error) {
+					errs <- errors.New("func 1 err")
+					close(errs)
+				},
+				func(errs chan error) {
+					time.Sleep(500 * time.Millisecond)
+					close(errs)
+				},
+			},
+			check: func(ctx context.Context, t *testing.T, errs <-chan error) bool {
+				count := 0
+				for {
+					select {
+					case <-ctx.Done():
+						return false
+					case e, ok := <-errs:
+						if !ok {
+							assert.Equal(t, 1, count)
+							return true
+						}
+						assert.Equal(t, errors.New("func 1 err"), e)
+						count++
+					}
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -87,3 +117,51 @@ func TestErrorHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestTag(t *testing.T) {
+	in := make(chan error)
+	go func() {
+		in <- errors.New("reconcile: no such service")
+		in <- nil
+		in <- New(ComponentEventHandler, SeverityInfo, errors.New("unhandled container event: start"))
+		close(in)
+	}()
+
+	var got []*Error
+	for err := range Tag(ComponentReconciler, in) {
+		got = append(got, err.(*Error))
+	}
+	assert.Len(t, got, 2)
+	assert.Equal(t, ComponentReconciler, got[0].Component)
+	assert.Equal(t, SeverityError, got[0].Severity)
+	assert.Equal(t, ComponentEventHandler, got[1].Component)
+	assert.Equal(t, SeverityInfo, got[1].Severity)
+}
+
+func TestRoute(t *testing.T) {
+	errs := make(chan error)
+	go func() {
+		errs <- New(ComponentAPI, SeverityFatal, errors.New("address in use"))
+		errs <- Transient(ComponentEventMonitor, errors.New("stream closed"))
+		errs <- Transient(ComponentEventMonitor, errors.New("stream closed"))
+		errs <- errors.New("untagged")
+		close(errs)
+	}()
+
+	before := metrics.Errors.Value("event_monitor", "warning")
+	var fatal, warnings []*Error
+	Route(errs, Routes{
+		SeverityFatal: func(e *Error) {
+			fatal = append(fatal, e)
+		},
+		SeverityWarning: func(e *Error) {
+			warnings = append(warnings, e)
+		},
+	})
+
+	assert.Len(t, fatal, 1)
+	assert.Equal(t, ComponentAPI, fatal[0].Component)
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, before+2, metrics.Errors.Value("event_monitor", "warning"))
+	assert.True(t, metrics.Errors.Value("unknown", "error") >= 1)
+}
@@ -0,0 +1,185 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckFunc returns an error if a part of the
+// controller isn't working.
+type CheckFunc func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Name     string
+	OK       bool
+	Error    string `json:",omitempty"`
+	Duration string
+}
+
+var (
+	checksLock sync.Mutex
+	checks     = make(map[string]CheckFunc)
+)
+
+// Register adds a check to those run by Run,
+// replacing any with the same name.
+func Register(name string, check CheckFunc) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	checks[name] = check
+}
+
+// Unregister removes a check.
+func Unregister(name string) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+
+	delete(checks, name)
+}
+
+// Run runs every check at once, returning whether
+// they all passed and their results by name. A check
+// still running when the context is done fails.
+func Run(ctx context.Context) (bool, []Result) {
+	checksLock.Lock()
+	names := make([]string, 0, len(checks))
+	funcs := make(map[string]CheckFunc, len(checks))
+	for name, check := range checks {
+		names = append(names, name)
+		funcs[name] = check
+	}
+	checksLock.Unlock()
+	sort.Strings(names)
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	wg.Add(len(names))
+	for i, name := range names {
+		go func(i int, name string) {
+			defer wg.Done()
+
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- funcs[name](ctx)
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = fmt.Errorf("check timed out: %v", ctx.Err())
+			}
+
+			results[i] = Result{
+				Name:     name,
+				OK:       err == nil,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, res := range results {
+		ok = ok && res.OK
+	}
+	return ok, results
+}
+
+// Status is the reported state of a routine,
+// made up of one or more named parts.
+type Status struct {
+	mu    sync.Mutex
+	parts map[string]error
+}
+
+// NewStatus returns a Status that fails
+// until a part is reported.
+func NewStatus() *Status {
+	return &Status{parts: make(map[string]error)}
+}
+
+// Set records whether a part is working
+// (err is nil) or not.
+func (s *Status) Set(part string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parts[part] = err
+}
+
+// Check is a CheckFunc failing if any part isn't working.
+func (s *Status) Check(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.parts) == 0 {
+		return errors.New("not started")
+	}
+
+	var failed []string
+	for part, err := range s.parts {
+		if err == nil {
+			continue
+		}
+		if part == "" {
+			failed = append(failed, err.Error())
+		} else {
+			failed = append(failed, fmt.Sprintf("%v: %v", part, err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return errors.New(strings.Join(failed, "; "))
+}
+
+// Heartbeat tracks a loop that should run
+// at least every maxAge.
+type Heartbeat struct {
+	maxAge time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewHeartbeat returns a Heartbeat that fails until
+// Beat is called, and when Beat hasn't been called
+// for maxAge.
+func NewHeartbeat(maxAge time.Duration) *Heartbeat {
+	return &Heartbeat{maxAge: maxAge}
+}
+
+// Beat records that the loop is running.
+func (h *Heartbeat) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.last = time.Now()
+}
+
+// Check is a CheckFunc failing if the last
+// Beat was too long ago.
+func (h *Heartbeat) Check(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.last.IsZero() {
+		return errors.New("not started")
+	}
+	if age := time.Since(h.last); age > h.maxAge {
+		return fmt.Errorf("last ran %v ago", age.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	Register("up", func(ctx context.Context) error { return nil })
+	Register("down", func(ctx context.Context) error { return errors.New("unreachable") })
+	Register("stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	defer func() {
+		Unregister("up")
+		Unregister("down")
+		Unregister("stuck")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	ok, results := Run(ctx)
+	assert.False(t, ok)
+	assert.Len(t, results, 3)
+
+	// Sorted by name
+	assert.Equal(t, "down", results[0].Name)
+	assert.False(t, results[0].OK)
+	assert.Equal(t, "unreachable", results[0].Error)
+	assert.Equal(t, "stuck", results[1].Name)
+	assert.False(t, results[1].OK)
+	assert.Contains(t, results[1].Error, "timed out")
+	assert.Equal(t, "up", results[2].Name)
+	assert.True(t, results[2].OK)
+	assert.Empty(t, results[2].Error)
+
+	Unregister("down")
+	Unregister("stuck")
+	ok, results = Run(context.Background())
+	assert.True(t, ok)
+	assert.Len(t, results, 1)
+}
+
+func TestStatus_Check(t *testing.T) {
+	s := NewStatus()
+	assert.EqualError(t, s.Check(context.Background()), "not started")
+
+	s.Set("container", nil)
+	s.Set("service", nil)
+	assert.Nil(t, s.Check(context.Background()))
+
+	s.Set("service", errors.New("stream closed"))
+	s.Set("container", errors.New("stream closed"))
+	assert.EqualError(t, s.Check(context.Background()), "container: stream closed; service: stream closed")
+
+	s.Set("container", nil)
+	s.Set("service", nil)
+	assert.Nil(t, s.Check(context.Background()))
+
+	u := NewStatus()
+	u.Set("", errors.New("stopped"))
+	assert.EqualError(t, u.Check(context.Background()), "stopped")
+}
+
+func TestHeartbeat_Check(t *testing.T) {
+	h := NewHeartbeat(50 * time.Millisecond)
+	assert.EqualError(t, h.Check(context.Background()), "not started")
+
+	h.Beat()
+	assert.Nil(t, h.Check(context.Background()))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, h.Check(context.Background()).Error(), "last ran")
+
+	h.Beat()
+	assert.Nil(t, h.Check(context.Background()))
+}
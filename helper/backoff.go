@@ -0,0 +1,42 @@
+package helper
+
+import "time"
+
+// Backoff returns exponentially increasing delays
+// for retrying an operation, capped at Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+
+	current time.Duration
+}
+
+// NewBackoff returns a Backoff starting at initial
+// and doubling up to max.
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{
+		Initial: initial,
+		Max:     max,
+		Factor:  2,
+	}
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Initial
+		return b.current
+	}
+	b.current = time.Duration(float64(b.current) * b.Factor)
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return b.current
+}
+
+// Reset starts the delays over from Initial,
+// after an operation has succeeded.
+func (b *Backoff) Reset() {
+	b.current = 0
+}
@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/ramrod-project/backend-controller-go/api"
 	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
 	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/health"
+	"github.com/ramrod-project/backend-controller-go/metrics"
 	"github.com/ramrod-project/backend-controller-go/rethink"
 	r "gopkg.in/gorethink/gorethink.v4"
 )
 
-func checkDB(timeout time.Duration) bool { // pragma: no cover
+func checkDB(sessions *rethink.SessionManager, timeout time.Duration) bool { // pragma: no cover
 	// Verify db connection
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -28,13 +36,11 @@ func checkDB(timeout time.Duration) bool { // pragma: no cover
 				default:
 					break
 				}
-				session, err := r.Connect(r.ConnectOpts{
-					Address: rethink.GetRethinkHost(),
-					Timeout: 3 * time.Second,
-				})
+				session, err := sessions.Session()
 				if err == nil {
-					_, err := r.DB("Controller").Table("Plugins").Run(session)
+					cursor, err := r.DB("Controller").Table("Plugins").Run(session)
 					if err == nil {
+						cursor.Close()
 						con <- struct{}{}
 						close(con)
 						return
@@ -54,14 +60,124 @@ func checkDB(timeout time.Duration) bool { // pragma: no cover
 	}
 }
 
-func main() { // pragma: no cover
+// reconcileInterval returns RECONCILE_INTERVAL
+// (e.g. "1m"), or 30 seconds if it is not set.
+func reconcileInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL"))
+	if err != nil || d <= 0 {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// manifestInterval returns MANIFEST_INTERVAL
+// (e.g. "30s"), or 10 seconds if it is not set.
+func manifestInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("MANIFEST_INTERVAL"))
+	if err != nil || d <= 0 {
+		return 10 * time.Second
+	}
+	return d
+}
+
+// apiAddr returns API_ADDR (e.g. ":9000"),
+// or ":8080" if it is not set.
+func apiAddr() string {
+	if addr := os.Getenv("API_ADDR"); addr != "" {
+		return addr
+	}
+	return ":8080"
+}
+
+// streamHistory returns STREAM_HISTORY, the number of
+// events kept for replay, or 100 if it is not set.
+func streamHistory() int {
+	n, err := strconv.Atoi(os.Getenv("STREAM_HISTORY"))
+	if err != nil || n < 0 {
+		return 100
+	}
+	return n
+}
+
+// shutdownTimeout returns SHUTDOWN_TIMEOUT (e.g. "30s"),
+// or 20 seconds if it is not set.
+func shutdownTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || d <= 0 {
+		return 20 * time.Second
+	}
+	return d
+}
+
+// registerHealthChecks adds the checks run by /readyz.
+func registerHealthChecks(sessions *rethink.SessionManager) { // pragma: no cover
+	health.Register("rethinkdb", func(ctx context.Context) error {
+		if err := sessions.LastError(); err != nil {
+			return err
+		}
+		if !sessions.Healthy() {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+	health.Register("docker", dockerservicemanager.PingOrchestrator)
+	health.Register("plugin_changefeed", rethink.PluginFeedHealth.Check)
+	health.Register("docker_events", dockerservicemanager.EventStreamHealth.Check)
+	health.Register("log_aggregator", rethink.LogAggregatorHealth.Check)
+}
+
+// cancelOnSignal cancels the root context on SIGINT or
+// SIGTERM, and exits if shutdown takes longer than timeout.
+func cancelOnSignal(cancel context.CancelFunc, timeout time.Duration) { // pragma: no cover
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, shutting down...", sig)
+		cancel()
+		time.AfterFunc(timeout, func() {
+			log.Fatalf("fatal: %v", errors.New("shutdown timed out, exiting"))
+		})
+	}()
+}
+
+// runCommand runs the controller ("controller run"),
+// until SIGINT or SIGTERM.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	fs := newFlagSet("run", "controller run", stderr)
+	if _, err := parseArgs(fs, args); err != nil {
+		return 2
+	}
+
+	// Share one pooled, reconnecting session to the
+	// brain across the whole controller.
+	sessions := rethink.NewSessionManager(rethink.DefaultConnectOpts())
+	defer sessions.Close()
+	rethink.SetSessionManager(sessions)
+	rethink.SetStore(rethink.NewRethinkStore(sessions))
+
 	// Check the connection to the database before
 	// doing anything.
-	if !checkDB(10 * time.Second) {
+	if !checkDB(sessions, 10*time.Second) {
 		log.Fatalf("fatal: %v", errors.New("database connection attempt timed out, exiting"))
 	}
 
-	ctx := context.Background()
+	// Failed plugin actions are kept in Controller.Errors,
+	// and where the docker event streams are up to in
+	// Controller.Checkpoints
+	if err := rethink.CreateErrorsTable(sessions); err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+	if err := rethink.CreateCheckpointsTable(sessions); err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+
+	// Every routine stops when the root context is
+	// cancelled by SIGINT or SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnSignal(cancel, shutdownTimeout())
 
 	// Start log monitor, handler, and aggregator
 	logMonitor, logMonErrs := dockerservicemanager.NewLogMonitor(ctx)
@@ -96,33 +212,95 @@ func main() { // pragma: no cover
 	log.Printf("success: advertisement complete without errors...")
 
 	// Start the event monitor
-	eventData, eventErr := dockerservicemanager.EventMonitor()
+	eventData, eventErr := dockerservicemanager.EventMonitor(ctx)
 
 	log.Printf("success: event monitor started...")
 
 	// Start event handler
-	eventDBErr := rethink.EventUpdate(eventData)
+	eventDBErr := rethink.EventUpdate(ctx, eventData)
 
 	log.Printf("success: event handler started...")
 
 	// Start the plugin database change monitor
-	pluginData, pluginErr := rethink.MonitorPlugins()
+	pluginData, pluginErr := rethink.MonitorPlugins(ctx)
 
 	log.Printf("success: plugin monitor started...")
 
 	// Start the plugin action handler
-	actionErr := dockerservicemanager.HandlePluginChanges(pluginData)
+	actionErr := dockerservicemanager.HandlePluginChanges(ctx, pluginData)
 
 	log.Printf("success: plugin handler started...")
 
-	// Monitor all errors in the main loop
+	// Periodically fix anything the handlers missed
+	reconcileErr := dockerservicemanager.ReconcilePlugins(ctx, reconcileInterval())
+
+	log.Printf("success: reconciler started...")
+
+	// Re-advertise plugins when the manifest changes
+	manifestErr := dockerservicemanager.WatchManifest(ctx, manifestInterval())
+
+	log.Printf("success: manifest watcher started...")
+
+	// Count used ports whenever metrics are scraped
+	metrics.OnCollect(rethink.CollectPortMetrics)
+
+	// Stream plugin, node and log events
+	broker := api.NewBroker(streamHistory())
+	streamErr := broker.Follow(ctx, 5*time.Second)
+
+	// Report readiness on /readyz
+	registerHealthChecks(sessions)
+
+	// Serve the HTTP API
+	apiErr := api.Serve(ctx, apiAddr(), api.NewHandler(broker))
+
+	log.Printf("success: api started...")
+
+	// Monitor all errors in the main loop, tagged
+	// with the routine they came from
 	errChan := errorhandler.ErrorHandler(
-		pluginErr, actionErr, eventErr, eventDBErr, logMonErrs, logChanErrs, logAggErrs,
+		errorhandler.Tag(errorhandler.ComponentPluginMonitor, pluginErr),
+		errorhandler.Tag(errorhandler.ComponentPluginHandler, actionErr),
+		errorhandler.Tag(errorhandler.ComponentEventMonitor, eventErr),
+		errorhandler.Tag(errorhandler.ComponentEventHandler, eventDBErr),
+		errorhandler.Tag(errorhandler.ComponentLogMonitor, logMonErrs),
+		errorhandler.Tag(errorhandler.ComponentLogHandler, logChanErrs),
+		errorhandler.Tag(errorhandler.ComponentLogAggregator, logAggErrs),
+		errorhandler.Tag(errorhandler.ComponentReconciler, reconcileErr),
+		errorhandler.Tag(errorhandler.ComponentManifest, manifestErr),
+		errorhandler.Tag(errorhandler.ComponentStream, streamErr),
+		errorhandler.Tag(errorhandler.ComponentAPI, apiErr),
 	)
 
-	for err := range errChan {
-		if err != nil {
-			log.Printf("error: %v\n", err)
-		}
+	// The error channel closes once every routine
+	// has finished, after which the session is closed.
+	// A fatal error shuts the controller down, for
+	// swarm to restart it.
+	exitCode := 0
+	errorhandler.Route(errChan, errorhandler.Routes{
+		errorhandler.SeverityFatal: func(e *errorhandler.Error) {
+			log.Printf("fatal: %v, shutting down...", e)
+			exitCode = 1
+			cancel()
+		},
+	})
+
+	log.Printf("success: shutdown complete")
+	return exitCode
+}
+
+func main() { // pragma: no cover
+	// With no subcommand the controller runs, as
+	// it did before there were subcommands.
+	args := os.Args[1:]
+	if len(args) < 1 {
+		args = []string{"run"}
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		os.Exit(2)
 	}
+	os.Exit(cmd(args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ramrod-project/backend-controller-go/dockerservicemanager"
+)
+
+const manifestUsage = `usage:
+  controller manifest validate <file>...
+  controller manifest schema`
+
+// manifestCommand runs "controller manifest ...",
+// returning the exit code.
+func manifestCommand(args []string, stdout io.Writer, stderr io.Writer) int { // pragma: no cover
+	if len(args) < 1 {
+		fmt.Fprintln(stderr, manifestUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "validate":
+		if len(args) < 2 {
+			fmt.Fprintln(stderr, manifestUsage)
+			return 2
+		}
+		code := 0
+		for _, file := range args[1:] {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				code = 1
+				continue
+			}
+			errs := dockerservicemanager.ValidateManifest(content)
+			for _, e := range errs {
+				fmt.Fprintf(stderr, "%v:%v\n", file, e)
+			}
+			if len(errs) > 0 {
+				code = 1
+				continue
+			}
+			fmt.Fprintf(stdout, "%v: ok\n", file)
+		}
+		return code
+	case "schema":
+		schema, err := dockerservicemanager.ManifestSchema()
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s\n", schema)
+		return 0
+	}
+
+	fmt.Fprintln(stderr, manifestUsage)
+	return 2
+}
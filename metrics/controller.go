@@ -0,0 +1,75 @@
+package metrics
+
+// The controller's metrics, served at /metrics.
+var (
+	// PluginActions counts the DesiredStates seen by the
+	// plugin handler, by outcome ("ok" or "error" if acted
+	// on, "queued" or "skipped" if not).
+	PluginActions = NewCounterVec(
+		"controller_plugin_actions_total",
+		"Plugin DesiredStates seen, by desired state and outcome.",
+		"desired_state", "outcome",
+	)
+	// ServiceOperationSeconds is how long service creates,
+	// updates, scales, pauses, resumes, upgrades and removes
+	// take, by outcome.
+	ServiceOperationSeconds = NewHistogramVec(
+		"controller_service_operation_seconds",
+		"Time taken to create, update, scale, pause, resume, upgrade or remove a plugin service.",
+		DefaultBuckets,
+		"operation", "outcome",
+	)
+	// DockerEvents counts the docker events
+	// processed by EventUpdate.
+	DockerEvents = NewCounterVec(
+		"controller_docker_events_total",
+		"Docker events processed, by type and action.",
+		"type", "action",
+	)
+	// EventUpdateFailures counts the docker events
+	// EventUpdate couldn't apply to the Plugins table.
+	EventUpdateFailures = NewCounterVec(
+		"controller_event_update_failures_total",
+		"Docker events that failed to update the Plugins table.",
+	)
+	// LogLinesIngested counts the log lines read
+	// from plugin services.
+	LogLinesIngested = NewCounterVec(
+		"controller_log_lines_ingested_total",
+		"Log lines read from plugin services, by service.",
+		"service",
+	)
+	// LogLinesInserted counts the log lines
+	// written to Brain.Logs.
+	LogLinesInserted = NewCounterVec(
+		"controller_log_lines_inserted_total",
+		"Log lines written to Brain.Logs, by service.",
+		"service",
+	)
+	// LogQueueDepth is how many log lines are waiting
+	// to be written by AggregateLogs.
+	LogQueueDepth = NewGaugeVec(
+		"controller_log_queue_depth",
+		"Log lines waiting to be written to Brain.Logs.",
+	)
+	// RethinkReconnects counts reconnections
+	// to the brain after the connection was lost.
+	RethinkReconnects = NewCounterVec(
+		"controller_rethink_reconnects_total",
+		"Reconnections to the brain after losing the connection.",
+	)
+	// Errors counts the errors reported by the
+	// controller's routines, by component and severity.
+	Errors = NewCounterVec(
+		"controller_errors_total",
+		"Errors reported by the controller, by component and severity.",
+		"component", "severity",
+	)
+	// PortsUsed is how many ports are marked as
+	// used in the Ports table, by node and protocol.
+	PortsUsed = NewGaugeVec(
+		"controller_ports_used",
+		"Ports marked as used in the Ports table, by node and protocol.",
+		"interface", "protocol",
+	)
+)
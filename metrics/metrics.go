@@ -0,0 +1,345 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram bucket upper
+// bounds, in seconds.
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	registryLock sync.Mutex
+	registry     []family
+	collectors   []func()
+)
+
+// family is a metric with all of its label values,
+// written in the Prometheus text format.
+type family interface {
+	name() string
+	write(w io.Writer)
+}
+
+func register(f family) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	registry = append(registry, f)
+}
+
+// OnCollect adds a func that is run before the metrics
+// are written, to update gauges that are read on demand.
+func OnCollect(f func()) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	collectors = append(collectors, f)
+}
+
+// WriteTo writes every metric in the Prometheus
+// text exposition format, sorted by name.
+func WriteTo(w io.Writer) {
+	registryLock.Lock()
+	funcs := append([]func(){}, collectors...)
+	families := append([]family{}, registry...)
+	registryLock.Unlock()
+
+	for _, f := range funcs {
+		f()
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name() < families[j].name()
+	})
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// Handler serves the metrics for Prometheus to scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats label names and values as
+// {a="x",b="y"}, with extra appended unescaped.
+func labelString(names []string, values []string, extra string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, n, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec holds one value per set of label values.
+type vec struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func newVec(name string, help string, kind string, labels []string) vec {
+	return vec{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		values:     make(map[string][]string),
+	}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// key returns the map key for label values, recording
+// them the first time. The caller holds v.mu.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %v wants %v label values, got %v", v.metricName, len(v.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := v.values[k]; !ok {
+		v.values[k] = append([]string{}, values...)
+	}
+	return k
+}
+
+// sortedKeys returns the keys in label value order.
+// The caller holds v.mu.
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", v.metricName, v.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", v.metricName, v.kind)
+}
+
+// CounterVec is a counter per set of label values.
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+// NewCounterVec registers a counter with the given labels.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		vec:    newVec(name, help, "counter", labels),
+		counts: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		c.counts[c.key(nil)] = 0
+	}
+	register(c)
+	return c
+}
+
+// Add adds delta to the counter for the label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[c.key(values)] += delta
+}
+
+// Inc adds one to the counter for the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the counter for the label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[strings.Join(values, "\xff")]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%v%v %v\n", c.metricName, labelString(c.labels, c.values[k], ""), formatValue(c.counts[k]))
+	}
+}
+
+// GaugeVec is a gauge per set of label values.
+type GaugeVec struct {
+	vec
+	gauges map[string]float64
+}
+
+// NewGaugeVec registers a gauge with the given labels.
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		vec:    newVec(name, help, "gauge", labels),
+		gauges: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		g.gauges[g.key(nil)] = 0
+	}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.gauges[g.key(values)] = value
+}
+
+// Add adds delta to the gauge for the label values.
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.gauges[g.key(values)] += delta
+}
+
+// Value returns the gauge for the label values.
+func (g *GaugeVec) Value(values ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.gauges[strings.Join(values, "\xff")]
+}
+
+// Reset removes every label value, for gauges
+// that are rebuilt on each collection.
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values = make(map[string][]string)
+	g.gauges = make(map[string]float64)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w)
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%v%v %v\n", g.metricName, labelString(g.labels, g.values[k], ""), formatValue(g.gauges[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram per set of label values.
+type HistogramVec struct {
+	vec
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+// NewHistogramVec registers a histogram with the given
+// bucket upper bounds and labels.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec:        newVec(name, help, "histogram", labels),
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+// Observe records a value for the label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.key(values)
+	hist, ok := h.histograms[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[k] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// Count returns how many values were
+// observed for the label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hist, ok := h.histograms[strings.Join(values, "\xff")]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, k := range h.sortedKeys() {
+		hist, ok := h.histograms[k]
+		if !ok {
+			continue
+		}
+		values := h.values[k]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf(`le="%v"`, formatValue(bound))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, labelString(h.labels, values, le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, labelString(h.labels, values, `le="+Inf"`), hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, labelString(h.labels, values, ""), formatValue(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, labelString(h.labels, values, ""), hist.count)
+	}
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_labelString(t *testing.T) {
+	tests := []struct {
+		name   string
+		names  []string
+		values []string
+		extra  string
+		want   string
+	}{
+		{
+			name: "No labels",
+			want: "",
+		},
+		{
+			name:   "Labels",
+			names:  []string{"a", "b"},
+			values: []string{"x", "y"},
+			want:   `{a="x",b="y"}`,
+		},
+		{
+			name:   "Escaped",
+			names:  []string{"a"},
+			values: []string{"say \"hi\"\\\n"},
+			want:   `{a="say \"hi\"\\\n"}`,
+		},
+		{
+			name:   "Extra",
+			names:  []string{"a"},
+			values: []string{"x"},
+			extra:  `le="1"`,
+			want:   `{a="x",le="1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, labelString(tt.names, tt.values, tt.extra))
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "A test counter.", "service")
+	g := NewGaugeVec("test_gauge", "A test gauge.")
+	h := NewHistogramVec("test_seconds", "A test histogram.", []float64{0.5, 1}, "op")
+
+	collected := 0
+	OnCollect(func() {
+		collected++
+		g.Set(float64(collected))
+	})
+
+	c.Inc("b")
+	c.Add(2, "a")
+	h.Observe(0.2, "create")
+	h.Observe(0.7, "create")
+	h.Observe(3, "create")
+
+	assert.Equal(t, float64(2), c.Value("a"))
+	assert.Equal(t, float64(0), c.Value("c"))
+	assert.Equal(t, uint64(3), h.Count("create"))
+
+	var b bytes.Buffer
+	WriteTo(&b)
+	out := b.String()
+
+	assert.Contains(t, out, ""+
+		"# HELP test_counter_total A test counter.\n"+
+		"# TYPE test_counter_total counter\n"+
+		"test_counter_total{service=\"a\"} 2\n"+
+		"test_counter_total{service=\"b\"} 1\n")
+	assert.Contains(t, out, ""+
+		"# TYPE test_gauge gauge\n"+
+		"test_gauge 1\n")
+	assert.Contains(t, out, ""+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{op=\"create\",le=\"0.5\"} 1\n"+
+		"test_seconds_bucket{op=\"create\",le=\"1\"} 2\n"+
+		"test_seconds_bucket{op=\"create\",le=\"+Inf\"} 3\n"+
+		"test_seconds_sum{op=\"create\"} 3.9\n"+
+		"test_seconds_count{op=\"create\"} 3\n")
+	// Unlabelled metrics are written before
+	// anything is recorded
+	assert.Contains(t, out, "controller_rethink_reconnects_total 0\n")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_gauge 2\n")
+
+	g.Reset()
+	b.Reset()
+	g.Set(5)
+	WriteTo(&b)
+	assert.Contains(t, b.String(), "test_gauge 3\n")
+}
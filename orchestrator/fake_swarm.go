@@ -0,0 +1,1050 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	events "github.com/docker/docker/api/types/events"
+	filters "github.com/docker/docker/api/types/filters"
+	swarm "github.com/docker/docker/api/types/swarm"
+)
+
+// maxHistory is the number of past events kept for
+// replay with EventsOptions.Since (the docker daemon
+// keeps the same amount in memory).
+const maxHistory = 1000
+
+var idRunes = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+func newID(n int) string {
+	id := make([]rune, n)
+	for i := range id {
+		id[i] = idRunes[rand.Intn(len(idRunes))]
+	}
+	return string(id)
+}
+
+func newContainerID() string {
+	id := make([]byte, 32)
+	rand.Read(id)
+	return fmt.Sprintf("%x", id)
+}
+
+// copyInto deep copies in to out so that the caller
+// and the fake never share pointers (replica counts,
+// update configs, etc.).
+func copyInto(in interface{}, out interface{}) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		panic(err)
+	}
+}
+
+type fakeTask struct {
+	task        swarm.Task
+	containerID string
+}
+
+type fakeService struct {
+	service  swarm.Service
+	tasks    []*fakeTask
+	failures uint64
+	logs     []*io.PipeWriter
+}
+
+// FakeSwarm is an in-memory Orchestrator. Services
+// get tasks scheduled onto the nodes added with AddNode,
+// and the same events a real swarm would produce (service
+// create/update/remove, container create/start/health_status/
+// kill/die/stop) are emitted to subscribers of Events.
+type FakeSwarm struct {
+	mu          sync.Mutex
+	index       uint64
+	lastNano    int64
+	nodes       []*swarm.Node
+	services    map[string]*fakeService
+	history     []events.Message
+	subscribers map[*subscriber]struct{}
+	pingErr     error
+	rejected    map[string]bool
+}
+
+var _ Orchestrator = (*FakeSwarm)(nil)
+
+// NewFakeSwarm returns an empty FakeSwarm with no nodes.
+func NewFakeSwarm() *FakeSwarm {
+	return &FakeSwarm{
+		services:    make(map[string]*fakeService),
+		subscribers: make(map[*subscriber]struct{}),
+		rejected:    make(map[string]bool),
+	}
+}
+
+func (f *FakeSwarm) nextVersion() swarm.Version {
+	f.index++
+	return swarm.Version{Index: f.index}
+}
+
+func (f *FakeSwarm) now() time.Time {
+	n := time.Now().UnixNano()
+	if n <= f.lastNano {
+		n = f.lastNano + 1
+	}
+	f.lastNano = n
+	return time.Unix(0, n)
+}
+
+func (f *FakeSwarm) emit(evt events.Message) {
+	t := f.now()
+	evt.Time = t.Unix()
+	evt.TimeNano = t.UnixNano()
+
+	f.history = append(f.history, evt)
+	if len(f.history) > maxHistory {
+		f.history = f.history[len(f.history)-maxHistory:]
+	}
+	for s := range f.subscribers {
+		s.push(evt)
+	}
+}
+
+func (f *FakeSwarm) serviceEvent(action string, svc swarm.Service, attrs map[string]string) {
+	attributes := map[string]string{
+		"name": svc.Spec.Annotations.Name,
+	}
+	for k, v := range attrs {
+		attributes[k] = v
+	}
+	f.emit(events.Message{
+		Type:   "service",
+		Action: action,
+		Actor: events.Actor{
+			ID:         svc.ID,
+			Attributes: attributes,
+		},
+	})
+}
+
+func (f *FakeSwarm) containerEvent(action string, fs *fakeService, t *fakeTask, attrs map[string]string) {
+	image := t.task.Spec.ContainerSpec.Image
+	taskName := fmt.Sprintf("%v.%v.%v", fs.service.Spec.Annotations.Name, t.task.Slot, t.task.ID)
+	attributes := map[string]string{
+		"com.docker.swarm.node.id":      t.task.NodeID,
+		"com.docker.swarm.service.id":   fs.service.ID,
+		"com.docker.swarm.service.name": fs.service.Spec.Annotations.Name,
+		"com.docker.swarm.task":         "",
+		"com.docker.swarm.task.id":      t.task.ID,
+		"com.docker.swarm.task.name":    taskName,
+		"image":                         image,
+		"name":                          taskName,
+	}
+	for k, v := range t.task.Spec.ContainerSpec.Labels {
+		attributes[k] = v
+	}
+	for k, v := range attrs {
+		attributes[k] = v
+	}
+	f.emit(events.Message{
+		Status: action,
+		ID:     t.containerID,
+		From:   image,
+		Type:   "container",
+		Action: action,
+		Actor: events.Actor{
+			ID:         t.containerID,
+			Attributes: attributes,
+		},
+	})
+}
+
+func hasHealthcheck(spec swarm.ContainerSpec) bool {
+	if spec.Healthcheck == nil {
+		return false
+	}
+	return len(spec.Healthcheck.Test) == 0 || spec.Healthcheck.Test[0] != "NONE"
+}
+
+func nodeMatches(node *swarm.Node, placement *swarm.Placement) bool {
+	if node.Status.State != swarm.NodeStateReady {
+		return false
+	}
+	if placement == nil {
+		return true
+	}
+	for _, c := range placement.Constraints {
+		var (
+			want  = true
+			split = strings.SplitN(c, "==", 2)
+		)
+		if len(split) != 2 {
+			split = strings.SplitN(c, "!=", 2)
+			want = false
+		}
+		if len(split) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		var actual string
+		switch {
+		case strings.HasPrefix(key, "node.labels."):
+			actual = node.Spec.Annotations.Labels[strings.TrimPrefix(key, "node.labels.")]
+		case key == "node.role":
+			actual = string(node.Spec.Role)
+		case key == "node.hostname":
+			actual = node.Description.Hostname
+		case key == "node.id":
+			actual = node.ID
+		default:
+			continue
+		}
+		if (actual == value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeSwarm) eligibleNodes(spec swarm.ServiceSpec) []*swarm.Node {
+	var nodes []*swarm.Node
+	for _, n := range f.nodes {
+		if nodeMatches(n, spec.TaskTemplate.Placement) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (fs *fakeService) running() []*fakeTask {
+	var tasks []*fakeTask
+	for _, t := range fs.tasks {
+		if t.task.DesiredState == swarm.TaskStateRunning {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+func (f *FakeSwarm) startTask(fs *fakeService, slot int, node *swarm.Node) {
+	now := f.now()
+	t := &fakeTask{
+		containerID: newContainerID(),
+		task: swarm.Task{
+			ID: newID(25),
+			Meta: swarm.Meta{
+				Version:   f.nextVersion(),
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+			ServiceID:    fs.service.ID,
+			Slot:         slot,
+			DesiredState: swarm.TaskStateRunning,
+			Status: swarm.TaskStatus{
+				Timestamp: now,
+				State:     swarm.TaskStatePending,
+				Message:   "no suitable node",
+			},
+		},
+	}
+	copyInto(fs.service.Spec.TaskTemplate, &t.task.Spec)
+	fs.tasks = append(fs.tasks, t)
+
+	// Like swarm, a task with nowhere to go just
+	// sits in pending without ever creating a container
+	if node == nil {
+		return
+	}
+	t.task.NodeID = node.ID
+	t.task.Status.State = swarm.TaskStateRunning
+	t.task.Status.Message = "started"
+	t.task.Status.ContainerStatus.ContainerID = t.containerID
+
+	f.containerEvent("create", fs, t, nil)
+	f.containerEvent("start", fs, t, nil)
+	if f.rejected[t.task.Spec.ContainerSpec.Image] {
+		f.stopTask(fs, t, 1, false)
+		return
+	}
+	if hasHealthcheck(t.task.Spec.ContainerSpec) {
+		f.containerEvent("health_status: healthy", fs, t, nil)
+	}
+}
+
+func (f *FakeSwarm) stopTask(fs *fakeService, t *fakeTask, exitCode int, killed bool) {
+	t.task.DesiredState = swarm.TaskStateShutdown
+	t.task.Status.Timestamp = f.now()
+	t.task.Status.ContainerStatus.ExitCode = exitCode
+	if exitCode == 0 {
+		t.task.Status.State = swarm.TaskStateShutdown
+	} else {
+		t.task.Status.State = swarm.TaskStateFailed
+		t.task.Status.Err = fmt.Sprintf("task: non-zero exit (%v)", exitCode)
+	}
+	if t.task.NodeID == "" {
+		return
+	}
+	if killed {
+		f.containerEvent("kill", fs, t, map[string]string{"signal": "15"})
+	}
+	f.containerEvent("die", fs, t, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	if killed {
+		f.containerEvent("stop", fs, t, nil)
+	}
+}
+
+// scheduleTasks starts or stops tasks until the number
+// running matches the service mode.
+func (f *FakeSwarm) scheduleTasks(fs *fakeService) {
+	nodes := f.eligibleNodes(fs.service.Spec)
+	running := fs.running()
+
+	if fs.service.Spec.Mode.Global != nil {
+		onNode := make(map[string]bool)
+		for _, t := range running {
+			onNode[t.task.NodeID] = true
+		}
+		for _, n := range nodes {
+			if !onNode[n.ID] {
+				f.startTask(fs, 0, n)
+			}
+		}
+		return
+	}
+
+	desired := 1
+	if r := fs.service.Spec.Mode.Replicated; r != nil && r.Replicas != nil {
+		desired = int(*r.Replicas)
+	}
+	for i := len(running); i < desired; i++ {
+		var node *swarm.Node
+		if len(nodes) > 0 {
+			node = nodes[i%len(nodes)]
+		}
+		f.startTask(fs, i+1, node)
+	}
+	for i := len(running) - 1; i >= desired; i-- {
+		f.stopTask(fs, running[i], 0, true)
+	}
+}
+
+func (f *FakeSwarm) findService(serviceID string) (*fakeService, error) {
+	if fs, ok := f.services[serviceID]; ok {
+		return fs, nil
+	}
+	for _, fs := range f.services {
+		if fs.service.Spec.Annotations.Name == serviceID {
+			return fs, nil
+		}
+	}
+	return nil, fmt.Errorf("Error: no such service: %v", serviceID)
+}
+
+func endpointFor(spec swarm.ServiceSpec) swarm.Endpoint {
+	var endpoint swarm.Endpoint
+	if spec.EndpointSpec != nil {
+		endpoint.Spec = *spec.EndpointSpec
+		endpoint.Ports = spec.EndpointSpec.Ports
+	}
+	return endpoint
+}
+
+// ServiceCreate creates a service and schedules its tasks.
+func (f *FakeSwarm) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if service.Annotations.Name == "" {
+		return types.ServiceCreateResponse{}, errors.New("Error response from daemon: rpc error: code = 3 desc = name must be valid as a DNS name component")
+	}
+	for _, fs := range f.services {
+		if fs.service.Spec.Annotations.Name == service.Annotations.Name {
+			return types.ServiceCreateResponse{}, errors.New("Error response from daemon: rpc error: code = 2 desc = name conflicts with an existing object")
+		}
+	}
+
+	now := f.now()
+	fs := &fakeService{
+		service: swarm.Service{
+			ID: newID(25),
+			Meta: swarm.Meta{
+				Version:   f.nextVersion(),
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+		},
+	}
+	copyInto(service, &fs.service.Spec)
+	fs.service.Endpoint = endpointFor(fs.service.Spec)
+	f.services[fs.service.ID] = fs
+
+	f.serviceEvent("create", fs.service, nil)
+	f.scheduleTasks(fs)
+
+	return types.ServiceCreateResponse{ID: fs.service.ID}, nil
+}
+
+// ServiceInspectWithRaw returns a service by ID or name.
+func (f *FakeSwarm) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return swarm.Service{}, nil, err
+	}
+	var svc swarm.Service
+	copyInto(fs.service, &svc)
+	raw, _ := json.Marshal(svc)
+	return svc, raw, nil
+}
+
+// ServiceUpdate updates a service. Changes to the task
+// template roll every task (emitting the updatestate
+// events), while replica changes only rescale.
+func (f *FakeSwarm) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return types.ServiceUpdateResponse{}, err
+	}
+	if version.Index != fs.service.Version.Index {
+		return types.ServiceUpdateResponse{}, errors.New("Error response from daemon: rpc error: code = 2 desc = update out of sequence")
+	}
+
+	var previous, next swarm.ServiceSpec
+	copyInto(fs.service.Spec, &previous)
+	copyInto(service, &next)
+
+	fs.service.PreviousSpec = &previous
+	fs.service.Spec = next
+	fs.service.Endpoint = endpointFor(next)
+	fs.service.Version = f.nextVersion()
+	fs.service.UpdatedAt = f.now()
+
+	attrs := make(map[string]string)
+	if oldMode, newMode := previous.Mode.Replicated, next.Mode.Replicated; oldMode != nil && newMode != nil &&
+		oldMode.Replicas != nil && newMode.Replicas != nil && *oldMode.Replicas != *newMode.Replicas {
+		attrs["replicas.old"] = strconv.FormatUint(*oldMode.Replicas, 10)
+		attrs["replicas.new"] = strconv.FormatUint(*newMode.Replicas, 10)
+	}
+	f.serviceEvent("update", fs.service, attrs)
+
+	if reflect.DeepEqual(previous.TaskTemplate, next.TaskTemplate) {
+		f.scheduleTasks(fs)
+		return types.ServiceUpdateResponse{}, nil
+	}
+
+	fs.service.UpdateStatus = swarm.UpdateStatus{
+		State:     swarm.UpdateStateUpdating,
+		StartedAt: f.now(),
+		Message:   "update in progress",
+	}
+	f.serviceEvent("update", fs.service, map[string]string{
+		"updatestate.new": string(swarm.UpdateStateUpdating),
+	})
+
+	nodes := f.eligibleNodes(next)
+	for i, t := range fs.running() {
+		f.stopTask(fs, t, 0, true)
+		var node *swarm.Node
+		if len(nodes) > 0 {
+			node = nodes[i%len(nodes)]
+		}
+		f.startTask(fs, t.task.Slot, node)
+	}
+	if f.rejected[next.TaskTemplate.ContainerSpec.Image] {
+		f.failUpdate(fs, previous)
+		return types.ServiceUpdateResponse{}, nil
+	}
+	f.scheduleTasks(fs)
+
+	fs.service.UpdateStatus.State = swarm.UpdateStateCompleted
+	fs.service.UpdateStatus.CompletedAt = f.now()
+	fs.service.UpdateStatus.Message = "update completed"
+	f.serviceEvent("update", fs.service, map[string]string{
+		"updatestate.new": string(swarm.UpdateStateCompleted),
+		"updatestate.old": string(swarm.UpdateStateUpdating),
+	})
+
+	return types.ServiceUpdateResponse{}, nil
+}
+
+// failUpdate ends an update whose new tasks failed, rolling
+// the service back to previous if its UpdateConfig says to
+// and pausing the update otherwise.
+func (f *FakeSwarm) failUpdate(fs *fakeService, previous swarm.ServiceSpec) {
+	config := fs.service.Spec.UpdateConfig
+	if config == nil || config.FailureAction != UpdateFailureActionRollback {
+		fs.service.UpdateStatus.State = swarm.UpdateStatePaused
+		fs.service.UpdateStatus.Message = "update paused due to failure or early termination of task"
+		f.serviceEvent("update", fs.service, map[string]string{
+			"updatestate.new": string(swarm.UpdateStatePaused),
+			"updatestate.old": string(swarm.UpdateStateUpdating),
+		})
+		return
+	}
+
+	fs.service.UpdateStatus.State = UpdateStateRollbackStarted
+	fs.service.UpdateStatus.Message = "update rolled back due to failure or early termination of task"
+	f.serviceEvent("update", fs.service, map[string]string{
+		"updatestate.new": string(UpdateStateRollbackStarted),
+		"updatestate.old": string(swarm.UpdateStateUpdating),
+	})
+
+	var failed swarm.ServiceSpec
+	copyInto(fs.service.Spec, &failed)
+	fs.service.PreviousSpec = &failed
+	fs.service.Spec = previous
+	fs.service.Endpoint = endpointFor(previous)
+	fs.service.Version = f.nextVersion()
+	f.scheduleTasks(fs)
+
+	fs.service.UpdateStatus.State = UpdateStateRollbackCompleted
+	fs.service.UpdateStatus.CompletedAt = f.now()
+	fs.service.UpdateStatus.Message = "rollback completed"
+	f.serviceEvent("update", fs.service, map[string]string{
+		"updatestate.new": string(UpdateStateRollbackCompleted),
+		"updatestate.old": string(UpdateStateRollbackStarted),
+	})
+}
+
+// ServiceRemove stops every task of a service and removes it.
+func (f *FakeSwarm) ServiceRemove(ctx context.Context, serviceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return err
+	}
+	for _, t := range fs.running() {
+		f.stopTask(fs, t, 0, true)
+	}
+	for _, w := range fs.logs {
+		w.Close()
+	}
+	delete(f.services, fs.service.ID)
+	f.serviceEvent("remove", fs.service, nil)
+
+	return nil
+}
+
+// ServiceList lists services, honoring the id, name and
+// label filters.
+func (f *FakeSwarm) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	services := []swarm.Service{}
+	for _, fs := range f.services {
+		if !options.Filters.FuzzyMatch("id", fs.service.ID) ||
+			!options.Filters.FuzzyMatch("name", fs.service.Spec.Annotations.Name) ||
+			!options.Filters.MatchKVList("label", fs.service.Spec.Annotations.Labels) {
+			continue
+		}
+		var svc swarm.Service
+		copyInto(fs.service, &svc)
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// ServiceLogs returns a reader that follows the logs written
+// to the service with WriteServiceLog. The stream begins with
+// a single 8 byte multiplexing header followed by newline
+// delimited log lines.
+func (f *FakeSwarm) ServiceLogs(ctx context.Context, serviceID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	fs.logs = append(fs.logs, writer)
+
+	go func() {
+		header := make([]byte, 8)
+		header[0] = 1
+		binary.BigEndian.PutUint32(header[4:], 0)
+		if _, err := writer.Write(header); err != nil {
+			return
+		}
+		<-ctx.Done()
+		writer.CloseWithError(ctx.Err())
+	}()
+
+	return reader, nil
+}
+
+// TaskList lists tasks, honoring the service, node and
+// desired-state filters.
+func (f *FakeSwarm) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tasks := []swarm.Task{}
+	for _, fs := range f.services {
+		if !options.Filters.ExactMatch("service", fs.service.ID) &&
+			!options.Filters.ExactMatch("service", fs.service.Spec.Annotations.Name) {
+			continue
+		}
+		for _, t := range fs.tasks {
+			if !options.Filters.ExactMatch("node", t.task.NodeID) ||
+				!options.Filters.ExactMatch("desired-state", string(t.task.DesiredState)) {
+				continue
+			}
+			var task swarm.Task
+			copyInto(t.task, &task)
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// NodeList lists all nodes in the swarm.
+func (f *FakeSwarm) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	nodes := []swarm.Node{}
+	for _, n := range f.nodes {
+		var node swarm.Node
+		copyInto(n, &node)
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// NodeInspectWithRaw returns a node by ID or hostname.
+func (f *FakeSwarm) NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, n := range f.nodes {
+		if n.ID == nodeID || n.Description.Hostname == nodeID {
+			var node swarm.Node
+			copyInto(n, &node)
+			raw, _ := json.Marshal(node)
+			return node, raw, nil
+		}
+	}
+	return swarm.Node{}, nil, fmt.Errorf("Error: No such node: %v", nodeID)
+}
+
+// NodeUpdate replaces a node's spec, and like swarm
+// rejects stale versions.
+func (f *FakeSwarm) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, n := range f.nodes {
+		if n.ID != nodeID {
+			continue
+		}
+		if n.Version.Index != version.Index {
+			return errors.New("Error response from daemon: rpc error: code = 2 desc = update out of sequence")
+		}
+		copyInto(node, &n.Spec)
+		n.Version = f.nextVersion()
+		n.UpdatedAt = f.now()
+		return nil
+	}
+	return fmt.Errorf("Error: No such node: %v", nodeID)
+}
+
+// Events subscribes to the swarm's events. As with the
+// docker client, the message channel is never closed; the
+// error channel receives exactly one error (io.EOF once
+// Until is reached, or the context error) and is then closed.
+func (f *FakeSwarm) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	s := &subscriber{
+		filters: options.Filters,
+		msgs:    make(chan events.Message),
+		errs:    make(chan error, 1),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	since, err := parseTimestamp(options.Since)
+	if err == nil {
+		s.until, err = parseTimestamp(options.Until)
+	}
+	if err != nil {
+		s.errs <- err
+		close(s.errs)
+		return s.msgs, s.errs
+	}
+
+	f.mu.Lock()
+	if options.Since != "" {
+		for _, evt := range f.history {
+			if evt.TimeNano >= since {
+				s.push(evt)
+			}
+		}
+	}
+	f.subscribers[s] = struct{}{}
+	f.mu.Unlock()
+
+	if s.until != 0 {
+		wait := time.Until(time.Unix(0, s.until))
+		time.AfterFunc(wait, func() {
+			s.terminate(io.EOF)
+		})
+	}
+
+	go s.run(ctx, func() {
+		f.mu.Lock()
+		delete(f.subscribers, s)
+		f.mu.Unlock()
+	})
+
+	return s.msgs, s.errs
+}
+
+// AddNode adds a ready node to the swarm. The first
+// manager added becomes the leader.
+func (f *FakeSwarm) AddNode(hostname string, addr string, os string, role swarm.NodeRole) swarm.Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	node := &swarm.Node{
+		ID: newID(25),
+		Meta: swarm.Meta{
+			Version:   f.nextVersion(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		Spec: swarm.NodeSpec{
+			Role:         role,
+			Availability: swarm.NodeAvailabilityActive,
+		},
+		Description: swarm.NodeDescription{
+			Hostname: hostname,
+			Platform: swarm.Platform{
+				Architecture: "x86_64",
+				OS:           os,
+			},
+		},
+		Status: swarm.NodeStatus{
+			State: swarm.NodeStateReady,
+			Addr:  addr,
+		},
+	}
+	if role == swarm.NodeRoleManager {
+		leader := true
+		for _, n := range f.nodes {
+			if n.ManagerStatus != nil && n.ManagerStatus.Leader {
+				leader = false
+			}
+		}
+		node.ManagerStatus = &swarm.ManagerStatus{
+			Leader:       leader,
+			Reachability: swarm.ReachabilityReachable,
+			Addr:         addr + ":2377",
+		}
+	}
+	f.nodes = append(f.nodes, node)
+
+	var ret swarm.Node
+	copyInto(node, &ret)
+	return ret
+}
+
+// KillTask makes the container of one running task of the
+// service exit with the given code. The service's restart
+// policy then decides whether a replacement task starts.
+func (f *FakeSwarm) KillTask(serviceID string, exitCode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return err
+	}
+	running := fs.running()
+	if len(running) == 0 {
+		return fmt.Errorf("service %v has no running tasks", serviceID)
+	}
+	t := running[0]
+	f.stopTask(fs, t, exitCode, false)
+
+	policy := fs.service.Spec.TaskTemplate.RestartPolicy
+	restart := true
+	if policy != nil {
+		switch policy.Condition {
+		case swarm.RestartPolicyConditionNone:
+			restart = false
+		case swarm.RestartPolicyConditionOnFailure:
+			restart = exitCode != 0
+		}
+		if policy.MaxAttempts != nil && *policy.MaxAttempts > 0 && fs.failures >= *policy.MaxAttempts {
+			restart = false
+		}
+	}
+	if !restart {
+		return nil
+	}
+	fs.failures++
+
+	var node *swarm.Node
+	for _, n := range f.nodes {
+		if n.ID == t.task.NodeID && nodeMatches(n, fs.service.Spec.TaskTemplate.Placement) {
+			node = n
+		}
+	}
+	f.startTask(fs, t.task.Slot, node)
+	return nil
+}
+
+// RejectImage makes the containers of tasks using image
+// exit with code 1 as soon as they start, so that updating
+// a service to it fails.
+func (f *FakeSwarm) RejectImage(image string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejected[image] = true
+}
+
+// SetTaskHealth emits a health_status event for every
+// running task of the service.
+func (f *FakeSwarm) SetTaskHealth(serviceID string, healthy bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		return err
+	}
+	status := "health_status: unhealthy"
+	if healthy {
+		status = "health_status: healthy"
+	}
+	for _, t := range fs.running() {
+		if t.task.NodeID != "" {
+			f.containerEvent(status, fs, t, nil)
+		}
+	}
+	return nil
+}
+
+// WriteServiceLog writes a log line to every reader
+// following the service's logs.
+func (f *FakeSwarm) WriteServiceLog(serviceID string, line string) error {
+	f.mu.Lock()
+	fs, err := f.findService(serviceID)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	writers := make([]*io.PipeWriter, len(fs.logs))
+	copy(writers, fs.logs)
+	f.mu.Unlock()
+
+	for _, w := range writers {
+		w.Write([]byte(line + "\n"))
+	}
+	return nil
+}
+
+// InterruptEvents ends every open event stream with err,
+// the way a daemon restart or dropped connection would.
+func (f *FakeSwarm) InterruptEvents(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for s := range f.subscribers {
+		s.terminate(err)
+	}
+}
+
+// Ping returns the error set by SetPingError,
+// or the API version if there is none.
+func (f *FakeSwarm) Ping(ctx context.Context) (types.Ping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pingErr != nil {
+		return types.Ping{}, f.pingErr
+	}
+	return types.Ping{APIVersion: "1.26"}, nil
+}
+
+// SetPingError makes Ping fail with err, as an
+// unreachable daemon would, until it is set to nil.
+func (f *FakeSwarm) SetPingError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pingErr = err
+}
+
+// parseTimestamp parses the unix "seconds[.nanoseconds]"
+// format used by the docker API into unix nanoseconds.
+func parseTimestamp(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	split := strings.SplitN(value, ".", 2)
+	sec, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil {
+		t, terr := time.Parse(time.RFC3339Nano, value)
+		if terr != nil {
+			return 0, fmt.Errorf("invalid timestamp %v", value)
+		}
+		return t.UnixNano(), nil
+	}
+	var nsec int64
+	if len(split) == 2 {
+		frac := (split[1] + "000000000")[:9]
+		nsec, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %v", value)
+		}
+	}
+	return sec*int64(time.Second) + nsec, nil
+}
+
+// stripTag removes the tag and digest from an image
+// reference, as the daemon does for the image filter.
+func stripTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func eventMatches(args filters.Args, evt events.Message) bool {
+	if args.Len() == 0 {
+		return true
+	}
+	action := strings.SplitN(evt.Action, ":", 2)[0]
+	if !args.ExactMatch("event", evt.Action) && !args.ExactMatch("event", action) {
+		return false
+	}
+	if !args.ExactMatch("type", evt.Type) {
+		return false
+	}
+	if args.Include("image") {
+		image := evt.Actor.Attributes["image"]
+		if !args.ExactMatch("image", image) && !args.ExactMatch("image", stripTag(image)) {
+			return false
+		}
+	}
+	if args.Include("service") && evt.Type == "service" {
+		if !args.ExactMatch("service", evt.Actor.ID) && !args.ExactMatch("service", evt.Actor.Attributes["name"]) {
+			return false
+		}
+	}
+	if args.Include("container") && evt.Type == "container" {
+		if !args.ExactMatch("container", evt.Actor.ID) && !args.ExactMatch("container", evt.Actor.Attributes["name"]) {
+			return false
+		}
+	}
+	return args.MatchKVList("label", evt.Actor.Attributes)
+}
+
+type subscriber struct {
+	filters filters.Args
+	until   int64
+	msgs    chan events.Message
+	errs    chan error
+
+	mu    sync.Mutex
+	queue []events.Message
+	err   error
+	once  sync.Once
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+func (s *subscriber) push(evt events.Message) {
+	if !eventMatches(s.filters, evt) {
+		return
+	}
+	s.mu.Lock()
+	s.queue = append(s.queue, evt)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) terminate(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// run delivers queued events in order. Events queued
+// before the stream terminates are still delivered.
+func (s *subscriber) run(ctx context.Context, unsubscribe func()) {
+	defer close(s.errs)
+	defer unsubscribe()
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				s.errs <- ctx.Err()
+				return
+			case <-s.done:
+				s.mu.Lock()
+				pending := len(s.queue)
+				err := s.err
+				s.mu.Unlock()
+				if pending > 0 {
+					continue
+				}
+				s.errs <- err
+				return
+			case <-s.wake:
+				continue
+			}
+		}
+		evt := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		if s.until != 0 && evt.TimeNano > s.until {
+			s.errs <- io.EOF
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			s.errs <- ctx.Err()
+			return
+		case s.msgs <- evt:
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	container "github.com/docker/docker/api/types/container"
+	events "github.com/docker/docker/api/types/events"
+	filters "github.com/docker/docker/api/types/filters"
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpec(name string, replicas uint64) swarm.ServiceSpec {
+	maxAttempts := uint64(3)
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name: name,
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:       "ramrodpcp/interpreter-plugin:test",
+				Healthcheck: &container.HealthConfig{},
+			},
+			RestartPolicy: &swarm.RestartPolicy{
+				Condition:   swarm.RestartPolicyConditionOnFailure,
+				MaxAttempts: &maxAttempts,
+			},
+			Placement: &swarm.Placement{
+				Constraints: []string{"node.labels.os==posix"},
+			},
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{
+				Replicas: &replicas,
+			},
+		},
+	}
+}
+
+func newTestSwarm() *FakeSwarm {
+	f := NewFakeSwarm()
+	node := f.AddNode("manager", "192.168.1.1", "linux", swarm.NodeRoleManager)
+	node.Spec.Annotations.Labels = map[string]string{"os": "posix", "ip": "192.168.1.1"}
+	if err := f.NodeUpdate(context.Background(), node.ID, node.Version, node.Spec); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// collect reads events until the wanted number
+// has arrived or the timeout expires.
+func collect(evts <-chan events.Message, n int, timeout time.Duration) []string {
+	var got []string
+	deadline := time.After(timeout)
+	for len(got) < n {
+		select {
+		case e := <-evts:
+			got = append(got, e.Type+" "+e.Action+" "+e.Actor.Attributes["updatestate.new"])
+		case <-deadline:
+			return got
+		}
+	}
+	return got
+}
+
+func TestFakeSwarm_Events(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(f *FakeSwarm) error
+		want []string
+	}{
+		{
+			name: "create",
+			run: func(f *FakeSwarm) error {
+				_, err := f.ServiceCreate(context.Background(), testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+				return err
+			},
+			want: []string{
+				"service create ",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+			},
+		},
+		{
+			name: "update",
+			run: func(f *FakeSwarm) error {
+				spec := testSpec("TestPlugin", 1)
+				resp, err := f.ServiceCreate(context.Background(), spec, types.ServiceCreateOptions{})
+				if err != nil {
+					return err
+				}
+				svc, _, err := f.ServiceInspectWithRaw(context.Background(), resp.ID)
+				if err != nil {
+					return err
+				}
+				spec.TaskTemplate.ForceUpdate++
+				_, err = f.ServiceUpdate(context.Background(), resp.ID, svc.Version, spec, types.ServiceUpdateOptions{})
+				return err
+			},
+			want: []string{
+				"service create ",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+				"service update ",
+				"service update updating",
+				"container kill ",
+				"container die ",
+				"container stop ",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+				"service update completed",
+			},
+		},
+		{
+			name: "rollback",
+			run: func(f *FakeSwarm) error {
+				spec := testSpec("TestPlugin", 1)
+				spec.UpdateConfig = &swarm.UpdateConfig{FailureAction: UpdateFailureActionRollback}
+				resp, err := f.ServiceCreate(context.Background(), spec, types.ServiceCreateOptions{})
+				if err != nil {
+					return err
+				}
+				svc, _, err := f.ServiceInspectWithRaw(context.Background(), resp.ID)
+				if err != nil {
+					return err
+				}
+				f.RejectImage("ramrodpcp/interpreter-plugin:bad")
+				spec.TaskTemplate.ContainerSpec.Image = "ramrodpcp/interpreter-plugin:bad"
+				_, err = f.ServiceUpdate(context.Background(), resp.ID, svc.Version, spec, types.ServiceUpdateOptions{})
+				return err
+			},
+			want: []string{
+				"service create ",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+				"service update ",
+				"service update updating",
+				"container kill ",
+				"container die ",
+				"container stop ",
+				"container create ",
+				"container start ",
+				"container die ",
+				"service update rollback_started",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+				"service update rollback_completed",
+			},
+		},
+		{
+			name: "remove",
+			run: func(f *FakeSwarm) error {
+				resp, err := f.ServiceCreate(context.Background(), testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+				if err != nil {
+					return err
+				}
+				return f.ServiceRemove(context.Background(), resp.ID)
+			},
+			want: []string{
+				"service create ",
+				"container create ",
+				"container start ",
+				"container health_status: healthy ",
+				"container kill ",
+				"container die ",
+				"container stop ",
+				"service remove ",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			f := newTestSwarm()
+			evts, _ := f.Events(ctx, types.EventsOptions{})
+			assert.Nil(t, tt.run(f))
+			assert.Equal(t, tt.want, collect(evts, len(tt.want), 3*time.Second))
+		})
+	}
+}
+
+func TestFakeSwarm_EventFilters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newTestSwarm()
+	containerFilter := filters.NewArgs()
+	containerFilter.Add("type", "container")
+	containerFilter.Add("image", "ramrodpcp/interpreter-plugin")
+	containerFilter.Add("event", "die")
+	containerFilter.Add("event", "health_status")
+	evts, _ := f.Events(ctx, types.EventsOptions{Filters: containerFilter})
+
+	resp, err := f.ServiceCreate(ctx, testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, f.ServiceRemove(ctx, resp.ID))
+
+	assert.Equal(t, []string{
+		"container health_status: healthy ",
+		"container die ",
+	}, collect(evts, 2, 3*time.Second))
+}
+
+func TestFakeSwarm_EventsSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newTestSwarm()
+	start := time.Now()
+	_, err := f.ServiceCreate(ctx, testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	serviceFilter := filters.NewArgs()
+	serviceFilter.Add("type", "service")
+	evts, errs := f.Events(ctx, types.EventsOptions{
+		Filters: serviceFilter,
+		Since:   strconv.FormatInt(start.Unix(), 10),
+		Until:   strconv.FormatInt(time.Now().Unix()+1, 10),
+	})
+	assert.Equal(t, []string{"service create "}, collect(evts, 1, 3*time.Second))
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(3 * time.Second):
+		t.Errorf("stream did not end at Until")
+	}
+}
+
+func TestFakeSwarm_InterruptEvents(t *testing.T) {
+	f := newTestSwarm()
+	_, errs := f.Events(context.Background(), types.EventsOptions{})
+
+	f.InterruptEvents(errors.New("unexpected EOF"))
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, errors.New("unexpected EOF"), err)
+	case <-time.After(3 * time.Second):
+		t.Errorf("stream was not interrupted")
+	}
+	_, ok := <-errs
+	assert.False(t, ok)
+}
+
+func TestFakeSwarm_KillTask(t *testing.T) {
+	ctx := context.Background()
+	f := newTestSwarm()
+	resp, err := f.ServiceCreate(ctx, testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	// Three restarts are allowed, the fourth
+	// failure leaves the service without tasks
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, f.KillTask(resp.ID, 1))
+	}
+	running := filters.NewArgs()
+	running.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := f.TaskList(ctx, types.TaskListOptions{Filters: running})
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 0)
+	assert.NotNil(t, f.KillTask(resp.ID, 1))
+}
+
+func TestFakeSwarm_Scale(t *testing.T) {
+	ctx := context.Background()
+	f := newTestSwarm()
+	spec := testSpec("TestPlugin", 1)
+	resp, err := f.ServiceCreate(ctx, spec, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	for _, replicas := range []uint64{3, 0, 2} {
+		svc, _, err := f.ServiceInspectWithRaw(ctx, resp.ID)
+		assert.Nil(t, err)
+		spec.Mode.Replicated.Replicas = &replicas
+		_, err = f.ServiceUpdate(ctx, resp.ID, svc.Version, spec, types.ServiceUpdateOptions{})
+		assert.Nil(t, err)
+
+		running := filters.NewArgs()
+		running.Add("desired-state", string(swarm.TaskStateRunning))
+		tasks, err := f.TaskList(ctx, types.TaskListOptions{Filters: running})
+		assert.Nil(t, err)
+		assert.Len(t, tasks, int(replicas))
+	}
+}
+
+func TestFakeSwarm_ServiceUpdateOutOfSequence(t *testing.T) {
+	ctx := context.Background()
+	f := newTestSwarm()
+	spec := testSpec("TestPlugin", 1)
+	resp, err := f.ServiceCreate(ctx, spec, types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+	_, err = f.ServiceUpdate(ctx, resp.ID, swarm.Version{Index: 1}, spec, types.ServiceUpdateOptions{})
+	assert.NotNil(t, err)
+
+	_, err = f.ServiceCreate(ctx, spec, types.ServiceCreateOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestFakeSwarm_ServiceLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newTestSwarm()
+	resp, err := f.ServiceCreate(ctx, testSpec("TestPlugin", 1), types.ServiceCreateOptions{})
+	assert.Nil(t, err)
+
+	logs, err := f.ServiceLogs(ctx, resp.ID, types.ContainerLogsOptions{Follow: true})
+	assert.Nil(t, err)
+	defer logs.Close()
+
+	header := make([]byte, 8)
+	_, err = io.ReadFull(logs, header)
+	assert.Nil(t, err)
+
+	go f.WriteServiceLog(resp.ID, "hello")
+	line := make([]byte, 6)
+	_, err = io.ReadFull(logs, line)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", string(line))
+}
+
+func Test_parseTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  0,
+		},
+		{
+			name:  "seconds",
+			value: "1533221452",
+			want:  1533221452000000000,
+		},
+		{
+			name:  "nanoseconds",
+			value: "1533221452.162910336",
+			want:  1533221452162910336,
+		},
+		{
+			name:  "short fraction",
+			value: "1533221452.5",
+			want:  1533221452500000000,
+		},
+		{
+			name:    "garbage",
+			value:   "yesterday",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimestamp(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTimestamp() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+
+	types "github.com/docker/docker/api/types"
+	events "github.com/docker/docker/api/types/events"
+	swarm "github.com/docker/docker/api/types/swarm"
+	client "github.com/docker/docker/client"
+)
+
+// Orchestrator is the subset of the docker swarm API
+// used by the controller. The docker client satisfies
+// it directly, and FakeSwarm provides an in-memory
+// implementation for running without a docker daemon.
+type Orchestrator interface {
+	ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+	ServiceRemove(ctx context.Context, serviceID string) error
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceLogs(ctx context.Context, serviceID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error)
+	NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+var _ Orchestrator = (*client.Client)(nil)
+
+// Rolling back a failed service update needs a newer
+// swarm (API 1.28) than these docker types describe.
+const (
+	// UpdateFailureActionRollback rolls a service back
+	// to its previous spec when an update fails.
+	UpdateFailureActionRollback = "rollback"
+	// UpdateStateRollbackStarted is a service
+	// rolling back to its previous spec.
+	UpdateStateRollbackStarted swarm.UpdateState = "rollback_started"
+	// UpdateStateRollbackCompleted is a service
+	// back on its previous spec.
+	UpdateStateRollbackCompleted swarm.UpdateState = "rollback_completed"
+	// UpdateStateRollbackPaused is a rollback
+	// that failed as well.
+	UpdateStateRollbackPaused swarm.UpdateState = "rollback_paused"
+)
+
+// NewDockerOrchestrator returns an Orchestrator backed
+// by a docker client configured from the environment
+// (DOCKER_HOST, DOCKER_API_VERSION, etc.).
+func NewDockerOrchestrator() (Orchestrator, error) {
+	dockerClient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	return dockerClient, nil
+}
@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"github.com/ramrod-project/backend-controller-go/customtypes"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/health"
+	"github.com/ramrod-project/backend-controller-go/metrics"
 	r "gopkg.in/gorethink/gorethink.v4"
 )
 
@@ -28,15 +31,19 @@ returns: <-chan error
 		defer close error chan
 		make <-chan customtypes.Log list
 		rethink SetTags("rethinkdb", "json")
-		connect to db
+		get shared session manager
 		while forever
-			check context done or new chan
+			check context done (flush ready logs) or new chan
 			if new chan, append to chans
 			for each channel
 				if not readable remove from slice
 				if readable and value not nil, logSend()
 */
 
+// LogAggregatorHealth fails when the AggregateLogs
+// loop hasn't run for 5 seconds.
+var LogAggregatorHealth = health.NewHeartbeat(5 * time.Second)
+
 var dbLogQuery = r.DB("Brain").Table("Logs")
 
 func logSend(sess *r.Session, logEntry customtypes.Log) error {
@@ -53,9 +60,27 @@ func logSend(sess *r.Session, logEntry customtypes.Log) error {
 	return nil
 }
 
+// drainLogs sends every log a channel has ready,
+// without waiting for more.
+func drainLogs(c <-chan customtypes.Log, send func(customtypes.Log)) {
+	for {
+		select {
+		case l, ok := <-c:
+			if !ok {
+				return
+			}
+			send(l)
+		default:
+			return
+		}
+	}
+}
+
 // AggregateLogs takes a dynamic number of log
 // channels and aggregates the output to send to
-// the logs database.
+// the logs database. Once the context is done, logs
+// already waiting on the channels are flushed before
+// it returns. Each log stored is sent to WatchLogs.
 func AggregateLogs(ctx context.Context, logChans <-chan (<-chan customtypes.Log)) <-chan error {
 	errs := make(chan error)
 
@@ -66,17 +91,33 @@ func AggregateLogs(ctx context.Context, logChans <-chan (<-chan customtypes.Log)
 
 		r.SetTags("json")
 
-		session, err := r.Connect(r.ConnectOpts{
-			Address: GetRethinkHost(),
-		})
-		if err != nil {
-			errs <- err
-			return
+		sessions := GetSessionManager()
+
+		send := func(l customtypes.Log) {
+			if l != (customtypes.Log{}) {
+				metrics.LogQueueDepth.Add(-1)
+			}
+			session, err := sessions.Session()
+			if err == nil {
+				err = logSend(session, l)
+			}
+			if err != nil {
+				errs <- errorhandler.Transient(errorhandler.ComponentLogAggregator, err).ForService(l.ServiceName, "")
+				return
+			}
+			if l != (customtypes.Log{}) {
+				metrics.LogLinesInserted.Inc(l.ServiceName)
+				logWatchers.publish(l)
+			}
 		}
 
 		for {
+			LogAggregatorHealth.Beat()
 			select {
 			case <-ctx.Done():
+				for _, c := range logSlice {
+					drainLogs(c, send)
+				}
 				return
 			case c, ok := <-logChans:
 				if !ok {
@@ -94,10 +135,7 @@ func AggregateLogs(ctx context.Context, logChans <-chan (<-chan customtypes.Log)
 						logSlice = append(logSlice[:i], logSlice[i+1:]...)
 						i--
 					} else {
-						err = logSend(session, l)
-						if err != nil {
-							errs <- err
-						}
+						send(l)
 					}
 				default:
 					break
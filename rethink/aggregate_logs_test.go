@@ -285,3 +285,45 @@ func TestAggregateLogs(t *testing.T) {
 	}
 	os.Setenv("STAGE", oldStage)
 }
+
+func Test_drainLogs(t *testing.T) {
+	tests := []struct {
+		name  string
+		logs  []string
+		close bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "ready logs",
+			logs: []string{"test1", "test2", "test3"},
+		},
+		{
+			name:  "closed",
+			logs:  []string{"test1"},
+			close: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := make(chan customtypes.Log, len(tt.logs))
+			for _, l := range tt.logs {
+				c <- customtypes.Log{Log: l}
+			}
+			if tt.close {
+				close(c)
+			}
+
+			var got []string
+			drainLogs(c, func(l customtypes.Log) {
+				got = append(got, l.Log)
+			})
+			if len(tt.logs) == 0 {
+				assert.Nil(t, got)
+			} else {
+				assert.Equal(t, tt.logs, got)
+			}
+		})
+	}
+}
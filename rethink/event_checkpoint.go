@@ -0,0 +1,45 @@
+package rethink
+
+import (
+	"fmt"
+	"strconv"
+
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+var checkpointTable = r.DB("Controller").Table("Checkpoints")
+
+// CreateCheckpointsTable creates the Controller.Checkpoints
+// table if the brain doesn't have it yet. It holds where
+// each docker event stream is up to, by event type, so
+// that a restarted controller resumes from there.
+func CreateCheckpointsTable(sessions *SessionManager) error { // pragma: no cover
+	session, err := sessions.Session()
+	if err != nil {
+		return err
+	}
+	_, err = r.Branch(
+		r.DB("Controller").TableList().Contains("Checkpoints"),
+		nil,
+		r.DB("Controller").TableCreate("Checkpoints"),
+	).RunWrite(session)
+	return err
+}
+
+// checkpointDoc is the Checkpoints document for an event
+// type. The time is kept as a string, since a float64
+// can't hold nanoseconds since the epoch exactly.
+func checkpointDoc(eventType string, timeNano int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       eventType,
+		"TimeNano": strconv.FormatInt(timeNano, 10),
+	}
+}
+
+func parseTimeNano(v interface{}) (int64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("bad checkpoint: %v", v)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -1,10 +1,16 @@
 package rethink
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	events "github.com/docker/docker/api/types/events"
-	r "gopkg.in/gorethink/gorethink.v4"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/metrics"
 )
 
 func updatePluginStatus(serviceName string, update map[string]string) error {
@@ -12,20 +18,13 @@ func updatePluginStatus(serviceName string, update map[string]string) error {
 		return fmt.Errorf("cannot update without valid ServiceName")
 	}
 
-	filter := map[string]string{"ServiceName": serviceName}
-
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
+	return GetStore().UpdatePluginStatus(serviceName, update)
+}
 
-	res, err := r.DB("Controller").Table("Plugins").Filter(filter).Update(update).RunWrite(session)
-	if res.Errors > 0 || !(res.Replaced > 0 || res.Updated > 0) {
-		return fmt.Errorf("no plugin to update")
-	}
-	return err
+// unhandled is an event the controller doesn't act on,
+// which is expected and harmless.
+func unhandled(err error) *errorhandler.Error {
+	return errorhandler.New(errorhandler.ComponentEventHandler, errorhandler.SeverityInfo, err)
 }
 
 func handleContainer(event events.Message) (string, map[string]string, error) {
@@ -33,7 +32,7 @@ func handleContainer(event events.Message) (string, map[string]string, error) {
 	update := make(map[string]string)
 
 	if _, ok := event.Actor.Attributes["com.docker.swarm.service.name"]; !ok {
-		return "", update, fmt.Errorf("no container 'com.docker.swarm.service.name' Attribute")
+		return "", update, unhandled(fmt.Errorf("no container 'com.docker.swarm.service.name' Attribute"))
 	}
 	serviceName = event.Actor.Attributes["com.docker.swarm.service.name"]
 	if event.Action == "health_status: healthy" || event.Status == "health_status: healthy" {
@@ -44,9 +43,12 @@ func handleContainer(event events.Message) (string, map[string]string, error) {
 	} else if event.Action == "die" || event.Action == "health_status: unhealthy" || event.Status == "health_status: unhealthy" {
 		update["State"] = "Stopped"
 		update["DesiredState"] = ""
+		if exitCode, ok := event.Actor.Attributes["exitCode"]; ok {
+			update["ExitCode"] = exitCode
+		}
 		return serviceName, update, nil
 	}
-	return "", update, fmt.Errorf("unhandled container event: %v", event.Action)
+	return "", update, unhandled(fmt.Errorf("unhandled container event: %v", event.Action)).ForService(serviceName, "")
 }
 
 func handleServiceAction(event events.Message, update *map[string]string) error {
@@ -58,6 +60,7 @@ func handleServiceAction(event events.Message, update *map[string]string) error
 		return nil
 	} else if event.Action == "remove" { // case: Stopped
 		(*update)["DesiredState"] = ""
+		(*update)["ServiceID"] = ""
 		(*update)["State"] = "Stopped"
 		return nil
 	} else if v, ok := event.Actor.Attributes["updatestate.new"]; ok && v == "updating" { // case: Restarting
@@ -68,73 +71,369 @@ func handleServiceAction(event events.Message, update *map[string]string) error
 		(*update)["DesiredState"] = ""
 		(*update)["State"] = "Active"
 		return nil
+	} else if v, ok := event.Actor.Attributes["updatestate.new"]; ok && v == "rollback_started" { // case: RollingBack
+		(*update)["DesiredState"] = ""
+		(*update)["State"] = "RollingBack"
+		return nil
+	} else if v, ok := event.Actor.Attributes["updatestate.new"]; ok && v == "rollback_completed" { // case: Rolled back
+		(*update)["DesiredState"] = ""
+		(*update)["State"] = "Active"
+		return nil
+	} else if v, ok := event.Actor.Attributes["updatestate.new"]; ok && (v == "paused" || v == "rollback_paused") { // case: Failed
+		(*update)["DesiredState"] = ""
+		(*update)["State"] = "Failed"
+		return nil
 	}
-	return fmt.Errorf("unhandled windows service event: %v", event.Action)
+	return unhandled(fmt.Errorf("unhandled windows service event: %v", event.Action))
 }
 
 func handleService(event events.Message) (string, map[string]string, error) {
 	var (
 		serviceName string
 		update      = make(map[string]string)
-		doc         map[string]interface{}
 	)
 
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		return "", update, err
-	}
-
 	if _, ok := event.Actor.Attributes["name"]; !ok {
-		return "", update, fmt.Errorf("no service 'name' Attribute")
+		return "", update, unhandled(fmt.Errorf("no service 'name' Attribute"))
 	}
 	serviceName = event.Actor.Attributes["name"]
 
-	cursor, err := r.DB("Controller").Table("Plugins").Filter(map[string]string{"ServiceName": serviceName}).Run(session)
-	if !cursor.Next(&doc) {
-		return "", update, fmt.Errorf("no plugin %v in database", serviceName)
+	doc, err := GetStore().GetPluginByServiceName(serviceName)
+	if err != nil {
+		return "", update, errorhandler.Transient(errorhandler.ComponentEventHandler, err).ForService(serviceName, event.Actor.ID)
+	} else if doc == nil {
+		return "", update, unhandled(fmt.Errorf("no plugin %v in database", serviceName))
 	}
 
 	err = handleServiceAction(event, &update)
+	if e, ok := err.(*errorhandler.Error); ok {
+		e.ForService(serviceName, event.Actor.ID)
+	}
 	return serviceName, update, err
 }
 
+// hasTask returns whether a task ID is in tasks.
+func hasTask(tasks []string, taskID string) bool {
+	for _, t := range tasks {
+		if t == taskID {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTask returns tasks without a task ID.
+func withoutTask(tasks []string, taskID string) []string {
+	res := []string{}
+	for _, t := range tasks {
+		if t != taskID {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// staleEvent returns why an event is about a task or
+// service the plugin has moved on from, or "" if it isn't.
+func staleEvent(plugin *Plugin, event events.Message) string {
+	var serviceID, taskID string
+	switch event.Type {
+	case "container":
+		serviceID = event.Actor.Attributes["com.docker.swarm.service.id"]
+		taskID = event.Actor.Attributes["com.docker.swarm.task.id"]
+	case "service":
+		if event.Action == "create" {
+			return ""
+		}
+		serviceID = event.Actor.ID
+	}
+	if serviceID != "" && plugin.ServiceID != "" && serviceID != plugin.ServiceID {
+		return fmt.Sprintf("event from old service %v", serviceID)
+	}
+	if taskID != "" && hasTask(plugin.OldTasks, taskID) {
+		return fmt.Sprintf("event from old task %v", taskID)
+	}
+	if event.Type != "container" || strings.HasPrefix(event.Action, "health_status: healthy") {
+		return ""
+	}
+	switch plugin.State {
+	case StateRestarting:
+		// The old tasks are expected to stop
+		return fmt.Sprintf("%v while restarting", event.Action)
+	case StateRollingBack:
+		return fmt.Sprintf("%v while rolling back", event.Action)
+	case StatePaused:
+		return fmt.Sprintf("%v while paused", event.Action)
+	}
+	return ""
+}
+
+// taskSlots returns how many tasks a plugin's service
+// runs, each of which the swarm restarts up to
+// MaxRestartAttempts times. A global service runs one
+// on each node for its OS.
+func taskSlots(plugin *Plugin) int {
+	if plugin.Mode != ModeGlobal {
+		if plugin.Replicas > 0 {
+			return plugin.Replicas
+		}
+		return 1
+	}
+	nodes, err := GetStore().ListPorts()
+	if err != nil {
+		// Failed sooner rather than never
+		log.Printf("%v: counting nodes failed: %v", plugin.ServiceName, err)
+		return 1
+	}
+	slots := 0
+	for _, node := range nodes {
+		if node["OS"] == NodeOS(plugin.OS) {
+			slots++
+		}
+	}
+	if slots == 0 {
+		return 1
+	}
+	return slots
+}
+
+// nextState returns the State a plugin moves to for
+// an event, adjusting its update and the other fields
+// written with it to suit. Its healthy tasks are tracked
+// so that it stays Active while any are, and a plugin
+// that is Starting stays so until one is, as does an
+// upgrading one until the swarm says how the update
+// ended. A plugin whose tasks have failed more times
+// than the swarm restarts them is Failed. Failures are
+// counted from when its service was created or last
+// updated. Failures and ExitCode are written to fields
+// as numbers, and to update as strings.
+func nextState(plugin *Plugin, event events.Message, update map[string]string, fields map[string]interface{}) PluginState {
+	next := PluginState(update["State"])
+	healthy := withoutTask(plugin.HealthyTasks, "")
+	taskID := event.Actor.Attributes["com.docker.swarm.task.id"]
+
+	switch {
+	case event.Type == "service" && event.Action == "create":
+		if plugin.State == StateStarting {
+			next = StateStarting
+		}
+		// Its tasks may have reported healthy first, as
+		// the two event streams aren't ordered, so they
+		// are kept. Those of an earlier service were
+		// cleared when it was removed.
+		fields["OldTasks"] = []string{}
+		if plugin.Failures > 0 {
+			update["Failures"] = "0"
+			fields["Failures"] = 0
+		}
+	case event.Type == "service" && (next == StateRestarting || next == StateRollingBack):
+		// Its tasks are all being replaced
+		fields["OldTasks"] = append(withoutTask(plugin.OldTasks, ""), healthy...)
+		healthy = []string{}
+		if plugin.Failures > 0 {
+			update["Failures"] = "0"
+			fields["Failures"] = 0
+		}
+	case event.Type == "service" && next == StateStopped:
+		healthy = []string{}
+	case event.Type == "container" && next == StateActive:
+		if taskID != "" && !hasTask(healthy, taskID) {
+			healthy = append(healthy, taskID)
+		}
+	case event.Type == "container":
+		healthy = withoutTask(healthy, taskID)
+		failures := plugin.Failures
+		exitCode, err := strconv.Atoi(update["ExitCode"])
+		if err == nil {
+			fields["ExitCode"] = exitCode
+		}
+		if event.Action == "die" && plugin.State != StateStopping && err == nil && exitCode != 0 {
+			failures++
+			update["Failures"] = strconv.Itoa(failures)
+			fields["Failures"] = failures
+		}
+		if len(healthy) > 0 {
+			// Its other tasks are still serving
+			next = plugin.State
+		} else if failures > MaxRestartAttempts*taskSlots(plugin) {
+			next = StateFailed
+		}
+	}
+	if event.Type == "container" && Upgrading(plugin) &&
+		(plugin.State == StateRestarting || plugin.State == StateRollingBack) {
+		next = plugin.State
+	}
+
+	fields["HealthyTasks"] = healthy
+	counted := *plugin
+	counted.HealthyTasks = healthy
+	update["Health"] = HealthSummary(&counted)
+	update["State"] = string(next)
+	return next
+}
+
+// transitionTries is how many times a transition is
+// tried when the plugin keeps changing under it.
+const transitionTries = 3
+
+// applyTransition moves a plugin to the State an event
+// implies, if its state machine allows it, and adds the
+// change to its StateHistory. Events about tasks or
+// services it has moved on from are ignored, and its
+// DesiredState is only cleared once the new State meets
+// it. A failed upgrade is added to the Errors table.
+// It returns what was written.
+func applyTransition(serviceName string, update map[string]string, event events.Message) (map[string]string, error) {
+	store := GetStore()
+
+	for try := 0; try < transitionTries; try++ {
+		doc, err := store.GetPluginByServiceName(serviceName)
+		if err != nil {
+			return nil, errorhandler.Transient(errorhandler.ComponentEventHandler, err).ForService(serviceName, "")
+		} else if doc == nil {
+			return nil, unhandled(fmt.Errorf("no plugin %v in database", serviceName))
+		}
+		plugin, err := newPlugin(doc)
+		if err != nil {
+			return nil, errorhandler.New(errorhandler.ComponentEventHandler, errorhandler.SeverityWarning, err).ForService(serviceName, "")
+		}
+
+		if reason := staleEvent(plugin, event); reason != "" {
+			return nil, unhandled(fmt.Errorf("ignoring %v", reason)).ForService(serviceName, plugin.ServiceID)
+		}
+		write := make(map[string]string)
+		for k, v := range update {
+			write[k] = v
+		}
+		fields := make(map[string]interface{})
+		next := nextState(plugin, event, write, fields)
+		if !CanTransition(plugin.State, next) {
+			return nil, unhandled(fmt.Errorf("ignoring %v %v: cannot go from %v to %v", event.Type, event.Action, plugin.State, next)).ForService(serviceName, plugin.ServiceID)
+		}
+		ended := event.Type == "service" && UpgradeOutcome(plugin, event.Actor.Attributes["updatestate.new"], write)
+		if _, ok := write["DesiredState"]; ok && !ended && !Completes(next, plugin.DesiredState) {
+			delete(write, "DesiredState")
+		}
+		var change *StateChange
+		if next != plugin.State {
+			change = &StateChange{
+				From:   plugin.State,
+				To:     next,
+				At:     Timestamp(time.Now()),
+				Reason: fmt.Sprintf("%v %v", event.Type, event.Action),
+			}
+		}
+
+		expect := map[string]string{
+			"State":        string(plugin.State),
+			"DesiredState": string(plugin.DesiredState),
+		}
+		for k, v := range write {
+			if _, ok := fields[k]; !ok {
+				// Counts are written as numbers
+				fields[k] = v
+			}
+		}
+		err = store.TransitionPlugin(serviceName, expect, fields, change)
+		if err == ErrStaleState {
+			continue
+		}
+		if err != nil {
+			return nil, errorhandler.Transient(errorhandler.ComponentEventHandler, err).ForService(serviceName, plugin.ServiceID)
+		}
+		if ended && write["LastError"] != "" {
+			err = store.InsertError(PluginError{
+				Timestamp:   write["LastErrorAt"],
+				Plugin:      plugin.Name,
+				ServiceName: serviceName,
+				ServiceID:   plugin.ServiceID,
+				Action:      string(DesiredStateUpgrade),
+				Message:     write["LastError"],
+			})
+			if err != nil {
+				log.Printf("%v: recording failed upgrade failed: %v", serviceName, err)
+			}
+		}
+		return write, nil
+	}
+	return nil, errorhandler.Transient(errorhandler.ComponentEventHandler, ErrStaleState).ForService(serviceName, "")
+}
+
+// updateFromEvent writes the change an event makes
+// to its plugin, if any, and sends it to WatchTransitions.
+func updateFromEvent(event events.Message) error {
+	var (
+		err         error
+		serviceName string
+		update      map[string]string
+	)
+	switch event.Type {
+	case "service":
+		// Check if updatestatus.new == updating
+		serviceName, update, err = handleService(event)
+	case "container":
+		// Check if health_status == healthy
+		// Check if event == die or health_status == unhealthy
+		serviceName, update, err = handleContainer(event)
+	default:
+		return unhandled(fmt.Errorf("not container or service type"))
+	}
+	if err != nil || serviceName == "" {
+		return err
+	}
+	written, err := applyTransition(serviceName, update, event)
+	if err != nil {
+		return err
+	}
+	transitionWatchers.publish(PluginTransition{
+		ServiceName: serviceName,
+		Update:      written,
+	})
+	return nil
+}
+
 // EventUpdate consumes the event channel from the docker
 // client event monitor. If handles events (one by one at
-// the moment) and updates the database as they are recieved.
-func EventUpdate(in <-chan events.Message) <-chan error {
+// the moment) and updates the database as they are recieved,
+// through each plugin's state machine.
+// It returns once the event channel is closed or the
+// context is done, finishing any update in progress.
+// Each update written is sent to WatchTransitions, and
+// each event's time is recorded as its type's checkpoint
+// once it has been handled.
+func EventUpdate(ctx context.Context, in <-chan events.Message) <-chan error {
 	outErr := make(chan error)
 
+	sendErr := func(err error) {
+		select {
+		case <-ctx.Done():
+		case outErr <- err:
+		}
+	}
+
 	go func(in <-chan events.Message) {
-	L:
-		for event := range in {
+		defer close(outErr)
+		for {
 			var (
-				err         error
-				serviceName string
-				update      map[string]string
+				event events.Message
+				ok    bool
 			)
-			switch event.Type {
-			case "service":
-				// Check if updatestatus.new == updating
-				serviceName, update, err = handleService(event)
-			case "container":
-				// Check if health_status == healthy
-				// Check if event == die or health_status == unhealthy
-				serviceName, update, err = handleContainer(event)
-			default:
-				outErr <- fmt.Errorf("not container or service type")
-				continue L
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok = <-in:
+				if !ok {
+					return
+				}
 			}
-			if err != nil {
-				outErr <- err
-				continue L
-			} else if serviceName == "" {
-				continue L
+			metrics.DockerEvents.Inc(event.Type, event.Action)
+			if err := updateFromEvent(event); err != nil {
+				metrics.EventUpdateFailures.Inc()
+				sendErr(err)
 			}
-			err = updatePluginStatus(serviceName, update)
-			if err != nil {
-				outErr <- err
+			if err := GetStore().SetEventCheckpoint(event.Type, event.TimeNano); err != nil {
+				sendErr(errorhandler.Transient(errorhandler.ComponentEventHandler, err))
 			}
 		}
 	}(in)
@@ -14,6 +14,7 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
 	"github.com/ramrod-project/backend-controller-go/helper"
 	"github.com/ramrod-project/backend-controller-go/test"
 	"github.com/stretchr/testify/assert"
@@ -1236,7 +1237,7 @@ func TestEventUpdate(t *testing.T) {
 			timeoutCtx, cancel := context.WithTimeout(context.Background(), tt.timeout)
 			defer cancel()
 			events, _ := dockerClient.Events(timeoutCtx, types.EventsOptions{})
-			errs := EventUpdate(events)
+			errs := EventUpdate(timeoutCtx, events)
 			// have to get errors so they don't block
 			go func() {
 				for e := range errs {
@@ -1578,6 +1579,12 @@ func Test_handleContainer(t *testing.T) {
 				t.Errorf("handleContainer() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				// Unhandled events are harmless
+				e, ok := err.(*errorhandler.Error)
+				assert.True(t, ok)
+				assert.Equal(t, errorhandler.SeverityInfo, e.Severity)
+			}
 			if gotSvc != tt.wantSvc {
 				t.Errorf("handleContainer() got = %v, want %v", gotSvc, tt.wantSvc)
 			}
@@ -1,26 +1,17 @@
 package rethink
 
 import (
-	"errors"
 	"fmt"
-	"log"
 
 	"github.com/docker/docker/api/types/swarm"
 	r "gopkg.in/gorethink/gorethink.v4"
 )
 
+// GetIPFromID returns the Interface of the plugin
+// running as the given service.
 func GetIPFromID(servID string) (string, error) {
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		return "", err
-	}
-	filter := make(map[string]interface{})
-	filter["ServiceID"] = servID
-	entry, _ := r.DB("Controller").Table("Plugins").Filter(filter).Run(session)
-	var res map[string]interface{}
-	if !entry.Next(&res) {
+	res, err := GetStore().GetPluginByServiceID(servID)
+	if err != nil || res == nil {
 		return "", err
 	}
 	addr := res["Interface"].(string)
@@ -48,7 +39,11 @@ func remove(arr []string, element string) []string {
 func getCurrentEntry(IPaddr string, session *r.Session) (map[string]interface{}, error) {
 	filter := make(map[string]interface{})
 	filter["Interface"] = IPaddr
-	entry, _ := r.DB("Controller").Table("Ports").Filter(filter).Run(session)
+	entry, err := portTable.Filter(filter).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Close()
 	var port map[string]interface{}
 	if !entry.Next(&port) {
 		return port, fmt.Errorf("Interface not found: %v", IPaddr)
@@ -56,99 +51,16 @@ func getCurrentEntry(IPaddr string, session *r.Session) (map[string]interface{},
 	return port, nil
 }
 
-// AddPort adds a port to the Ports table. it returns an error if
-// there was a duplicate
+// AddPort adds a port to the Ports table. Adding a port
+// that is already there changes nothing. It returns an
+// error if the interface isn't in the table.
 func AddPort(IPaddr string, newPort string, protocol swarm.PortConfigProtocol) error {
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
-
-	var (
-		port   map[string]interface{}
-		newTCP []string
-		newUDP []string
-	)
-	port, err = getCurrentEntry(IPaddr, session)
-	if err != nil {
-		log.Printf("%v", err)
-		return err
-	}
-
-	for _, tcpPort := range port["TCPPorts"].([]interface{}) {
-		newTCP = append(newTCP, tcpPort.(string))
-	}
-	for _, udpPort := range port["UDPPorts"].([]interface{}) {
-		newUDP = append(newUDP, udpPort.(string))
-	}
-
-	//update the ports
-	if protocol == swarm.PortConfigProtocolTCP {
-		if Contains(newTCP, newPort) {
-			return nil
-		}
-		port["TCPPorts"] = append(newTCP, newPort)
-	} else if protocol == swarm.PortConfigProtocolUDP {
-		if Contains(newUDP, newPort) {
-			return nil
-		}
-		port["UDPPorts"] = append(newUDP, newPort)
-	} else {
-		return errors.New("only tcp and udp are supported protocols")
-	}
-	//update the entry
-	_, err = r.DB("Controller").Table("Ports").Get(port["id"]).Update(port).RunWrite(session)
-	if err != nil {
-		log.Printf("%v", err)
-		return err
-	}
-	return nil
+	return GetStore().AddPort(IPaddr, newPort, protocol)
 }
 
-// RemovePort removes a port to the Ports table. it returns an error if
-// there was a duplicate
+// RemovePort removes a port from the Ports table. Removing
+// a port that isn't there changes nothing. It returns an
+// error if the interface isn't in the table.
 func RemovePort(IPaddr string, remPort string, protocol swarm.PortConfigProtocol) error {
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		return err
-	}
-
-	// get current entry
-	var (
-		port   map[string]interface{}
-		newTCP []string
-		newUDP []string
-	)
-	port, err = getCurrentEntry(IPaddr, session)
-	if err != nil {
-		log.Printf("%v", err)
-		return err
-	}
-
-	for _, tcpPort := range port["TCPPorts"].([]interface{}) {
-		newTCP = append(newTCP, tcpPort.(string))
-	}
-	for _, udpPort := range port["UDPPorts"].([]interface{}) {
-		newUDP = append(newUDP, udpPort.(string))
-	}
-
-	// update ports
-	if protocol == swarm.PortConfigProtocolTCP {
-		port["TCPPorts"] = remove(newTCP, remPort)
-	} else if protocol == swarm.PortConfigProtocolUDP {
-		port["UDPPorts"] = remove(newUDP, remPort)
-	} else {
-		return errors.New("only tcp and udp are supported protocols")
-	}
-	// update entry
-	_, err = r.DB("Controller").Table("Ports").Get(port["id"]).Update(port).RunWrite(session)
-	if err != nil {
-		log.Printf("%v", err)
-		return err
-	}
-	return nil
+	return GetStore().RemovePort(IPaddr, remPort, protocol)
 }
@@ -0,0 +1,493 @@
+package rethink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// MemoryStore is an in-memory Store, for running the
+// controller without a brain. It behaves like the
+// rethinkdb tables, including changefeeds.
+type MemoryStore struct {
+	mu          sync.Mutex
+	plugins     []map[string]interface{}
+	ports       []map[string]interface{}
+	errorDocs   []map[string]interface{}
+	checkpoints map[string]map[string]interface{}
+	subscribers map[*memoryFeed]struct{}
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subscribers: make(map[*memoryFeed]struct{}),
+		checkpoints: make(map[string]map[string]interface{}),
+	}
+}
+
+func newDocID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// normalize round trips a document through json so that
+// it decodes the same way the rethinkdb driver would, and
+// so that stored documents never share memory with callers.
+func normalize(doc interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	var res map[string]interface{}
+	if err = json.Unmarshal(b, &res); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// merge applies an update to a document, returning
+// whether anything changed.
+func merge(doc map[string]interface{}, update interface{}) bool {
+	changed := false
+	for k, v := range normalize(update) {
+		if k == "id" {
+			continue
+		}
+		if !reflect.DeepEqual(doc[k], v) {
+			doc[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *MemoryStore) publish(oldVal map[string]interface{}, newVal map[string]interface{}) {
+	change := map[string]interface{}{
+		"old_val": normalize(oldVal),
+		"new_val": normalize(newVal),
+	}
+	for f := range m.subscribers {
+		f.push(normalize(change))
+	}
+}
+
+func (m *MemoryStore) findPlugin(key string, value string) map[string]interface{} {
+	for _, p := range m.plugins {
+		if v, ok := p[key].(string); ok && v == value {
+			return p
+		}
+	}
+	return nil
+}
+
+// GetPluginByServiceName implements Store.
+func (m *MemoryStore) GetPluginByServiceName(serviceName string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return normalize(m.findPlugin("ServiceName", serviceName)), nil
+}
+
+// GetPluginByServiceID implements Store.
+func (m *MemoryStore) GetPluginByServiceID(serviceID string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return normalize(m.findPlugin("ServiceID", serviceID)), nil
+}
+
+// ListPlugins implements Store.
+func (m *MemoryStore) ListPlugins() ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	docs := make([]map[string]interface{}, len(m.plugins))
+	for i, p := range m.plugins {
+		docs[i] = normalize(p)
+	}
+	return docs, nil
+}
+
+// InsertPlugin implements Store.
+func (m *MemoryStore) InsertPlugin(plugin map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc := normalize(plugin)
+	if _, ok := doc["id"]; !ok {
+		doc["id"] = newDocID()
+	}
+	if m.findPlugin("id", doc["id"].(string)) != nil {
+		return fmt.Errorf("Duplicate primary key `id`: %v", doc["id"])
+	}
+	m.plugins = append(m.plugins, doc)
+	m.publish(nil, doc)
+	return nil
+}
+
+// UpdatePlugin implements Store.
+func (m *MemoryStore) UpdatePlugin(id string, update map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc := m.findPlugin("id", id)
+	if doc == nil {
+		return nil
+	}
+	old := normalize(doc)
+	if merge(doc, update) {
+		m.publish(old, doc)
+	}
+	return nil
+}
+
+// UpdatePluginStatus implements Store.
+func (m *MemoryStore) UpdatePluginStatus(serviceName string, update map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updated := 0
+	for _, doc := range m.plugins {
+		if v, ok := doc["ServiceName"].(string); !ok || v != serviceName {
+			continue
+		}
+		old := normalize(doc)
+		if merge(doc, update) {
+			m.publish(old, doc)
+			updated++
+		}
+	}
+	if updated == 0 {
+		return fmt.Errorf("no plugin to update")
+	}
+	return nil
+}
+
+// TransitionPlugin implements Store.
+func (m *MemoryStore) TransitionPlugin(serviceName string, expect map[string]string, update map[string]interface{}, change *StateChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc := m.findPlugin("ServiceName", serviceName)
+	if doc == nil {
+		return fmt.Errorf("no plugin to update")
+	}
+	for k, v := range expect {
+		if current, _ := doc[k].(string); current != v {
+			return ErrStaleState
+		}
+	}
+
+	old := normalize(doc)
+	changed := merge(doc, update)
+	if change != nil {
+		history, _ := doc["StateHistory"].([]interface{})
+		history = append(history, normalize(change))
+		if len(history) > MaxStateHistory {
+			history = history[len(history)-MaxStateHistory:]
+		}
+		doc["StateHistory"] = history
+		changed = true
+	}
+	if changed {
+		m.publish(old, doc)
+	}
+	return nil
+}
+
+// PluginChanges implements Store.
+func (m *MemoryStore) PluginChanges(ctx context.Context, opts ChangesOpts) (<-chan map[string]interface{}, <-chan error) {
+	f := &memoryFeed{
+		changes: make(chan map[string]interface{}),
+		errs:    make(chan error, 1),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if opts.IncludeStates {
+		f.push(map[string]interface{}{"state": "initializing"})
+	}
+	if opts.IncludeInitial {
+		for _, p := range m.plugins {
+			f.push(map[string]interface{}{"new_val": normalize(p)})
+		}
+	}
+	if opts.IncludeStates {
+		f.push(map[string]interface{}{"state": "ready"})
+	}
+	m.subscribers[f] = struct{}{}
+	m.mu.Unlock()
+
+	go f.run(ctx, func() {
+		m.mu.Lock()
+		delete(m.subscribers, f)
+		m.mu.Unlock()
+	})
+
+	return f.changes, f.errs
+}
+
+// CloseFeeds ends every open changefeed with err, the
+// way a brain restart would.
+func (m *MemoryStore) CloseFeeds(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for f := range m.subscribers {
+		f.terminate(err)
+	}
+}
+
+func (m *MemoryStore) findPorts(address string) map[string]interface{} {
+	for _, p := range m.ports {
+		if v, ok := p["Interface"].(string); ok && v == address {
+			return p
+		}
+	}
+	return nil
+}
+
+// ListPorts implements Store.
+func (m *MemoryStore) ListPorts() ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	docs := make([]map[string]interface{}, len(m.ports))
+	for i, p := range m.ports {
+		docs[i] = normalize(p)
+	}
+	return docs, nil
+}
+
+// GetPorts implements Store.
+func (m *MemoryStore) GetPorts(address string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc := m.findPorts(address)
+	if doc == nil {
+		return nil, fmt.Errorf("Interface not found: %v", address)
+	}
+	return normalize(doc), nil
+}
+
+// UpsertNode implements Store.
+func (m *MemoryStore) UpsertNode(node map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.ports {
+		if p["NodeHostName"] == node["NodeHostName"] {
+			merge(p, node)
+			return nil
+		}
+	}
+	doc := normalize(node)
+	if _, ok := doc["id"]; !ok {
+		doc["id"] = newDocID()
+	}
+	m.ports = append(m.ports, doc)
+	return nil
+}
+
+func portsField(protocol swarm.PortConfigProtocol) (string, error) {
+	switch protocol {
+	case swarm.PortConfigProtocolTCP:
+		return "TCPPorts", nil
+	case swarm.PortConfigProtocolUDP:
+		return "UDPPorts", nil
+	}
+	return "", errors.New("only tcp and udp are supported protocols")
+}
+
+func portList(doc map[string]interface{}, field string) []string {
+	var ports []string
+	if list, ok := doc[field].([]interface{}); ok {
+		for _, p := range list {
+			ports = append(ports, p.(string))
+		}
+	}
+	return ports
+}
+
+// AddPort implements Store.
+func (m *MemoryStore) AddPort(address string, newPort string, protocol swarm.PortConfigProtocol) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	field, err := portsField(protocol)
+	if err != nil {
+		return err
+	}
+	doc := m.findPorts(address)
+	if doc == nil {
+		return fmt.Errorf("Interface not found: %v", address)
+	}
+	ports := portList(doc, field)
+	if Contains(ports, newPort) {
+		return nil
+	}
+	merge(doc, map[string]interface{}{field: append(ports, newPort)})
+	return nil
+}
+
+// RemovePort implements Store.
+func (m *MemoryStore) RemovePort(address string, remPort string, protocol swarm.PortConfigProtocol) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	field, err := portsField(protocol)
+	if err != nil {
+		return err
+	}
+	doc := m.findPorts(address)
+	if doc == nil {
+		return fmt.Errorf("Interface not found: %v", address)
+	}
+	merge(doc, map[string]interface{}{field: remove(portList(doc, field), remPort)})
+	return nil
+}
+
+// InsertError implements Store.
+func (m *MemoryStore) InsertError(e PluginError) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc := normalize(e)
+	doc["id"] = newDocID()
+	m.errorDocs = append(m.errorDocs, doc)
+	return nil
+}
+
+// ListErrors implements Store.
+func (m *MemoryStore) ListErrors(serviceName string, limit int) ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	docs := []map[string]interface{}{}
+	for _, doc := range m.errorDocs {
+		if serviceName == "" || doc["ServiceName"] == serviceName {
+			docs = append(docs, normalize(doc))
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i]["Timestamp"].(string) > docs[j]["Timestamp"].(string)
+	})
+	if limit > 0 && len(docs) > limit {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+// GetEventCheckpoint implements Store.
+func (m *MemoryStore) GetEventCheckpoint(eventType string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.checkpoints[eventType]
+	if !ok {
+		return 0, nil
+	}
+	return parseTimeNano(doc["TimeNano"])
+}
+
+// SetEventCheckpoint implements Store.
+func (m *MemoryStore) SetEventCheckpoint(eventType string, timeNano int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checkpoints[eventType] = checkpointDoc(eventType, timeNano)
+	return nil
+}
+
+// memoryFeed is a single changefeed subscription. Changes
+// are queued so that writers never block on readers.
+type memoryFeed struct {
+	changes chan map[string]interface{}
+	errs    chan error
+
+	mu    sync.Mutex
+	queue []map[string]interface{}
+	err   error
+	once  sync.Once
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+func (f *memoryFeed) push(change map[string]interface{}) {
+	f.mu.Lock()
+	f.queue = append(f.queue, change)
+	f.mu.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *memoryFeed) terminate(err error) {
+	f.once.Do(func() {
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+		close(f.done)
+	})
+}
+
+func (f *memoryFeed) run(ctx context.Context, unsubscribe func()) {
+	defer close(f.errs)
+	defer close(f.changes)
+	defer unsubscribe()
+
+	for {
+		f.mu.Lock()
+		if len(f.queue) == 0 {
+			f.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.done:
+				f.mu.Lock()
+				err := f.err
+				f.mu.Unlock()
+				if err != nil {
+					f.errs <- err
+				}
+				return
+			case <-f.wake:
+				continue
+			}
+		}
+		change := f.queue[0]
+		f.queue = f.queue[1:]
+		f.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.done:
+			f.mu.Lock()
+			err := f.err
+			f.mu.Unlock()
+			if err != nil {
+				f.errs <- err
+			}
+			return
+		case f.changes <- change:
+		}
+	}
+}
@@ -0,0 +1,870 @@
+package rethink
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	events "github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+var memoryTestPlugin = map[string]interface{}{
+	"Name":          "TestPlugin",
+	"ServiceID":     "",
+	"ServiceName":   "TestPluginService",
+	"DesiredState":  string(DesiredStateNull),
+	"State":         string(StateAvailable),
+	"Interface":     "192.168.1.1",
+	"ExternalPorts": []string{"1080/tcp"},
+	"InternalPorts": []string{"1080/tcp"},
+	"OS":            string(PluginOSPosix),
+	"Environment":   []string{},
+}
+
+var memoryTestNode = map[string]interface{}{
+	"Interface":    "192.168.1.1",
+	"NodeHostName": "Docker",
+	"OS":           "posix",
+	"TCPPorts":     []string{"6003"},
+	"UDPPorts":     []string{},
+}
+
+func newTestMemoryStore(t *testing.T) *MemoryStore {
+	m := NewMemoryStore()
+	assert.Nil(t, m.InsertPlugin(memoryTestPlugin))
+	assert.Nil(t, m.UpsertNode(memoryTestNode))
+	return m
+}
+
+func TestMemoryStore_Plugins(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "TestPlugin", doc["Name"])
+	assert.Equal(t, []interface{}{"1080/tcp"}, doc["ExternalPorts"])
+	assert.NotEmpty(t, doc["id"])
+
+	doc, err = m.GetPluginByServiceName("Missing")
+	assert.Nil(t, err)
+	assert.Nil(t, doc)
+
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{"ServiceID": "abc"}))
+	assert.Equal(t, errors.New("no plugin to update"), m.UpdatePluginStatus("TestPluginService", map[string]string{"ServiceID": "abc"}))
+	assert.Equal(t, errors.New("no plugin to update"), m.UpdatePluginStatus("Missing", map[string]string{"ServiceID": "abc"}))
+
+	doc, err = m.GetPluginByServiceID("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "TestPluginService", doc["ServiceName"])
+
+	docs, err := m.ListPlugins()
+	assert.Nil(t, err)
+	assert.Len(t, docs, 1)
+}
+
+func TestMemoryStore_TransitionPlugin(t *testing.T) {
+	m := newTestMemoryStore(t)
+	expect := map[string]string{"State": "Available", "DesiredState": ""}
+
+	assert.Nil(t, m.TransitionPlugin("TestPluginService", expect, map[string]interface{}{"State": "Active"}, &StateChange{
+		From:   StateAvailable,
+		To:     StateActive,
+		At:     "2018-05-01T10:00:00.000Z",
+		Reason: "service create",
+	}))
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Active", doc["State"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"From":   "Available",
+		"To":     "Active",
+		"At":     "2018-05-01T10:00:00.000Z",
+		"Reason": "service create",
+	}}, doc["StateHistory"])
+
+	// It moved on since expect was read
+	assert.Equal(t, ErrStaleState, m.TransitionPlugin("TestPluginService", expect, map[string]interface{}{"State": "Stopped"}, nil))
+	assert.Equal(t, errors.New("no plugin to update"), m.TransitionPlugin("Missing", expect, map[string]interface{}{"State": "Stopped"}, nil))
+
+	// Only the latest changes are kept
+	expect["State"] = "Active"
+	for i := 0; i < MaxStateHistory; i++ {
+		assert.Nil(t, m.TransitionPlugin("TestPluginService", expect, map[string]interface{}{}, &StateChange{
+			From:   StateActive,
+			To:     StateActive,
+			Reason: "container die",
+		}))
+	}
+	doc, err = m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Len(t, doc["StateHistory"], MaxStateHistory)
+	assert.Equal(t, "container die", doc["StateHistory"].([]interface{})[0].(map[string]interface{})["Reason"])
+}
+
+func TestMemoryStore_Errors(t *testing.T) {
+	m := NewMemoryStore()
+
+	assert.Nil(t, m.InsertError(PluginError{
+		Timestamp:   "2018-05-01T10:00:00.000Z",
+		Plugin:      "Harness",
+		ServiceName: "Harness-5000",
+		Action:      "Activate",
+		Message:     "no such image",
+	}))
+	assert.Nil(t, m.InsertError(PluginError{
+		Timestamp:   "2018-05-01T10:00:30.000Z",
+		Plugin:      "Harness",
+		ServiceName: "Harness-5000",
+		Action:      "Activate",
+		Message:     "port conflict",
+	}))
+	assert.Nil(t, m.InsertError(PluginError{
+		Timestamp:   "2018-05-01T10:00:10.000Z",
+		Plugin:      "Harness",
+		ServiceName: "Harness-6000",
+		Action:      "Stop",
+		Message:     "no such service",
+	}))
+
+	docs, err := m.ListErrors("", 0)
+	assert.Nil(t, err)
+	assert.Len(t, docs, 3)
+	assert.Equal(t, "port conflict", docs[0]["Message"])
+	assert.NotEmpty(t, docs[0]["id"])
+
+	docs, err = m.ListErrors("Harness-5000", 1)
+	assert.Nil(t, err)
+	assert.Len(t, docs, 1)
+	assert.Equal(t, "port conflict", docs[0]["Message"])
+
+	docs, err = m.ListErrors("Missing", 0)
+	assert.Nil(t, err)
+	assert.Empty(t, docs)
+}
+
+func TestMemoryStore_Ports(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(m *MemoryStore) error
+		wantErr  bool
+		wantTCP  interface{}
+		wantUDP  interface{}
+		hostname string
+	}{
+		{
+			name: "add tcp",
+			run: func(m *MemoryStore) error {
+				return m.AddPort("192.168.1.1", "9990", swarm.PortConfigProtocolTCP)
+			},
+			wantTCP: []interface{}{"6003", "9990"},
+			wantUDP: []interface{}{},
+		},
+		{
+			name: "add duplicate",
+			run: func(m *MemoryStore) error {
+				return m.AddPort("192.168.1.1", "6003", swarm.PortConfigProtocolTCP)
+			},
+			wantTCP: []interface{}{"6003"},
+			wantUDP: []interface{}{},
+		},
+		{
+			name: "add udp",
+			run: func(m *MemoryStore) error {
+				return m.AddPort("192.168.1.1", "53", swarm.PortConfigProtocolUDP)
+			},
+			wantTCP: []interface{}{"6003"},
+			wantUDP: []interface{}{"53"},
+		},
+		{
+			name: "remove tcp",
+			run: func(m *MemoryStore) error {
+				return m.RemovePort("192.168.1.1", "6003", swarm.PortConfigProtocolTCP)
+			},
+			wantTCP: []interface{}{},
+			wantUDP: []interface{}{},
+		},
+		{
+			name: "bad interface",
+			run: func(m *MemoryStore) error {
+				return m.AddPort("10.0.0.1", "9990", swarm.PortConfigProtocolTCP)
+			},
+			wantErr: true,
+			wantTCP: []interface{}{"6003"},
+			wantUDP: []interface{}{},
+		},
+		{
+			name: "bad protocol",
+			run: func(m *MemoryStore) error {
+				return m.AddPort("192.168.1.1", "9990", swarm.PortConfigProtocol("sctp"))
+			},
+			wantErr: true,
+			wantTCP: []interface{}{"6003"},
+			wantUDP: []interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemoryStore(t)
+			if err := tt.run(m); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			doc, err := m.GetPorts("192.168.1.1")
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantTCP, doc["TCPPorts"])
+			assert.Equal(t, tt.wantUDP, doc["UDPPorts"])
+		})
+	}
+}
+
+func TestMemoryStore_PluginChanges(t *testing.T) {
+	m := newTestMemoryStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes, errs := m.PluginChanges(ctx, ChangesOpts{})
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{"DesiredState": "Activate"}))
+
+	select {
+	case c := <-changes:
+		assert.Equal(t, "Activate", c["new_val"].(map[string]interface{})["DesiredState"])
+		assert.Equal(t, "", c["old_val"].(map[string]interface{})["DesiredState"])
+	case <-time.After(time.Second):
+		t.Errorf("no change received")
+	}
+
+	cancel()
+	_, ok := <-changes
+	assert.False(t, ok)
+	_, ok = <-errs
+	assert.False(t, ok)
+
+	changes, errs = m.PluginChanges(context.Background(), ChangesOpts{})
+	m.CloseFeeds(errors.New("connection closed"))
+	assert.Equal(t, errors.New("connection closed"), <-errs)
+	_, ok = <-changes
+	assert.False(t, ok)
+}
+
+func TestMonitorPlugins_MemoryStore(t *testing.T) {
+	m := newTestMemoryStore(t)
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plugins, _ := MonitorPlugins(ctx)
+	// Give the feed a moment to subscribe
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{"DesiredState": "Activate"}))
+
+	select {
+	case p := <-plugins:
+		assert.Equal(t, DesiredStateActivate, p.DesiredState)
+		assert.Equal(t, "TestPluginService", p.ServiceName)
+	case <-time.After(time.Second):
+		t.Errorf("no plugin received")
+	}
+}
+
+func TestMonitorPlugins_Resume(t *testing.T) {
+	m := newTestMemoryStore(t)
+	idle := normalize(memoryTestPlugin)
+	idle["Name"] = "IdlePlugin"
+	idle["ServiceName"] = "IdlePluginService"
+	assert.Nil(t, m.InsertPlugin(idle))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plugins, errs := MonitorPlugins(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	// Brain restarts, and a plugin is activated
+	// while the feed is down
+	m.CloseFeeds(errors.New("connection closed"))
+	select {
+	case err := <-errs:
+		assert.Contains(t, err.Error(), "plugin changefeed ended: connection closed")
+	case <-time.After(time.Second):
+		t.Errorf("reconnect not reported")
+	}
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{"DesiredState": "Activate"}))
+
+	select {
+	case p := <-plugins:
+		assert.Equal(t, DesiredStateActivate, p.DesiredState)
+		assert.Equal(t, "TestPluginService", p.ServiceName)
+	case <-time.After(time.Second):
+		t.Errorf("missed desired state not resent")
+	}
+
+	// Only pending plugins are resent, and
+	// new changes keep coming after resuming
+	assert.Nil(t, m.UpdatePluginStatus("IdlePluginService", map[string]string{"DesiredState": "Stop"}))
+	select {
+	case p := <-plugins:
+		assert.Equal(t, DesiredStateStop, p.DesiredState)
+		assert.Equal(t, "IdlePluginService", p.ServiceName)
+	case <-time.After(time.Second):
+		t.Errorf("no plugin received after resuming")
+	}
+}
+
+func TestEventUpdate_MemoryStore(t *testing.T) {
+	m := newTestMemoryStore(t)
+	SetStore(m)
+	defer SetStore(nil)
+
+	in := make(chan events.Message)
+	errs := EventUpdate(context.Background(), in)
+	defer close(in)
+
+	in <- events.Message{
+		Type:   "service",
+		Action: "create",
+		Actor: events.Actor{
+			ID: "some-service-id",
+			Attributes: map[string]string{
+				"name": "TestPluginService",
+			},
+		},
+		TimeNano: 42,
+	}
+
+	// The checkpoint is only moved on once
+	// the event has been applied
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		at, err := m.GetEventCheckpoint("service")
+		assert.Nil(t, err)
+		if at == 42 {
+			doc, err := m.GetPluginByServiceName("TestPluginService")
+			assert.Nil(t, err)
+			assert.Equal(t, string(StateActive), doc["State"])
+			assert.Equal(t, "some-service-id", doc["ServiceID"])
+			return
+		}
+		select {
+		case err := <-errs:
+			t.Errorf("%v", err)
+			return
+		default:
+		}
+	}
+	t.Errorf("plugin state not updated")
+}
+
+func TestEventUpdate_StateMachine(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{
+		"State":        "Active",
+		"DesiredState": "Restart",
+		"ServiceID":    "some-service-id",
+	}))
+	assert.Nil(t, m.TransitionPlugin("TestPluginService", nil, map[string]interface{}{
+		"HealthyTasks": []string{"old-task-id"},
+	}, nil))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	container := func(action string, taskID string) events.Message {
+		return events.Message{
+			Type:   "container",
+			Action: action,
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"com.docker.swarm.task.id":      taskID,
+				},
+			},
+		}
+	}
+	updating := events.Message{
+		Type:   "service",
+		Action: "update",
+		Actor: events.Actor{
+			ID: "some-service-id",
+			Attributes: map[string]string{
+				"name":            "TestPluginService",
+				"updatestate.new": "updating",
+			},
+		},
+	}
+	steps := []struct {
+		event events.Message
+		err   string
+		state string
+	}{
+		{event: updating, state: "Restarting"},
+		{event: container("die", "old-task-id"), err: "ignoring event from old task old-task-id"},
+		{event: container("die", ""), err: "ignoring die while restarting"},
+		{event: container("health_status: healthy", "new-task-id"), state: "Active"},
+		{event: container("die", "old-task-id"), err: "ignoring event from old task old-task-id"},
+	}
+	for _, step := range steps {
+		in <- step.event
+		if step.err != "" {
+			select {
+			case err := <-errs:
+				assert.Contains(t, err.Error(), step.err)
+			case <-time.After(time.Second):
+				t.Errorf("%v not ignored", step.event.Action)
+			}
+			continue
+		}
+		select {
+		case tr := <-transitions:
+			assert.Equal(t, step.state, tr.Update["State"])
+		case err := <-errs:
+			t.Errorf("%v", err)
+		case <-time.After(time.Second):
+			t.Errorf("no transition for %v", step.event.Action)
+		}
+	}
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Active", doc["State"])
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, []interface{}{"new-task-id"}, doc["HealthyTasks"])
+	assert.Equal(t, []interface{}{"old-task-id"}, doc["OldTasks"])
+	assert.Equal(t, "1/1 healthy", doc["Health"])
+	history := doc["StateHistory"].([]interface{})
+	assert.Len(t, history, 2)
+	assert.Equal(t, "Restarting", history[0].(map[string]interface{})["To"])
+	assert.Equal(t, "container health_status: healthy", history[1].(map[string]interface{})["Reason"])
+}
+
+func TestEventUpdate_Failed(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{
+		"State":     "Active",
+		"ServiceID": "some-service-id",
+	}))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	// The swarm restarts the task MaxRestartAttempts
+	// times, then gives up
+	for i := 1; i <= MaxRestartAttempts+1; i++ {
+		in <- events.Message{
+			Type:   "container",
+			Action: "die",
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"exitCode":                      "2",
+				},
+			},
+		}
+		select {
+		case tr := <-transitions:
+			assert.Equal(t, strconv.Itoa(i), tr.Update["Failures"])
+		case err := <-errs:
+			t.Errorf("%v", err)
+		case <-time.After(time.Second):
+			t.Errorf("no transition for die %v", i)
+		}
+	}
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Failed", doc["State"])
+	assert.Equal(t, float64(2), doc["ExitCode"])
+	assert.Equal(t, float64(MaxRestartAttempts+1), doc["Failures"])
+	plugin, err := newPlugin(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxRestartAttempts+1, plugin.Failures)
+
+	// Restarting it starts the count again
+	in <- events.Message{
+		Type:   "service",
+		Action: "update",
+		Actor: events.Actor{
+			ID: "some-service-id",
+			Attributes: map[string]string{
+				"name":            "TestPluginService",
+				"updatestate.new": "updating",
+			},
+		},
+	}
+	select {
+	case tr := <-transitions:
+		assert.Equal(t, "Restarting", tr.Update["State"])
+		assert.Equal(t, "0", tr.Update["Failures"])
+	case err := <-errs:
+		t.Errorf("%v", err)
+	case <-time.After(time.Second):
+		t.Errorf("no transition for update")
+	}
+}
+
+func Test_taskSlots(t *testing.T) {
+	m := newTestMemoryStore(t)
+	for _, node := range []map[string]interface{}{
+		{"Interface": "192.168.1.2", "NodeHostName": "posix", "OS": "posix"},
+		{"Interface": "192.168.1.3", "NodeHostName": "nt", "OS": "nt"},
+	} {
+		assert.Nil(t, m.UpsertNode(node))
+	}
+	SetStore(m)
+	defer SetStore(nil)
+
+	tests := []struct {
+		name   string
+		plugin Plugin
+		want   int
+	}{
+		{
+			name:   "One replica",
+			plugin: Plugin{OS: PluginOSPosix},
+			want:   1,
+		},
+		{
+			name:   "Replicated",
+			plugin: Plugin{OS: PluginOSPosix, Replicas: 3},
+			want:   3,
+		},
+		{
+			name:   "Global",
+			plugin: Plugin{OS: PluginOSAll, Mode: ModeGlobal},
+			want:   2,
+		},
+		{
+			name:   "Global windows",
+			plugin: Plugin{OS: PluginOSWindows, Mode: ModeGlobal},
+			want:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, taskSlots(&tt.plugin))
+		})
+	}
+}
+
+func TestEventUpdate_Replicas(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.TransitionPlugin("TestPluginService", nil, map[string]interface{}{
+		"State":     "Active",
+		"ServiceID": "some-service-id",
+		"Replicas":  3,
+	}, nil))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	container := func(action string, taskID string) events.Message {
+		return events.Message{
+			Type:   "container",
+			Action: action,
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"com.docker.swarm.task.id":      taskID,
+					"exitCode":                      "1",
+				},
+			},
+		}
+	}
+	steps := []struct {
+		event  events.Message
+		state  string
+		health string
+	}{
+		{event: container("health_status: healthy", "task-1"), state: "Active", health: "1/3 healthy"},
+		{event: container("health_status: healthy", "task-2"), state: "Active", health: "2/3 healthy"},
+		{event: container("health_status: healthy", "task-3"), state: "Active", health: "3/3 healthy"},
+		// One task failing leaves the plugin Active
+		{event: container("die", "task-2"), state: "Active", health: "2/3 healthy"},
+		{event: container("health_status: unhealthy", "task-1"), state: "Active", health: "1/3 healthy"},
+		{event: container("die", "task-3"), state: "Stopped", health: "0/3 healthy"},
+	}
+	for _, step := range steps {
+		in <- step.event
+		select {
+		case tr := <-transitions:
+			assert.Equal(t, step.state, tr.Update["State"])
+			assert.Equal(t, step.health, tr.Update["Health"])
+		case err := <-errs:
+			t.Errorf("%v", err)
+		case <-time.After(time.Second):
+			t.Errorf("no transition for %v", step.event.Action)
+		}
+	}
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), doc["Failures"])
+	assert.Equal(t, []interface{}{}, doc["HealthyTasks"])
+}
+
+func TestEventUpdate_LateCreate(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{
+		"State":        "Starting",
+		"DesiredState": "Activate",
+	}))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	// The task's event overtakes the service's
+	steps := []events.Message{
+		{
+			Type:   "container",
+			Action: "health_status: healthy",
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"com.docker.swarm.task.id":      "task-1",
+				},
+			},
+		},
+		{
+			Type:   "service",
+			Action: "create",
+			Actor: events.Actor{
+				ID:         "some-service-id",
+				Attributes: map[string]string{"name": "TestPluginService"},
+			},
+		},
+	}
+	for _, event := range steps {
+		in <- event
+		select {
+		case tr := <-transitions:
+			assert.Equal(t, "Active", tr.Update["State"])
+			assert.Equal(t, "1/1 healthy", tr.Update["Health"])
+		case err := <-errs:
+			t.Errorf("%v", err)
+		case <-time.After(time.Second):
+			t.Errorf("no transition for %v", event.Action)
+		}
+	}
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"task-1"}, doc["HealthyTasks"])
+	assert.Equal(t, "some-service-id", doc["ServiceID"])
+}
+
+func TestEventUpdate_Paused(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.TransitionPlugin("TestPluginService", nil, map[string]interface{}{
+		"State":        "Paused",
+		"ServiceID":    "some-service-id",
+		"HealthyTasks": []string{},
+		"OldTasks":     []string{"task-1"},
+	}, nil))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	container := func(action string, taskID string) events.Message {
+		return events.Message{
+			Type:   "container",
+			Action: action,
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"com.docker.swarm.task.id":      taskID,
+					"exitCode":                      "143",
+				},
+			},
+		}
+	}
+
+	// Its tasks stopping doesn't stop the plugin
+	for _, event := range []events.Message{container("die", "task-1"), container("die", "task-2")} {
+		select {
+		case in <- event:
+		case <-time.After(time.Second):
+			t.Fatalf("event not taken")
+		}
+		select {
+		case err := <-errs:
+			assert.Contains(t, err.Error(), "ignoring")
+		case tr := <-transitions:
+			t.Errorf("unexpected transition %v", tr.Update)
+		case <-time.After(time.Second):
+			t.Errorf("no error for %v", event.Actor.Attributes["com.docker.swarm.task.id"])
+		}
+	}
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Paused", doc["State"])
+	assert.Nil(t, doc["Failures"])
+
+	// Resumed once a new task is healthy
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{
+		"State":        "Starting",
+		"DesiredState": "Resume",
+	}))
+	in <- container("health_status: healthy", "task-3")
+	select {
+	case tr := <-transitions:
+		assert.Equal(t, "Active", tr.Update["State"])
+		assert.Equal(t, "", tr.Update["DesiredState"])
+		assert.Equal(t, "1/1 healthy", tr.Update["Health"])
+	case err := <-errs:
+		t.Errorf("%v", err)
+	case <-time.After(time.Second):
+		t.Errorf("no transition for health_status: healthy")
+	}
+}
+
+func TestEventUpdate_Upgrade(t *testing.T) {
+	m := newTestMemoryStore(t)
+	assert.Nil(t, m.TransitionPlugin("TestPluginService", nil, map[string]interface{}{
+		"State":        "Restarting",
+		"DesiredState": "Upgrade",
+		"ServiceID":    "some-service-id",
+		"Tag":          "1.0",
+		"TargetTag":    "2.0",
+		"HealthyTasks": []string{"old-task-id"},
+	}, nil))
+	SetStore(m)
+	defer SetStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transitions := WatchTransitions(ctx)
+	in := make(chan events.Message)
+	errs := EventUpdate(ctx, in)
+	defer close(in)
+
+	container := func(action string, taskID string) events.Message {
+		return events.Message{
+			Type:   "container",
+			Action: action,
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"com.docker.swarm.service.name": "TestPluginService",
+					"com.docker.swarm.service.id":   "some-service-id",
+					"com.docker.swarm.task.id":      taskID,
+					"exitCode":                      "1",
+				},
+			},
+		}
+	}
+	update := func(updateState string) events.Message {
+		return events.Message{
+			Type:   "service",
+			Action: "update",
+			Actor: events.Actor{
+				ID: "some-service-id",
+				Attributes: map[string]string{
+					"name":            "TestPluginService",
+					"updatestate.new": updateState,
+				},
+			},
+		}
+	}
+	steps := []struct {
+		event events.Message
+		err   string
+		state string
+	}{
+		{event: update("updating"), state: "Restarting"},
+		{event: container("die", "old-task-id"), err: "ignoring event from old task old-task-id"},
+		{event: container("die", "new-task-id"), err: "ignoring die while restarting"},
+		{event: update("rollback_started"), state: "RollingBack"},
+		// Left rolling back until the swarm is done
+		{event: container("health_status: healthy", "rolled-back-task-id"), state: "RollingBack"},
+		{event: update("rollback_completed"), state: "Active"},
+	}
+	for _, step := range steps {
+		in <- step.event
+		if step.err != "" {
+			select {
+			case err := <-errs:
+				assert.Contains(t, err.Error(), step.err)
+			case <-time.After(time.Second):
+				t.Errorf("%v not ignored", step.event.Action)
+			}
+			continue
+		}
+		select {
+		case tr := <-transitions:
+			assert.Equal(t, step.state, tr.Update["State"])
+		case err := <-errs:
+			t.Errorf("%v", err)
+		case <-time.After(time.Second):
+			t.Errorf("no transition for %v", step.event.Action)
+		}
+	}
+
+	doc, err := m.GetPluginByServiceName("TestPluginService")
+	assert.Nil(t, err)
+	assert.Equal(t, "Active", doc["State"])
+	assert.Equal(t, "", doc["DesiredState"])
+	assert.Equal(t, "1.0", doc["Tag"])
+	assert.Equal(t, "", doc["TargetTag"])
+	assert.Equal(t, "RolledBack", doc["UpgradeStatus"])
+	assert.Equal(t, "upgrade to 2.0 failed and was rolled back", doc["LastError"])
+	assert.Equal(t, "1/1 healthy", doc["Health"])
+	errors, err := m.ListErrors("TestPluginService", 0)
+	assert.Nil(t, err)
+	assert.Len(t, errors, 1)
+	assert.Equal(t, "Upgrade", errors[0]["Action"])
+
+	// An upgrade that works keeps its tag
+	assert.Nil(t, m.UpdatePluginStatus("TestPluginService", map[string]string{
+		"State":        "Restarting",
+		"DesiredState": "Upgrade",
+		"TargetTag":    "2.1",
+	}))
+	in <- update("completed")
+	select {
+	case tr := <-transitions:
+		assert.Equal(t, "Active", tr.Update["State"])
+		assert.Equal(t, "2.1", tr.Update["Tag"])
+		assert.Equal(t, "Completed", tr.Update["UpgradeStatus"])
+		assert.Equal(t, "", tr.Update["DesiredState"])
+	case err := <-errs:
+		t.Errorf("%v", err)
+	case <-time.After(time.Second):
+		t.Errorf("no transition for completed")
+	}
+}
@@ -1,10 +1,17 @@
 package rethink
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"time"
 
-	r "gopkg.in/gorethink/gorethink.v4"
+	"github.com/ramrod-project/backend-controller-go/errorhandler"
+	"github.com/ramrod-project/backend-controller-go/health"
+	"github.com/ramrod-project/backend-controller-go/helper"
 )
 
 // Plugin represents a plugin entry
@@ -18,9 +25,60 @@ type Plugin struct {
 	Address       string
 	ExternalPorts []string
 	InternalPorts []string
-	OS            PluginOS
-	Environment   []string
-	Extra         bool
+	// PublishedPorts are the ports the service publishes,
+	// with any "auto" ExternalPorts assigned.
+	PublishedPorts []string `json:",omitempty"`
+	OS             PluginOS
+	Environment    []string
+	Extra          bool
+	Description    string             `json:",omitempty"`
+	Image          string             `json:",omitempty"`
+	Tag            string             `json:",omitempty"`
+	Digest         string             `json:",omitempty"`
+	Resources      *PluginResources   `json:",omitempty"`
+	Healthcheck    *PluginHealthcheck `json:",omitempty"`
+	LastError      string             `json:",omitempty"`
+	LastErrorAt    string             `json:",omitempty"`
+	// Failures counts the service's tasks that exited
+	// with an error since it was started or restarted,
+	// and ExitCode is the latest task's exit code.
+	Failures int `json:",omitempty"`
+	ExitCode int `json:",omitempty"`
+	// Replicas is how many tasks a replicated plugin
+	// runs, 1 unless set. Mode is replicated unless set.
+	Replicas int        `json:",omitempty"`
+	Mode     PluginMode `json:",omitempty"`
+	// HealthyTasks are the IDs of the service's healthy
+	// tasks, and OldTasks those from before it was last
+	// restarted. Health summarizes them, e.g. "2/3 healthy".
+	HealthyTasks []string `json:",omitempty"`
+	OldTasks     []string `json:",omitempty"`
+	Health       string   `json:",omitempty"`
+	// TargetTag and TargetDigest are the image an Upgrade
+	// moves to, becoming Tag and Digest if it succeeds.
+	// UpgradeStatus is how the latest upgrade ended.
+	TargetTag     string              `json:",omitempty"`
+	TargetDigest  string              `json:",omitempty"`
+	UpgradeStatus PluginUpgradeStatus `json:",omitempty"`
+}
+
+// PluginResources are the resource limits
+// for a plugin's service.
+type PluginResources struct {
+	// CPUs is the CPU limit, e.g. 0.5
+	CPUs float64 `json:",omitempty"`
+	// MemoryMB is the memory limit in megabytes.
+	MemoryMB int64 `json:",omitempty"`
+}
+
+// PluginHealthcheck is the healthcheck for a plugin's
+// service. Interval and Timeout are durations such as
+// "5s". Unset fields keep the controller's defaults.
+type PluginHealthcheck struct {
+	Test     []string `json:",omitempty"`
+	Interval string   `json:",omitempty"`
+	Timeout  string   `json:",omitempty"`
+	Retries  int      `json:",omitempty"`
 }
 
 // PluginOS is the supported OS for the plugin
@@ -35,6 +93,42 @@ const (
 	PluginOSAll PluginOS = "all"
 )
 
+// NodeOS returns the os label of the nodes a plugin
+// for an OS is placed on, which is posix for any.
+func NodeOS(pluginOS PluginOS) string {
+	if pluginOS == PluginOSWindows {
+		return "nt"
+	}
+	return "posix"
+}
+
+// PluginMode is how a plugin's tasks are scheduled.
+type PluginMode string
+
+const (
+	// ModeReplicated runs Replicas tasks.
+	ModeReplicated PluginMode = "replicated"
+	// ModeGlobal runs a task on every node
+	// matching the plugin's OS.
+	ModeGlobal PluginMode = "global"
+)
+
+// PluginUpgradeStatus is how a plugin's
+// latest upgrade ended.
+type PluginUpgradeStatus string
+
+const (
+	// UpgradeCompleted is an upgrade whose
+	// new tasks all started.
+	UpgradeCompleted PluginUpgradeStatus = "Completed"
+	// UpgradeRolledBack is an upgrade the swarm
+	// undid after its new tasks failed.
+	UpgradeRolledBack PluginUpgradeStatus = "RolledBack"
+	// UpgradeRollbackFailed is an upgrade
+	// that failed to roll back as well.
+	UpgradeRollbackFailed PluginUpgradeStatus = "RollbackFailed"
+)
+
 // PluginDesiredState is the desired state of the
 // plugin service.
 type PluginDesiredState string
@@ -46,6 +140,18 @@ const (
 	DesiredStateRestart PluginDesiredState = "Restart"
 	// DesiredStateStop is the stop plugin command.
 	DesiredStateStop PluginDesiredState = "Stop"
+	// DesiredStateScale is the command to change
+	// the number of tasks to Replicas.
+	DesiredStateScale PluginDesiredState = "Scale"
+	// DesiredStatePause is the command to stop a
+	// plugin's tasks but keep its service.
+	DesiredStatePause PluginDesiredState = "Pause"
+	// DesiredStateResume is the command to start
+	// a paused plugin's tasks again.
+	DesiredStateResume PluginDesiredState = "Resume"
+	// DesiredStateUpgrade is the command to roll
+	// the service out to TargetTag and TargetDigest.
+	DesiredStateUpgrade PluginDesiredState = "Upgrade"
 	// DesiredStateNull is no command.
 	DesiredStateNull PluginDesiredState = ""
 )
@@ -56,12 +162,28 @@ type PluginState string
 const (
 	// StateAvailable is the plugin available state.
 	StateAvailable PluginState = "Available"
+	// StateStarting is the service being created.
+	StateStarting PluginState = "Starting"
 	// StateActive is the running state.
 	StateActive PluginState = "Active"
 	// StateRestarting is the updating state.
 	StateRestarting PluginState = "Restarting"
+	// StateStopping is the service being removed.
+	StateStopping PluginState = "Stopping"
 	// StateStopped is the removed state.
 	StateStopped PluginState = "Stopped"
+	// StateRollingBack is a failed update
+	// being undone.
+	StateRollingBack PluginState = "RollingBack"
+	// StatePaused is a service kept with
+	// no tasks running.
+	StatePaused PluginState = "Paused"
+	// StateFailed is a service that couldn't
+	// be started, or keeps failing.
+	StateFailed PluginState = "Failed"
+	// StateRetired is an advertised plugin no
+	// longer in the manifest.
+	StateRetired PluginState = "Retired"
 )
 
 // NewControllerError returns a custom ControllerError.
@@ -88,8 +210,26 @@ func GetRethinkHost() string {
 	return "rethinkdb"
 }
 
+// ParsePlugin parses a document from the
+// Plugins table into a Plugin.
+func ParsePlugin(doc map[string]interface{}) (*Plugin, error) {
+	return newPlugin(doc)
+}
+
+// decodeField decodes an optional object field of a
+// document into out, whichever way it was decoded.
+func decodeField(v interface{}, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
 func newPlugin(change map[string]interface{}) (*Plugin, error) {
 	var (
+		resources   *PluginResources
+		healthcheck *PluginHealthcheck
 		name        string
 		serviceID   string
 		serviceName string
@@ -110,6 +250,14 @@ func newPlugin(change map[string]interface{}) (*Plugin, error) {
 		desired = DesiredStateRestart
 	case string(DesiredStateStop):
 		desired = DesiredStateStop
+	case string(DesiredStateScale):
+		desired = DesiredStateScale
+	case string(DesiredStatePause):
+		desired = DesiredStatePause
+	case string(DesiredStateResume):
+		desired = DesiredStateResume
+	case string(DesiredStateUpgrade):
+		desired = DesiredStateUpgrade
 	case "":
 		desired = DesiredStateNull
 	default:
@@ -121,10 +269,22 @@ func newPlugin(change map[string]interface{}) (*Plugin, error) {
 		state = StateActive
 	case string(StateAvailable):
 		state = StateAvailable
+	case string(StateStarting):
+		state = StateStarting
 	case string(StateRestarting):
 		state = StateRestarting
+	case string(StateStopping):
+		state = StateStopping
 	case string(StateStopped):
 		state = StateStopped
+	case string(StatePaused):
+		state = StatePaused
+	case string(StateRollingBack):
+		state = StateRollingBack
+	case string(StateFailed):
+		state = StateFailed
+	case string(StateRetired):
+		state = StateRetired
 	default:
 		return &Plugin{}, NewControllerError(fmt.Sprintf("invalid state %v sent", change["State"]))
 	}
@@ -196,40 +356,204 @@ func newPlugin(change map[string]interface{}) (*Plugin, error) {
 		extra = v
 	}
 
+	if v, ok := change["Resources"]; ok && v != nil {
+		resources = &PluginResources{}
+		if err := decodeField(v, resources); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid resources %v sent", v))
+		}
+	}
+	if v, ok := change["Healthcheck"]; ok && v != nil {
+		healthcheck = &PluginHealthcheck{}
+		if err := decodeField(v, healthcheck); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid healthcheck %v sent", v))
+		}
+	}
+	description, _ := change["Description"].(string)
+	image, _ := change["Image"].(string)
+	tag, _ := change["Tag"].(string)
+	digest, _ := change["Digest"].(string)
+	lastError, _ := change["LastError"].(string)
+	lastErrorAt, _ := change["LastErrorAt"].(string)
+	var failures, exitCode int
+	if v, ok := change["Failures"]; ok && v != nil {
+		if err := decodeField(v, &failures); err != nil || failures < 0 {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid Failures %v sent", v))
+		}
+	}
+	if v, ok := change["ExitCode"]; ok && v != nil {
+		if err := decodeField(v, &exitCode); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid ExitCode %v sent", v))
+		}
+	}
+	var replicas int
+	if v, ok := change["Replicas"]; ok && v != nil {
+		if err := decodeField(v, &replicas); err != nil || replicas < 1 {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid Replicas %v sent", v))
+		}
+	}
+	var mode PluginMode
+	switch change["Mode"] {
+	case nil, "":
+	case string(ModeReplicated):
+		mode = ModeReplicated
+	case string(ModeGlobal):
+		mode = ModeGlobal
+	default:
+		return &Plugin{}, NewControllerError(fmt.Sprintf("invalid Mode %v sent", change["Mode"]))
+	}
+	var healthyTasks, oldTasks []string
+	if v, ok := change["HealthyTasks"]; ok && v != nil {
+		if err := decodeField(v, &healthyTasks); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid HealthyTasks %v sent", v))
+		}
+	}
+	var publishedPorts []string
+	if v, ok := change["PublishedPorts"]; ok && v != nil {
+		if err := decodeField(v, &publishedPorts); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid PublishedPorts %v sent", v))
+		}
+	}
+	if v, ok := change["OldTasks"]; ok && v != nil {
+		if err := decodeField(v, &oldTasks); err != nil {
+			return &Plugin{}, NewControllerError(fmt.Sprintf("invalid OldTasks %v sent", v))
+		}
+	}
+	pluginHealth, _ := change["Health"].(string)
+	targetTag, _ := change["TargetTag"].(string)
+	targetDigest, _ := change["TargetDigest"].(string)
+	var upgradeStatus PluginUpgradeStatus
+	switch change["UpgradeStatus"] {
+	case nil, "":
+	case string(UpgradeCompleted):
+		upgradeStatus = UpgradeCompleted
+	case string(UpgradeRolledBack):
+		upgradeStatus = UpgradeRolledBack
+	case string(UpgradeRollbackFailed):
+		upgradeStatus = UpgradeRollbackFailed
+	default:
+		return &Plugin{}, NewControllerError(fmt.Sprintf("invalid UpgradeStatus %v sent", change["UpgradeStatus"]))
+	}
+
 	plugin := &Plugin{
-		Name:          name,
-		ServiceID:     serviceID,
-		ServiceName:   serviceName,
-		DesiredState:  desired,
-		State:         state,
-		Address:       address,
-		ExternalPorts: extports,
-		InternalPorts: intports,
-		OS:            os,
-		Environment:   environment,
-		Extra:         extra,
+		Name:           name,
+		ServiceID:      serviceID,
+		ServiceName:    serviceName,
+		DesiredState:   desired,
+		State:          state,
+		Address:        address,
+		ExternalPorts:  extports,
+		InternalPorts:  intports,
+		PublishedPorts: publishedPorts,
+		OS:             os,
+		Environment:    environment,
+		Extra:          extra,
+		Description:    description,
+		Image:          image,
+		Tag:            tag,
+		Digest:         digest,
+		Resources:      resources,
+		Healthcheck:    healthcheck,
+		LastError:      lastError,
+		LastErrorAt:    lastErrorAt,
+		Failures:       failures,
+		ExitCode:       exitCode,
+		Replicas:       replicas,
+		Mode:           mode,
+		HealthyTasks:   healthyTasks,
+		OldTasks:       oldTasks,
+		Health:         pluginHealth,
+		TargetTag:      targetTag,
+		TargetDigest:   targetDigest,
+		UpgradeStatus:  upgradeStatus,
 	}
 
 	return plugin, nil
 }
 
-func watchChanges(res *r.Cursor) (<-chan Plugin, <-chan error) {
-	out := make(chan Plugin)
-	errChan := make(chan error)
-	go func(cursor *r.Cursor) {
-		var doc map[string]interface{}
-		for cursor.Next(&doc) {
-			if v, ok := doc["new_val"]; ok {
-				plugin, err := newPlugin(v.(map[string]interface{}))
-				if err != nil {
-					errChan <- err
-				} else {
-					out <- *plugin
-				}
+// PluginFeedHealth reports whether the changefeed
+// followed by MonitorPlugins is open.
+var PluginFeedHealth = health.NewStatus()
+
+// errorFields are the fields written back to a
+// plugin's row when an action on it fails.
+var errorFields = map[string]bool{
+	"LastError":   true,
+	"LastErrorAt": true,
+}
+
+// onlyErrorChanged returns whether a change to a plugin's
+// row only recorded an error, which isn't acted on (acting
+// on it would retry the failed action again and again).
+func onlyErrorChanged(oldVal map[string]interface{}, newVal map[string]interface{}) bool {
+	changed := false
+	for k, v := range newVal {
+		if !reflect.DeepEqual(oldVal[k], v) {
+			if !errorFields[k] {
+				return false
 			}
+			changed = true
 		}
-	}(res)
-	return out, errChan
+	}
+	for k := range oldVal {
+		if _, ok := newVal[k]; !ok {
+			if !errorFields[k] {
+				return false
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// followFeed sends the plugins from a changefeed to out
+// until the feed ends, and reports it healthy once it is
+// ready. Documents sent while the feed is
+// initializing are the current rows, and only those with
+// a pending DesiredState are sent. It returns whether the
+// feed became ready.
+func followFeed(ctx context.Context, feed <-chan map[string]interface{}, out chan<- Plugin, errs chan<- error) bool {
+	var (
+		ready        = false
+		initializing = false
+	)
+
+	for doc := range feed {
+		if state, ok := doc["state"].(string); ok {
+			initializing = state == "initializing"
+			if state == "ready" {
+				ready = true
+				PluginFeedHealth.Set("", nil)
+			}
+			continue
+		}
+		v, ok := doc["new_val"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if old, ok := doc["old_val"].(map[string]interface{}); ok && onlyErrorChanged(old, v) {
+			continue
+		}
+		plugin, err := newPlugin(v)
+		if err != nil {
+			// A bad row is skipped, retrying won't fix it
+			serviceName, _ := v["ServiceName"].(string)
+			serviceID, _ := v["ServiceID"].(string)
+			e := errorhandler.New(errorhandler.ComponentPluginMonitor, errorhandler.SeverityWarning, err)
+			select {
+			case <-ctx.Done():
+			case errs <- e.ForService(serviceName, serviceID):
+			}
+			continue
+		}
+		if initializing && plugin.DesiredState == DesiredStateNull {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case out <- *plugin:
+		}
+	}
+	return ready
 }
 
 // MonitorPlugins purpose of this function is to monitor changes
@@ -239,20 +563,59 @@ func watchChanges(res *r.Cursor) (<-chan Plugin, <-chan error) {
 // handling the changes to the state of the services.
 // At some point the query here will be filtered down
 // to only the changes that matter.
-func MonitorPlugins() (<-chan Plugin, <-chan error) {
-	session, err := r.Connect(r.ConnectOpts{
-		Address: GetRethinkHost(),
-	})
-	if err != nil {
-		panic(err)
-	}
+//
+// If the changefeed ends (e.g. the brain restarts) it is
+// reopened with backoff, and any DesiredState written
+// while it was down is sent when it resumes. Reconnects
+// are reported on the error channel. Both channels are
+// closed once the context is done.
+func MonitorPlugins(ctx context.Context) (<-chan Plugin, <-chan error) {
+	out := make(chan Plugin)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(out)
+		defer PluginFeedHealth.Set("", errors.New("stopped"))
+
+		var (
+			backoff = helper.NewBackoff(100*time.Millisecond, 30*time.Second)
+			opts    = ChangesOpts{IncludeStates: true}
+		)
+
+		for {
+			feed, feedErrs := GetStore().PluginChanges(ctx, opts)
+			if followFeed(ctx, feed, out, errs) {
+				backoff.Reset()
+			}
+			if ctx.Err() != nil {
+				return
+			}
 
-	res, err := r.DB("Controller").Table("Plugins").Changes().Run(session)
-	if err != nil {
-		panic(err)
-	}
+			err := <-feedErrs
+			if err == nil {
+				err = errors.New("cursor closed")
+			}
+			PluginFeedHealth.Set("", fmt.Errorf("changefeed ended: %v", err))
+			delay := backoff.Next()
+			select {
+			case <-ctx.Done():
+				return
+			case errs <- errorhandler.Transient(
+				errorhandler.ComponentPluginMonitor,
+				fmt.Errorf("plugin changefeed ended: %v, reconnecting in %v", err, delay),
+			):
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
 
-	outDB, errDB := watchChanges(res)
+			// Pick up whatever was missed while down
+			opts = ChangesOpts{IncludeInitial: true, IncludeStates: true}
+		}
+	}()
 
-	return outDB, errDB
+	return out, errs
 }
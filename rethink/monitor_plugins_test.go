@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/client"
 	"github.com/ramrod-project/backend-controller-go/test"
@@ -54,6 +55,94 @@ func Test_newPlugin(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Plugin with image and limits",
+			args: args{
+				change: map[string]interface{}{
+					"Name":          "ThirdParty",
+					"ServiceID":     "",
+					"ServiceName":   "ThirdParty-5000",
+					"DesiredState":  "",
+					"State":         "Available",
+					"Interface":     "192.168.1.1",
+					"ExternalPorts": []interface{}{"5000/tcp"},
+					"InternalPorts": []interface{}{"5000/tcp"},
+					"OS":            "posix",
+					"Environment":   []interface{}{"MODE=fast"},
+					"Description":   "A third-party plugin",
+					"Image":         "example/plugin",
+					"Tag":           "1.2.0",
+					"Resources":     map[string]interface{}{"CPUs": 0.5, "MemoryMB": float64(256)},
+					"Healthcheck": map[string]interface{}{
+						"Test":     []interface{}{"CMD", "true"},
+						"Interval": "10s",
+					},
+				},
+			},
+			want: &Plugin{
+				Name:          "ThirdParty",
+				ServiceID:     "",
+				ServiceName:   "ThirdParty-5000",
+				DesiredState:  DesiredStateNull,
+				State:         StateAvailable,
+				Address:       "192.168.1.1",
+				ExternalPorts: []string{"5000/tcp"},
+				InternalPorts: []string{"5000/tcp"},
+				OS:            PluginOSPosix,
+				Environment:   []string{"MODE=fast"},
+				Description:   "A third-party plugin",
+				Image:         "example/plugin",
+				Tag:           "1.2.0",
+				Resources:     &PluginResources{CPUs: 0.5, MemoryMB: 256},
+				Healthcheck: &PluginHealthcheck{
+					Test:     []string{"CMD", "true"},
+					Interval: "10s",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Bad resources",
+			args: args{
+				change: map[string]interface{}{
+					"Name":          "ThirdParty",
+					"ServiceID":     "",
+					"ServiceName":   "ThirdParty-5000",
+					"DesiredState":  "",
+					"State":         "Available",
+					"Interface":     "192.168.1.1",
+					"ExternalPorts": []interface{}{"5000/tcp"},
+					"InternalPorts": []interface{}{"5000/tcp"},
+					"OS":            "posix",
+					"Environment":   []string{},
+					"Resources":     "lots",
+				},
+			},
+			want:    &Plugin{},
+			wantErr: true,
+			err:     NewControllerError("invalid resources lots sent"),
+		},
+		{
+			name: "Bad failures",
+			args: args{
+				change: map[string]interface{}{
+					"Name":          "ThirdParty",
+					"ServiceID":     "",
+					"ServiceName":   "ThirdParty-5000",
+					"DesiredState":  "",
+					"State":         "Failed",
+					"Interface":     "192.168.1.1",
+					"ExternalPorts": []interface{}{"5000/tcp"},
+					"InternalPorts": []interface{}{"5000/tcp"},
+					"OS":            "posix",
+					"Environment":   []string{},
+					"Failures":      "lots",
+				},
+			},
+			want:    &Plugin{},
+			wantErr: true,
+			err:     NewControllerError("invalid Failures lots sent"),
+		},
 		{
 			name: "Bad no ServiceName",
 			args: args{
@@ -161,7 +250,7 @@ func Test_newPlugin(t *testing.T) {
 	}
 }
 
-func Test_watchChanges(t *testing.T) {
+func Test_followFeed(t *testing.T) {
 
 	ctx := context.Background()
 	dockerClient, err := client.NewEnvClient()
@@ -351,13 +440,18 @@ func Test_watchChanges(t *testing.T) {
 	filter := map[string]string{"Name": "TestPlugin"}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			// Generate cursor for changefeed
 			c, err := r.DB("Controller").Table("Plugins").Changes().Run(session)
 			if err != nil {
 				t.Errorf("%v", err)
 			}
-			// Create channel and start goroutine
-			resChan, errChan := watchChanges(c)
+			// Follow it the way MonitorPlugins does
+			feed, _ := cursorFeed(ctx, c)
+			resChan := make(chan Plugin)
+			errChan := make(chan error)
+			go followFeed(ctx, feed, resChan, errChan)
 			// Insert change into database
 			_, err = r.DB("Controller").Table("Plugins").Filter(filter).Update(tt.change).RunWrite(session)
 			if err != nil {
@@ -368,7 +462,7 @@ func Test_watchChanges(t *testing.T) {
 				assert.Equal(t, tt.want, recvData)
 			case recvErr := <-errChan:
 				t.Errorf("%v", recvErr)
-			default:
+			case <-time.After(time.Second):
 				t.Errorf("no messages received on either channel")
 			}
 			// Close cursor to stop goroutine
@@ -519,7 +613,7 @@ func TestMonitorPlugins(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Create channel and start goroutine
-			dbChan, errChan := MonitorPlugins()
+			dbChan, errChan := MonitorPlugins(ctx)
 			var err error
 			// Insert new plugin
 			if tt.plugin != nil {
@@ -592,3 +686,74 @@ func Test_getRethinkHost(t *testing.T) {
 	}
 	os.Setenv("STAGE", oldEnv)
 }
+
+func Test_onlyErrorChanged(t *testing.T) {
+	row := map[string]interface{}{
+		"ServiceName":  "Harness-5000tcp",
+		"DesiredState": "Activate",
+		"State":        "Available",
+	}
+	with := func(update map[string]interface{}) map[string]interface{} {
+		doc := make(map[string]interface{})
+		for k, v := range row {
+			doc[k] = v
+		}
+		for k, v := range update {
+			doc[k] = v
+		}
+		return doc
+	}
+	failed := with(map[string]interface{}{
+		"LastError":   "no such image",
+		"LastErrorAt": "2018-05-01T10:00:00.000Z",
+	})
+
+	tests := []struct {
+		name   string
+		oldVal map[string]interface{}
+		newVal map[string]interface{}
+		want   bool
+	}{
+		{
+			name:   "Error recorded",
+			oldVal: row,
+			newVal: failed,
+			want:   true,
+		},
+		{
+			name:   "Error cleared",
+			oldVal: failed,
+			newVal: row,
+			want:   true,
+		},
+		{
+			name:   "Error recorded again",
+			oldVal: failed,
+			newVal: with(map[string]interface{}{"LastError": "no such image", "LastErrorAt": "2018-05-01T10:00:30.000Z"}),
+			want:   true,
+		},
+		{
+			name:   "DesiredState changed",
+			oldVal: failed,
+			newVal: with(map[string]interface{}{"DesiredState": "Stop"}),
+			want:   false,
+		},
+		{
+			name:   "Error and DesiredState changed",
+			oldVal: row,
+			newVal: with(map[string]interface{}{"DesiredState": "", "LastError": "port conflict"}),
+			want:   false,
+		},
+		{
+			name:   "Nothing changed",
+			oldVal: row,
+			newVal: with(nil),
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, onlyErrorChanged(tt.oldVal, tt.newVal))
+		})
+	}
+}
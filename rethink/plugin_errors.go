@@ -0,0 +1,44 @@
+package rethink
+
+import (
+	"time"
+
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+var errorTable = r.DB("Controller").Table("Errors")
+
+// TimeFormat is the format of the timestamps the
+// controller writes, fixed width so they sort.
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp formats a time for the brain, in UTC.
+func Timestamp(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// PluginError is a failed plugin action, kept
+// in the Controller.Errors table.
+type PluginError struct {
+	Timestamp   string
+	Plugin      string
+	ServiceName string
+	ServiceID   string
+	Action      string
+	Message     string
+}
+
+// CreateErrorsTable creates the Controller.Errors
+// table if the brain doesn't have it yet.
+func CreateErrorsTable(sessions *SessionManager) error { // pragma: no cover
+	session, err := sessions.Session()
+	if err != nil {
+		return err
+	}
+	_, err = r.Branch(
+		r.DB("Controller").TableList().Contains("Errors"),
+		nil,
+		r.DB("Controller").TableCreate("Errors"),
+	).RunWrite(session)
+	return err
+}
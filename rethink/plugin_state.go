@@ -0,0 +1,185 @@
+package rethink
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxStateHistory is how many state changes
+// are kept in a plugin's StateHistory.
+const MaxStateHistory = 20
+
+// MaxRestartAttempts is how many times the swarm restarts
+// a plugin's failed task before giving up, after which
+// the plugin is Failed.
+const MaxRestartAttempts = 3
+
+// ErrStaleState is returned by TransitionPlugin when the
+// plugin changed since it was read.
+var ErrStaleState = errors.New("plugin changed since it was read")
+
+// ErrRequestQueued is returned by CheckRequest for a
+// DesiredState that has to wait for the plugin's
+// current change to finish.
+var ErrRequestQueued = errors.New("waiting for the current change to finish")
+
+// StateChange is an entry in a plugin's StateHistory.
+type StateChange struct {
+	From   PluginState
+	To     PluginState
+	At     string
+	Reason string
+}
+
+// transitions are the States each State can move to.
+// Moving to the same State is always allowed.
+var transitions = map[PluginState][]PluginState{
+	StateAvailable:   {StateStarting, StateActive, StateStopped, StateRetired},
+	StateStarting:    {StateActive, StateStopping, StateStopped, StateFailed},
+	StateActive:      {StateRestarting, StateRollingBack, StateStopping, StateStopped, StateFailed, StatePaused},
+	StateRestarting:  {StateActive, StateRollingBack, StateStopping, StateStopped, StateFailed},
+	StateRollingBack: {StateActive, StateStopping, StateStopped, StateFailed},
+	StateStopping:    {StateStopped, StateFailed},
+	StateStopped:     {StateStarting, StateActive, StateFailed, StateAvailable, StateRetired},
+	StateFailed:      {StateStarting, StateActive, StateRestarting, StateStopping, StateStopped, StateRetired},
+	StatePaused:      {StateStarting, StateActive, StateStopping, StateStopped},
+	StateRetired:     {StateAvailable},
+}
+
+// CanTransition returns whether a plugin
+// can move from one State to another.
+func CanTransition(from PluginState, to PluginState) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transitional returns whether a State is part
+// way through a change to the plugin's service.
+func Transitional(state PluginState) bool {
+	switch state {
+	case StateStarting, StateRestarting, StateRollingBack, StateStopping:
+		return true
+	}
+	return false
+}
+
+// requestable are the States each
+// DesiredState can be asked for in.
+var requestable = map[PluginDesiredState][]PluginState{
+	DesiredStateActivate: {StateAvailable, StateStopped, StateFailed},
+	DesiredStateRestart:  {StateActive, StateFailed},
+	DesiredStateStop:     {StateActive, StateFailed, StatePaused},
+	DesiredStateScale:    {StateActive},
+	DesiredStatePause:    {StateActive},
+	DesiredStateResume:   {StatePaused},
+	DesiredStateUpgrade:  {StateActive, StateFailed},
+}
+
+// IllegalRequestError is a DesiredState that
+// can't be met from the plugin's State.
+type IllegalRequestError struct {
+	State   PluginState
+	Desired PluginDesiredState
+}
+
+func (e *IllegalRequestError) Error() string {
+	return fmt.Sprintf("cannot %v a plugin that is %v", e.Desired, e.State)
+}
+
+// CheckRequest returns an *IllegalRequestError if a
+// DesiredState can't be asked of a plugin in state, or
+// ErrRequestQueued if the plugin is in the middle of a
+// change, after which it is checked again.
+func CheckRequest(state PluginState, desired PluginDesiredState) error {
+	if desired == DesiredStateNull {
+		return nil
+	}
+	if Transitional(state) {
+		return ErrRequestQueued
+	}
+	for _, s := range requestable[desired] {
+		if s == state {
+			return nil
+		}
+	}
+	return &IllegalRequestError{State: state, Desired: desired}
+}
+
+// HealthSummary describes how many of a plugin's tasks
+// are healthy, e.g. "2/3 healthy", or "3 healthy" for a
+// global plugin.
+func HealthSummary(plugin *Plugin) string {
+	if plugin.Mode == ModeGlobal {
+		return fmt.Sprintf("%d healthy", len(plugin.HealthyTasks))
+	}
+	replicas := plugin.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	return fmt.Sprintf("%d/%d healthy", len(plugin.HealthyTasks), replicas)
+}
+
+// Completes returns whether reaching a State meets
+// a DesiredState, which is then cleared. Scale and
+// Pause are cleared once the service has been updated,
+// and Upgrade once the swarm says how it ended.
+func Completes(state PluginState, desired PluginDesiredState) bool {
+	switch desired {
+	case DesiredStateActivate, DesiredStateRestart, DesiredStateResume:
+		return state == StateActive
+	case DesiredStateStop:
+		return state == StateStopped
+	}
+	return false
+}
+
+// Upgrading returns whether a plugin has
+// an upgrade that hasn't ended yet.
+func Upgrading(plugin *Plugin) bool {
+	return plugin.TargetTag != "" || plugin.TargetDigest != ""
+}
+
+// UpgradeOutcome adds how an upgrading plugin's service
+// update ended to update, given the service's update state
+// (e.g. "rollback_completed"), and returns whether it has
+// ended. Its TargetTag and TargetDigest only become its Tag
+// and Digest if the update completed, and an upgrade that
+// failed is set as its LastError.
+func UpgradeOutcome(plugin *Plugin, updateState string, update map[string]string) bool {
+	if !Upgrading(plugin) {
+		return false
+	}
+	target := plugin.TargetTag
+	if plugin.TargetDigest != "" {
+		target += "@" + plugin.TargetDigest
+	}
+
+	switch updateState {
+	case "completed":
+		update["Tag"] = plugin.TargetTag
+		update["Digest"] = plugin.TargetDigest
+		update["UpgradeStatus"] = string(UpgradeCompleted)
+	case "rollback_completed":
+		update["UpgradeStatus"] = string(UpgradeRolledBack)
+		update["LastError"] = fmt.Sprintf("upgrade to %v failed and was rolled back", target)
+	case "paused", "rollback_paused":
+		update["UpgradeStatus"] = string(UpgradeRollbackFailed)
+		update["LastError"] = fmt.Sprintf("upgrade to %v failed and was not rolled back", target)
+	default:
+		return false
+	}
+	if update["LastError"] != "" {
+		update["LastErrorAt"] = Timestamp(time.Now())
+	}
+	update["TargetTag"] = ""
+	update["TargetDigest"] = ""
+	return true
+}
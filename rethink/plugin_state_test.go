@@ -0,0 +1,224 @@
+package rethink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		name string
+		from PluginState
+		to   PluginState
+		want bool
+	}{
+		{
+			name: "Start",
+			from: StateAvailable,
+			to:   StateStarting,
+			want: true,
+		},
+		{
+			name: "Restart",
+			from: StateActive,
+			to:   StateRestarting,
+			want: true,
+		},
+		{
+			name: "Restarted",
+			from: StateRestarting,
+			to:   StateActive,
+			want: true,
+		},
+		{
+			name: "Same state",
+			from: StateActive,
+			to:   StateActive,
+			want: true,
+		},
+		{
+			name: "Restart stopped",
+			from: StateStopped,
+			to:   StateRestarting,
+			want: false,
+		},
+		{
+			name: "Fail after restarts",
+			from: StateStopped,
+			to:   StateFailed,
+			want: true,
+		},
+		{
+			name: "Start while stopping",
+			from: StateStopping,
+			to:   StateStarting,
+			want: false,
+		},
+		{
+			name: "Pause",
+			from: StateActive,
+			to:   StatePaused,
+			want: true,
+		},
+		{
+			name: "Restart paused",
+			from: StatePaused,
+			to:   StateRestarting,
+			want: false,
+		},
+		{
+			name: "Roll back",
+			from: StateRestarting,
+			to:   StateRollingBack,
+			want: true,
+		},
+		{
+			name: "Retire active",
+			from: StateActive,
+			to:   StateRetired,
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CanTransition(tt.from, tt.to))
+		})
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   PluginState
+		desired PluginDesiredState
+		err     error
+	}{
+		{
+			name:    "Activate available",
+			state:   StateAvailable,
+			desired: DesiredStateActivate,
+		},
+		{
+			name:    "Restart failed",
+			state:   StateFailed,
+			desired: DesiredStateRestart,
+		},
+		{
+			name:    "Nothing desired",
+			state:   StateStopped,
+			desired: DesiredStateNull,
+		},
+		{
+			name:    "Restart stopped",
+			state:   StateStopped,
+			desired: DesiredStateRestart,
+			err:     &IllegalRequestError{State: StateStopped, Desired: DesiredStateRestart},
+		},
+		{
+			name:    "Activate active",
+			state:   StateActive,
+			desired: DesiredStateActivate,
+			err:     &IllegalRequestError{State: StateActive, Desired: DesiredStateActivate},
+		},
+		{
+			name:    "Stop paused",
+			state:   StatePaused,
+			desired: DesiredStateStop,
+		},
+		{
+			name:    "Resume active",
+			state:   StateActive,
+			desired: DesiredStateResume,
+			err:     &IllegalRequestError{State: StateActive, Desired: DesiredStateResume},
+		},
+		{
+			name:    "Upgrade paused",
+			state:   StatePaused,
+			desired: DesiredStateUpgrade,
+			err:     &IllegalRequestError{State: StatePaused, Desired: DesiredStateUpgrade},
+		},
+		{
+			name:    "Stop while restarting",
+			state:   StateRestarting,
+			desired: DesiredStateStop,
+			err:     ErrRequestQueued,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.err, CheckRequest(tt.state, tt.desired))
+		})
+	}
+}
+
+func TestUpgradeOutcome(t *testing.T) {
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		updateState string
+		ended       bool
+		want        map[string]string
+	}{
+		{
+			name:        "Completed",
+			plugin:      Plugin{Tag: "1.0", TargetTag: "2.0"},
+			updateState: "completed",
+			ended:       true,
+			want: map[string]string{
+				"Tag":           "2.0",
+				"Digest":        "",
+				"TargetTag":     "",
+				"TargetDigest":  "",
+				"UpgradeStatus": "Completed",
+			},
+		},
+		{
+			name:        "Rolled back",
+			plugin:      Plugin{Tag: "1.0", TargetTag: "2.0", TargetDigest: "sha256:0123456789abcdef0123456789abcdef"},
+			updateState: "rollback_completed",
+			ended:       true,
+			want: map[string]string{
+				"TargetTag":     "",
+				"TargetDigest":  "",
+				"UpgradeStatus": "RolledBack",
+				"LastError":     "upgrade to 2.0@sha256:0123456789abcdef0123456789abcdef failed and was rolled back",
+			},
+		},
+		{
+			name:        "Rollback failed",
+			plugin:      Plugin{Tag: "1.0", TargetTag: "2.0"},
+			updateState: "rollback_paused",
+			ended:       true,
+			want: map[string]string{
+				"TargetTag":     "",
+				"TargetDigest":  "",
+				"UpgradeStatus": "RollbackFailed",
+				"LastError":     "upgrade to 2.0 failed and was not rolled back",
+			},
+		},
+		{
+			name:        "Still updating",
+			plugin:      Plugin{Tag: "1.0", TargetTag: "2.0"},
+			updateState: "updating",
+			want:        map[string]string{},
+		},
+		{
+			name:        "Not upgrading",
+			plugin:      Plugin{Tag: "1.0"},
+			updateState: "completed",
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := make(map[string]string)
+			assert.Equal(t, tt.ended, UpgradeOutcome(&tt.plugin, tt.updateState, update))
+			if update["LastError"] != "" {
+				assert.NotEmpty(t, update["LastErrorAt"])
+				delete(update, "LastErrorAt")
+			}
+			assert.Equal(t, tt.want, update)
+		})
+	}
+}
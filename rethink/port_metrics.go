@@ -0,0 +1,30 @@
+package rethink
+
+import (
+	"fmt"
+
+	"github.com/ramrod-project/backend-controller-go/metrics"
+)
+
+// CollectPortMetrics sets metrics.PortsUsed from the
+// Ports table. It is meant for metrics.OnCollect.
+func CollectPortMetrics() {
+	docs, err := GetStore().ListPorts()
+	if err != nil {
+		// Keep the last values rather than
+		// report every node as empty
+		return
+	}
+
+	metrics.PortsUsed.Reset()
+	for _, doc := range docs {
+		address := fmt.Sprintf("%v", doc["Interface"])
+		for field, protocol := range map[string]string{
+			"TCPPorts": "tcp",
+			"UDPPorts": "udp",
+		} {
+			list, _ := doc[field].([]interface{})
+			metrics.PortsUsed.Set(float64(len(list)), address, protocol)
+		}
+	}
+}
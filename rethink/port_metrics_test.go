@@ -0,0 +1,28 @@
+package rethink
+
+import (
+	"testing"
+
+	swarm "github.com/docker/docker/api/types/swarm"
+	"github.com/ramrod-project/backend-controller-go/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectPortMetrics(t *testing.T) {
+	m := NewMemoryStore()
+	SetStore(m)
+	defer SetStore(nil)
+
+	assert.Nil(t, m.UpsertNode(map[string]interface{}{
+		"Interface":    "192.168.1.1",
+		"NodeHostName": "manager",
+		"OS":           "posix",
+		"TCPPorts":     []string{"5000", "6000"},
+		"UDPPorts":     []string{},
+	}))
+	assert.Nil(t, m.AddPort("192.168.1.1", "53", swarm.PortConfigProtocolUDP))
+
+	CollectPortMetrics()
+	assert.Equal(t, float64(2), metrics.PortsUsed.Value("192.168.1.1", "tcp"))
+	assert.Equal(t, float64(1), metrics.PortsUsed.Value("192.168.1.1", "udp"))
+}
@@ -0,0 +1,399 @@
+package rethink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+var (
+	pluginTable = r.DB("Controller").Table("Plugins")
+	portTable   = r.DB("Controller").Table("Ports")
+)
+
+// RethinkStore is a Store backed by the brain's
+// Controller database.
+type RethinkStore struct {
+	connect func() (*r.Session, error)
+}
+
+var _ Store = (*RethinkStore)(nil)
+
+// NewRethinkStore returns a RethinkStore sharing
+// the sessions of a SessionManager.
+func NewRethinkStore(sessions *SessionManager) *RethinkStore {
+	return &RethinkStore{
+		connect: sessions.Session,
+	}
+}
+
+func (s *RethinkStore) getPlugin(filter map[string]interface{}) (map[string]interface{}, error) {
+	session, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := pluginTable.Filter(filter).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var doc map[string]interface{}
+	if !cursor.Next(&doc) {
+		return nil, cursor.Err()
+	}
+	return doc, nil
+}
+
+// GetPluginByServiceName implements Store.
+func (s *RethinkStore) GetPluginByServiceName(serviceName string) (map[string]interface{}, error) {
+	return s.getPlugin(map[string]interface{}{"ServiceName": serviceName})
+}
+
+// GetPluginByServiceID implements Store.
+func (s *RethinkStore) GetPluginByServiceID(serviceID string) (map[string]interface{}, error) {
+	return s.getPlugin(map[string]interface{}{"ServiceID": serviceID})
+}
+
+// ListPlugins implements Store.
+func (s *RethinkStore) ListPlugins() ([]map[string]interface{}, error) {
+	session, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := pluginTable.Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	docs := []map[string]interface{}{}
+	err = cursor.All(&docs)
+	return docs, err
+}
+
+// InsertPlugin implements Store.
+func (s *RethinkStore) InsertPlugin(plugin map[string]interface{}) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = pluginTable.Insert(plugin).RunWrite(session)
+	return err
+}
+
+// UpdatePlugin implements Store.
+func (s *RethinkStore) UpdatePlugin(id string, update map[string]interface{}) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = pluginTable.Get(id).Update(update).RunWrite(session)
+	return err
+}
+
+// UpdatePluginStatus implements Store.
+func (s *RethinkStore) UpdatePluginStatus(serviceName string, update map[string]string) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	filter := map[string]string{"ServiceName": serviceName}
+	res, err := pluginTable.Filter(filter).Update(update).RunWrite(session)
+	if err != nil {
+		return err
+	}
+	if res.Errors > 0 || !(res.Replaced > 0 || res.Updated > 0) {
+		return fmt.Errorf("no plugin to update")
+	}
+	return nil
+}
+
+// TransitionPlugin implements Store. The check and
+// update are made atomically by the server.
+func (s *RethinkStore) TransitionPlugin(serviceName string, expect map[string]string, update map[string]interface{}, change *StateChange) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	filter := map[string]string{"ServiceName": serviceName}
+	res, err := pluginTable.Filter(filter).Update(func(doc r.Term) interface{} {
+		matches := r.Expr(true)
+		for k, v := range expect {
+			matches = matches.And(doc.Field(k).Default("").Eq(v))
+		}
+		fields := make(map[string]interface{})
+		for k, v := range update {
+			fields[k] = v
+		}
+		if change != nil {
+			history := doc.Field("StateHistory").Default([]interface{}{}).Append(change)
+			fields["StateHistory"] = r.Branch(
+				history.Count().Gt(MaxStateHistory),
+				history.Slice(history.Count().Sub(MaxStateHistory)),
+				history,
+			)
+		}
+		return r.Branch(matches, fields, r.Error(ErrStaleState.Error()))
+	}).RunWrite(session)
+	if err != nil {
+		if strings.Contains(err.Error(), ErrStaleState.Error()) {
+			return ErrStaleState
+		}
+		return err
+	}
+	if res.Errors > 0 {
+		if strings.Contains(res.FirstError, ErrStaleState.Error()) {
+			return ErrStaleState
+		}
+		return errors.New(res.FirstError)
+	}
+	if res.Replaced+res.Unchanged == 0 {
+		return fmt.Errorf("no plugin to update")
+	}
+	return nil
+}
+
+// PluginChanges implements Store.
+func (s *RethinkStore) PluginChanges(ctx context.Context, opts ChangesOpts) (<-chan map[string]interface{}, <-chan error) {
+	errs := make(chan error, 1)
+
+	session, err := s.connect()
+	if err != nil {
+		errs <- err
+		close(errs)
+		changes := make(chan map[string]interface{})
+		close(changes)
+		return changes, errs
+	}
+
+	cursor, err := pluginTable.Changes(r.ChangesOpts{
+		IncludeInitial: opts.IncludeInitial,
+		IncludeStates:  opts.IncludeStates,
+	}).Run(session)
+	if err != nil {
+		errs <- err
+		close(errs)
+		changes := make(chan map[string]interface{})
+		close(changes)
+		return changes, errs
+	}
+
+	return cursorFeed(ctx, cursor)
+}
+
+// cursorFeed reads documents off of a changefeed cursor
+// until it ends or the context is cancelled.
+func cursorFeed(ctx context.Context, cursor *r.Cursor) (<-chan map[string]interface{}, <-chan error) {
+	changes := make(chan map[string]interface{})
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cursor.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(errs)
+		defer close(changes)
+		defer close(done)
+
+		doc := make(map[string]interface{})
+		for cursor.Next(&doc) {
+			select {
+			case <-ctx.Done():
+				return
+			case changes <- doc:
+			}
+			doc = make(map[string]interface{})
+		}
+		if err := cursor.Err(); err != nil && ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+
+	return changes, errs
+}
+
+// ListPorts implements Store.
+func (s *RethinkStore) ListPorts() ([]map[string]interface{}, error) {
+	session, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := portTable.Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	docs := []map[string]interface{}{}
+	err = cursor.All(&docs)
+	return docs, err
+}
+
+// GetPorts implements Store.
+func (s *RethinkStore) GetPorts(address string) (map[string]interface{}, error) {
+	session, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return getCurrentEntry(address, session)
+}
+
+// UpsertNode implements Store.
+func (s *RethinkStore) UpsertNode(node map[string]interface{}) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	cursor, err := portTable.Filter(map[string]interface{}{
+		"NodeHostName": node["NodeHostName"],
+	}).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var doc map[string]interface{}
+	if cursor.Next(&doc) {
+		_, err = portTable.Get(doc["id"]).Update(node).RunWrite(session)
+	} else {
+		_, err = portTable.Insert(node).RunWrite(session)
+	}
+	return err
+}
+
+// updatePorts atomically applies change to one of the
+// port lists of an interface's node document.
+func (s *RethinkStore) updatePorts(address string, protocol swarm.PortConfigProtocol, change func(r.Term) r.Term) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	field, err := portsField(protocol)
+	if err != nil {
+		return err
+	}
+
+	res, err := portTable.Filter(map[string]interface{}{
+		"Interface": address,
+	}).Update(func(doc r.Term) interface{} {
+		return map[string]interface{}{
+			field: change(doc.Field(field).Default([]interface{}{})),
+		}
+	}).RunWrite(session)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+	if res.Replaced+res.Unchanged == 0 {
+		return fmt.Errorf("Interface not found: %v", address)
+	}
+	return nil
+}
+
+// AddPort implements Store. The port is added server-side
+// with setInsert, so concurrent writers can't drop it.
+func (s *RethinkStore) AddPort(address string, newPort string, protocol swarm.PortConfigProtocol) error {
+	return s.updatePorts(address, protocol, func(ports r.Term) r.Term {
+		return ports.SetInsert(newPort)
+	})
+}
+
+// RemovePort implements Store. The port is removed
+// server-side with difference.
+func (s *RethinkStore) RemovePort(address string, remPort string, protocol swarm.PortConfigProtocol) error {
+	return s.updatePorts(address, protocol, func(ports r.Term) r.Term {
+		return ports.Difference([]interface{}{remPort})
+	})
+}
+
+// InsertError implements Store.
+func (s *RethinkStore) InsertError(e PluginError) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = errorTable.Insert(e).RunWrite(session)
+	return err
+}
+
+// ListErrors implements Store.
+func (s *RethinkStore) ListErrors(serviceName string, limit int) ([]map[string]interface{}, error) {
+	session, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	query := errorTable
+	if serviceName != "" {
+		query = query.Filter(map[string]interface{}{"ServiceName": serviceName})
+	}
+	query = query.OrderBy(r.Desc("Timestamp"))
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	cursor, err := query.Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	docs := []map[string]interface{}{}
+	err = cursor.All(&docs)
+	return docs, err
+}
+
+// GetEventCheckpoint implements Store.
+func (s *RethinkStore) GetEventCheckpoint(eventType string) (int64, error) {
+	session, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := checkpointTable.Get(eventType).Run(session)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var doc map[string]interface{}
+	if !cursor.Next(&doc) || doc == nil {
+		return 0, cursor.Err()
+	}
+	return parseTimeNano(doc["TimeNano"])
+}
+
+// SetEventCheckpoint implements Store.
+func (s *RethinkStore) SetEventCheckpoint(eventType string, timeNano int64) error {
+	session, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = checkpointTable.Insert(
+		checkpointDoc(eventType, timeNano),
+		r.InsertOpts{Conflict: "replace"},
+	).RunWrite(session)
+	return err
+}
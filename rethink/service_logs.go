@@ -0,0 +1,95 @@
+package rethink
+
+import (
+	"context"
+
+	"github.com/ramrod-project/backend-controller-go/customtypes"
+)
+
+// ServiceLogs sends the logs in Brain.Logs for a service,
+// oldest first. With follow, new logs are sent as they are
+// written until the context is done; otherwise both
+// channels are closed once the existing logs are sent.
+func ServiceLogs(ctx context.Context, serviceName string, follow bool) (<-chan customtypes.Log, <-chan error) {
+	out := make(chan customtypes.Log)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(out)
+
+		session, err := GetSessionManager().Session()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		filter := map[string]interface{}{"sourceServiceName": serviceName}
+
+		// The changefeed is opened before reading the
+		// existing logs, so none are missed in between
+		var feed <-chan map[string]interface{}
+		var feedErrs <-chan error
+		if follow {
+			cursor, err := dbLogQuery.Filter(filter).Changes().Run(session)
+			if err != nil {
+				errs <- err
+				return
+			}
+			feed, feedErrs = cursorFeed(ctx, cursor)
+		}
+
+		cursor, err := dbLogQuery.Filter(filter).OrderBy("rt").Run(session)
+		if err != nil {
+			errs <- err
+			return
+		}
+		var docs []map[string]interface{}
+		err = cursor.All(&docs)
+		cursor.Close()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		send := func(doc interface{}) bool {
+			var l customtypes.Log
+			if err := decodeField(doc, &l); err != nil {
+				errs <- err
+				return false
+			}
+			select {
+			case <-ctx.Done():
+				return false
+			case out <- l:
+				return true
+			}
+		}
+
+		seen := make(map[interface{}]bool)
+		for _, doc := range docs {
+			seen[doc["id"]] = true
+			if !send(doc) {
+				return
+			}
+		}
+		if !follow {
+			return
+		}
+
+		for change := range feed {
+			doc, ok := change["new_val"].(map[string]interface{})
+			if !ok || seen[doc["id"]] {
+				continue
+			}
+			if !send(doc) {
+				return
+			}
+		}
+		if err := <-feedErrs; err != nil {
+			errs <- err
+		}
+	}()
+
+	return out, errs
+}
@@ -0,0 +1,274 @@
+package rethink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ramrod-project/backend-controller-go/helper"
+	"github.com/ramrod-project/backend-controller-go/metrics"
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+// ErrSessionManagerClosed is returned by Session
+// once the SessionManager has been closed.
+var ErrSessionManagerClosed = errors.New("session manager closed")
+
+// SessionManager owns the controller's pooled
+// connection to the brain. It checks the connection
+// periodically and reconnects with backoff when the
+// brain goes away.
+type SessionManager struct {
+	opts     r.ConnectOpts
+	connect  func(r.ConnectOpts) (*r.Session, error)
+	ping     func(*r.Session) error
+	interval time.Duration
+	wait     time.Duration
+	backoff  *helper.Backoff
+
+	mu        sync.Mutex
+	session   *r.Session
+	healthy   bool
+	connected bool
+	lastErr   error
+	ready     chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// DefaultConnectOpts returns the connection options
+// for the brain at GetRethinkHost().
+func DefaultConnectOpts() r.ConnectOpts {
+	return r.ConnectOpts{
+		Address:    GetRethinkHost(),
+		Timeout:    3 * time.Second,
+		InitialCap: 2,
+		MaxOpen:    20,
+	}
+}
+
+func pingSession(session *r.Session) error {
+	_, err := session.Server()
+	return err
+}
+
+// NewSessionManager connects to the brain in the
+// background and keeps the connection alive until
+// Close is called.
+func NewSessionManager(opts r.ConnectOpts) *SessionManager {
+	return newSessionManager(opts, r.Connect, pingSession, 5*time.Second)
+}
+
+func newSessionManager(
+	opts r.ConnectOpts,
+	connect func(r.ConnectOpts) (*r.Session, error),
+	ping func(*r.Session) error,
+	interval time.Duration,
+) *SessionManager {
+	m := &SessionManager{
+		opts:     opts,
+		connect:  connect,
+		ping:     ping,
+		interval: interval,
+		wait:     opts.Timeout,
+		backoff:  helper.NewBackoff(100*time.Millisecond, 10*time.Second),
+		lastErr:  errors.New("not connected yet"),
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if m.wait == 0 {
+		m.wait = 3 * time.Second
+	}
+	go m.run()
+	return m
+}
+
+// Session returns the shared session. If the brain is
+// unreachable it waits briefly for a reconnect before
+// returning an error.
+func (m *SessionManager) Session() (*r.Session, error) {
+	m.mu.Lock()
+	if m.isClosed() {
+		m.mu.Unlock()
+		return nil, ErrSessionManagerClosed
+	}
+	if m.healthy && m.session != nil {
+		s := m.session
+		m.mu.Unlock()
+		return s, nil
+	}
+	ready := m.ready
+	m.mu.Unlock()
+
+	select {
+	case <-ready:
+		return m.Session()
+	case <-m.done:
+		return nil, ErrSessionManagerClosed
+	case <-time.After(m.wait):
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return nil, fmt.Errorf("brain unavailable: %v", m.lastErr)
+}
+
+// Healthy reports whether the last check of the
+// connection succeeded.
+func (m *SessionManager) Healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.healthy
+}
+
+// LastError returns the error from the last failed
+// connection attempt or check, or nil if healthy.
+func (m *SessionManager) LastError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.healthy {
+		return nil
+	}
+	return m.lastErr
+}
+
+// Close stops reconnecting and closes the session.
+func (m *SessionManager) Close() error {
+	m.mu.Lock()
+	if m.isClosed() {
+		m.mu.Unlock()
+		return nil
+	}
+	close(m.done)
+	m.mu.Unlock()
+
+	<-m.stopped
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.healthy = false
+	if m.session == nil {
+		return nil
+	}
+	return m.session.Close()
+}
+
+func (m *SessionManager) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setHealthy records the result of a connection
+// attempt or check, waking any waiting callers. After
+// a failure the session is dropped, so that it isn't
+// handed out again, and closed.
+func (m *SessionManager) setHealthy(session *r.Session, err error) {
+	m.mu.Lock()
+
+	if err == nil {
+		m.session = session
+		if !m.healthy {
+			close(m.ready)
+			if m.connected {
+				metrics.RethinkReconnects.Inc()
+			}
+		}
+		m.connected = true
+		m.healthy = true
+		m.lastErr = nil
+		m.mu.Unlock()
+		return
+	}
+	if m.healthy {
+		log.Printf("brain connection lost: %v", err)
+		m.ready = make(chan struct{})
+	}
+	stale := m.session
+	m.session = nil
+	m.healthy = false
+	m.lastErr = err
+	m.mu.Unlock()
+
+	if stale != nil {
+		stale.Close()
+	}
+}
+
+func (m *SessionManager) run() {
+	defer close(m.stopped)
+
+	for {
+		var delay time.Duration
+
+		m.mu.Lock()
+		session, healthy := m.session, m.healthy
+		m.mu.Unlock()
+
+		if healthy {
+			if err := m.ping(session); err != nil {
+				m.setHealthy(nil, err)
+				continue
+			}
+			delay = m.interval
+		} else {
+			conn, err := m.connect(m.opts)
+			if err == nil {
+				err = m.ping(conn)
+			}
+			m.setHealthy(conn, err)
+			if err == nil {
+				log.Printf("success: brain connection established")
+				m.backoff.Reset()
+				delay = m.interval
+			} else {
+				if conn != nil {
+					conn.Close()
+				}
+				delay = m.backoff.Next()
+			}
+		}
+
+		select {
+		case <-m.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+var (
+	sessionLock           sync.Mutex
+	defaultSessionManager *SessionManager
+)
+
+// SetSessionManager sets the SessionManager used by
+// the controller.
+func SetSessionManager(m *SessionManager) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	defaultSessionManager = m
+}
+
+// GetSessionManager returns the SessionManager set with
+// SetSessionManager, or starts one for the brain at
+// GetRethinkHost() if none was set.
+func GetSessionManager() *SessionManager {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if defaultSessionManager == nil {
+		defaultSessionManager = NewSessionManager(DefaultConnectOpts())
+	}
+	return defaultSessionManager
+}
@@ -0,0 +1,108 @@
+package rethink
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+// fakeBrain stands in for the rethinkdb server,
+// counting connections and failing while down.
+type fakeBrain struct {
+	mu       sync.Mutex
+	down     bool
+	connects int
+}
+
+func (b *fakeBrain) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.down = down
+}
+
+func (b *fakeBrain) connect(opts r.ConnectOpts) (*r.Session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		return nil, errors.New("connection refused")
+	}
+	b.connects++
+	return &r.Session{}, nil
+}
+
+func (b *fakeBrain) ping(session *r.Session) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (b *fakeBrain) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.connects
+}
+
+func TestSessionManager(t *testing.T) {
+	brain := &fakeBrain{}
+	m := newSessionManager(r.ConnectOpts{Timeout: time.Second}, brain.connect, brain.ping, 10*time.Millisecond)
+
+	// Every caller shares the one session
+	first, err := m.Session()
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		s, err := m.Session()
+		assert.Nil(t, err)
+		assert.True(t, first == s)
+	}
+	assert.True(t, m.Healthy())
+	assert.Nil(t, m.LastError())
+	assert.Equal(t, 1, brain.connections())
+
+	// Brain goes away
+	brain.setDown(true)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, m.Healthy())
+	assert.NotNil(t, m.LastError())
+
+	// and its session is dropped
+	m.mu.Lock()
+	assert.Nil(t, m.session)
+	m.mu.Unlock()
+
+	// Callers wait for the reconnect
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		brain.setDown(false)
+	}()
+	s, err := m.Session()
+	assert.Nil(t, err)
+	assert.False(t, first == s)
+	assert.True(t, m.Healthy())
+	assert.Equal(t, 2, brain.connections())
+
+	assert.Nil(t, m.Close())
+	_, err = m.Session()
+	assert.Equal(t, ErrSessionManagerClosed, err)
+	assert.False(t, m.Healthy())
+}
+
+func TestSessionManager_Unavailable(t *testing.T) {
+	brain := &fakeBrain{down: true}
+	m := newSessionManager(r.ConnectOpts{Timeout: 100 * time.Millisecond}, brain.connect, brain.ping, 10*time.Millisecond)
+	defer m.Close()
+
+	_, err := m.Session()
+	assert.Equal(t, errors.New("brain unavailable: connection refused"), err)
+	assert.Equal(t, 0, brain.connections())
+}
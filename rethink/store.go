@@ -0,0 +1,103 @@
+package rethink
+
+import (
+	"context"
+	"sync"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// Store is the controller's view of the Controller.Plugins,
+// Controller.Ports, Controller.Errors and Controller.Checkpoints
+// tables. Documents are returned the way the rethinkdb driver
+// decodes them (arrays as []interface{}, numbers as float64),
+// whichever backend is in use.
+type Store interface {
+	// GetPluginByServiceName returns the plugin with the
+	// given ServiceName, or nil if there is none.
+	GetPluginByServiceName(serviceName string) (map[string]interface{}, error)
+	// GetPluginByServiceID returns the plugin with the
+	// given ServiceID, or nil if there is none.
+	GetPluginByServiceID(serviceID string) (map[string]interface{}, error)
+	// ListPlugins returns every plugin document.
+	ListPlugins() ([]map[string]interface{}, error)
+	// InsertPlugin inserts a new plugin document.
+	InsertPlugin(plugin map[string]interface{}) error
+	// UpdatePlugin updates the plugin with the given id.
+	UpdatePlugin(id string, update map[string]interface{}) error
+	// UpdatePluginStatus updates the plugin(s) with the
+	// given ServiceName, and errors if nothing changed.
+	UpdatePluginStatus(serviceName string, update map[string]string) error
+	// TransitionPlugin updates the plugin with the given
+	// ServiceName if its fields still have the expected
+	// values, returning ErrStaleState if not. A change,
+	// if not nil, is added to its StateHistory.
+	TransitionPlugin(serviceName string, expect map[string]string, update map[string]interface{}, change *StateChange) error
+	// PluginChanges returns a changefeed of the Plugins
+	// table. Each change has "new_val" and "old_val" keys.
+	// The change channel is closed when the feed ends.
+	PluginChanges(ctx context.Context, opts ChangesOpts) (<-chan map[string]interface{}, <-chan error)
+
+	// ListPorts returns every node document.
+	ListPorts() ([]map[string]interface{}, error)
+	// GetPorts returns the node document for an interface.
+	GetPorts(address string) (map[string]interface{}, error)
+	// UpsertNode inserts or updates a node document,
+	// matched on NodeHostName.
+	UpsertNode(node map[string]interface{}) error
+	// AddPort marks a port as used on an interface.
+	AddPort(address string, port string, protocol swarm.PortConfigProtocol) error
+	// RemovePort marks a port as free on an interface.
+	RemovePort(address string, port string, protocol swarm.PortConfigProtocol) error
+
+	// InsertError records a failed plugin action.
+	InsertError(e PluginError) error
+	// ListErrors returns the latest limit errors, newest
+	// first, for a ServiceName or for every plugin if
+	// serviceName is empty. A limit of 0 returns them all.
+	ListErrors(serviceName string, limit int) ([]map[string]interface{}, error)
+
+	// GetEventCheckpoint returns the time, in nanoseconds,
+	// of the last docker event of a type that was handled,
+	// or 0 if there is none.
+	GetEventCheckpoint(eventType string) (int64, error)
+	// SetEventCheckpoint records the time of the last
+	// docker event of a type that was handled.
+	SetEventCheckpoint(eventType string, timeNano int64) error
+}
+
+// ChangesOpts are the options for a changefeed.
+type ChangesOpts struct {
+	// IncludeInitial sends every current document
+	// as a "new_val" before any changes.
+	IncludeInitial bool
+	// IncludeStates sends {"state": "initializing"} and
+	// {"state": "ready"} documents around the initial
+	// documents.
+	IncludeStates bool
+}
+
+var (
+	storeLock    sync.Mutex
+	defaultStore Store
+)
+
+// SetStore sets the Store used by the controller.
+func SetStore(s Store) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	defaultStore = s
+}
+
+// GetStore returns the Store set with SetStore, or a
+// RethinkStore using GetSessionManager() if none was set.
+func GetStore() Store {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if defaultStore == nil {
+		defaultStore = NewRethinkStore(GetSessionManager())
+	}
+	return defaultStore
+}
@@ -0,0 +1,104 @@
+package rethink
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ramrod-project/backend-controller-go/customtypes"
+)
+
+// watchBuffer is how many values a watcher can fall
+// behind by before further values are dropped for it.
+const watchBuffer = 256
+
+// PluginTransition is a plugin status update
+// written by EventUpdate.
+type PluginTransition struct {
+	ServiceName string
+	Update      map[string]string
+}
+
+// watchers fans values out to subscribers without
+// ever blocking the publisher.
+type watchers struct {
+	mu   sync.Mutex
+	subs map[chan interface{}]struct{}
+}
+
+func (w *watchers) watch(ctx context.Context) <-chan interface{} {
+	c := make(chan interface{}, watchBuffer)
+
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[chan interface{}]struct{})
+	}
+	w.subs[c] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		delete(w.subs, c)
+		close(c)
+		w.mu.Unlock()
+	}()
+	return c
+}
+
+func (w *watchers) publish(v interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for c := range w.subs {
+		select {
+		case c <- v:
+		default:
+		}
+	}
+}
+
+var (
+	transitionWatchers watchers
+	logWatchers        watchers
+)
+
+// WatchTransitions returns the plugin status updates
+// written by EventUpdate from now until the context is
+// done, when the channel is closed. A watcher that falls
+// too far behind misses updates.
+func WatchTransitions(ctx context.Context) <-chan PluginTransition {
+	out := make(chan PluginTransition)
+	in := transitionWatchers.watch(ctx)
+
+	go func() {
+		defer close(out)
+		for v := range in {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- v.(PluginTransition):
+			}
+		}
+	}()
+	return out
+}
+
+// WatchLogs returns the logs sent by AggregateLogs from
+// now until the context is done, when the channel is
+// closed. A watcher that falls too far behind misses logs.
+func WatchLogs(ctx context.Context) <-chan customtypes.Log {
+	out := make(chan customtypes.Log)
+	in := logWatchers.watch(ctx)
+
+	go func() {
+		defer close(out)
+		for v := range in {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- v.(customtypes.Log):
+			}
+		}
+	}()
+	return out
+}
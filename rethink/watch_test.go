@@ -0,0 +1,58 @@
+package rethink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	events "github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchTransitions(t *testing.T) {
+	m := newTestMemoryStore(t)
+	SetStore(m)
+	defer SetStore(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transitions := WatchTransitions(ctx)
+
+	in := make(chan events.Message)
+	errs := EventUpdate(context.Background(), in)
+	defer close(in)
+
+	in <- events.Message{
+		Type:   "service",
+		Action: "create",
+		Actor: events.Actor{
+			ID: "some-service-id",
+			Attributes: map[string]string{
+				"name": "TestPluginService",
+			},
+		},
+	}
+
+	select {
+	case tr := <-transitions:
+		assert.Equal(t, PluginTransition{
+			ServiceName: "TestPluginService",
+			Update: map[string]string{
+				"Health":    "0/1 healthy",
+				"ServiceID": "some-service-id",
+				"State":     "Active",
+			},
+		}, tr)
+	case err := <-errs:
+		t.Errorf("%v", err)
+	case <-time.After(time.Second):
+		t.Errorf("transition not sent")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-transitions:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Errorf("transitions not closed")
+	}
+}
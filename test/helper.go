@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types"
+	container "github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	mount "github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/swarm"
@@ -391,6 +392,12 @@ var controllerSpec = swarm.ServiceSpec{
 			DNSConfig: &swarm.DNSConfig{},
 			Env:       []string{"TAG=" + getTagFromEnv()},
 			Image:     "ramrodpcp/backend-controller:test",
+			Healthcheck: &container.HealthConfig{
+				Test:     []string{"CMD", "./controller", "healthcheck"},
+				Interval: 10 * time.Second,
+				Timeout:  5 * time.Second,
+				Retries:  3,
+			},
 			Mounts: []mount.Mount{
 				mount.Mount{
 					Type:   mount.TypeBind,
@@ -19,6 +19,14 @@ import (
 	r "gopkg.in/gorethink/gorethink.v4"
 )
 
+func managerIP(t *testing.T) string {
+	ip, err := dockerservicemanager.GetManagerIP()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return ip
+}
+
 func dumpEverything(ctx context.Context, t *testing.T, dockerClient *client.Client, session *r.Session) {
 	var doc map[string]interface{}
 
@@ -488,7 +496,7 @@ func Test_Integration(t *testing.T) {
 					"ServiceName":   "Harness-5000tcp",
 					"DesiredState":  "Activate",
 					"State":         "Available",
-					"Interface":     dockerservicemanager.GetManagerIP(),
+					"Interface":     managerIP(t),
 					"ExternalPorts": []string{"5000/tcp"},
 					"InternalPorts": []string{"5000/tcp"},
 					"OS":            string(rethink.PluginOSAll),
@@ -654,7 +662,7 @@ func Test_Integration(t *testing.T) {
 							if _, ok := d["new_val"]; !ok {
 								break
 							}
-							if d["new_val"].(map[string]interface{})["Interface"].(string) != dockerservicemanager.GetManagerIP() {
+							if d["new_val"].(map[string]interface{})["Interface"].(string) != managerIP(t) {
 								break
 							}
 							if len(d["new_val"].(map[string]interface{})["TCPPorts"].([]interface{})) != 1 {
@@ -1134,7 +1142,7 @@ func Test_Integration(t *testing.T) {
 					"ServiceName":   "Harness-6000tcp",
 					"DesiredState":  "Activate",
 					"State":         "Available",
-					"Interface":     dockerservicemanager.GetManagerIP(),
+					"Interface":     managerIP(t),
 					"ExternalPorts": []string{"6000/tcp"},
 					"InternalPorts": []string{"6000/tcp"},
 					"OS":            string(rethink.PluginOSPosix),